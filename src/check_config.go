@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/appservice"
+	"maunium.net/go/mautrix/id"
+
+	"nextcloud-media-bridge/src/config"
+	"nextcloud-media-bridge/src/handlers"
+)
+
+type checkReport struct {
+	out    io.Writer
+	failed bool
+}
+
+func (r *checkReport) section(title string) {
+	fmt.Fprintf(r.out, "\n%s\n", title)
+}
+
+func (r *checkReport) ok(format string, args ...any) {
+	fmt.Fprintf(r.out, "  [OK]   %s\n", fmt.Sprintf(format, args...))
+}
+
+func (r *checkReport) fail(format string, args ...any) {
+	r.failed = true
+	fmt.Fprintf(r.out, "  [FAIL] %s\n", fmt.Sprintf(format, args...))
+}
+
+func (r *checkReport) skip(format string, args ...any) {
+	fmt.Fprintf(r.out, "  [SKIP] %s\n", fmt.Sprintf(format, args...))
+}
+
+func runCheckConfig(args []string) int {
+	flags, configPath := newCommandFlags("check-config")
+	offline := flags.Bool("offline", false, "only validate the configuration, skip connectivity checks")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	report := &checkReport{out: os.Stdout}
+	cfg, source, err := loadCommandConfig(*configPath)
+	fmt.Fprintf(report.out, "Configuration source: %s\n", source)
+	if err != nil {
+		report.section("Configuration")
+		report.fail("failed to load configuration: %v", err)
+		return 1
+	}
+
+	checkConfigValues(report, cfg)
+	if *offline {
+		report.section("Connectivity")
+		report.skip("connectivity checks disabled with -offline")
+	} else {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		checkConnectivity(ctx, report, cfg)
+	}
+
+	fmt.Fprintln(report.out)
+	if report.failed {
+		fmt.Fprintln(report.out, "Configuration check FAILED")
+		return 1
+	}
+	fmt.Fprintln(report.out, "Configuration check passed")
+	return 0
+}
+
+func checkConfigValues(report *checkReport, cfg *config.Config) {
+	report.section("Configuration")
+	err := cfg.Validate()
+	if err == nil {
+		report.ok("all values are valid")
+		return
+	}
+	var validationErr config.ValidationError
+	if errors.As(err, &validationErr) {
+		for _, fieldErr := range validationErr {
+			report.fail("%s", fieldErr.Error())
+		}
+		return
+	}
+	report.fail("%v", err)
+}
+
+func checkConnectivity(ctx context.Context, report *checkReport, cfg *config.Config) {
+	report.section("Connectivity")
+
+	if cfg.Nextcloud.BaseURL == "" {
+		report.skip("Nextcloud: no base_url configured")
+	} else {
+		nextcloud := handlers.NewNextcloudClient(cfg.Nextcloud.BaseURL, cfg.Nextcloud.Username, cfg.Nextcloud.Password)
+		if err := nextcloud.CheckConnection(ctx); err != nil {
+			report.fail("Nextcloud WebDAV %s: %v", cfg.Nextcloud.BaseURL, err)
+		} else {
+			report.ok("Nextcloud WebDAV %s reachable as %s", cfg.Nextcloud.BaseURL, cfg.Nextcloud.Username)
+			if cfg.Quota.Enabled {
+				checkQuota(ctx, report, nextcloud)
+			}
+		}
+	}
+
+	names := make([]string, 0, len(cfg.Storages))
+	for name := range cfg.Storages {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		storage, err := handlers.NewStorage(cfg.Storages[name])
+		if err == nil {
+			// An empty storage has no root folder yet
+			if _, err = storage.List(ctx, ""); errors.Is(err, handlers.ErrNotFound) {
+				err = nil
+			}
+		}
+		if err != nil {
+			report.fail("Storage %s (%s): %v", name, cfg.Storages[name].Type, err)
+		} else {
+			report.ok("Storage %s (%s) reachable", name, cfg.Storages[name].Type)
+		}
+	}
+
+	if cfg.Antivirus.Enabled {
+		scanner, err := handlers.NewClamAVClient(cfg.Antivirus.Address, cfg.Antivirus.Timeout)
+		if err == nil {
+			err = scanner.Ping(ctx)
+		}
+		if err != nil {
+			report.fail("clamd %s: %v", cfg.Antivirus.Address, err)
+		} else {
+			report.ok("clamd %s reachable", cfg.Antivirus.Address)
+		}
+	}
+
+	if cfg.Matrix.HomeserverURL == "" {
+		report.skip("Matrix homeserver: no homeserver_url configured")
+		return
+	}
+	client, err := mautrix.NewClient(cfg.Matrix.HomeserverURL, "", "")
+	if err != nil {
+		report.fail("Matrix homeserver %s: %v", cfg.Matrix.HomeserverURL, err)
+		return
+	}
+	versions, err := client.Versions(ctx)
+	if err != nil {
+		report.fail("Matrix homeserver %s: %v", cfg.Matrix.HomeserverURL, err)
+		return
+	}
+	report.ok("Matrix homeserver %s reachable (spec versions: %d)", cfg.Matrix.HomeserverURL, len(versions.Versions))
+
+	if cfg.Matrix.Appservice.RegistrationPath == "" {
+		report.skip("Appservice registration: no registration_path configured")
+		return
+	}
+	registration, err := appservice.LoadRegistration(cfg.Matrix.Appservice.RegistrationPath)
+	if err != nil {
+		report.fail("Appservice registration %s: %v", cfg.Matrix.Appservice.RegistrationPath, err)
+		return
+	}
+	botMXID := id.NewUserID(registration.SenderLocalpart, cfg.Matrix.HomeserverDomain)
+	client.AccessToken = registration.AppToken
+	client.UserID = botMXID
+	client.SetAppServiceUserID = true
+	whoami, err := client.Whoami(ctx)
+	if err != nil {
+		report.fail("Appservice token for %s rejected by homeserver: %v", botMXID, err)
+		return
+	}
+	report.ok("Homeserver accepts appservice token as %s", whoami.UserID)
+}
+
+func checkQuota(ctx context.Context, report *checkReport, nextcloud *handlers.NextcloudClient) {
+	quota, err := nextcloud.Quota(ctx)
+	switch {
+	case err != nil:
+		report.fail("Nextcloud quota: %v", err)
+	case !quota.Limited():
+		report.ok("Nextcloud quota: unlimited, %d bytes used", quota.Used)
+	default:
+		report.ok("Nextcloud quota: %.0f%% used, %d of %d bytes", quota.UsedPercent(), quota.Used, quota.Used+quota.Available)
+	}
+}
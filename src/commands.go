@@ -0,0 +1,71 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"nextcloud-media-bridge/src/config"
+)
+
+type command struct {
+	name        string
+	description string
+	run         func(args []string) int
+}
+
+func commands() []command {
+	return []command{
+		{name: "check-config", description: "Validate the configuration and test connectivity", run: runCheckConfig},
+		{name: "generate-registration", description: "Write an appservice registration file with new tokens", run: runGenerateRegistration},
+		{name: "verify-replicas", description: "Compare archived files with the mirror and repair divergence", run: runVerifyReplicas},
+		{name: "generate-keys", description: "Generate server_key, hmac_secret and pickle_key", run: runGenerateKeys},
+	}
+}
+
+// runCommand dispatches a subcommand and returns the process exit code.
+func runCommand(name string, args []string) int {
+	for _, cmd := range commands() {
+		if cmd.name == name {
+			return cmd.run(args)
+		}
+	}
+	if name != "help" && name != "-h" && name != "--help" {
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n\n", name)
+	}
+	printUsage()
+	if name == "help" || name == "-h" || name == "--help" {
+		return 0
+	}
+	return 2
+}
+
+func printUsage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s [command] [flags]\n\n", os.Args[0])
+	fmt.Fprintln(os.Stderr, "Without a command the bridge is started.")
+	fmt.Fprintln(os.Stderr, "\nCommands:")
+	for _, cmd := range commands() {
+		fmt.Fprintf(os.Stderr, "  %-24s %s\n", cmd.name, cmd.description)
+	}
+}
+
+// newCommandFlags returns a flag set with the -config flag shared by all commands.
+func newCommandFlags(name string) (*flag.FlagSet, *string) {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	configPath := flags.String("config", "", "path to config.yaml (defaults to $CONFIG_PATH or config/config.yaml)")
+	return flags, configPath
+}
+
+// loadCommandConfig loads the configuration from an explicit path or falls
+// back to the same lookup the bridge uses at startup.
+func loadCommandConfig(configPath string) (*config.Config, string, error) {
+	if configPath != "" {
+		cfg, err := config.LoadConfig(configPath)
+		return cfg, configPath, err
+	}
+	cfg, err := loadConfig()
+	if source := defaultConfigPath(); source != "" {
+		return cfg, source, err
+	}
+	return cfg, "environment", err
+}
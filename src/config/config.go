@@ -3,8 +3,7 @@ package config
 import (
 	"io/ioutil"
 	"os"
-	"strconv"
-	"strings"
+	"time"
 
 	"gopkg.in/yaml.v2"
 )
@@ -16,15 +15,71 @@ type Config struct {
 		DisableWebLink bool   `yaml:"disable_web_link"`
 		Username       string `yaml:"username"`
 		Password       string `yaml:"password"`
+		// Metadata mirrors the sender, room, event and caption of each
+		// message onto the archived file.
+		Metadata struct {
+			Properties bool `yaml:"properties"` // Store them as WebDAV properties
+			Comments   bool `yaml:"comments"`   // Add them as a file comment
+			// Tags are templates for system tags assigned to each file, such
+			// as "matrix" or "room:${room_name}". They use the path template
+			// variables and filters.
+			Tags []string `yaml:"tags"`
+		} `yaml:"metadata"`
 	} `yaml:"nextcloud"`
+	// Storages are other storage backends, by name, that room rules can
+	// archive to instead of the Nextcloud account.
+	Storages map[string]StorageConfig `yaml:"storages"`
+	// Mirror replicates every archived file to one of the storages as a
+	// backup. The media proxy serves the mirror copy when a file cannot be
+	// downloaded from its storage.
+	Mirror struct {
+		Enabled bool   `yaml:"enabled"`
+		Storage string `yaml:"storage"` // Name of the storage backend in storages to replicate to
+		Retries int    `yaml:"retries"` // Attempts to copy a file before giving up (default 3)
+	} `yaml:"mirror"`
+	// Quota watches the quota of the Nextcloud account and of storages of
+	// type nextcloud or webdav. Uploads that do not fit are refused and the
+	// message keeps its original media.
+	Quota struct {
+		Enabled  bool          `yaml:"enabled"`
+		Interval time.Duration `yaml:"interval"` // How long a queried quota is used before querying it again (default 5m)
+		// Thresholds are percentages of the quota used at which the admins
+		// of the rooms archiving to the storage are warned.
+		Thresholds []int `yaml:"thresholds"`
+		Metrics    bool  `yaml:"metrics"` // Serve quota metrics at /metrics on the appservice listener
+	} `yaml:"quota"`
 	Matrix struct {
 		HomeserverURL    string            `yaml:"homeserver_url"`
 		HomeserverDomain string            `yaml:"homeserver_domain"`
 		RoomPathTemplate map[string]string `yaml:"room_path_template"`
+		// RoomRules match rooms by ID, canonical alias or space membership.
+		// Precedence: room_path_template, rules with room, rules with alias,
+		// rules with space, then default_path_template.
+		RoomRules           []RoomRule `yaml:"room_rules"`
+		DefaultPathTemplate string     `yaml:"default_path_template"`  // Catch-all for every joined room without another match
+		MoveFoldersOnRename bool       `yaml:"move_folders_on_rename"` // Move folders named after ${room_name} when a room is renamed
+		// MediaFilter decides which media is archived. A room rule's filter
+		// overrides the fields it sets.
+		MediaFilter MediaFilter `yaml:"media_filter"`
+		// StripMetadata removes location and device metadata from images
+		// before upload. A room rule's setting overrides the fields it sets.
+		StripMetadata MetadataStripping `yaml:"strip_metadata"`
+		// Redaction decides what happens to archived files of redacted
+		// messages. A room rule's policy overrides the fields it sets.
+		Redaction         RedactionPolicy `yaml:"redaction"`
+		RedactionAuditLog string          `yaml:"redaction_audit_log"` // File to append JSON audit records of redactions to (optional)
+		// ConflictStrategy names a file whose path is taken by another
+		// file: counter, timestamp, event_id, overwrite or hash (default
+		// counter). A room rule's conflict_strategy overrides it.
+		ConflictStrategy string `yaml:"conflict_strategy"`
 		Appservice       struct {
 			RegistrationPath string `yaml:"registration_path"`
 			Hostname         string `yaml:"hostname"`
 			Port             uint16 `yaml:"port"`
+			// Used by generate-registration only; the running bridge reads them from the registration file.
+			ID              string `yaml:"id"`               // Appservice ID (default: nextcloud-media-bridge)
+			Address         string `yaml:"address"`          // URL at which the homeserver reaches the appservice
+			SenderLocalpart string `yaml:"sender_localpart"` // Localpart of the bridge bot (default: mediabridge)
 		} `yaml:"appservice"`
 		Admin struct {
 			Enabled     bool   `yaml:"enabled"`      // Enable Synapse admin API for media deletion
@@ -45,143 +100,274 @@ type Config struct {
 		UseTLS     bool   `yaml:"use_tls"`
 		TLSCert    string `yaml:"tls_cert"`
 		TLSKey     string `yaml:"tls_key"`
+		// Thumbnails are rendered by the proxy from the archived image and
+		// linked as thumbnail_url in edited events.
+		Thumbnails struct {
+			Enabled   bool `yaml:"enabled"`
+			MaxWidth  int  `yaml:"max_width"`
+			MaxHeight int  `yaml:"max_height"`
+		} `yaml:"thumbnails"`
 	} `yaml:"media_proxy"`
+	Antivirus struct {
+		Enabled bool          `yaml:"enabled"`
+		Address string        `yaml:"address"` // clamd address: host:port, tcp://host:port or unix:///path/to/clamd.sock
+		Timeout time.Duration `yaml:"timeout"` // Timeout for a single scan (default 60s)
+		// FailPolicy decides what happens when clamd cannot be reached:
+		// "closed" (default) skips archiving, "open" archives unscanned.
+		FailPolicy string `yaml:"fail_policy"`
+		// OnInfected is "flag" (reply with a warning), "redact" (redact the
+		// message) or "ignore" (only log). Infected files are never archived.
+		OnInfected string `yaml:"on_infected"`
+	} `yaml:"antivirus"`
+	// Reconcile periodically checks that archived files still exist in
+	// Nextcloud and updates the messages of files deleted there.
+	Reconcile struct {
+		Enabled  bool          `yaml:"enabled"`
+		Interval time.Duration `yaml:"interval"` // Time between runs (default 1h)
+		// Action is "edit" (edit the message to say the file was removed),
+		// "redact" (redact the message) or "restore" (upload the copy still
+		// on the homeserver again, editing the message if there is none).
+		Action string `yaml:"action"`
+		// MaxActions stops a run from acting when it finds more missing
+		// files, which usually means the storage is misconfigured (default
+		// 100, 0 for no limit).
+		MaxActions int `yaml:"max_actions"`
+	} `yaml:"reconcile"`
+	// Outbox posts files dropped into a Nextcloud folder of a bridged room
+	// to that room.
+	Outbox struct {
+		Enabled bool `yaml:"enabled"`
+		// Template is the folder watched for each bridged room, e.g.
+		// "/bridge-media/${room}/outbox". Only the room variables are
+		// available.
+		Template string        `yaml:"template"`
+		Interval time.Duration `yaml:"interval"` // Time between polls (default 1m)
+	} `yaml:"outbox"`
+	// Talk bridges media between Matrix rooms and Nextcloud Talk
+	// conversations. The Nextcloud user of the bridge must take part in the
+	// conversations.
+	Talk struct {
+		Enabled  bool          `yaml:"enabled"`
+		Interval time.Duration `yaml:"interval"` // Time between polls of the conversations (default 30s)
+		Rooms    []TalkRoom    `yaml:"rooms"`
+	} `yaml:"talk"`
+	// Gallery serves a page per room listing its archived files from the
+	// media proxy's HTTP server. Links to the page and the files are signed
+	// and expire.
+	Gallery struct {
+		Enabled   bool          `yaml:"enabled"`
+		PublicURL string        `yaml:"public_url"` // URL at which users reach the media proxy, e.g. "https://media.example.com"
+		LinkTTL   time.Duration `yaml:"link_ttl"`   // How long signed links stay valid (default 24h)
+		Command   string        `yaml:"command"`    // Message the bot answers with a gallery link (default "!gallery"); empty disables it
+		Widget    bool          `yaml:"widget"`     // Add the gallery as a widget to bridged rooms, refreshed before its link expires
+	} `yaml:"gallery"`
 }
 
-func LoadConfig(path string) (*Config, error) {
-	data, err := ioutil.ReadFile(path)
-	if err != nil {
-		return nil, err
-	}
+// TalkRoom links a Matrix room to a Nextcloud Talk conversation.
+type TalkRoom struct {
+	Room  string `yaml:"room"`  // Matrix room ID
+	Token string `yaml:"token"` // Conversation token, e.g. "a1b2c3d4" from https://cloud.example.com/call/a1b2c3d4
+}
 
-	expanded := expandEnvPreserveUnknown(string(data))
-	var cfg Config
-	if err := yaml.Unmarshal([]byte(expanded), &cfg); err != nil {
-		return nil, err
-	}
+// RoomRule assigns a path template to the rooms it selects. Exactly one of
+// Room, Alias or Space should be set.
+type RoomRule struct {
+	Room     string `yaml:"room"`  // Exact room ID
+	Alias    string `yaml:"alias"` // Glob matched against the canonical alias, e.g. "#proj-*:example.com"
+	Space    string `yaml:"space"` // Room ID of a space; matches all rooms in the space hierarchy
+	Template string `yaml:"template"`
 
-	return &cfg, nil
+	Filter        *MediaFilter       `yaml:"filter"`         // Overrides matrix.media_filter for these rooms
+	StripMetadata *MetadataStripping `yaml:"strip_metadata"` // Overrides matrix.strip_metadata for these rooms
+	Redaction     *RedactionPolicy   `yaml:"redaction"`      // Overrides matrix.redaction for these rooms
+	Storage       string             `yaml:"storage"`        // Name of a storage backend to archive to instead of Nextcloud
+	// ConflictStrategy overrides matrix.conflict_strategy for these rooms.
+	ConflictStrategy string `yaml:"conflict_strategy"`
 }
 
-func LoadConfigFromEnv() *Config {
-	port, _ := strconv.ParseUint(os.Getenv("MATRIX_APP_PORT"), 10, 16)
-	mediaPort, _ := strconv.ParseUint(os.Getenv("MEDIA_PROXY_LISTEN_PORT"), 10, 16)
-	return &Config{
-		Nextcloud: struct {
-			BaseURL        string `yaml:"base_url"`
-			WebURL         string `yaml:"web_url"`
-			DisableWebLink bool   `yaml:"disable_web_link"`
-			Username       string `yaml:"username"`
-			Password       string `yaml:"password"`
-		}{
-			BaseURL:        os.Getenv("NEXTCLOUD_BASE_URL"),
-			WebURL:         os.Getenv("NEXTCLOUD_WEB_URL"),
-			DisableWebLink: parseBool(os.Getenv("NEXTCLOUD_DISABLE_WEB_LINK")),
-			Username:       os.Getenv("NEXTCLOUD_USERNAME"),
-			Password:       os.Getenv("NEXTCLOUD_PASSWORD"),
-		},
-		Matrix: struct {
-			HomeserverURL    string            `yaml:"homeserver_url"`
-			HomeserverDomain string            `yaml:"homeserver_domain"`
-			RoomPathTemplate map[string]string `yaml:"room_path_template"`
-			Appservice       struct {
-				RegistrationPath string `yaml:"registration_path"`
-				Hostname         string `yaml:"hostname"`
-				Port             uint16 `yaml:"port"`
-			} `yaml:"appservice"`
-			Admin struct {
-				Enabled     bool   `yaml:"enabled"`
-				AccessToken string `yaml:"access_token"`
-			} `yaml:"admin"`
-			Encryption struct {
-				Enabled      bool   `yaml:"enabled"`
-				PickleKey    string `yaml:"pickle_key"`
-				DatabasePath string `yaml:"database_path"`
-			} `yaml:"encryption"`
-		}{
-			HomeserverURL:    os.Getenv("MATRIX_HOMESERVER_URL"),
-			HomeserverDomain: os.Getenv("MATRIX_HOMESERVER_DOMAIN"),
-			RoomPathTemplate: parseRoomPathTemplate(os.Getenv("MATRIX_ROOM_PATH_TEMPLATE")),
-			Appservice: struct {
-				RegistrationPath string `yaml:"registration_path"`
-				Hostname         string `yaml:"hostname"`
-				Port             uint16 `yaml:"port"`
-			}{
-				RegistrationPath: os.Getenv("MATRIX_APP_REGISTRATION_PATH"),
-				Hostname:         os.Getenv("MATRIX_APP_HOST"),
-				Port:             uint16(port),
-			},
-			Admin: struct {
-				Enabled     bool   `yaml:"enabled"`
-				AccessToken string `yaml:"access_token"`
-			}{
-				Enabled:     parseBool(os.Getenv("MATRIX_ADMIN_ENABLED")),
-				AccessToken: os.Getenv("MATRIX_ADMIN_ACCESS_TOKEN"),
-			},
-			Encryption: struct {
-				Enabled      bool   `yaml:"enabled"`
-				PickleKey    string `yaml:"pickle_key"`
-				DatabasePath string `yaml:"database_path"`
-			}{
-				Enabled:      parseBool(os.Getenv("ENCRYPTION_ENABLED")),
-				PickleKey:    os.Getenv("ENCRYPTION_PICKLE_KEY"),
-				DatabasePath: envOrDefault("ENCRYPTION_DATABASE_PATH", "/data/crypto.db"),
-			},
-		},
-		MediaProxy: struct {
-			ServerName string `yaml:"server_name"`
-			ServerKey  string `yaml:"server_key"`
-			HMACSecret string `yaml:"hmac_secret"`
-			ListenAddr string `yaml:"listen_address"`
-			ListenPort uint16 `yaml:"listen_port"`
-			UseTLS     bool   `yaml:"use_tls"`
-			TLSCert    string `yaml:"tls_cert"`
-			TLSKey     string `yaml:"tls_key"`
-		}{
-			ServerName: os.Getenv("MEDIA_PROXY_SERVER_NAME"),
-			ServerKey:  os.Getenv("MEDIA_PROXY_SERVER_KEY"),
-			HMACSecret: os.Getenv("MEDIA_PROXY_HMAC_SECRET"),
-			ListenAddr: envOrDefault("MEDIA_PROXY_LISTEN_ADDRESS", "0.0.0.0"),
-			ListenPort: uint16(mediaPort),
-			UseTLS:     parseBool(os.Getenv("MEDIA_PROXY_USE_TLS")),
-			TLSCert:    os.Getenv("MEDIA_PROXY_TLS_CERT"),
-			TLSKey:     os.Getenv("MEDIA_PROXY_TLS_KEY"),
-		},
+// Conflict strategies decide what happens when the path of a new file is
+// taken. The timestamp, event_id and hash names only depend on the event, so
+// archiving it again finds the file under the same name.
+const (
+	ConflictCounter   = "counter"   // Add the first free _1, _2, ... counter
+	ConflictTimestamp = "timestamp" // Add the time the message was sent, e.g. _20240101-120000
+	ConflictEventID   = "event_id"  // Add the event ID
+	ConflictOverwrite = "overwrite" // Replace the file; Nextcloud keeps the old content as a version
+	ConflictHash      = "hash"      // Add the start of the SHA-256 hash of the content
+)
+
+// EffectiveConflictStrategy returns the conflict strategy of a rule, falling
+// back to the global one and then to counter.
+func (c *Config) EffectiveConflictStrategy(rule RoomRule) string {
+	switch {
+	case rule.ConflictStrategy != "":
+		return rule.ConflictStrategy
+	case c.Matrix.ConflictStrategy != "":
+		return c.Matrix.ConflictStrategy
 	}
+	return ConflictCounter
+}
+
+// Storage backend types.
+const (
+	StorageNextcloud = "nextcloud" // Another Nextcloud server or account
+	StorageWebDAV    = "webdav"    // Any WebDAV server
+	StorageLocal     = "local"     // A directory on the bridge's filesystem
+	StorageS3        = "s3"        // An S3 bucket or S3-compatible server such as MinIO
+)
+
+// StorageConfig configures a storage backend. Which fields are used depends
+// on the type.
+type StorageConfig struct {
+	Type string `yaml:"type"` // nextcloud, webdav, local or s3
+
+	// nextcloud and webdav
+	URL      string `yaml:"url"` // WebDAV folder files are stored in, like nextcloud.base_url
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	WebURL   string `yaml:"web_url"` // nextcloud only: web interface for links, like nextcloud.web_url
+
+	// local
+	Path string `yaml:"path"` // Directory files are stored in
+
+	// s3
+	Endpoint  string `yaml:"endpoint"` // e.g. "https://s3.eu-central-1.amazonaws.com" or "http://minio:9000"
+	Region    string `yaml:"region"`   // default us-east-1
+	Bucket    string `yaml:"bucket"`
+	Prefix    string `yaml:"prefix"` // Key prefix all files are stored under (optional)
+	AccessKey string `yaml:"access_key"`
+	SecretKey string `yaml:"secret_key"`
 }
 
-func envOrDefault(key, fallback string) string {
-	value := os.Getenv(key)
-	if value == "" {
-		return fallback
+// MetadataStripping configures removal of EXIF and XMP metadata from JPEG,
+// PNG and WebP images.
+type MetadataStripping struct {
+	Enabled *bool `yaml:"enabled"`
+	// OriginalsTemplate is a path template for an untouched copy of each
+	// stripped image, e.g. in a folder that is not shared. Empty keeps none.
+	OriginalsTemplate string `yaml:"originals_template"`
+}
+
+// Merge returns the settings with every field set in override replaced.
+func (m MetadataStripping) Merge(override *MetadataStripping) MetadataStripping {
+	if override == nil {
+		return m
+	}
+	merged := m
+	if override.Enabled != nil {
+		merged.Enabled = override.Enabled
 	}
-	return value
+	if override.OriginalsTemplate != "" {
+		merged.OriginalsTemplate = override.OriginalsTemplate
+	}
+	return merged
+}
+
+// IsEnabled reports whether metadata is stripped.
+func (m MetadataStripping) IsEnabled() bool {
+	return m.Enabled != nil && *m.Enabled
 }
 
-func parseRoomPathTemplate(value string) map[string]string {
-	if value == "" {
-		return map[string]string{}
+// Redaction actions.
+const (
+	RedactionDelete = "delete" // Delete the file and purge it from the trash bin
+	RedactionTrash  = "trash"  // Delete the file into the Nextcloud trash bin
+	RedactionMove   = "move"   // Move the file to the move template
+	RedactionKeep   = "keep"   // Keep the file and only revoke its proxy URL
+)
+
+// RedactionPolicy decides what happens to the archived file when its message
+// is redacted.
+type RedactionPolicy struct {
+	Action string `yaml:"action"` // delete, trash, move or keep
+	// MoveTemplate is the path template files are moved to by the move
+	// action, e.g. "/.redacted/${year}/${room}/${file}". Time variables use
+	// the time of the redaction.
+	MoveTemplate string `yaml:"move_template"`
+}
+
+// Merge returns the policy with every field set in override replaced.
+func (p RedactionPolicy) Merge(override *RedactionPolicy) RedactionPolicy {
+	if override == nil {
+		return p
 	}
-	result := map[string]string{}
-	pairs := strings.Split(value, ",")
-	for _, pair := range pairs {
-		kv := strings.SplitN(pair, "=", 2)
-		if len(kv) == 2 {
-			result[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
-		}
+	merged := p
+	if override.Action != "" {
+		merged.Action = override.Action
+	}
+	if override.MoveTemplate != "" {
+		merged.MoveTemplate = override.MoveTemplate
 	}
-	return result
+	return merged
 }
 
-func parseBool(value string) bool {
-	if value == "" {
-		return false
+// Selector describes which rooms the rule matches, for log and error messages.
+func (r RoomRule) Selector() string {
+	switch {
+	case r.Room != "":
+		return "room " + r.Room
+	case r.Alias != "":
+		return "alias " + r.Alias
+	case r.Space != "":
+		return "space " + r.Space
+	default:
+		return "default"
 	}
-	parsed, err := strconv.ParseBool(value)
+}
+
+// LoadConfig reads a YAML configuration file and layers environment variable
+// overrides on top of it (see ApplyEnv).
+func LoadConfig(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
 	if err != nil {
-		return false
+		return nil, err
+	}
+
+	expanded := expandEnvPreserveUnknown(string(data))
+	cfg := defaultConfig()
+	if err := yaml.Unmarshal([]byte(expanded), cfg); err != nil {
+		return nil, err
+	}
+	if err := ApplyEnv(cfg); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+// LoadConfigFromEnv builds the configuration from environment variables only.
+func LoadConfigFromEnv() (*Config, error) {
+	cfg := defaultConfig()
+	if err := ApplyEnv(cfg); err != nil {
+		return nil, err
 	}
-	return parsed
+	return cfg, nil
+}
+
+func defaultConfig() *Config {
+	cfg := &Config{}
+	cfg.Matrix.RoomPathTemplate = map[string]string{}
+	cfg.Matrix.Encryption.DatabasePath = "/data/crypto.db"
+	cfg.Matrix.Redaction.Action = RedactionDelete
+	cfg.Matrix.Redaction.MoveTemplate = "/.redacted/${year}/${room}/${file}"
+	cfg.MediaProxy.ListenAddr = "0.0.0.0"
+	cfg.MediaProxy.Thumbnails.Enabled = true
+	cfg.MediaProxy.Thumbnails.MaxWidth = 800
+	cfg.MediaProxy.Thumbnails.MaxHeight = 600
+	cfg.Antivirus.Timeout = 60 * time.Second
+	cfg.Antivirus.FailPolicy = "closed"
+	cfg.Antivirus.OnInfected = "flag"
+	cfg.Reconcile.Interval = time.Hour
+	cfg.Reconcile.Action = "edit"
+	cfg.Reconcile.MaxActions = 100
+	cfg.Outbox.Template = "/bridge-media/${room}/outbox"
+	cfg.Outbox.Interval = time.Minute
+	cfg.Talk.Interval = 30 * time.Second
+	cfg.Quota.Interval = 5 * time.Minute
+	cfg.Quota.Thresholds = []int{80, 90, 95}
+	cfg.Gallery.LinkTTL = 24 * time.Hour
+	cfg.Gallery.Command = "!gallery"
+	return cfg
 }
 
 func expandEnvPreserveUnknown(value string) string {
@@ -0,0 +1,194 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// legacyEnvNames maps generated variable names to the names used by earlier
+// releases, which are still honoured when the generated name is not set.
+var legacyEnvNames = map[string]string{
+	"MATRIX_APPSERVICE_REGISTRATION_PATH": "MATRIX_APP_REGISTRATION_PATH",
+	"MATRIX_APPSERVICE_HOSTNAME":          "MATRIX_APP_HOST",
+	"MATRIX_APPSERVICE_PORT":              "MATRIX_APP_PORT",
+	"MATRIX_ENCRYPTION_ENABLED":           "ENCRYPTION_ENABLED",
+	"MATRIX_ENCRYPTION_PICKLE_KEY":        "ENCRYPTION_PICKLE_KEY",
+	"MATRIX_ENCRYPTION_DATABASE_PATH":     "ENCRYPTION_DATABASE_PATH",
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// EnvName returns the environment variable name for a dotted yaml field path,
+// e.g. "media_proxy.hmac_secret" becomes MEDIA_PROXY_HMAC_SECRET.
+func EnvName(fieldPath string) string {
+	return strings.ToUpper(strings.ReplaceAll(fieldPath, ".", "_"))
+}
+
+// ApplyEnv overrides configuration fields from environment variables. Every
+// field is addressable by the upper-cased yaml path joined with underscores.
+// A variable with a _FILE suffix is read from the named file instead, which
+// allows Docker secrets to be used for passwords and keys.
+func ApplyEnv(cfg *Config) error {
+	return applyEnvToStruct(reflect.ValueOf(cfg).Elem(), "")
+}
+
+func applyEnvToStruct(value reflect.Value, prefix string) error {
+	valueType := value.Type()
+	for i := 0; i < valueType.NumField(); i++ {
+		field := valueType.Field(i)
+		tag := strings.Split(field.Tag.Get("yaml"), ",")[0]
+		if tag == "" || tag == "-" || !field.IsExported() {
+			continue
+		}
+		name := EnvName(tag)
+		if prefix != "" {
+			name = prefix + "_" + name
+		}
+		fieldValue := value.Field(i)
+		if fieldValue.Kind() == reflect.Struct {
+			if err := applyEnvToStruct(fieldValue, name); err != nil {
+				return err
+			}
+			continue
+		}
+		raw, source, ok, err := lookupEnv(name)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		if err := setFromEnv(fieldValue, raw); err != nil {
+			return fmt.Errorf("invalid value for %s: %w", source, err)
+		}
+	}
+	return nil
+}
+
+// lookupEnv finds the value for a generated name, its _FILE variant or the
+// legacy name, returning which variable supplied it. Empty variables and
+// empty files count as unset, so a compose file passing "${VAR}" for an unset
+// variable keeps the value from the config file.
+func lookupEnv(name string) (string, string, bool, error) {
+	names := []string{name}
+	if legacy, ok := legacyEnvNames[name]; ok {
+		names = append(names, legacy)
+	}
+	for _, candidate := range names {
+		value := os.Getenv(candidate)
+		filePath := os.Getenv(candidate + "_FILE")
+		if value != "" && filePath != "" {
+			return "", "", false, fmt.Errorf("both %s and %s_FILE are set", candidate, candidate)
+		}
+		if value != "" {
+			return value, candidate, true, nil
+		}
+		if filePath != "" {
+			data, err := os.ReadFile(filePath)
+			if err != nil {
+				return "", "", false, fmt.Errorf("failed to read %s_FILE: %w", candidate, err)
+			}
+			if value = strings.TrimRight(string(data), "\r\n"); value != "" {
+				return value, candidate + "_FILE", true, nil
+			}
+		}
+	}
+	return "", "", false, nil
+}
+
+func setFromEnv(field reflect.Value, raw string) error {
+	if field.Type() == durationType {
+		parsed, err := time.ParseDuration(raw)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(parsed))
+		return nil
+	}
+	if _, ok := field.Addr().Interface().(yaml.Unmarshaler); ok {
+		return setFromYAML(field, raw)
+	}
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(raw)
+	case reflect.Bool:
+		parsed, err := strconv.ParseBool(raw)
+		if err != nil {
+			return err
+		}
+		field.SetBool(parsed)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		parsed, err := strconv.ParseInt(raw, 10, field.Type().Bits())
+		if err != nil {
+			return err
+		}
+		field.SetInt(parsed)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		parsed, err := strconv.ParseUint(raw, 10, field.Type().Bits())
+		if err != nil {
+			return err
+		}
+		field.SetUint(parsed)
+	case reflect.Float32, reflect.Float64:
+		parsed, err := strconv.ParseFloat(raw, field.Type().Bits())
+		if err != nil {
+			return err
+		}
+		field.SetFloat(parsed)
+	case reflect.Map:
+		if field.Type().Key().Kind() == reflect.String && field.Type().Elem().Kind() == reflect.String && !strings.HasPrefix(strings.TrimSpace(raw), "{") {
+			field.Set(reflect.ValueOf(parseKeyValueList(raw)).Convert(field.Type()))
+			return nil
+		}
+		return setFromYAML(field, raw)
+	case reflect.Slice:
+		if field.Type().Elem().Kind() == reflect.String && !strings.HasPrefix(strings.TrimSpace(raw), "[") {
+			field.Set(reflect.ValueOf(parseList(raw)).Convert(field.Type()))
+			return nil
+		}
+		return setFromYAML(field, raw)
+	default:
+		return setFromYAML(field, raw)
+	}
+	return nil
+}
+
+// setFromYAML parses structured values such as lists of objects from an
+// inline YAML or JSON document.
+func setFromYAML(field reflect.Value, raw string) error {
+	parsed := reflect.New(field.Type())
+	if err := yaml.Unmarshal([]byte(raw), parsed.Interface()); err != nil {
+		return err
+	}
+	field.Set(parsed.Elem())
+	return nil
+}
+
+// parseKeyValueList parses "key=value,key=value" into a map.
+func parseKeyValueList(value string) map[string]string {
+	result := map[string]string{}
+	for _, pair := range strings.Split(value, ",") {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) == 2 {
+			result[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+		}
+	}
+	return result
+}
+
+// parseList parses a comma-separated list, dropping empty entries.
+func parseList(value string) []string {
+	result := []string{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			result = append(result, item)
+		}
+	}
+	return result
+}
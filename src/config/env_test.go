@@ -0,0 +1,82 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadConfigLayersEnvOverFile(t *testing.T) {
+	dir := t.TempDir()
+	configPath := filepath.Join(dir, "config.yaml")
+	configYAML := `nextcloud:
+  base_url: "https://nextcloud.example.com/remote.php/dav/files/media-bridge"
+  username: "media-bridge"
+matrix:
+  homeserver_url: "https://matrix.example.com"
+  appservice:
+    port: 29334
+media_proxy:
+  server_name: "media.example.com"
+`
+	if err := os.WriteFile(configPath, []byte(configYAML), 0600); err != nil {
+		t.Fatalf("failed to write temp config: %v", err)
+	}
+	secretPath := filepath.Join(dir, "hmac_secret")
+	if err := os.WriteFile(secretPath, []byte("from-file\n"), 0600); err != nil {
+		t.Fatalf("failed to write secret file: %v", err)
+	}
+
+	emptyPath := filepath.Join(dir, "pickle_key")
+	if err := os.WriteFile(emptyPath, []byte("\n"), 0600); err != nil {
+		t.Fatalf("failed to write secret file: %v", err)
+	}
+
+	t.Setenv("NEXTCLOUD_USERNAME", "override")
+	// Unset variables passed on by docker compose as "${VAR}" are empty
+	t.Setenv("NEXTCLOUD_BASE_URL", "")
+	t.Setenv("MATRIX_APPSERVICE_PORT", "")
+	t.Setenv("MATRIX_ENCRYPTION_PICKLE_KEY_FILE", emptyPath)
+	t.Setenv("MEDIA_PROXY_HMAC_SECRET_FILE", secretPath)
+	t.Setenv("MATRIX_APP_PORT", "29400")
+	t.Setenv("MATRIX_ENCRYPTION_ENABLED", "true")
+	t.Setenv("MATRIX_ROOM_PATH_TEMPLATE", "!a:example.com=/a/${file},!b:example.com=/b/${file}")
+
+	cfg, err := LoadConfig(configPath)
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+	if cfg.Nextcloud.BaseURL != "https://nextcloud.example.com/remote.php/dav/files/media-bridge" {
+		t.Fatalf("expected base_url from file, got %q", cfg.Nextcloud.BaseURL)
+	}
+	if cfg.Nextcloud.Username != "override" {
+		t.Fatalf("expected username from env, got %q", cfg.Nextcloud.Username)
+	}
+	if cfg.MediaProxy.HMACSecret != "from-file" {
+		t.Fatalf("expected hmac_secret from file, got %q", cfg.MediaProxy.HMACSecret)
+	}
+	if cfg.Matrix.Appservice.Port != 29400 {
+		t.Fatalf("expected port from legacy env name, got %d", cfg.Matrix.Appservice.Port)
+	}
+	if !cfg.Matrix.Encryption.Enabled || cfg.Matrix.Encryption.DatabasePath != "/data/crypto.db" || cfg.Matrix.Encryption.PickleKey != "" {
+		t.Fatalf("expected encryption enabled with default database path, got %+v", cfg.Matrix.Encryption)
+	}
+	if len(cfg.Matrix.RoomPathTemplate) != 2 || cfg.Matrix.RoomPathTemplate["!b:example.com"] != "/b/${file}" {
+		t.Fatalf("unexpected room templates: %v", cfg.Matrix.RoomPathTemplate)
+	}
+}
+
+func TestApplyEnvRejectsInvalidValues(t *testing.T) {
+	t.Setenv("MEDIA_PROXY_USE_TLS", "maybe")
+	if _, err := LoadConfigFromEnv(); err == nil {
+		t.Fatalf("expected error for invalid boolean")
+	}
+}
+
+func TestApplyEnvRejectsValueAndFile(t *testing.T) {
+	t.Setenv("NEXTCLOUD_PASSWORD", "secret")
+	t.Setenv("NEXTCLOUD_PASSWORD_FILE", "/run/secrets/nextcloud_password")
+	if _, err := LoadConfigFromEnv(); err == nil {
+		t.Fatalf("expected error when both NEXTCLOUD_PASSWORD and NEXTCLOUD_PASSWORD_FILE are set")
+	}
+}
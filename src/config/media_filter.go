@@ -0,0 +1,137 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// MediaFilter restricts which media is archived to Nextcloud. Empty allow
+// lists allow everything; deny lists are checked first.
+type MediaFilter struct {
+	AllowMimeTypes  []string `yaml:"allow_mime_types"` // Globs such as "image/*"
+	DenyMimeTypes   []string `yaml:"deny_mime_types"`
+	AllowMsgTypes   []string `yaml:"allow_msgtypes"` // m.image, m.video, m.audio, m.file or m.voice
+	DenyMsgTypes    []string `yaml:"deny_msgtypes"`
+	AllowExtensions []string `yaml:"allow_extensions"` // Without the dot, case-insensitive
+	DenyExtensions  []string `yaml:"deny_extensions"`
+	MinSize         ByteSize `yaml:"min_size"` // 0 disables the limit
+	MaxSize         ByteSize `yaml:"max_size"`
+	// NotifySender replies to skipped media with the reason it was not archived.
+	NotifySender *bool `yaml:"notify_sender"`
+
+	// Whether the sizes were written in the YAML, so a room rule setting 0
+	// lifts the global limit instead of keeping it.
+	minSizeSet, maxSizeSet bool
+}
+
+func (f *MediaFilter) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain MediaFilter
+	if err := unmarshal((*plain)(f)); err != nil {
+		return err
+	}
+	var keys map[string]interface{}
+	if err := unmarshal(&keys); err != nil {
+		return err
+	}
+	_, f.minSizeSet = keys["min_size"]
+	_, f.maxSizeSet = keys["max_size"]
+	return nil
+}
+
+// Merge returns the filter with every field set in override replaced.
+func (f MediaFilter) Merge(override *MediaFilter) MediaFilter {
+	if override == nil {
+		return f
+	}
+	merged := f
+	if override.AllowMimeTypes != nil {
+		merged.AllowMimeTypes = override.AllowMimeTypes
+	}
+	if override.DenyMimeTypes != nil {
+		merged.DenyMimeTypes = override.DenyMimeTypes
+	}
+	if override.AllowMsgTypes != nil {
+		merged.AllowMsgTypes = override.AllowMsgTypes
+	}
+	if override.DenyMsgTypes != nil {
+		merged.DenyMsgTypes = override.DenyMsgTypes
+	}
+	if override.AllowExtensions != nil {
+		merged.AllowExtensions = override.AllowExtensions
+	}
+	if override.DenyExtensions != nil {
+		merged.DenyExtensions = override.DenyExtensions
+	}
+	if override.MinSize != 0 || override.minSizeSet {
+		merged.MinSize = override.MinSize
+	}
+	if override.MaxSize != 0 || override.maxSizeSet {
+		merged.MaxSize = override.MaxSize
+	}
+	if override.NotifySender != nil {
+		merged.NotifySender = override.NotifySender
+	}
+	return merged
+}
+
+// ByteSize is a size in bytes that can be written as a plain number or with a
+// unit such as "512KB", "100MB" or "2GiB".
+type ByteSize int64
+
+var byteSizeUnits = []struct {
+	suffix     string
+	multiplier int64
+}{
+	{"KIB", 1 << 10}, {"MIB", 1 << 20}, {"GIB", 1 << 30}, {"TIB", 1 << 40},
+	{"KB", 1000}, {"MB", 1000 * 1000}, {"GB", 1000 * 1000 * 1000}, {"TB", 1000 * 1000 * 1000 * 1000},
+	{"K", 1 << 10}, {"M", 1 << 20}, {"G", 1 << 30}, {"T", 1 << 40},
+	{"B", 1},
+}
+
+// ParseByteSize parses a size such as "1048576", "100MB" or "1.5GiB".
+func ParseByteSize(value string) (ByteSize, error) {
+	trimmed := strings.ToUpper(strings.TrimSpace(value))
+	if trimmed == "" {
+		return 0, nil
+	}
+	multiplier := int64(1)
+	for _, unit := range byteSizeUnits {
+		if strings.HasSuffix(trimmed, unit.suffix) {
+			multiplier = unit.multiplier
+			trimmed = strings.TrimSpace(strings.TrimSuffix(trimmed, unit.suffix))
+			break
+		}
+	}
+	number, err := strconv.ParseFloat(trimmed, 64)
+	if err != nil || number < 0 {
+		return 0, fmt.Errorf("invalid size %q", value)
+	}
+	return ByteSize(number * float64(multiplier)), nil
+}
+
+func (s *ByteSize) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var raw string
+	if err := unmarshal(&raw); err != nil {
+		return err
+	}
+	parsed, err := ParseByteSize(raw)
+	if err != nil {
+		return err
+	}
+	*s = parsed
+	return nil
+}
+
+func (s ByteSize) String() string {
+	switch {
+	case s >= 1<<30 && s%(1<<30) == 0:
+		return fmt.Sprintf("%dGiB", s>>30)
+	case s >= 1<<20 && s%(1<<20) == 0:
+		return fmt.Sprintf("%dMiB", s>>20)
+	case s >= 1<<10 && s%(1<<10) == 0:
+		return fmt.Sprintf("%dKiB", s>>10)
+	default:
+		return fmt.Sprintf("%d bytes", int64(s))
+	}
+}
@@ -0,0 +1,68 @@
+package config
+
+import (
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+func TestParseByteSize(t *testing.T) {
+	cases := map[string]ByteSize{
+		"":       0,
+		"1024":   1024,
+		"512KB":  512000,
+		"100 MB": 100000000,
+		"2GiB":   2 << 30,
+		"1.5m":   3 << 19,
+	}
+	for input, expected := range cases {
+		parsed, err := ParseByteSize(input)
+		if err != nil {
+			t.Fatalf("%q: unexpected error: %v", input, err)
+		}
+		if parsed != expected {
+			t.Fatalf("%q: expected %d, got %d", input, expected, parsed)
+		}
+	}
+	for _, input := range []string{"ten", "-5MB", "5XB"} {
+		if _, err := ParseByteSize(input); err == nil {
+			t.Fatalf("%q: expected error", input)
+		}
+	}
+}
+
+func TestMediaFilterYAMLAndMerge(t *testing.T) {
+	var cfg Config
+	err := yaml.Unmarshal([]byte(`
+matrix:
+  media_filter:
+    deny_extensions: [exe]
+    max_size: 100MB
+    notify_sender: true
+  room_rules:
+    - room: "!photos:example.com"
+      template: "/photos/${file}"
+      filter:
+        allow_mime_types: ["image/*"]
+        notify_sender: false
+    - room: "!videos:example.com"
+      template: "/videos/${file}"
+      filter:
+        max_size: 0
+`), &cfg)
+	if err != nil {
+		t.Fatalf("failed to parse: %v", err)
+	}
+	merged := cfg.Matrix.MediaFilter.Merge(cfg.Matrix.RoomRules[0].Filter)
+	if merged.MaxSize != 100000000 || len(merged.DenyExtensions) != 1 || len(merged.AllowMimeTypes) != 1 {
+		t.Fatalf("unexpected merged filter: %+v", merged)
+	}
+	if merged.NotifySender == nil || *merged.NotifySender {
+		t.Fatalf("expected room rule to disable notifications")
+	}
+	// A size of 0 lifts the global limit
+	merged = cfg.Matrix.MediaFilter.Merge(cfg.Matrix.RoomRules[1].Filter)
+	if merged.MaxSize != 0 || len(merged.DenyExtensions) != 1 {
+		t.Fatalf("expected room rule to lift the size limit: %+v", merged)
+	}
+}
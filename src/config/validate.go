@@ -0,0 +1,472 @@
+package config
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"maunium.net/go/mautrix/federation"
+
+	"nextcloud-media-bridge/src/utils"
+)
+
+// FieldError describes a single invalid configuration value.
+type FieldError struct {
+	Field   string
+	Message string
+}
+
+func (e FieldError) Error() string {
+	return e.Field + ": " + e.Message
+}
+
+// ValidationError collects every problem found while validating a Config.
+type ValidationError []FieldError
+
+func (v ValidationError) Error() string {
+	messages := make([]string, len(v))
+	for i, fieldErr := range v {
+		messages[i] = fieldErr.Error()
+	}
+	return fmt.Sprintf("%d configuration error(s): %s", len(v), strings.Join(messages, "; "))
+}
+
+type validator struct {
+	errors ValidationError
+}
+
+func (v *validator) addf(field, format string, args ...any) {
+	v.errors = append(v.errors, FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+// required reports an error if value is empty or still references an unset environment variable.
+func (v *validator) required(field, value string) bool {
+	if strings.TrimSpace(value) == "" {
+		v.addf(field, "is required")
+		return false
+	}
+	return v.resolved(field, value)
+}
+
+// resolved reports an error if value is a ${VAR} reference that was not expanded at load time.
+func (v *validator) resolved(field, value string) bool {
+	if strings.HasPrefix(value, "${") && strings.HasSuffix(value, "}") {
+		v.addf(field, "references unset environment variable %s", strings.TrimSuffix(strings.TrimPrefix(value, "${"), "}"))
+		return false
+	}
+	return true
+}
+
+// fileNameVariables are the template variables that make a path unique per file.
+var fileNameVariables = []string{"file", "basename", "hash8", "event_id"}
+
+func (v *validator) pathTemplate(field, template string) {
+	if strings.TrimSpace(template) == "" {
+		v.addf(field, "template is empty")
+		return
+	}
+	parsed, err := utils.ParsePathTemplate(template)
+	if err != nil {
+		v.addf(field, "%v", err)
+		return
+	}
+	for _, variable := range fileNameVariables {
+		if parsed.Uses(variable) {
+			return
+		}
+	}
+	v.addf(field, "template must contain ${file}, ${basename}, ${hash8} or ${event_id}")
+}
+
+// roomVariables are the template variables that only depend on the room.
+var roomVariables = map[string]bool{"room": true, "room_id": true, "room_alias": true, "room_name": true}
+
+// roomFolderTemplate checks a template for a folder per room, which can only
+// use the room variables.
+func (v *validator) roomFolderTemplate(field, template string) {
+	if strings.TrimSpace(template) == "" {
+		v.addf(field, "template is empty")
+		return
+	}
+	parsed, err := utils.ParsePathTemplate(template)
+	if err != nil {
+		v.addf(field, "%v", err)
+		return
+	}
+	variables := parsed.Variables()
+	for _, variable := range variables {
+		if !roomVariables[variable] {
+			v.addf(field, "template can only use room variables, got ${%s}", variable)
+			return
+		}
+	}
+	if len(variables) == 0 {
+		v.addf(field, "template must contain ${room}, ${room_id}, ${room_alias} or ${room_name}")
+	}
+}
+
+// redactionPolicy checks the fields a policy sets and that the effective
+// policy, after merging with the global one, is complete.
+func (v *validator) redactionPolicy(field string, policy, effective RedactionPolicy) {
+	switch policy.Action {
+	case "", RedactionDelete, RedactionTrash, RedactionMove, RedactionKeep:
+	default:
+		v.addf(field+".action", "must be delete, trash, move or keep, got %q", policy.Action)
+	}
+	if policy.MoveTemplate != "" {
+		v.pathTemplate(field+".move_template", policy.MoveTemplate)
+	} else if effective.Action == RedactionMove && effective.MoveTemplate == "" {
+		v.addf(field+".move_template", "is required for the move action")
+	}
+}
+
+func (v *validator) conflictStrategy(field, strategy string) {
+	switch strategy {
+	case "", ConflictCounter, ConflictTimestamp, ConflictEventID, ConflictOverwrite, ConflictHash:
+	default:
+		v.addf(field, "must be counter, timestamp, event_id, overwrite or hash, got %q", strategy)
+	}
+}
+
+// knownMsgTypes are the media msgtypes a filter can name. m.voice selects
+// voice messages, which are m.audio with the MSC3245 voice flag.
+var knownMsgTypes = map[string]bool{"m.image": true, "m.video": true, "m.audio": true, "m.file": true, "m.voice": true}
+
+func (v *validator) mediaFilter(field string, filter MediaFilter) {
+	for _, list := range []struct {
+		name     string
+		patterns []string
+	}{{"allow_mime_types", filter.AllowMimeTypes}, {"deny_mime_types", filter.DenyMimeTypes}} {
+		for _, pattern := range list.patterns {
+			if _, err := path.Match(pattern, ""); err != nil || !strings.Contains(pattern, "/") {
+				v.addf(field+"."+list.name, "%q is not a MIME type pattern like image/*", pattern)
+			}
+		}
+	}
+	for _, list := range []struct {
+		name     string
+		msgTypes []string
+	}{{"allow_msgtypes", filter.AllowMsgTypes}, {"deny_msgtypes", filter.DenyMsgTypes}} {
+		for _, msgType := range list.msgTypes {
+			if !knownMsgTypes[msgType] {
+				v.addf(field+"."+list.name, "unknown msgtype %q, expected m.image, m.video, m.audio, m.file or m.voice", msgType)
+			}
+		}
+	}
+	if filter.MinSize < 0 || filter.MaxSize < 0 {
+		v.addf(field, "sizes must not be negative")
+	} else if filter.MaxSize > 0 && filter.MinSize > filter.MaxSize {
+		v.addf(field+".min_size", "is larger than max_size (%s > %s)", filter.MinSize, filter.MaxSize)
+	}
+}
+
+func (v *validator) httpURL(field, value string) {
+	parsed, err := url.Parse(value)
+	if err != nil {
+		v.addf(field, "is not a valid URL: %v", err)
+		return
+	}
+	if parsed.Scheme != "http" && parsed.Scheme != "https" {
+		v.addf(field, "must be an http:// or https:// URL, got %q", value)
+		return
+	}
+	if parsed.Host == "" {
+		v.addf(field, "is missing a host: %q", value)
+	}
+}
+
+func (v *validator) storage(field string, storage StorageConfig) {
+	switch storage.Type {
+	case StorageNextcloud:
+		if v.required(field+".url", storage.URL) {
+			v.httpURL(field+".url", storage.URL)
+		}
+		if storage.WebURL != "" && v.resolved(field+".web_url", storage.WebURL) {
+			v.httpURL(field+".web_url", storage.WebURL)
+		}
+		v.required(field+".username", storage.Username)
+		v.required(field+".password", storage.Password)
+	case StorageWebDAV:
+		if v.required(field+".url", storage.URL) {
+			v.httpURL(field+".url", storage.URL)
+		}
+	case StorageLocal:
+		v.required(field+".path", storage.Path)
+	case StorageS3:
+		if v.required(field+".endpoint", storage.Endpoint) {
+			v.httpURL(field+".endpoint", storage.Endpoint)
+		}
+		v.required(field+".bucket", storage.Bucket)
+		v.required(field+".access_key", storage.AccessKey)
+		v.required(field+".secret_key", storage.SecretKey)
+	default:
+		v.addf(field+".type", "must be nextcloud, webdav, local or s3, got %q", storage.Type)
+	}
+}
+
+// Validate checks the configuration for mistakes that would otherwise only
+// surface at runtime. All problems are returned at once as a ValidationError.
+func (c *Config) Validate() error {
+	v := &validator{}
+
+	if v.required("nextcloud.base_url", c.Nextcloud.BaseURL) {
+		v.httpURL("nextcloud.base_url", c.Nextcloud.BaseURL)
+	}
+	if c.Nextcloud.WebURL != "" && v.resolved("nextcloud.web_url", c.Nextcloud.WebURL) {
+		v.httpURL("nextcloud.web_url", c.Nextcloud.WebURL)
+	}
+	v.required("nextcloud.username", c.Nextcloud.Username)
+	v.required("nextcloud.password", c.Nextcloud.Password)
+	for i, tag := range c.Nextcloud.Metadata.Tags {
+		field := fmt.Sprintf("nextcloud.metadata.tags[%d]", i)
+		if strings.TrimSpace(tag) == "" {
+			v.addf(field, "tag is empty")
+		} else if _, err := utils.ParsePathTemplate(tag); err != nil {
+			v.addf(field, "%v", err)
+		}
+	}
+
+	if v.required("matrix.homeserver_url", c.Matrix.HomeserverURL) {
+		v.httpURL("matrix.homeserver_url", c.Matrix.HomeserverURL)
+	}
+	v.required("matrix.homeserver_domain", c.Matrix.HomeserverDomain)
+
+	roomIDs := make([]string, 0, len(c.Matrix.RoomPathTemplate))
+	for roomID := range c.Matrix.RoomPathTemplate {
+		roomIDs = append(roomIDs, roomID)
+	}
+	sort.Strings(roomIDs)
+	for _, roomID := range roomIDs {
+		field := fmt.Sprintf("matrix.room_path_template[%s]", roomID)
+		if !strings.HasPrefix(roomID, "!") || !strings.Contains(roomID, ":") {
+			v.addf(field, "key must be a room ID like !roomid:example.com")
+		}
+		v.pathTemplate(field, c.Matrix.RoomPathTemplate[roomID])
+	}
+	for i, rule := range c.Matrix.RoomRules {
+		field := fmt.Sprintf("matrix.room_rules[%d]", i)
+		selectors := 0
+		if rule.Room != "" {
+			selectors++
+			if !strings.HasPrefix(rule.Room, "!") || !strings.Contains(rule.Room, ":") {
+				v.addf(field+".room", "must be a room ID like !roomid:example.com")
+			}
+		}
+		if rule.Alias != "" {
+			selectors++
+			if !strings.HasPrefix(rule.Alias, "#") {
+				v.addf(field+".alias", "must be an alias pattern like #proj-*:example.com")
+			} else if _, err := path.Match(rule.Alias, ""); err != nil {
+				v.addf(field+".alias", "is not a valid pattern: %v", err)
+			}
+		}
+		if rule.Space != "" {
+			selectors++
+			if !strings.HasPrefix(rule.Space, "!") || !strings.Contains(rule.Space, ":") {
+				v.addf(field+".space", "must be a room ID like !spaceid:example.com")
+			}
+		}
+		if selectors != 1 {
+			v.addf(field, "exactly one of room, alias or space must be set")
+		}
+		v.pathTemplate(field+".template", rule.Template)
+		if rule.Filter != nil {
+			v.mediaFilter(field+".filter", *rule.Filter)
+		}
+		if rule.StripMetadata != nil && rule.StripMetadata.OriginalsTemplate != "" {
+			v.pathTemplate(field+".strip_metadata.originals_template", rule.StripMetadata.OriginalsTemplate)
+		}
+		if rule.Redaction != nil {
+			v.redactionPolicy(field+".redaction", *rule.Redaction, c.Matrix.Redaction.Merge(rule.Redaction))
+		}
+		if _, ok := c.Storages[rule.Storage]; rule.Storage != "" && !ok {
+			v.addf(field+".storage", "unknown storage %q", rule.Storage)
+		}
+		v.conflictStrategy(field+".conflict_strategy", rule.ConflictStrategy)
+	}
+	if c.Matrix.DefaultPathTemplate != "" {
+		v.pathTemplate("matrix.default_path_template", c.Matrix.DefaultPathTemplate)
+	}
+	v.mediaFilter("matrix.media_filter", c.Matrix.MediaFilter)
+	if c.Matrix.StripMetadata.OriginalsTemplate != "" {
+		v.pathTemplate("matrix.strip_metadata.originals_template", c.Matrix.StripMetadata.OriginalsTemplate)
+	}
+	v.redactionPolicy("matrix.redaction", c.Matrix.Redaction, c.Matrix.Redaction)
+	v.conflictStrategy("matrix.conflict_strategy", c.Matrix.ConflictStrategy)
+
+	storageNames := make([]string, 0, len(c.Storages))
+	for name := range c.Storages {
+		storageNames = append(storageNames, name)
+	}
+	sort.Strings(storageNames)
+	for _, name := range storageNames {
+		v.storage(fmt.Sprintf("storages[%s]", name), c.Storages[name])
+	}
+	if c.Mirror.Enabled && v.required("mirror.storage", c.Mirror.Storage) {
+		if _, ok := c.Storages[c.Mirror.Storage]; !ok {
+			v.addf("mirror.storage", "unknown storage %q", c.Mirror.Storage)
+		}
+		for i, rule := range c.Matrix.RoomRules {
+			if rule.Storage == c.Mirror.Storage {
+				v.addf("mirror.storage", "storage %q is also used by matrix.room_rules[%d]", c.Mirror.Storage, i)
+			}
+		}
+	}
+	if c.Quota.Enabled {
+		if c.Quota.Interval < 10*time.Second {
+			v.addf("quota.interval", "must be at least 10s, got %s", c.Quota.Interval)
+		}
+		for i, threshold := range c.Quota.Thresholds {
+			if threshold <= 0 || threshold > 100 {
+				v.addf(fmt.Sprintf("quota.thresholds[%d]", i), "must be a percentage between 1 and 100, got %d", threshold)
+			}
+		}
+	}
+
+	v.required("matrix.appservice.registration_path", c.Matrix.Appservice.RegistrationPath)
+	if c.Matrix.Admin.Enabled {
+		v.required("matrix.admin.access_token", c.Matrix.Admin.AccessToken)
+	}
+	if c.Matrix.Encryption.Enabled {
+		v.required("matrix.encryption.pickle_key", c.Matrix.Encryption.PickleKey)
+		v.required("matrix.encryption.database_path", c.Matrix.Encryption.DatabasePath)
+	}
+
+	v.required("media_proxy.server_name", c.MediaProxy.ServerName)
+	if v.required("media_proxy.server_key", c.MediaProxy.ServerKey) {
+		if err := checkServerKey(c.MediaProxy.ServerKey); err != nil {
+			v.addf("media_proxy.server_key", "is not a valid Synapse signing key: %v", err)
+		}
+	}
+	v.required("media_proxy.hmac_secret", c.MediaProxy.HMACSecret)
+	if c.MediaProxy.UseTLS && (c.MediaProxy.TLSCert == "") != (c.MediaProxy.TLSKey == "") {
+		v.addf("media_proxy.tls_cert", "tls_cert and tls_key must be set together")
+	}
+
+	if c.MediaProxy.Thumbnails.Enabled && (c.MediaProxy.Thumbnails.MaxWidth <= 0 || c.MediaProxy.Thumbnails.MaxHeight <= 0) {
+		v.addf("media_proxy.thumbnails", "max_width and max_height must be positive")
+	}
+
+	if c.Antivirus.Enabled {
+		if v.required("antivirus.address", c.Antivirus.Address) {
+			if _, _, err := ParseClamdAddress(c.Antivirus.Address); err != nil {
+				v.addf("antivirus.address", "%v", err)
+			}
+		}
+		switch c.Antivirus.FailPolicy {
+		case "", "open", "closed":
+		default:
+			v.addf("antivirus.fail_policy", "must be open or closed, got %q", c.Antivirus.FailPolicy)
+		}
+		switch c.Antivirus.OnInfected {
+		case "", "flag", "redact", "ignore":
+		default:
+			v.addf("antivirus.on_infected", "must be flag, redact or ignore, got %q", c.Antivirus.OnInfected)
+		}
+	}
+
+	if c.Reconcile.Enabled {
+		if c.Reconcile.Interval < time.Minute {
+			v.addf("reconcile.interval", "must be at least 1m, got %s", c.Reconcile.Interval)
+		}
+		switch c.Reconcile.Action {
+		case "", "edit", "redact", "restore":
+		default:
+			v.addf("reconcile.action", "must be edit, redact or restore, got %q", c.Reconcile.Action)
+		}
+		if c.Reconcile.MaxActions < 0 {
+			v.addf("reconcile.max_actions", "must not be negative, got %d", c.Reconcile.MaxActions)
+		}
+	}
+
+	if c.Outbox.Enabled {
+		v.roomFolderTemplate("outbox.template", c.Outbox.Template)
+		if c.Outbox.Interval < 10*time.Second {
+			v.addf("outbox.interval", "must be at least 10s, got %s", c.Outbox.Interval)
+		}
+	}
+
+	if c.Talk.Enabled {
+		if c.Talk.Interval < 5*time.Second {
+			v.addf("talk.interval", "must be at least 5s, got %s", c.Talk.Interval)
+		}
+		if len(c.Talk.Rooms) == 0 {
+			v.addf("talk.rooms", "at least one room is required")
+		}
+		rooms, tokens := map[string]bool{}, map[string]bool{}
+		for i, room := range c.Talk.Rooms {
+			field := fmt.Sprintf("talk.rooms[%d]", i)
+			if !strings.HasPrefix(room.Room, "!") {
+				v.addf(field+".room", "must be a room ID starting with !, got %q", room.Room)
+			} else if rooms[room.Room] {
+				v.addf(field+".room", "room %s is linked to more than one conversation", room.Room)
+			}
+			if room.Token == "" || strings.ContainsAny(room.Token, "/?#") {
+				v.addf(field+".token", "must be a conversation token, got %q", room.Token)
+			} else if tokens[room.Token] {
+				v.addf(field+".token", "conversation %s is linked to more than one room", room.Token)
+			}
+			rooms[room.Room], tokens[room.Token] = true, true
+		}
+	}
+
+	if c.Gallery.Enabled {
+		if v.required("gallery.public_url", c.Gallery.PublicURL) {
+			v.httpURL("gallery.public_url", c.Gallery.PublicURL)
+		}
+		if c.Gallery.LinkTTL < time.Minute {
+			v.addf("gallery.link_ttl", "must be at least 1m, got %s", c.Gallery.LinkTTL)
+		}
+	}
+
+	if len(v.errors) > 0 {
+		return v.errors
+	}
+	return nil
+}
+
+// ParseClamdAddress splits a clamd address into a network and address for
+// net.Dial. Plain host:port addresses use TCP.
+func ParseClamdAddress(address string) (string, string, error) {
+	switch {
+	case strings.HasPrefix(address, "unix://"):
+		socket := strings.TrimPrefix(address, "unix://")
+		if socket == "" {
+			return "", "", fmt.Errorf("unix socket path is empty")
+		}
+		return "unix", socket, nil
+	case strings.HasPrefix(address, "tcp://"):
+		address = strings.TrimPrefix(address, "tcp://")
+	case strings.Contains(address, "://"):
+		return "", "", fmt.Errorf("unsupported scheme in %q, use tcp:// or unix://", address)
+	case strings.HasPrefix(address, "/"):
+		return "unix", address, nil
+	}
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		return "", "", fmt.Errorf("invalid clamd address %q: %v", address, err)
+	}
+	return "tcp", address, nil
+}
+
+// checkServerKey parses a Synapse signing key line. The seed length is checked
+// up front because federation.ParseSynapseKey panics on short seeds.
+func checkServerKey(key string) error {
+	parts := strings.Split(key, " ")
+	if len(parts) == 3 {
+		seed, err := base64.RawStdEncoding.DecodeString(parts[2])
+		if err != nil {
+			return fmt.Errorf("invalid private key: %w", err)
+		}
+		if len(seed) != ed25519.SeedSize {
+			return fmt.Errorf("private key must be %d bytes, got %d", ed25519.SeedSize, len(seed))
+		}
+	}
+	_, err := federation.ParseSynapseKey(key)
+	return err
+}
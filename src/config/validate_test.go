@@ -0,0 +1,105 @@
+package config
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"maunium.net/go/mautrix/federation"
+)
+
+func validTestConfig() *Config {
+	cfg := &Config{}
+	cfg.Nextcloud.BaseURL = "https://nextcloud.example.com/remote.php/dav/files/media-bridge"
+	cfg.Nextcloud.Username = "media-bridge"
+	cfg.Nextcloud.Password = "secret"
+	cfg.Matrix.HomeserverURL = "https://matrix.example.com"
+	cfg.Matrix.HomeserverDomain = "example.com"
+	cfg.Matrix.RoomPathTemplate = map[string]string{"!roomid:example.com": "/media/${year}/${user}/${file}"}
+	cfg.Matrix.Appservice.RegistrationPath = "/data/registration.yaml"
+	cfg.MediaProxy.ServerName = "media.example.com"
+	cfg.MediaProxy.ServerKey = federation.GenerateSigningKey().SynapseString()
+	cfg.MediaProxy.HMACSecret = "secret"
+	return cfg
+}
+
+func TestValidateAcceptsValidConfig(t *testing.T) {
+	if err := validTestConfig().Validate(); err != nil {
+		t.Fatalf("expected valid config, got %v", err)
+	}
+}
+
+func TestValidateReportsAllErrors(t *testing.T) {
+	cfg := validTestConfig()
+	cfg.Nextcloud.BaseURL = "nextcloud.example.com/remote.php"
+	cfg.Nextcloud.Password = "${NEXTCLOUD_PASSWORD}"
+	cfg.Nextcloud.Metadata.Tags = []string{"matrix", "room:${roomname}"}
+	cfg.Matrix.RoomPathTemplate["!other:example.com"] = "/media/${year}/${user}"
+	cfg.Matrix.RoomRules = []RoomRule{{Alias: "#archive-*:example.com", Template: "/archive/${file}", Storage: "cold", ConflictStrategy: "random"}}
+	cfg.Matrix.DefaultPathTemplate = "/misc/${roomname}/${file}"
+	cfg.Storages = map[string]StorageConfig{
+		"disk":    {Type: StorageLocal, Path: "/srv/media"},
+		"finance": {Type: StorageNextcloud, URL: "https://finance.example.com/remote.php/dav/files/bridge", Username: "bridge"},
+		"minio":   {Type: StorageS3, Endpoint: "http://minio:9000", Bucket: "media", AccessKey: "bridge"},
+	}
+	cfg.Mirror.Enabled = true
+	cfg.Mirror.Storage = "backup"
+	cfg.Quota.Enabled = true
+	cfg.Quota.Interval = time.Minute
+	cfg.Quota.Thresholds = []int{80, 120}
+	cfg.Matrix.Redaction.Action = "shred"
+	cfg.Matrix.ConflictStrategy = "suffix"
+	cfg.Matrix.Encryption.Enabled = true
+	cfg.Matrix.Encryption.PickleKey = "pickle"
+	cfg.MediaProxy.ServerKey = "ed25519 a1b2c3d4 ABCDEF"
+	cfg.Reconcile.Enabled = true
+	cfg.Reconcile.Interval = time.Second
+	cfg.Reconcile.Action = "notify"
+	cfg.Outbox.Enabled = true
+	cfg.Outbox.Template = "/bridge-media/${room}/${user}"
+	cfg.Outbox.Interval = time.Minute
+	cfg.Talk.Enabled = true
+	cfg.Talk.Interval = 30 * time.Second
+	cfg.Gallery.Enabled = true
+	cfg.Gallery.PublicURL = "media.example.com"
+	cfg.Gallery.LinkTTL = time.Hour
+	cfg.Talk.Rooms = []TalkRoom{{Room: "#general:example.com", Token: "a1b2c3d4"}, {Room: "!general:example.com", Token: "a1b2c3d4"}}
+
+	err := cfg.Validate()
+	var validationErr ValidationError
+	if !errors.As(err, &validationErr) {
+		t.Fatalf("expected ValidationError, got %v", err)
+	}
+
+	expected := []string{
+		"nextcloud.base_url",
+		"nextcloud.password",
+		"nextcloud.metadata.tags[1]",
+		"matrix.room_path_template[!other:example.com]",
+		"matrix.room_rules[0].storage",
+		"matrix.room_rules[0].conflict_strategy",
+		"matrix.default_path_template",
+		"matrix.redaction.action",
+		"matrix.conflict_strategy",
+		"storages[finance].password",
+		"storages[minio].secret_key",
+		"mirror.storage",
+		"quota.thresholds[1]",
+		"matrix.encryption.database_path",
+		"media_proxy.server_key",
+		"reconcile.interval",
+		"reconcile.action",
+		"outbox.template",
+		"talk.rooms[0].room",
+		"talk.rooms[1].token",
+		"gallery.public_url",
+	}
+	if len(validationErr) != len(expected) {
+		t.Fatalf("expected %d errors, got %d: %v", len(expected), len(validationErr), validationErr)
+	}
+	for i, field := range expected {
+		if validationErr[i].Field != field {
+			t.Fatalf("error %d: expected field %s, got %s", i, field, validationErr[i].Field)
+		}
+	}
+}
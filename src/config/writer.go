@@ -0,0 +1,112 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+
+	yamlv3 "gopkg.in/yaml.v3"
+)
+
+// FileValue is a value to write to a dotted yaml path such as "media_proxy.hmac_secret".
+type FileValue struct {
+	Path  string
+	Value string
+}
+
+// UpdateFileValues sets dotted yaml paths (e.g. "media_proxy.hmac_secret") in
+// the config file at path, keeping comments and formatting of the rest of the
+// file intact. Existing non-empty values are only replaced if overwrite is set.
+// It returns the paths that were actually written.
+func UpdateFileValues(path string, values []FileValue, overwrite bool) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var doc yamlv3.Node
+	if err := yamlv3.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	if doc.Kind == 0 {
+		doc = yamlv3.Node{Kind: yamlv3.DocumentNode, Content: []*yamlv3.Node{{Kind: yamlv3.MappingNode}}}
+	}
+	if doc.Kind != yamlv3.DocumentNode || len(doc.Content) == 0 || doc.Content[0].Kind != yamlv3.MappingNode {
+		return nil, fmt.Errorf("%s does not contain a YAML mapping", path)
+	}
+
+	var written []string
+	for _, value := range values {
+		fieldPath := value.Path
+		node, err := ensureMappingPath(doc.Content[0], strings.Split(fieldPath, "."))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", fieldPath, err)
+		}
+		if node.Kind != yamlv3.ScalarNode {
+			return nil, fmt.Errorf("%s is not a scalar value", fieldPath)
+		}
+		if node.Value != "" && node.Tag != "!!null" && !overwrite {
+			continue
+		}
+		node.Kind = yamlv3.ScalarNode
+		node.Tag = "!!str"
+		node.Value = value.Value
+		node.Style = yamlv3.DoubleQuotedStyle
+		written = append(written, fieldPath)
+	}
+	if len(written) == 0 {
+		return nil, nil
+	}
+
+	var buf bytes.Buffer
+	encoder := yamlv3.NewEncoder(&buf)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(&doc); err != nil {
+		return nil, err
+	}
+	if err := encoder.Close(); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(path, buf.Bytes(), info.Mode().Perm()); err != nil {
+		return nil, err
+	}
+	return written, nil
+}
+
+// ensureMappingPath walks (and creates where missing) nested mappings and
+// returns the value node for the last key.
+func ensureMappingPath(mapping *yamlv3.Node, keys []string) (*yamlv3.Node, error) {
+	for i, key := range keys {
+		if mapping.Kind != yamlv3.MappingNode {
+			return nil, fmt.Errorf("%s is not a mapping", strings.Join(keys[:i], "."))
+		}
+		var valueNode *yamlv3.Node
+		for j := 0; j+1 < len(mapping.Content); j += 2 {
+			if mapping.Content[j].Value == key {
+				valueNode = mapping.Content[j+1]
+				break
+			}
+		}
+		if valueNode == nil {
+			valueNode = &yamlv3.Node{Kind: yamlv3.ScalarNode, Tag: "!!str"}
+			if i < len(keys)-1 {
+				valueNode = &yamlv3.Node{Kind: yamlv3.MappingNode, Tag: "!!map"}
+			}
+			mapping.Content = append(mapping.Content, &yamlv3.Node{Kind: yamlv3.ScalarNode, Tag: "!!str", Value: key}, valueNode)
+		}
+		if i == len(keys)-1 {
+			return valueNode, nil
+		}
+		if valueNode.Kind == yamlv3.ScalarNode && valueNode.Value == "" {
+			valueNode.Kind = yamlv3.MappingNode
+			valueNode.Tag = "!!map"
+		}
+		mapping = valueNode
+	}
+	return mapping, nil
+}
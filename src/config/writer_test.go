@@ -0,0 +1,53 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestUpdateFileValuesKeepsExistingValues(t *testing.T) {
+	configYAML := `# Bridge configuration
+matrix:
+  homeserver_url: "https://matrix.example.com"
+  encryption:
+    enabled: true
+    pickle_key: ""
+
+media_proxy:
+  # Signing key
+  server_key: "ed25519 existing key"
+`
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(configYAML), 0600); err != nil {
+		t.Fatalf("failed to write temp config: %v", err)
+	}
+
+	written, err := UpdateFileValues(path, []FileValue{
+		{Path: "media_proxy.server_key", Value: "ed25519 new key"},
+		{Path: "media_proxy.hmac_secret", Value: "hmac"},
+		{Path: "matrix.encryption.pickle_key", Value: "pickle"},
+	}, false)
+	if err != nil {
+		t.Fatalf("UpdateFileValues failed: %v", err)
+	}
+	if strings.Join(written, ",") != "media_proxy.hmac_secret,matrix.encryption.pickle_key" {
+		t.Fatalf("unexpected written fields: %v", written)
+	}
+
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+	if cfg.MediaProxy.ServerKey != "ed25519 existing key" {
+		t.Fatalf("expected existing server_key to be kept, got %q", cfg.MediaProxy.ServerKey)
+	}
+	if cfg.MediaProxy.HMACSecret != "hmac" || cfg.Matrix.Encryption.PickleKey != "pickle" {
+		t.Fatalf("expected generated values to be written, got %q and %q", cfg.MediaProxy.HMACSecret, cfg.Matrix.Encryption.PickleKey)
+	}
+	data, _ := os.ReadFile(path)
+	if !strings.Contains(string(data), "# Signing key") {
+		t.Fatalf("expected comments to be preserved:\n%s", data)
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"maunium.net/go/mautrix/appservice"
+	"maunium.net/go/mautrix/federation"
+
+	"nextcloud-media-bridge/src/config"
+)
+
+const (
+	defaultAppserviceID    = "nextcloud-media-bridge"
+	defaultSenderLocalpart = "mediabridge"
+)
+
+func runGenerateRegistration(args []string) int {
+	flags, configPath := newCommandFlags("generate-registration")
+	output := flags.String("output", "", "where to write the registration (defaults to matrix.appservice.registration_path)")
+	force := flags.Bool("force", false, "overwrite an existing registration file")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	cfg, _, err := loadCommandConfig(*configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load configuration: %v\n", err)
+		return 1
+	}
+	if cfg.Matrix.HomeserverDomain == "" {
+		fmt.Fprintln(os.Stderr, "matrix.homeserver_domain is required to generate a registration")
+		return 1
+	}
+
+	path := *output
+	if path == "" {
+		path = cfg.Matrix.Appservice.RegistrationPath
+	}
+	if path == "" {
+		path = "registration.yaml"
+	}
+	if _, err := os.Stat(path); err == nil && !*force {
+		fmt.Fprintf(os.Stderr, "%s already exists, use -force to replace it (the homeserver must then be updated with the new tokens)\n", path)
+		return 1
+	}
+
+	registration := newRegistration(cfg)
+	if err := registration.Save(path); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to write registration: %v\n", err)
+		return 1
+	}
+
+	fmt.Printf("Wrote appservice registration to %s\n", path)
+	fmt.Printf("  id:               %s\n", registration.ID)
+	fmt.Printf("  url:              %s\n", registration.URL)
+	fmt.Printf("  sender_localpart: %s\n", registration.SenderLocalpart)
+	fmt.Printf("  users namespace:  %s\n", registration.Namespaces.UserIDs[0].Regex)
+	if cfg.Matrix.Appservice.Address == "" {
+		fmt.Println("Note: matrix.appservice.address is not set; check that the homeserver can reach the url above.")
+	}
+	fmt.Println("Add the file to app_service_config_files in your homeserver configuration and restart it.")
+	return 0
+}
+
+// newRegistration builds an appservice registration with fresh random tokens.
+func newRegistration(cfg *config.Config) *appservice.Registration {
+	registration := appservice.CreateRegistration()
+	registration.ID = cfg.Matrix.Appservice.ID
+	if registration.ID == "" {
+		registration.ID = defaultAppserviceID
+	}
+	registration.SenderLocalpart = cfg.Matrix.Appservice.SenderLocalpart
+	if registration.SenderLocalpart == "" {
+		registration.SenderLocalpart = defaultSenderLocalpart
+	}
+	registration.URL = appserviceAddress(cfg)
+	rateLimited := false
+	registration.RateLimited = &rateLimited
+	// The bridge edits messages as their original senders, so it needs a
+	// non-exclusive claim on all local users.
+	registration.Namespaces.UserIDs.Register(regexp.MustCompile("^@.*:"+regexp.QuoteMeta(cfg.Matrix.HomeserverDomain)+"$"), false)
+	return registration
+}
+
+func appserviceAddress(cfg *config.Config) string {
+	if cfg.Matrix.Appservice.Address != "" {
+		return cfg.Matrix.Appservice.Address
+	}
+	host := cfg.Matrix.Appservice.Hostname
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		host = "localhost"
+	}
+	port := cfg.Matrix.Appservice.Port
+	if port == 0 {
+		port = 29334
+	}
+	return fmt.Sprintf("http://%s:%d", host, port)
+}
+
+func runGenerateKeys(args []string) int {
+	flags, configPath := newCommandFlags("generate-keys")
+	write := flags.Bool("write", false, "write the generated keys into the config file")
+	force := flags.Bool("force", false, "with -write, replace keys that are already set")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	values := []config.FileValue{
+		{Path: "media_proxy.server_key", Value: federation.GenerateSigningKey().SynapseString()},
+		{Path: "media_proxy.hmac_secret", Value: randomHex(32)},
+		{Path: "matrix.encryption.pickle_key", Value: randomHex(32)},
+	}
+
+	if !*write {
+		for _, value := range values {
+			fmt.Printf("%-29s %s\n", value.Path+":", value.Value)
+		}
+		return 0
+	}
+
+	path := *configPath
+	if path == "" {
+		path = defaultConfigPath()
+	}
+	if path == "" {
+		fmt.Fprintln(os.Stderr, "No config file found, pass -config to choose one")
+		return 1
+	}
+	written, err := config.UpdateFileValues(path, values, *force)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to update %s: %v\n", path, err)
+		return 1
+	}
+	if len(written) == 0 {
+		fmt.Printf("All keys in %s are already set, nothing written (use -force to replace them)\n", path)
+		return 0
+	}
+	fmt.Printf("Wrote %s to %s\n", strings.Join(written, ", "), path)
+	for _, fieldPath := range written {
+		if fieldPath == "matrix.encryption.pickle_key" && *force {
+			fmt.Println("Warning: replacing the pickle key makes an existing crypto database unreadable.")
+		}
+	}
+	return 0
+}
+
+func randomHex(length int) string {
+	buf := make([]byte, length)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(buf)
+}
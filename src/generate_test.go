@@ -0,0 +1,28 @@
+package main
+
+import (
+	"regexp"
+	"testing"
+
+	"nextcloud-media-bridge/src/config"
+)
+
+func TestNewRegistrationUserNamespace(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Matrix.HomeserverDomain = "example.com"
+	registration := newRegistration(cfg)
+	if len(registration.Namespaces.UserIDs) != 1 || registration.Namespaces.UserIDs[0].Exclusive {
+		t.Fatalf("expected one non-exclusive user namespace, got %+v", registration.Namespaces.UserIDs)
+	}
+	namespace := regexp.MustCompile(registration.Namespaces.UserIDs[0].Regex)
+	for userID, expected := range map[string]bool{
+		"@alice:example.com":          true,
+		"@x:example.com.evil.org":     false,
+		"@alice:exampleXcom":          false,
+		"@x:evil.org:example.com.org": false,
+	} {
+		if namespace.MatchString(userID) != expected {
+			t.Errorf("namespace %s matching %s: expected %v", namespace, userID, expected)
+		}
+	}
+}
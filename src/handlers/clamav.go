@@ -0,0 +1,154 @@
+package handlers
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"nextcloud-media-bridge/src/config"
+)
+
+// clamdChunkSize is the size of each INSTREAM chunk. clamd's default
+// StreamMaxLength is 25 MB, larger files are rejected by clamd itself.
+const clamdChunkSize = 64 * 1024
+
+// ErrScanFailed is returned when clamd could not scan a file, as opposed to
+// the file being infected.
+var ErrScanFailed = errors.New("virus scan failed")
+
+// ScanResult is the verdict for a scanned file.
+type ScanResult struct {
+	Infected  bool
+	Signature string // Name of the detected signature, e.g. "Eicar-Test-Signature"
+}
+
+// ClamAVClient scans files with clamd using the INSTREAM command.
+type ClamAVClient struct {
+	network string
+	address string
+	timeout time.Duration
+}
+
+func NewClamAVClient(address string, timeout time.Duration) (*ClamAVClient, error) {
+	network, dialAddress, err := config.ParseClamdAddress(address)
+	if err != nil {
+		return nil, err
+	}
+	if timeout <= 0 {
+		timeout = 60 * time.Second
+	}
+	return &ClamAVClient{network: network, address: dialAddress, timeout: timeout}, nil
+}
+
+func (c *ClamAVClient) dial(ctx context.Context) (net.Conn, error) {
+	dialer := net.Dialer{Timeout: c.timeout}
+	conn, err := dialer.DialContext(ctx, c.network, c.address)
+	if err != nil {
+		return nil, fmt.Errorf("%w: failed to connect to clamd: %v", ErrScanFailed, err)
+	}
+	deadline := time.Now().Add(c.timeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	_ = conn.SetDeadline(deadline)
+	return conn, nil
+}
+
+// Ping checks that clamd is reachable.
+func (c *ClamAVClient) Ping(ctx context.Context) error {
+	conn, err := c.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("zPING\x00")); err != nil {
+		return fmt.Errorf("%w: %v", ErrScanFailed, err)
+	}
+	reply, err := readClamdReply(conn)
+	if err != nil {
+		return err
+	}
+	if reply != "PONG" {
+		return fmt.Errorf("%w: unexpected reply to PING: %q", ErrScanFailed, reply)
+	}
+	return nil
+}
+
+// Scan streams the reader to clamd and returns its verdict.
+func (c *ClamAVClient) Scan(ctx context.Context, reader io.Reader) (ScanResult, error) {
+	conn, err := c.dial(ctx)
+	if err != nil {
+		return ScanResult{}, err
+	}
+	defer conn.Close()
+
+	writer := bufio.NewWriter(conn)
+	if _, err := writer.WriteString("zINSTREAM\x00"); err != nil {
+		return ScanResult{}, fmt.Errorf("%w: %v", ErrScanFailed, err)
+	}
+	buf := make([]byte, clamdChunkSize)
+	var length [4]byte
+	for {
+		n, readErr := reader.Read(buf)
+		if n > 0 {
+			binary.BigEndian.PutUint32(length[:], uint32(n))
+			if _, err := writer.Write(length[:]); err != nil {
+				return ScanResult{}, fmt.Errorf("%w: %v", ErrScanFailed, err)
+			}
+			if _, err := writer.Write(buf[:n]); err != nil {
+				return ScanResult{}, fmt.Errorf("%w: %v", ErrScanFailed, err)
+			}
+		}
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			return ScanResult{}, fmt.Errorf("failed to read file for scanning: %w", readErr)
+		}
+	}
+	// A zero-length chunk ends the stream
+	binary.BigEndian.PutUint32(length[:], 0)
+	if _, err := writer.Write(length[:]); err != nil {
+		return ScanResult{}, fmt.Errorf("%w: %v", ErrScanFailed, err)
+	}
+	if err := writer.Flush(); err != nil {
+		return ScanResult{}, fmt.Errorf("%w: %v", ErrScanFailed, err)
+	}
+
+	reply, err := readClamdReply(conn)
+	if err != nil {
+		return ScanResult{}, err
+	}
+	return parseClamdScanReply(reply)
+}
+
+func readClamdReply(conn net.Conn) (string, error) {
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && !(err == io.EOF && reply != "") {
+		return "", fmt.Errorf("%w: failed to read clamd reply: %v", ErrScanFailed, err)
+	}
+	return strings.TrimRight(reply, "\x00\n"), nil
+}
+
+// parseClamdScanReply parses replies such as "stream: OK" and
+// "stream: Eicar-Test-Signature FOUND".
+func parseClamdScanReply(reply string) (ScanResult, error) {
+	_, verdict, ok := strings.Cut(reply, ": ")
+	if !ok {
+		return ScanResult{}, fmt.Errorf("%w: unexpected clamd reply %q", ErrScanFailed, reply)
+	}
+	switch {
+	case verdict == "OK":
+		return ScanResult{}, nil
+	case strings.HasSuffix(verdict, " FOUND"):
+		return ScanResult{Infected: true, Signature: strings.TrimSuffix(verdict, " FOUND")}, nil
+	default:
+		return ScanResult{}, fmt.Errorf("%w: clamd reported %q", ErrScanFailed, verdict)
+	}
+}
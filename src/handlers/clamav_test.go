@@ -0,0 +1,130 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"maunium.net/go/mautrix/event"
+
+	"nextcloud-media-bridge/src/config"
+)
+
+const eicarSignature = `X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`
+
+// startFakeClamd serves the clamd PING and INSTREAM commands and reports any
+// stream containing the EICAR test string as infected.
+func startFakeClamd(t *testing.T, network, address string) net.Listener {
+	t.Helper()
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveFakeClamd(conn)
+		}
+	}()
+	t.Cleanup(func() { listener.Close() })
+	return listener
+}
+
+func serveFakeClamd(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	command, err := reader.ReadString(0)
+	if err != nil {
+		return
+	}
+	switch command {
+	case "zPING\x00":
+		_, _ = conn.Write([]byte("PONG\x00"))
+	case "zINSTREAM\x00":
+		var data bytes.Buffer
+		var length [4]byte
+		for {
+			if _, err := io.ReadFull(reader, length[:]); err != nil {
+				return
+			}
+			size := binary.BigEndian.Uint32(length[:])
+			if size == 0 {
+				break
+			}
+			if _, err := io.CopyN(&data, reader, int64(size)); err != nil {
+				return
+			}
+		}
+		if strings.Contains(data.String(), eicarSignature) {
+			_, _ = conn.Write([]byte("stream: Eicar-Test-Signature FOUND\x00"))
+			return
+		}
+		_, _ = conn.Write([]byte("stream: OK\x00"))
+	default:
+		_, _ = conn.Write([]byte("UNKNOWN COMMAND\x00"))
+	}
+}
+
+func TestClamAVScan(t *testing.T) {
+	tcp := startFakeClamd(t, "tcp", "127.0.0.1:0")
+	unixSocket := filepath.Join(t.TempDir(), "clamd.sock")
+	startFakeClamd(t, "unix", unixSocket)
+
+	for _, address := range []string{tcp.Addr().String(), "tcp://" + tcp.Addr().String(), "unix://" + unixSocket} {
+		client, err := NewClamAVClient(address, 5*time.Second)
+		if err != nil {
+			t.Fatalf("%s: %v", address, err)
+		}
+		if err := client.Ping(context.Background()); err != nil {
+			t.Fatalf("%s: ping failed: %v", address, err)
+		}
+		clean, err := client.Scan(context.Background(), bytes.NewReader(bytes.Repeat([]byte("a"), 3*clamdChunkSize+7)))
+		if err != nil || clean.Infected {
+			t.Fatalf("%s: expected clean result, got %+v, %v", address, clean, err)
+		}
+		infected, err := client.Scan(context.Background(), strings.NewReader(eicarSignature))
+		if err != nil || !infected.Infected || infected.Signature != "Eicar-Test-Signature" {
+			t.Fatalf("%s: expected infected result, got %+v, %v", address, infected, err)
+		}
+	}
+}
+
+func TestClamAVScanUnreachable(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	address := listener.Addr().String()
+	listener.Close()
+
+	client, err := NewClamAVClient(address, time.Second)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := client.Scan(context.Background(), strings.NewReader("data")); !errors.Is(err, ErrScanFailed) {
+		t.Fatalf("expected ErrScanFailed, got %v", err)
+	}
+
+	cfg := &config.Config{}
+	handler := &MediaHandler{config: cfg, scanner: client}
+	evt := &event.Event{ID: "$event", RoomID: "!room:example.com", Sender: "@user:example.com"}
+	cfg.Antivirus.FailPolicy = "open"
+	if !handler.scanMedia(context.Background(), evt, []byte("data")) {
+		t.Fatalf("expected fail_policy=open to archive unscanned media")
+	}
+	cfg.Antivirus.FailPolicy = "closed"
+	if handler.scanMedia(context.Background(), evt, []byte("data")) {
+		t.Fatalf("expected fail_policy=closed to skip unscanned media")
+	}
+}
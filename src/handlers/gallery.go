@@ -0,0 +1,345 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"nextcloud-media-bridge/src/utils"
+)
+
+// galleryWidgetID is the state key of the gallery widget in a room.
+const galleryWidgetID = "nextcloud_media_bridge_gallery"
+
+var widgetStateEvent = event.Type{Type: "im.vector.modular.widgets", Class: event.StateEventType}
+
+// Signed link kinds.
+const (
+	linkGallery = "gallery"
+	linkMedia   = "media"
+)
+
+// galleryFile is an archived file listed in the gallery.
+type galleryFile struct {
+	Name         string    `json:"name"`
+	EventID      string    `json:"event_id"`
+	MimeType     string    `json:"mime_type,omitempty"`
+	Timestamp    time.Time `json:"timestamp"`
+	URL          string    `json:"url"`
+	ThumbnailURL string    `json:"thumbnail_url,omitempty"`
+}
+
+// galleryPage is the JSON response and the data of the HTML page.
+type galleryPage struct {
+	RoomID   string        `json:"room_id"`
+	RoomName string        `json:"room_name"`
+	Expires  time.Time     `json:"expires"`
+	Files    []galleryFile `json:"files"`
+}
+
+var galleryTemplate = template.Must(template.New("gallery").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Files in {{.RoomName}}</title>
+<style>
+body { font-family: sans-serif; margin: 1em; color: #222; }
+ul { list-style: none; padding: 0; display: grid; grid-template-columns: repeat(auto-fill, minmax(180px, 1fr)); gap: 1em; }
+li { border: 1px solid #ddd; border-radius: 6px; padding: 0.5em; overflow-wrap: anywhere; }
+.preview { display: flex; align-items: center; justify-content: center; height: 140px; background: #f4f4f4; margin-bottom: 0.5em; }
+.preview img { max-width: 100%; max-height: 140px; }
+small { color: #666; }
+</style>
+</head>
+<body>
+<h1>Files in {{.RoomName}}</h1>
+{{if .Files}}<ul>
+{{range .Files}}<li>
+<a class="preview" href="{{.URL}}">{{if .ThumbnailURL}}<img src="{{.ThumbnailURL}}" alt="" loading="lazy">{{else}}{{.MimeType}}{{end}}</a>
+<a href="{{.URL}}&amp;download=1">{{.Name}}</a><br>
+<small>{{.Timestamp.Format "2006-01-02 15:04 MST"}}</small>
+</li>
+{{end}}</ul>
+{{else}}<p>No files have been archived from this room yet.</p>
+{{end}}<p><small>This page and its links expire on {{.Expires.Format "2006-01-02 15:04 MST"}}.</small></p>
+</body>
+</html>
+`))
+
+// Gallery serves a page per room listing the files archived from it, and the
+// files themselves, through signed links that expire.
+type Gallery struct {
+	handler    *MediaHandler
+	thumbnails *ThumbnailCache
+}
+
+func NewGallery(handler *MediaHandler) *Gallery {
+	return &Gallery{handler: handler, thumbnails: NewThumbnailCache(thumbnailCacheSize)}
+}
+
+func (g *Gallery) RegisterRoutes(router *http.ServeMux) {
+	router.HandleFunc("GET /gallery/room/{room}", g.serveRoom)
+	router.HandleFunc("GET /gallery/room/{room}/files.json", g.serveRoom)
+	router.HandleFunc("GET /gallery/media/{media}", g.serveMedia)
+}
+
+// serveRoom lists the archived files of a room as HTML, or as JSON for
+// files.json.
+func (g *Gallery) serveRoom(w http.ResponseWriter, r *http.Request) {
+	h := g.handler
+	roomID := id.RoomID(r.PathValue("room"))
+	expires, ok := h.verifyLink(linkGallery, roomID.String(), r.URL.Query())
+	if !ok {
+		http.Error(w, "This link is invalid or has expired.", http.StatusForbidden)
+		return
+	}
+	page, err := h.galleryPage(r.Context(), roomID, expires)
+	if err != nil {
+		log.Printf("Gallery of room %s failed: %v", roomID, err)
+		http.Error(w, "Failed to list the files of this room.", http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("Cache-Control", "private, no-store")
+	if strings.HasSuffix(r.URL.Path, "/files.json") {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(page)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := galleryTemplate.Execute(w, page); err != nil {
+		log.Printf("Failed to render gallery of room %s: %v", roomID, err)
+	}
+}
+
+// serveMedia streams an archived file or its thumbnail.
+func (g *Gallery) serveMedia(w http.ResponseWriter, r *http.Request) {
+	h := g.handler
+	mediaID := r.PathValue("media")
+	if _, ok := h.verifyLink(linkMedia, mediaID, r.URL.Query()); !ok {
+		http.Error(w, "This link is invalid or has expired.", http.StatusForbidden)
+		return
+	}
+	ref, err := utils.DecodeMediaID(h.mediaIDSecret, mediaID)
+	if err != nil {
+		http.Error(w, "Invalid media ID.", http.StatusBadRequest)
+		return
+	}
+	media, err := openMedia(r.Context(), h.config, h.storages, h.moves, h.revoked, g.thumbnails, ref)
+	if err != nil {
+		var respErr mautrix.RespError
+		if errors.Is(err, ErrNotFound) || (errors.As(err, &respErr) && respErr.ErrCode == mautrix.MNotFound.ErrCode) {
+			http.Error(w, "This file is no longer available.", http.StatusNotFound)
+			return
+		}
+		log.Printf("Gallery download of %s failed: %v", ref.Path, err)
+		http.Error(w, "Failed to download the file.", http.StatusBadGateway)
+		return
+	}
+	defer media.Reader.Close()
+
+	// Uploaded HTML, SVG or PDF files could run script on this origin, so
+	// only media browsers display without scripting is shown inline
+	disposition := "attachment"
+	if r.URL.Query().Get("download") == "" && isInlineMediaType(media.ContentType) {
+		disposition = "inline"
+	}
+	w.Header().Set("Content-Type", media.ContentType)
+	if media.ContentLength > 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(media.ContentLength, 10))
+	}
+	if !ref.Thumbnail {
+		w.Header().Set("Content-Disposition", fmt.Sprintf("%s; filename*=UTF-8''%s", disposition, url.PathEscape(ref.FileName)))
+	}
+	w.Header().Set("Cache-Control", "private, max-age=3600")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Security-Policy", "sandbox")
+	if _, err := io.Copy(w, media.Reader); err != nil {
+		log.Printf("Gallery download of %s interrupted: %v", ref.Path, err)
+	}
+}
+
+// inlineMediaTypes are the content types gallery links show in the browser.
+var inlineMediaTypes = map[string]bool{
+	"image/avif": true, "image/bmp": true, "image/gif": true, "image/jpeg": true, "image/png": true, "image/webp": true,
+	"video/mp4": true, "video/ogg": true, "video/quicktime": true, "video/webm": true,
+	"audio/aac": true, "audio/flac": true, "audio/mp4": true, "audio/mpeg": true, "audio/ogg": true, "audio/wav": true, "audio/webm": true,
+}
+
+func isInlineMediaType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && inlineMediaTypes[mediaType]
+}
+
+// galleryPage lists the archived files of a room, newest first, with links
+// that expire together with the page. Revoked files are left out.
+func (h *MediaHandler) galleryPage(ctx context.Context, roomID id.RoomID, expires time.Time) (galleryPage, error) {
+	mappings, err := h.roomMappings(ctx, roomID)
+	if err != nil {
+		return galleryPage{}, err
+	}
+	page := galleryPage{
+		RoomID:   roomID.String(),
+		RoomName: roomDisplayName(h.rooms.RoomName(ctx, roomID), h.rooms.CanonicalAlias(ctx, roomID), roomID.String()),
+		Expires:  expires.UTC(),
+		Files:    []galleryFile{},
+	}
+	sort.SliceStable(mappings, func(i, j int) bool { return mappings[i].Timestamp.After(mappings[j].Timestamp) })
+	for _, mapping := range mappings {
+		ref := mapping.ref(h.mediaIDSecret)
+		if h.revoked.IsRefRevoked(ref, h.moves) {
+			continue
+		}
+		mediaID, err := utils.EncodeMediaID(h.mediaIDSecret, ref)
+		if err != nil {
+			return galleryPage{}, err
+		}
+		file := galleryFile{
+			Name:      ref.FileName,
+			EventID:   mapping.EventID.String(),
+			MimeType:  ref.MimeType,
+			Timestamp: mapping.Timestamp.UTC(),
+			URL:       h.mediaLink(mediaID, expires),
+		}
+		if strings.HasPrefix(ref.MimeType, "image/") {
+			file.ThumbnailURL = file.URL
+			if h.config.MediaProxy.Thumbnails.Enabled {
+				ref.Thumbnail = true
+				if thumbnailID, err := utils.EncodeMediaID(h.mediaIDSecret, ref); err == nil {
+					file.ThumbnailURL = h.mediaLink(thumbnailID, expires)
+				}
+			}
+		}
+		page.Files = append(page.Files, file)
+	}
+	return page, nil
+}
+
+// ref returns the media reference of a mapping, taken from its proxy URL if
+// it has one.
+func (m storedMapping) ref(secret []byte) utils.MediaRef {
+	if uri, err := id.ContentURIString(m.State.MXC).Parse(); err == nil {
+		if ref, err := utils.DecodeMediaID(secret, uri.FileID); err == nil {
+			ref.Thumbnail = false
+			return ref
+		}
+	}
+	name := m.State.FileName
+	if name == "" {
+		name = m.State.Path[strings.LastIndex(m.State.Path, "/")+1:]
+	}
+	return utils.MediaRef{Path: strings.TrimLeft(m.State.Path, "/"), FileName: name, Storage: m.State.Storage}
+}
+
+// GalleryURL returns a signed link to the gallery of a room.
+func (h *MediaHandler) GalleryURL(roomID id.RoomID, expires time.Time) string {
+	return strings.TrimRight(h.config.Gallery.PublicURL, "/") + "/gallery/room/" + url.PathEscape(roomID.String()) +
+		"?" + h.signLink(linkGallery, roomID.String(), expires)
+}
+
+// mediaLink returns a signed link to a file in the gallery.
+func (h *MediaHandler) mediaLink(mediaID string, expires time.Time) string {
+	return strings.TrimRight(h.config.Gallery.PublicURL, "/") + "/gallery/media/" + url.PathEscape(mediaID) +
+		"?" + h.signLink(linkMedia, mediaID, expires)
+}
+
+// signLink returns the query string authorizing access to subject until
+// expires.
+func (h *MediaHandler) signLink(kind, subject string, expires time.Time) string {
+	unix := strconv.FormatInt(expires.Unix(), 10)
+	signature := utils.SignBytes(h.mediaIDSecret, []byte(kind+"\n"+subject+"\n"+unix))
+	return url.Values{"expires": {unix}, "sig": {signature}}.Encode()
+}
+
+// verifyLink checks the signature and expiry of a signed link and returns
+// when it expires.
+func (h *MediaHandler) verifyLink(kind, subject string, query url.Values) (time.Time, bool) {
+	unix, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	expires := time.Unix(unix, 0)
+	if time.Now().After(expires) {
+		return expires, false
+	}
+	payload := []byte(kind + "\n" + subject + "\n" + strconv.FormatInt(unix, 10))
+	return expires, utils.VerifyBytes(h.mediaIDSecret, payload, query.Get("sig"))
+}
+
+// isGalleryCommand reports whether a message asks for the gallery link.
+func (h *MediaHandler) isGalleryCommand(msg *event.MessageEventContent) bool {
+	command := h.config.Gallery.Command
+	return h.config.Gallery.Enabled && command != "" && msg.MsgType == event.MsgText && strings.TrimSpace(msg.Body) == command
+}
+
+// sendGalleryLink replies to a gallery command with a signed gallery link.
+func (h *MediaHandler) sendGalleryLink(ctx context.Context, evt *event.Event) {
+	expires := time.Now().Add(h.config.Gallery.LinkTTL)
+	link := h.GalleryURL(evt.RoomID, expires)
+	content := &event.MessageEventContent{
+		MsgType: event.MsgNotice,
+		Body:    fmt.Sprintf("Files archived from this room: %s (valid until %s)", link, expires.UTC().Format("2006-01-02 15:04 MST")),
+	}
+	content.SetReply(evt)
+	if _, err := h.as.BotIntent().SendMessageEvent(ctx, evt.RoomID, event.EventMessage, content); err != nil {
+		log.Printf("Failed to send gallery link to room %s: %v", evt.RoomID, err)
+	}
+}
+
+// StartGalleryWidgets adds the gallery widget to every bridged room and
+// renews its signed link every half link lifetime until ctx is done.
+func (h *MediaHandler) StartGalleryWidgets(ctx context.Context) {
+	ticker := time.NewTicker(h.config.Gallery.LinkTTL / 2)
+	defer ticker.Stop()
+
+	for {
+		h.updateGalleryWidgets(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// updateGalleryWidgets sets the gallery widget with a fresh link in every
+// bridged room the bot has joined.
+func (h *MediaHandler) updateGalleryWidgets(ctx context.Context) {
+	joined, err := h.as.BotIntent().JoinedRooms(ctx)
+	if err != nil {
+		log.Printf("Warning: failed to fetch joined rooms for gallery widgets: %v", err)
+		return
+	}
+	expires := time.Now().Add(h.config.Gallery.LinkTTL)
+	for _, roomID := range joined.JoinedRooms {
+		if _, ok := h.rooms.Resolve(ctx, roomID); !ok {
+			continue
+		}
+		content := map[string]any{
+			"type":          "m.custom",
+			"url":           h.GalleryURL(roomID, expires),
+			"name":          "Nextcloud files",
+			"id":            galleryWidgetID,
+			"creatorUserId": h.as.BotMXID().String(),
+			"data":          map[string]any{"title": "Files archived from this room"},
+		}
+		if _, err := h.as.BotClient().SendStateEvent(ctx, roomID, widgetStateEvent, galleryWidgetID, content); err != nil {
+			log.Printf("Warning: failed to set gallery widget in room %s: %v", roomID, err)
+		}
+	}
+}
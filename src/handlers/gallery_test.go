@@ -0,0 +1,124 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"maunium.net/go/mautrix/id"
+
+	"nextcloud-media-bridge/src/config"
+	"nextcloud-media-bridge/src/utils"
+)
+
+func TestGallery(t *testing.T) {
+	const roomID = "!roomid:example.com"
+	var handler *MediaHandler
+
+	nt := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet || r.URL.Path != "/media/alice/report.pdf" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/pdf")
+		_, _ = w.Write([]byte("%PDF"))
+	}))
+	defer nt.Close()
+
+	mt := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, "/state") {
+			_, _ = w.Write([]byte(`{}`))
+			return
+		}
+		var events []map[string]any
+		for i, file := range []struct{ eventID, path, name, mimeType string }{
+			{"$old", "/media/alice/report.pdf", "report.pdf", "application/pdf"},
+			{"$new", "/media/alice/photo.jpg", "photo.jpg", "image/jpeg"},
+			{"$revoked", "/media/alice/secret.jpg", "secret.jpg", "image/jpeg"},
+		} {
+			mediaID, _ := utils.EncodeMediaID(testSecret, utils.MediaRef{Path: strings.TrimLeft(file.path, "/"), FileName: file.name, MimeType: file.mimeType})
+			state := mediaState{Path: file.path, FileName: file.name, MXC: "mxc://media.example.com/" + mediaID}
+			state.Signature, _ = handler.signMediaState(state)
+			events = append(events, map[string]any{"type": nextcloudMediaStateEvent.Type, "state_key": file.eventID, "content": state, "event_id": "$s" + file.eventID, "sender": "@bridge:example.com", "origin_server_ts": 1000 * (i + 1)})
+		}
+		_ = json.NewEncoder(w).Encode(events)
+	}))
+	defer mt.Close()
+
+	cfg := &config.Config{}
+	cfg.MediaProxy.Thumbnails.Enabled = true
+	cfg.Gallery.Enabled = true
+	cfg.Gallery.PublicURL = "https://media.example.com/"
+	handler = newTestHandler(t, cfg, mt.URL, NewStorages(NewNextcloudClient(nt.URL, "user", "pass")))
+	handler.revoked.paths[""] = map[string]bool{"media/alice/secret.jpg": true}
+	mux := http.NewServeMux()
+	NewGallery(handler).RegisterRoutes(mux)
+
+	get := func(link string) *httptest.ResponseRecorder {
+		parsed, err := url.Parse(link)
+		if err != nil {
+			t.Fatalf("invalid link %q: %v", link, err)
+		}
+		recorder := httptest.NewRecorder()
+		mux.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, parsed.RequestURI(), nil))
+		return recorder
+	}
+
+	expires := time.Now().Add(time.Hour)
+	link := handler.GalleryURL(id.RoomID(roomID), expires)
+	if !strings.HasPrefix(link, "https://media.example.com/gallery/room/%21roomid:example.com?") {
+		t.Fatalf("unexpected gallery link %s", link)
+	}
+	if resp := get(handler.GalleryURL(id.RoomID(roomID), time.Now().Add(-time.Minute))); resp.Code != http.StatusForbidden {
+		t.Fatalf("expected expired link to be rejected, got %d", resp.Code)
+	}
+	if resp := get(strings.Replace(link, "roomid", "other", 1)); resp.Code != http.StatusForbidden {
+		t.Fatalf("expected link for another room to be rejected, got %d", resp.Code)
+	}
+
+	jsonLink := strings.Replace(link, "?", "/files.json?", 1)
+	resp := get(jsonLink)
+	if resp.Code != http.StatusOK {
+		t.Fatalf("expected gallery JSON, got %d: %s", resp.Code, resp.Body.String())
+	}
+	var page galleryPage
+	if err := json.Unmarshal(resp.Body.Bytes(), &page); err != nil {
+		t.Fatalf("invalid gallery JSON: %v", err)
+	}
+	if len(page.Files) != 2 || page.Files[0].Name != "photo.jpg" || page.Files[1].Name != "report.pdf" {
+		t.Fatalf("expected photo.jpg and report.pdf newest first, got %+v", page.Files)
+	}
+	if page.Files[0].ThumbnailURL == "" || page.Files[0].ThumbnailURL == page.Files[0].URL || page.Files[1].ThumbnailURL != "" {
+		t.Fatalf("expected a thumbnail for the image only, got %+v", page.Files)
+	}
+
+	download := get(page.Files[1].URL + "&download=1")
+	if download.Code != http.StatusOK || download.Body.String() != "%PDF" {
+		t.Fatalf("expected file download, got %d: %s", download.Code, download.Body.String())
+	}
+	if disposition := download.Header().Get("Content-Disposition"); disposition != "attachment; filename*=UTF-8''report.pdf" {
+		t.Fatalf("unexpected Content-Disposition %q", disposition)
+	}
+	// Only media types without scripting are shown inline
+	preview := get(page.Files[1].URL)
+	if disposition := preview.Header().Get("Content-Disposition"); !strings.HasPrefix(disposition, "attachment;") || preview.Header().Get("Content-Security-Policy") != "sandbox" {
+		t.Fatalf("expected PDF preview as sandboxed attachment, got %q", disposition)
+	}
+	for contentType, inline := range map[string]bool{"image/jpeg": true, "video/mp4; codecs=avc1": true, "image/svg+xml": false, "text/html": false, "application/pdf": false} {
+		if isInlineMediaType(contentType) != inline {
+			t.Fatalf("expected inline=%v for %s", inline, contentType)
+		}
+	}
+	if resp := get(strings.Replace(page.Files[1].URL, "sig=", "sig=x", 1)); resp.Code != http.StatusForbidden {
+		t.Fatalf("expected tampered file link to be rejected, got %d", resp.Code)
+	}
+
+	html := get(link)
+	if html.Code != http.StatusOK || !strings.Contains(html.Body.String(), "report.pdf") || strings.Contains(html.Body.String(), "secret.jpg") {
+		t.Fatalf("unexpected gallery page %d: %s", html.Code, html.Body.String())
+	}
+}
@@ -0,0 +1,45 @@
+package handlers
+
+import (
+	"testing"
+
+	"maunium.net/go/mautrix/appservice"
+
+	"nextcloud-media-bridge/src/config"
+)
+
+// testSecret signs the media IDs and mappings of handlers made by
+// newTestHandler.
+var testSecret = []byte("secret")
+
+// newTestAppService returns an appservice for the bot @bridge:example.com
+// that talks to the fake homeserver at homeserverURL.
+func newTestAppService(t *testing.T, homeserverURL string) *appservice.AppService {
+	t.Helper()
+	as, err := appservice.CreateFull(appservice.CreateOpts{
+		Registration: &appservice.Registration{
+			ID:              "nextcloud-media-bridge",
+			URL:             "http://localhost",
+			AppToken:        "app_token",
+			ServerToken:     "server_token",
+			SenderLocalpart: "bridge",
+		},
+		HomeserverDomain: "example.com",
+		HomeserverURL:    homeserverURL,
+		HostConfig:       appservice.HostConfig{Hostname: "127.0.0.1", Port: 0},
+	})
+	if err != nil {
+		t.Fatalf("failed to create appservice: %v", err)
+	}
+	return as
+}
+
+// newTestHandler returns a media handler archiving to storages, without
+// encryption or virus scanning, whose bot talks to the fake homeserver at
+// homeserverURL. Its appservice, folder moves and revoked files are
+// available as handler.as, handler.moves and handler.revoked.
+func newTestHandler(t *testing.T, cfg *config.Config, homeserverURL string, storages *Storages) *MediaHandler {
+	t.Helper()
+	as := newTestAppService(t, homeserverURL)
+	return NewMediaHandler(cfg, storages, testSecret, as, nil, NewRoomResolver(cfg, as), NewPathMoves(as), NewRevokedMedia(as), nil)
+}
@@ -0,0 +1,136 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"path"
+	"strings"
+	"sync"
+
+	"maunium.net/go/mautrix/id"
+)
+
+// mappingKey identifies the mapping of an event.
+type mappingKey struct {
+	roomID  id.RoomID
+	eventID id.EventID
+}
+
+// mappingIndex finds the mappings pointing at a file without reading the
+// state of every room. It is filled from the joined rooms on first use and
+// kept current by storeMediaState and clearMediaState, which write every
+// mapping. Files are indexed by storage and file name, since folder moves
+// keep the name. Rooms whose state could not be read are read again on the
+// next lookup.
+type mappingIndex struct {
+	mu       sync.Mutex
+	loaded   bool
+	unread   map[id.RoomID]bool
+	mappings map[mappingKey]storedMapping
+	names    map[string]map[mappingKey]bool // storage name and file name -> mappings
+}
+
+func newMappingIndex() *mappingIndex {
+	return &mappingIndex{unread: map[id.RoomID]bool{}, mappings: map[mappingKey]storedMapping{}, names: map[string]map[mappingKey]bool{}}
+}
+
+func indexName(storage, filePath string) string {
+	return storage + "\x00" + path.Base(strings.Trim(filePath, "/"))
+}
+
+// mappingFiles returns the archived file and the originals of a mapping.
+func mappingFiles(state mediaState) []string {
+	return append([]string{state.Path}, state.Originals...)
+}
+
+// put replaces the indexed mapping of an event. It is a no-op until the
+// index is loaded, which reads the stored mapping instead.
+func (x *mappingIndex) put(mapping storedMapping) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if x.loaded {
+		x.add(mapping)
+	}
+}
+
+// remove drops the indexed mapping of an event.
+func (x *mappingIndex) remove(roomID id.RoomID, eventID id.EventID) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.drop(mappingKey{roomID, eventID})
+}
+
+func (x *mappingIndex) add(mapping storedMapping) {
+	key := mappingKey{mapping.RoomID, mapping.EventID}
+	x.drop(key)
+	x.mappings[key] = mapping
+	for _, filePath := range mappingFiles(mapping.State) {
+		name := indexName(mapping.State.Storage, filePath)
+		if x.names[name] == nil {
+			x.names[name] = map[mappingKey]bool{}
+		}
+		x.names[name][key] = true
+	}
+}
+
+func (x *mappingIndex) drop(key mappingKey) {
+	mapping, ok := x.mappings[key]
+	if !ok {
+		return
+	}
+	delete(x.mappings, key)
+	for _, filePath := range mappingFiles(mapping.State) {
+		name := indexName(mapping.State.Storage, filePath)
+		delete(x.names[name], key)
+		if len(x.names[name]) == 0 {
+			delete(x.names, name)
+		}
+	}
+}
+
+// mappingsNamed returns the mappings with a file of the given name on the
+// named storage, loading the index first if needed. Rooms that cannot be read
+// only fail the lookup if their rule archives to the same storage, so one
+// broken room does not block files everywhere.
+func (h *MediaHandler) mappingsNamed(ctx context.Context, name, filePath string) ([]storedMapping, error) {
+	x := h.mappings
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if !x.loaded {
+		joined, err := h.as.BotIntent().JoinedRooms(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch joined rooms: %w", err)
+		}
+		for _, roomID := range joined.JoinedRooms {
+			x.unread[roomID] = true
+		}
+		x.loaded = true
+	}
+	var errs []error
+	for roomID := range x.unread {
+		mappings, err := h.roomMappings(ctx, roomID)
+		if err != nil {
+			if rule, ok := h.rooms.Resolve(ctx, roomID); ok && rule.Storage == name {
+				errs = append(errs, fmt.Errorf("failed to read mappings of room %s: %w", roomID, err))
+			} else {
+				log.Printf("Warning: failed to read mappings of room %s, which archives to another storage: %v", roomID, err)
+			}
+			continue
+		}
+		for _, mapping := range mappings {
+			x.add(mapping)
+		}
+		delete(x.unread, roomID)
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	keys := x.names[indexName(name, filePath)]
+	mappings := make([]storedMapping, 0, len(keys))
+	for key := range keys {
+		mappings = append(mappings, x.mappings[key])
+	}
+	return mappings, nil
+}
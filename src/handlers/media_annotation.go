@@ -0,0 +1,138 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"maunium.net/go/mautrix/event"
+
+	"nextcloud-media-bridge/src/utils"
+)
+
+// mediaAnnotation describes where an archived file came from.
+type mediaAnnotation struct {
+	Sender     string
+	SenderName string
+	RoomID     string
+	RoomName   string
+	EventID    string
+	Timestamp  time.Time
+	Caption    string
+}
+
+func (h *MediaHandler) newMediaAnnotation(ctx context.Context, evt *event.Event, msg *event.MessageEventContent) mediaAnnotation {
+	roomID := evt.RoomID.String()
+	return mediaAnnotation{
+		Sender:     evt.Sender.String(),
+		SenderName: h.rooms.DisplayName(ctx, evt.RoomID, evt.Sender),
+		RoomID:     roomID,
+		RoomName:   roomDisplayName(h.rooms.RoomName(ctx, evt.RoomID), h.rooms.CanonicalAlias(ctx, evt.RoomID), roomID),
+		EventID:    evt.ID.String(),
+		Timestamp:  time.UnixMilli(evt.Timestamp).UTC(),
+		Caption:    msg.GetCaption(),
+	}
+}
+
+// Properties returns the WebDAV properties stored on the file. Empty values
+// are left out.
+func (a mediaAnnotation) Properties() map[string]string {
+	properties := map[string]string{
+		"sender":    a.Sender,
+		"room_id":   a.RoomID,
+		"event_id":  a.EventID,
+		"timestamp": a.Timestamp.Format(time.RFC3339),
+	}
+	if a.SenderName != "" {
+		properties["sender_name"] = a.SenderName
+	}
+	if a.RoomName != "" {
+		properties["room_name"] = a.RoomName
+	}
+	if a.Caption != "" {
+		properties["caption"] = a.Caption
+	}
+	return properties
+}
+
+// Comment returns the text of the file comment.
+func (a mediaAnnotation) Comment() string {
+	sender := a.Sender
+	if a.SenderName != "" && a.SenderName != a.Sender {
+		sender = fmt.Sprintf("%s (%s)", a.SenderName, a.Sender)
+	}
+	var comment strings.Builder
+	fmt.Fprintf(&comment, "Posted by %s in %s on %s", sender, a.RoomName, a.Timestamp.Format("2006-01-02 15:04 MST"))
+	if a.Caption != "" {
+		fmt.Fprintf(&comment, ":\n%s", a.Caption)
+	}
+	fmt.Fprintf(&comment, "\n\nMatrix event %s in %s", a.EventID, a.RoomID)
+	return comment.String()
+}
+
+// annotateFile mirrors the message metadata onto the uploaded file and
+// assigns the configured system tags if the file is stored in a Nextcloud.
+// A reused file already got its comment when it was uploaded, so none is
+// added again. Failures are logged; the file itself is already archived.
+func (h *MediaHandler) annotateFile(ctx context.Context, storage Storage, evt *event.Event, msg *event.MessageEventContent, remotePath, filename, mimeType string, mediaData []byte, reused bool) {
+	settings := h.config.Nextcloud.Metadata
+	if !settings.Properties && !settings.Comments && len(settings.Tags) == 0 {
+		return
+	}
+	nextcloud, ok := storage.(*NextcloudClient)
+	if !ok {
+		return
+	}
+	annotation := h.newMediaAnnotation(ctx, evt, msg)
+	if settings.Properties {
+		if err := nextcloud.SetProperties(ctx, remotePath, annotation.Properties()); err != nil {
+			log.Printf("Warning: failed to set Nextcloud properties on %s: %v", remotePath, err)
+		}
+	}
+	comment := settings.Comments && !reused
+	if !comment && len(settings.Tags) == 0 {
+		return
+	}
+	fileID, err := nextcloud.FileID(ctx, remotePath)
+	if err != nil {
+		log.Printf("Warning: failed to look up Nextcloud file id of %s: %v", remotePath, err)
+		return
+	}
+	if comment {
+		if err := nextcloud.AddComment(ctx, fileID, annotation.Comment()); err != nil {
+			log.Printf("Warning: failed to add Nextcloud comment to %s: %v", remotePath, err)
+		}
+	}
+	for _, tag := range h.fileTags(ctx, evt, msg, filename, mimeType, mediaData) {
+		tagID, err := nextcloud.SystemTagID(ctx, tag)
+		if err == nil {
+			err = nextcloud.AssignSystemTag(ctx, fileID, tagID)
+		}
+		if err != nil {
+			log.Printf("Warning: failed to tag %s with %q: %v", remotePath, tag, err)
+		}
+	}
+}
+
+// fileTags renders the configured tag templates. Empty and duplicate tags are
+// dropped.
+func (h *MediaHandler) fileTags(ctx context.Context, evt *event.Event, msg *event.MessageEventContent, filename, mimeType string, mediaData []byte) []string {
+	var tags []string
+	seen := make(map[string]bool)
+	for _, tagTemplate := range h.config.Nextcloud.Metadata.Tags {
+		template, err := utils.ParsePathTemplate(tagTemplate)
+		if err != nil {
+			log.Printf("Warning: invalid tag template %q: %v", tagTemplate, err)
+			continue
+		}
+		tag := template.RenderText(h.templateVariables(ctx, template, evt, msg, filename, mimeType, mediaData))
+		if tag == "" || seen[tag] {
+			continue
+		}
+		seen[tag] = true
+		tags = append(tags, tag)
+	}
+	return tags
+}
@@ -0,0 +1,66 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"nextcloud-media-bridge/src/config"
+)
+
+func TestAnnotateFileSkipsCommentOnReusedFile(t *testing.T) {
+	var comments, proppatches int
+	mux := http.NewServeMux()
+	mux.HandleFunc("/remote.php/dav/files/bridge/", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "PROPPATCH":
+			proppatches++
+			w.WriteHeader(http.StatusMultiStatus)
+			_, _ = w.Write([]byte(`<?xml version="1.0"?><d:multistatus xmlns:d="DAV:"><d:response><d:href>/x</d:href><d:propstat><d:prop/><d:status>HTTP/1.1 200 OK</d:status></d:propstat></d:response></d:multistatus>`))
+		case "PROPFIND":
+			w.WriteHeader(http.StatusMultiStatus)
+			_, _ = w.Write([]byte(`<?xml version="1.0"?><d:multistatus xmlns:d="DAV:" xmlns:oc="http://owncloud.org/ns"><d:response><d:href>/x</d:href><d:propstat><d:prop><oc:fileid>4711</oc:fileid></d:prop><d:status>HTTP/1.1 200 OK</d:status></d:propstat></d:response></d:multistatus>`))
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	})
+	mux.HandleFunc("/remote.php/dav/comments/files/", func(w http.ResponseWriter, r *http.Request) {
+		comments++
+		w.WriteHeader(http.StatusCreated)
+	})
+	nt := httptest.NewServer(mux)
+	defer nt.Close()
+
+	mt := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "/state/") {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"errcode":"M_NOT_FOUND"}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{}`))
+	}))
+	defer mt.Close()
+
+	cfg := &config.Config{}
+	cfg.Nextcloud.Metadata.Properties = true
+	cfg.Nextcloud.Metadata.Comments = true
+	nextcloud := NewNextcloudClient(nt.URL+"/remote.php/dav/files/bridge", "bridge", "pass")
+	handler := newTestHandler(t, cfg, mt.URL, NewStorages(nextcloud))
+
+	evt := &event.Event{Type: event.EventMessage, RoomID: id.RoomID("!room:example.com"), Sender: id.UserID("@alice:example.com"), ID: id.EventID("$photo")}
+	msg := &event.MessageEventContent{MsgType: event.MsgImage, Body: "photo.jpg"}
+	ctx := context.Background()
+	handler.annotateFile(ctx, nextcloud, evt, msg, "media/photo.jpg", "photo.jpg", "image/jpeg", []byte("photo"), false)
+	handler.annotateFile(ctx, nextcloud, evt, msg, "media/photo.jpg", "photo.jpg", "image/jpeg", []byte("photo"), true)
+	if comments != 1 {
+		t.Fatalf("expected one comment for the uploaded file, got %d", comments)
+	}
+	if proppatches != 2 {
+		t.Fatalf("expected the properties to be set both times, got %d", proppatches)
+	}
+}
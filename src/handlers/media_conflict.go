@@ -0,0 +1,164 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"path"
+	"strings"
+	"time"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"nextcloud-media-bridge/src/config"
+	"nextcloud-media-bridge/src/utils"
+)
+
+// conflictNaming holds the conflict strategy of a room and the event values
+// new names are derived from.
+type conflictNaming struct {
+	strategy  string
+	eventID   id.EventID
+	timestamp time.Time
+}
+
+// conflictNaming returns the naming for archiving the media of an event to
+// the rooms of a rule.
+func (h *MediaHandler) conflictNaming(rule config.RoomRule, evt *event.Event) conflictNaming {
+	naming := conflictNaming{strategy: h.config.EffectiveConflictStrategy(rule)}
+	if evt != nil {
+		naming.eventID = evt.ID
+		naming.timestamp = time.UnixMilli(evt.Timestamp)
+	}
+	return naming
+}
+
+// storedCopy reports whether a file exists at remotePath of the named storage
+// and whether it can be reused as the upload of data: it has the same content
+// and was not kept after a redaction, whose files are not served. Only files
+// of the same size are downloaded to compare their content.
+func (h *MediaHandler) storedCopy(ctx context.Context, name string, storage Storage, remotePath string, data []byte) (bool, bool, error) {
+	exists, storedSize, err := storage.Stat(ctx, remotePath)
+	if err != nil {
+		return false, false, fmt.Errorf("failed to check existing file: %w", err)
+	}
+	if !exists || len(data) == 0 || storedSize != int64(len(data)) || h.revoked.IsRevoked(name, remotePath) {
+		return exists, false, nil
+	}
+	same, err := storedContentEquals(ctx, storage, remotePath, data)
+	if err != nil {
+		log.Printf("Warning: failed to compare %s with the new upload, keeping both: %v", remotePath, err)
+		return true, false, nil
+	}
+	return true, same, nil
+}
+
+// storedContentEquals reports whether a stored file has the SHA-256 hash of
+// data.
+func storedContentEquals(ctx context.Context, storage Storage, remotePath string, data []byte) (bool, error) {
+	file, err := storage.Download(ctx, remotePath)
+	if err != nil {
+		return false, err
+	}
+	defer file.Body.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, io.LimitReader(file.Body, int64(len(data))+1)); err != nil {
+		return false, err
+	}
+	expected := sha256.Sum256(data)
+	return bytes.Equal(hash.Sum(nil), expected[:]), nil
+}
+
+// conflictPath returns the path and file name to store data at because
+// remotePath is taken by a different file, and whether an earlier upload of
+// the same content already stored it there. The timestamp, event ID and hash
+// strategies add a suffix that only depends on the event; if another file
+// took that name too, or the event has no ID, a counter is added like the
+// counter strategy does.
+func (h *MediaHandler) conflictPath(ctx context.Context, name string, storage Storage, remotePath string, data []byte, naming conflictNaming) (string, string, bool, error) {
+	var suffix string
+	switch naming.strategy {
+	case config.ConflictTimestamp:
+		if !naming.timestamp.IsZero() {
+			suffix = naming.timestamp.UTC().Format("20060102-150405")
+		}
+	case config.ConflictEventID:
+		if naming.eventID != "" {
+			suffix = utils.SanitizePathSegment(strings.TrimPrefix(naming.eventID.String(), "$"))
+		}
+	case config.ConflictHash:
+		sum := sha256.Sum256(data)
+		suffix = hex.EncodeToString(sum[:8])
+	}
+	if suffix == "" {
+		return h.freePath(ctx, name, storage, remotePath, data)
+	}
+
+	candidatePath, candidateName := addNameSuffix(remotePath, suffix)
+	exists, reuse, err := h.storedCopy(ctx, name, storage, candidatePath, data)
+	if err != nil || !exists || reuse {
+		return candidatePath, candidateName, reuse, err
+	}
+	return h.freePath(ctx, name, storage, candidatePath, data)
+}
+
+// freePath returns the first path with a counter added to the name of
+// remotePath that is not taken, and its file name. If a taken one already
+// holds data, it is returned instead and reported as reusable, so uploading
+// the same file again does not add another copy. The folder is listed once
+// instead of checking every candidate, and only files of the size of data
+// are compared. Moves pass no data and always get a free path.
+func (h *MediaHandler) freePath(ctx context.Context, name string, storage Storage, remotePath string, data []byte) (string, string, bool, error) {
+	folder := path.Dir(remotePath)
+	if folder == "." {
+		folder = ""
+	}
+	files, err := storage.List(ctx, folder)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return "", "", false, fmt.Errorf("failed to list existing files: %w", err)
+	}
+	taken := make(map[string]*RemoteFile, len(files))
+	for i := range files {
+		taken[path.Base(files[i].Path)] = &files[i]
+	}
+	for i := 1; ; i++ {
+		candidatePath, candidateName := addNameSuffix(remotePath, fmt.Sprint(i))
+		file := taken[candidateName]
+		if file == nil {
+			return candidatePath, candidateName, false, nil
+		}
+		if len(data) == 0 || file.IsDir || file.Size != int64(len(data)) || h.revoked.IsRevoked(name, candidatePath) {
+			continue
+		}
+		same, err := storedContentEquals(ctx, storage, candidatePath, data)
+		if err != nil {
+			log.Printf("Warning: failed to compare %s with the new upload, keeping both: %v", candidatePath, err)
+		} else if same {
+			return candidatePath, candidateName, true, nil
+		}
+	}
+}
+
+// addNameSuffix adds "_" and suffix to the file name of remotePath, before
+// its extension. It returns the new path and file name.
+func addNameSuffix(remotePath, suffix string) (string, string) {
+	dir := path.Dir(remotePath)
+	base := path.Base(remotePath)
+	ext := path.Ext(base)
+	name := strings.TrimSuffix(base, ext)
+	newBase := fmt.Sprintf("%s_%s%s", name, suffix, ext)
+	if dir == "." {
+		return newBase, newBase
+	}
+	newPath := path.Join(dir, newBase)
+	if strings.HasPrefix(remotePath, "/") && !strings.HasPrefix(newPath, "/") {
+		newPath = "/" + newPath
+	}
+	return newPath, newBase
+}
@@ -0,0 +1,157 @@
+package handlers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"nextcloud-media-bridge/src/config"
+)
+
+func TestUploadMediaConflictStrategies(t *testing.T) {
+	sum := sha256.Sum256([]byte("photo"))
+	naming := conflictNaming{eventID: "$abc:example.com", timestamp: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)}
+	cases := []struct {
+		strategy string
+		path     string
+		again    string // Path of the second upload of the same event
+	}{
+		{config.ConflictCounter, "media/photo_1.jpg", "media/photo_1.jpg"},
+		{config.ConflictTimestamp, "media/photo_20240102-030405.jpg", "media/photo_20240102-030405.jpg"},
+		{config.ConflictEventID, "media/photo_abc_example.com.jpg", "media/photo_abc_example.com.jpg"},
+		{config.ConflictHash, "media/photo_" + hex.EncodeToString(sum[:8]) + ".jpg", "media/photo_" + hex.EncodeToString(sum[:8]) + ".jpg"},
+		{config.ConflictOverwrite, "media/photo.jpg", "media/photo.jpg"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.strategy, func(t *testing.T) {
+			storage, err := NewLocalStorage(t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctx := context.Background()
+			if err := storage.EnsureDirectories(ctx, "media/photo.jpg"); err != nil {
+				t.Fatal(err)
+			}
+			if err := storage.UploadReader(ctx, "media/photo.jpg", strings.NewReader("older photo"), 11); err != nil {
+				t.Fatal(err)
+			}
+			handler := &MediaHandler{}
+			naming := naming
+			naming.strategy = tc.strategy
+
+			for i, expected := range []string{tc.path, tc.again} {
+				finalPath, finalFilename, _, err := handler.uploadMedia(ctx, "disk", storage, "media/photo.jpg", "photo.jpg", []byte("photo"), naming)
+				if err != nil {
+					t.Fatalf("upload %d failed: %v", i+1, err)
+				}
+				if finalPath != expected || "media/"+finalFilename != expected {
+					t.Fatalf("upload %d: expected %s, got %s (%s)", i+1, expected, finalPath, finalFilename)
+				}
+				if data := readStored(t, storage, finalPath); data != "photo" {
+					t.Fatalf("unexpected content: %q", data)
+				}
+			}
+		})
+	}
+
+	// A different file at the timestamp name gets a counter
+	storage, err := NewLocalStorage(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err := storage.EnsureDirectories(ctx, "media/photo.jpg"); err != nil {
+		t.Fatal(err)
+	}
+	for _, taken := range []string{"media/photo.jpg", "media/photo_20240102-030405.jpg"} {
+		if err := storage.UploadReader(ctx, taken, strings.NewReader("older photo"), 11); err != nil {
+			t.Fatal(err)
+		}
+	}
+	naming.strategy = config.ConflictTimestamp
+	finalPath, _, _, err := (&MediaHandler{}).uploadMedia(ctx, "disk", storage, "media/photo.jpg", "photo.jpg", []byte("photo"), naming)
+	if err != nil || finalPath != "media/photo_20240102-030405_1.jpg" {
+		t.Fatalf("expected a counter after the timestamp, got %s: %v", finalPath, err)
+	}
+}
+
+func TestUploadMediaKeepsDifferentFileOfSameSize(t *testing.T) {
+	naming := conflictNaming{eventID: "$abc:example.com", timestamp: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)}
+	for _, strategy := range []string{config.ConflictCounter, config.ConflictTimestamp, config.ConflictEventID, config.ConflictHash} {
+		t.Run(strategy, func(t *testing.T) {
+			storage, err := NewLocalStorage(t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctx := context.Background()
+			if err := storage.EnsureDirectories(ctx, "media/image.png"); err != nil {
+				t.Fatal(err)
+			}
+			if err := storage.UploadReader(ctx, "media/image.png", strings.NewReader("AAAAA"), 5); err != nil {
+				t.Fatal(err)
+			}
+			handler := &MediaHandler{}
+			naming := naming
+			naming.strategy = strategy
+
+			first, _, reused, err := handler.uploadMedia(ctx, "disk", storage, "media/image.png", "image.png", []byte("BBBBB"), naming)
+			if err != nil {
+				t.Fatalf("upload failed: %v", err)
+			}
+			if reused || first == "media/image.png" || readStored(t, storage, "media/image.png") != "AAAAA" || readStored(t, storage, first) != "BBBBB" {
+				t.Fatalf("expected the new file next to the file of the same size, got %s", first)
+			}
+			// Archiving the same file again finds it
+			again, _, reused, err := handler.uploadMedia(ctx, "disk", storage, "media/image.png", "image.png", []byte("BBBBB"), naming)
+			if err != nil {
+				t.Fatalf("upload failed: %v", err)
+			}
+			if again != first || !reused {
+				t.Fatalf("expected %s to be reused, got %s", first, again)
+			}
+			if readStored(t, storage, again) != "BBBBB" {
+				t.Fatalf("unexpected content at %s", again)
+			}
+		})
+	}
+}
+
+func TestFreePathListsFolderOnce(t *testing.T) {
+	var heads, propfinds int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodHead:
+			heads++
+			w.WriteHeader(http.StatusNotFound)
+		case r.Method == "PROPFIND" && r.Header.Get("Depth") == "1":
+			propfinds++
+			w.WriteHeader(http.StatusMultiStatus)
+			fmt.Fprint(w, `<?xml version="1.0"?><d:multistatus xmlns:d="DAV:">`)
+			for _, name := range []string{"", "image.png", "image_1.png", "image_2.png", "image_4.png"} {
+				fmt.Fprintf(w, `<d:response><d:href>/remote.php/dav/files/bridge/media/%s</d:href><d:propstat><d:prop/><d:status>HTTP/1.1 200 OK</d:status></d:propstat></d:response>`, name)
+			}
+			fmt.Fprint(w, `</d:multistatus>`)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}))
+	defer server.Close()
+
+	client := NewNextcloudClient(server.URL+"/remote.php/dav/files/bridge", "bridge", "pass")
+	freePath, filename, _, err := (&MediaHandler{}).freePath(context.Background(), "", client, "/media/image.png", nil)
+	if err != nil {
+		t.Fatalf("freePath failed: %v", err)
+	}
+	if freePath != "/media/image_3.png" || filename != "image_3.png" {
+		t.Fatalf("unexpected path %s (%s)", freePath, filename)
+	}
+	if heads != 0 || propfinds != 1 {
+		t.Fatalf("expected a single PROPFIND, got %d HEAD and %d PROPFIND requests", heads, propfinds)
+	}
+}
@@ -0,0 +1,213 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"path"
+	"slices"
+	"strings"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"nextcloud-media-bridge/src/config"
+	"nextcloud-media-bridge/src/utils"
+)
+
+// handleMediaEdit archives the attachment of an edit (m.replace) that swaps
+// the media of an archived message. The new media is uploaded over the
+// archived file, so Nextcloud keeps the previous content as a version, and the
+// original event is edited to point at the new version. The file is renamed if
+// the file type changed. A file shared with other messages is left alone and
+// the new media is archived as a new file.
+//
+// Edits by anyone but the sender of the original message and edits that keep
+// the attachment are ignored. This includes the bridge's own
+// edits, whose media URL points at the proxy.
+func (h *MediaHandler) handleMediaEdit(ctx context.Context, rule config.RoomRule, evt *event.Event, msg *event.MessageEventContent) error {
+	newContent := msg.NewContent
+	if newContent == nil || !newContent.MsgType.IsMedia() {
+		log.Printf("Skipping edit event %s without new media in room %s", evt.ID.String(), evt.RoomID.String())
+		return nil
+	}
+	source := newContent.URL
+	if newContent.File != nil {
+		source = newContent.File.URL
+	}
+	if parsed, err := source.Parse(); err == nil && h.isProxiedMedia(parsed) {
+		log.Printf("Skipping edit event %s pointing at proxied media", evt.ID.String())
+		return nil
+	}
+	target := msg.RelatesTo.EventID
+	state, ok := h.loadMediaState(evt.RoomID, target)
+	if !ok {
+		log.Printf("Skipping edit event %s: no archived file for event %s", evt.ID.String(), target.String())
+		return nil
+	}
+	if source == "" || string(source) == state.Source || string(source) == state.MXC {
+		log.Printf("Skipping edit event %s that keeps the archived media of %s", evt.ID.String(), target.String())
+		return nil
+	}
+	// Clients ignore edits by other users, but the archived file is shared by
+	// every proxied URL of the message
+	original, err := h.as.BotClient().GetEvent(ctx, evt.RoomID, target)
+	if err != nil {
+		log.Printf("Skipping edit event %s: failed to fetch event %s: %v", evt.ID.String(), target.String(), err)
+		return nil
+	}
+	if original.Sender != evt.Sender {
+		log.Printf("Skipping edit event %s by %s of event %s sent by %s", evt.ID.String(), evt.Sender.String(), target.String(), original.Sender.String())
+		return nil
+	}
+
+	filter := h.roomFilter(rule)
+	filename := newContent.GetFileName()
+	media, err := h.fetchMedia(ctx, evt, newContent, filename, filter)
+	if err != nil || media == nil {
+		return err
+	}
+	mediaData, mimeType := media.Data, media.MimeType
+	if !h.scanMedia(ctx, evt, mediaData) {
+		return nil
+	}
+
+	storage, err := h.storages.Get(state.Storage)
+	if err != nil {
+		return fmt.Errorf("invalid storage of event %s: %w", target.String(), err)
+	}
+	filePath := h.currentPath(ctx, state.Storage, storage, state.Path)
+	if filename == "" {
+		filename = path.Base(filePath)
+	}
+	mediaData, unstripped := h.stripImageMetadata(rule, evt, mimeType, mediaData)
+	newPath := path.Join(path.Dir(filePath), editedFileName(path.Base(filePath), filename, mimeType))
+
+	var finalPath string
+	var reused bool
+	if h.sharedPath(ctx, evt.RoomID, target, state.Storage, filePath) {
+		// Other messages were archived to the same file, which must not
+		// change for them
+		log.Printf("%s is shared with other messages, archiving edit %s as a new file", filePath, evt.ID.String())
+		naming := h.conflictNaming(rule, evt)
+		if naming.strategy == config.ConflictOverwrite {
+			naming.strategy = config.ConflictCounter
+		}
+		finalPath, _, reused, err = h.uploadMedia(ctx, state.Storage, storage, newPath, path.Base(newPath), mediaData, naming)
+		if errors.Is(err, ErrInsufficientStorage) {
+			log.Printf("Not archiving edit %s of event %s: %v", evt.ID.String(), target.String(), err)
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to upload new version: %w", err)
+		}
+	} else {
+		// Upload over the archived file, so the new media becomes a version of
+		// that file
+		if err := h.quota.Check(ctx, state.Storage, int64(len(mediaData))); err != nil {
+			log.Printf("Not archiving edit %s of event %s: %v", evt.ID.String(), target.String(), err)
+			return nil
+		}
+		if err := storage.EnsureDirectories(ctx, filePath); err != nil {
+			return fmt.Errorf("failed to create directories: %w", err)
+		}
+		err = storage.UploadReader(ctx, filePath, bytes.NewReader(mediaData), int64(len(mediaData)))
+		h.quota.Uploaded(state.Storage, int64(len(mediaData)), err)
+		if err != nil {
+			return fmt.Errorf("failed to upload new version: %w", err)
+		}
+		finalPath = filePath
+		if newPath != filePath {
+			// The file type changed; the versions move with the file
+			if finalPath, err = h.moveToFreePath(ctx, storage, filePath, newPath); err != nil {
+				return fmt.Errorf("failed to rename %s for the new file type: %w", filePath, err)
+			}
+			h.replicator.Move(state.Storage, filePath, finalPath)
+		}
+	}
+	finalFilename := path.Base(finalPath)
+	log.Printf("Uploaded new version of %s to %s for edit %s of event %s", filePath, finalPath, evt.ID.String(), target.String())
+	h.annotateFile(ctx, storage, evt, newContent, finalPath, finalFilename, mimeType, mediaData, reused)
+	h.replicator.Upload(state.Storage, finalPath)
+
+	sum := sha256.Sum256(mediaData)
+	mediaRef := utils.MediaRef{
+		Path:     strings.TrimLeft(finalPath, "/"),
+		FileName: finalFilename,
+		MimeType: mimeType,
+		Version:  hex.EncodeToString(sum[:])[:8],
+		Storage:  state.Storage,
+	}
+	mxc, err := h.sendMediaEdit(ctx, evt.RoomID, evt.Sender, target, newContent, finalPath, mediaRef, mediaData)
+	if err != nil {
+		log.Printf("Failed to edit message %s as user: %v", target.String(), err)
+		return nil
+	}
+	log.Printf("Successfully edited message %s to the new version", target.String())
+	originals := state.Originals
+	if originalPath := h.keepOriginal(ctx, rule, evt, newContent, filename, mimeType, unstripped); originalPath != "" {
+		originals = append(originals, originalPath)
+	}
+	h.storeMediaState(evt.RoomID, target, mediaState{Path: finalPath, FileName: finalFilename, MXC: mxc, Source: media.Source.String(), Encrypted: media.Encrypted, Storage: state.Storage, Originals: originals})
+	h.deleteSourceMedia(ctx, media.Source)
+	return nil
+}
+
+// editedFileName returns the name of an archived file after an edit swapped
+// its media for filename of type mimeType. The name is kept unless the
+// extension of the new media is of a different type, so a PNG that replaces a
+// JPEG is not stored as .jpg.
+func editedFileName(archived, filename, mimeType string) string {
+	oldExt := path.Ext(archived)
+	newExt := path.Ext(filename)
+	if newExt == "" || newExt == "." || strings.EqualFold(newExt, oldExt) {
+		return archived
+	}
+	newExt = utils.SanitizePathSegment(newExt)
+	if mediaType, _, err := mime.ParseMediaType(mimeType); err == nil {
+		if oldType, _, err := mime.ParseMediaType(mime.TypeByExtension(oldExt)); err == nil && oldType == mediaType {
+			return archived
+		}
+	}
+	return strings.TrimSuffix(archived, oldExt) + newExt
+}
+
+// sharedPath reports whether the mapping of another message points at a
+// file, because uploadMedia reused it for a message with the same content.
+// A file is counted as shared if the mappings cannot be read.
+func (h *MediaHandler) sharedPath(ctx context.Context, roomID id.RoomID, eventID id.EventID, name, filePath string) bool {
+	mappings, err := h.sharingMappings(ctx, roomID, eventID, name, filePath)
+	if err != nil {
+		log.Printf("Warning: %v, treating %s as shared", err, filePath)
+		return true
+	}
+	return len(mappings) > 0
+}
+
+// sharingMappings returns the mappings of other messages that point at a file
+// of the named storage, either as their archived file or as a kept original.
+func (h *MediaHandler) sharingMappings(ctx context.Context, roomID id.RoomID, eventID id.EventID, name, filePath string) ([]storedMapping, error) {
+	candidates, err := h.mappingsNamed(ctx, name, filePath)
+	if err != nil {
+		return nil, err
+	}
+	filePath = strings.Trim(filePath, "/")
+	samePath := func(other string) bool {
+		return strings.Trim(other, "/") == filePath || strings.Trim(h.moves.Resolve(name, other), "/") == filePath
+	}
+	var sharing []storedMapping
+	for _, mapping := range candidates {
+		if (mapping.RoomID == roomID && mapping.EventID == eventID) || mapping.State.Storage != name {
+			continue
+		}
+		if samePath(mapping.State.Path) || slices.ContainsFunc(mapping.State.Originals, samePath) {
+			sharing = append(sharing, mapping)
+		}
+	}
+	return sharing, nil
+}
@@ -0,0 +1,182 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"nextcloud-media-bridge/src/config"
+	"nextcloud-media-bridge/src/utils"
+)
+
+func TestHandleMediaEdit(t *testing.T) {
+	const (
+		roomID   = "!roomid:example.com"
+		original = "$original"
+		newMedia = "new-file-bytes"
+	)
+
+	uploads := newFakeUploads()
+	var sentContent event.MessageEventContent
+	var storedState mediaState
+	var handler *MediaHandler
+	archivedPath := "/media/alice/photo.jpg"
+	shared := false
+
+	nt := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if uploads.serve(w, r) {
+			return
+		}
+		switch r.Method {
+		case "MKCOL":
+			w.WriteHeader(http.StatusCreated)
+		case "MOVE":
+			destination, _ := url.Parse(r.Header.Get("Destination"))
+			uploads.lock.Lock()
+			uploads.files[destination.Path] = uploads.files[r.URL.Path]
+			delete(uploads.files, r.URL.Path)
+			uploads.lock.Unlock()
+			w.WriteHeader(http.StatusCreated)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer nt.Close()
+
+	mt := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.Contains(r.URL.Path, "/state/com.nextcloud-media-bridge.media/") && r.Method == http.MethodGet:
+			state := mediaState{Path: archivedPath, FileName: path.Base(archivedPath), MXC: "mxc://media.example.com/old", Source: "mxc://example.com/old"}
+			state.Signature, _ = handler.signMediaState(state)
+			_ = json.NewEncoder(w).Encode(state)
+		case strings.HasSuffix(r.URL.Path, "/joined_rooms") && shared:
+			_, _ = w.Write([]byte(`{"joined_rooms":["` + roomID + `"]}`))
+		case strings.HasSuffix(r.URL.Path, "/state") && shared:
+			// Another message was archived to the same file
+			state := mediaState{Path: archivedPath, FileName: path.Base(archivedPath)}
+			state.Signature, _ = handler.signMediaState(state)
+			_ = json.NewEncoder(w).Encode([]map[string]any{{"type": nextcloudMediaStateEvent.Type, "state_key": "$other", "content": state, "event_id": "$s", "sender": "@bridge:example.com"}})
+		case strings.Contains(r.URL.Path, "/state/com.nextcloud-media-bridge.media/"):
+			_ = json.NewDecoder(r.Body).Decode(&storedState)
+			_, _ = w.Write([]byte(`{"event_id":"$state"}`))
+		case strings.HasSuffix(r.URL.Path, "/event/"+original):
+			_, _ = w.Write([]byte(`{"event_id":"$original","type":"m.room.message","sender":"@alice:example.com","content":{}}`))
+		case strings.Contains(r.URL.Path, "/media/download/"):
+			w.Header().Set("Content-Type", "image/png")
+			_, _ = w.Write([]byte(newMedia + path.Base(r.URL.Path)))
+		case strings.Contains(r.URL.Path, "/send/m.room.message/"):
+			_ = json.NewDecoder(r.Body).Decode(&sentContent)
+			_, _ = w.Write([]byte(`{"event_id":"$bridge-edit"}`))
+		default:
+			_, _ = w.Write([]byte(`{}`))
+		}
+	}))
+	defer mt.Close()
+
+	cfg := &config.Config{}
+	cfg.Nextcloud.BaseURL = nt.URL
+	cfg.Matrix.RoomPathTemplate = map[string]string{roomID: "/media/${user}/${file}"}
+	cfg.MediaProxy.ServerName = "media.example.com"
+	handler = newTestHandler(t, cfg, mt.URL, NewStorages(NewNextcloudClient(nt.URL, "user", "pass")))
+
+	editEvent := func(sender id.UserID, url string) *event.Event {
+		content := event.MessageEventContent{
+			MsgType: event.MsgImage,
+			Body:    "* other.png",
+			URL:     id.ContentURIString(url),
+			NewContent: &event.MessageEventContent{
+				MsgType: event.MsgImage,
+				Body:    "other.png",
+				URL:     id.ContentURIString(url),
+				Info:    &event.FileInfo{MimeType: "image/png"},
+			},
+			RelatesTo: &event.RelatesTo{Type: event.RelReplace, EventID: original},
+		}
+		raw, _ := json.Marshal(content)
+		return &event.Event{
+			Type:      event.EventMessage,
+			ID:        "$edit",
+			RoomID:    roomID,
+			Sender:    sender,
+			Timestamp: time.Now().UnixMilli(),
+			Content:   event.Content{VeryRaw: raw},
+		}
+	}
+
+	if err := handler.HandleMatrixEvent(context.Background(), handler.as, editEvent("@alice:example.com", "mxc://example.com/new")); err != nil {
+		t.Fatalf("HandleMatrixEvent failed: %v", err)
+	}
+	// The PNG replacing the JPEG is renamed, keeping the versions
+	if paths := uploads.paths(); len(paths) != 1 || paths[0] != "/media/alice/photo.png" || uploads.file(paths[0]) != newMedia+"new" {
+		t.Fatalf("expected new version uploaded over the archived file and renamed, got %v", paths)
+	}
+	if sentContent.RelatesTo == nil || sentContent.RelatesTo.EventID != original {
+		t.Fatalf("expected bridge edit of the original event, got %+v", sentContent.RelatesTo)
+	}
+	ref, err := utils.DecodeMediaID(testSecret, strings.TrimPrefix(string(sentContent.URL), "mxc://media.example.com/"))
+	if err != nil {
+		t.Fatalf("failed to decode proxy url: %v", err)
+	}
+	if ref.Path != "media/alice/photo.png" || ref.MimeType != "image/png" || ref.Version == "" {
+		t.Fatalf("unexpected media ref %+v", ref)
+	}
+	if storedState.Source != "mxc://example.com/new" || storedState.Path != "/media/alice/photo.png" || storedState.MXC != string(sentContent.URL) {
+		t.Fatalf("mapping not updated: %+v", storedState)
+	}
+
+	// The bridge's own edit, edits keeping the attachment and edits by other
+	// users are ignored
+	for _, edit := range []*event.Event{
+		editEvent("@alice:example.com", string(sentContent.URL)),
+		editEvent("@alice:example.com", "mxc://example.com/old"),
+		editEvent("@mallory:example.com", "mxc://example.com/evil"),
+	} {
+		if err := handler.HandleMatrixEvent(context.Background(), handler.as, edit); err != nil {
+			t.Fatalf("HandleMatrixEvent failed: %v", err)
+		}
+	}
+	if uploads.puts != 1 {
+		t.Fatalf("expected no further uploads, got %d", uploads.puts)
+	}
+
+	// A file shared with another message is kept for it. The mappings are
+	// read by a new handler, as after a restart.
+	archivedPath = "/media/alice/photo.png"
+	shared = true
+	handler = newTestHandler(t, cfg, mt.URL, NewStorages(NewNextcloudClient(nt.URL, "user", "pass")))
+	if err := handler.HandleMatrixEvent(context.Background(), handler.as, editEvent("@alice:example.com", "mxc://example.com/newer")); err != nil {
+		t.Fatalf("HandleMatrixEvent failed: %v", err)
+	}
+	if uploads.file("/media/alice/photo.png") != newMedia+"new" || uploads.file("/media/alice/photo_1.png") != newMedia+"newer" {
+		t.Fatalf("expected the edit to be archived as a new file, got %v", uploads.paths())
+	}
+	if storedState.Path != "/media/alice/photo_1.png" {
+		t.Fatalf("mapping not updated to the new file: %+v", storedState)
+	}
+}
+
+func TestEditedFileName(t *testing.T) {
+	cases := []struct {
+		archived, filename, mimeType, want string
+	}{
+		{"photo.jpg", "other.png", "image/png", "photo.png"},
+		{"photo.jpg", "IMG_1.JPEG", "image/jpeg", "photo.jpg"},
+		{"photo.jpg", "other.JPG", "image/jpeg", "photo.jpg"},
+		{"photo.jpg", "other", "image/png", "photo.jpg"},
+		{"report", "report.pdf", "application/pdf", "report.pdf"},
+	}
+	for _, tc := range cases {
+		if got := editedFileName(tc.archived, tc.filename, tc.mimeType); got != tc.want {
+			t.Errorf("editedFileName(%q, %q, %q) = %q, want %q", tc.archived, tc.filename, tc.mimeType, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"path"
+	"strings"
+
+	"maunium.net/go/mautrix/event"
+
+	"nextcloud-media-bridge/src/config"
+)
+
+// msgTypeVoice names voice messages in media filters. They are sent as m.audio
+// with the MSC3245 voice flag.
+const msgTypeVoice = "m.voice"
+
+// mediaAttributes describes media for filtering. Unknown values (an empty
+// MIME type or a negative size) pass the checks that need them, so the filter
+// can run once before downloading and again afterwards.
+type mediaAttributes struct {
+	MsgType   string
+	MimeType  string
+	Extension string
+	Size      int64
+}
+
+func newMediaAttributes(msg *event.MessageEventContent, filename, mimeType string, size int64) mediaAttributes {
+	msgType := string(msg.MsgType)
+	if msg.MsgType == event.MsgAudio && msg.MSC3245Voice != nil {
+		msgType = msgTypeVoice
+	}
+	mimeType, _, _ = strings.Cut(mimeType, ";")
+	return mediaAttributes{
+		MsgType:   msgType,
+		MimeType:  strings.ToLower(strings.TrimSpace(mimeType)),
+		Extension: strings.ToLower(strings.TrimPrefix(path.Ext(filename), ".")),
+		Size:      size,
+	}
+}
+
+// filterReason returns why the media is not archived, or "" if it passes.
+func filterReason(filter config.MediaFilter, media mediaAttributes) string {
+	if containsMsgType(filter.DenyMsgTypes, media.MsgType) {
+		return fmt.Sprintf("%s messages are not archived", media.MsgType)
+	}
+	if len(filter.AllowMsgTypes) > 0 && !containsMsgType(filter.AllowMsgTypes, media.MsgType) {
+		return fmt.Sprintf("%s messages are not archived", media.MsgType)
+	}
+	if media.MimeType != "" {
+		if matchesMimeType(filter.DenyMimeTypes, media.MimeType) {
+			return fmt.Sprintf("files of type %s are not archived", media.MimeType)
+		}
+		if len(filter.AllowMimeTypes) > 0 && !matchesMimeType(filter.AllowMimeTypes, media.MimeType) {
+			return fmt.Sprintf("files of type %s are not archived", media.MimeType)
+		}
+	}
+	if containsFold(filter.DenyExtensions, media.Extension) {
+		return fmt.Sprintf(".%s files are not archived", media.Extension)
+	}
+	if len(filter.AllowExtensions) > 0 && !containsFold(filter.AllowExtensions, media.Extension) {
+		if media.Extension == "" {
+			return "files without an extension are not archived"
+		}
+		return fmt.Sprintf(".%s files are not archived", media.Extension)
+	}
+	if media.Size >= 0 {
+		if filter.MaxSize > 0 && media.Size > int64(filter.MaxSize) {
+			return fmt.Sprintf("the file is larger than %s", filter.MaxSize)
+		}
+		if filter.MinSize > 0 && media.Size < int64(filter.MinSize) {
+			return fmt.Sprintf("the file is smaller than %s", filter.MinSize)
+		}
+	}
+	return ""
+}
+
+// containsMsgType reports whether the list names the msgtype. m.audio also
+// covers voice messages.
+func containsMsgType(list []string, msgType string) bool {
+	for _, entry := range list {
+		if entry == msgType || (entry == string(event.MsgAudio) && msgType == msgTypeVoice) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchesMimeType(patterns []string, mimeType string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(strings.ToLower(pattern), mimeType); matched {
+			return true
+		}
+	}
+	return false
+}
+
+func containsFold(list []string, value string) bool {
+	for _, entry := range list {
+		if strings.EqualFold(strings.TrimPrefix(entry, "."), value) {
+			return true
+		}
+	}
+	return false
+}
+
+// skipFilteredMedia logs why media was not archived and, if configured,
+// replies to the sender. The original message and its mxc are left untouched.
+func (h *MediaHandler) skipFilteredMedia(ctx context.Context, evt *event.Event, filter config.MediaFilter, reason string) {
+	log.Printf("Not archiving media %s in room %s: %s", evt.ID.String(), evt.RoomID.String(), reason)
+	if filter.NotifySender == nil || !*filter.NotifySender {
+		return
+	}
+	content := &event.MessageEventContent{
+		MsgType: event.MsgNotice,
+		Body:    fmt.Sprintf("This file was not archived to Nextcloud: %s.", reason),
+	}
+	content.SetReply(evt)
+	if _, err := h.as.BotIntent().SendMessageEvent(ctx, evt.RoomID, event.EventMessage, content); err != nil {
+		log.Printf("Failed to notify %s about skipped media: %v", evt.Sender.String(), err)
+	}
+}
+
+// roomFilter returns the media filter for a room rule.
+func (h *MediaHandler) roomFilter(rule config.RoomRule) config.MediaFilter {
+	return h.config.Matrix.MediaFilter.Merge(rule.Filter)
+}
@@ -0,0 +1,49 @@
+package handlers
+
+import (
+	"testing"
+
+	"maunium.net/go/mautrix/event"
+
+	"nextcloud-media-bridge/src/config"
+)
+
+func TestFilterReason(t *testing.T) {
+	global := config.MediaFilter{
+		DenyMsgTypes:   []string{"m.voice"},
+		DenyExtensions: []string{"exe", ".iso"},
+		MaxSize:        100 << 20,
+	}
+	photosOnly := global.Merge(&config.MediaFilter{AllowMimeTypes: []string{"image/*"}, MinSize: 1024})
+
+	image := &event.MessageEventContent{MsgType: event.MsgImage}
+	audio := &event.MessageEventContent{MsgType: event.MsgAudio}
+	voice := &event.MessageEventContent{MsgType: event.MsgAudio, MSC3245Voice: &event.MSC3245Voice{}}
+	file := &event.MessageEventContent{MsgType: event.MsgFile}
+
+	cases := []struct {
+		name    string
+		filter  config.MediaFilter
+		media   mediaAttributes
+		skipped bool
+	}{
+		{"image passes", global, newMediaAttributes(image, "a.jpg", "image/jpeg", 2048), false},
+		{"audio passes", global, newMediaAttributes(audio, "a.ogg", "audio/ogg", 2048), false},
+		{"voice denied", global, newMediaAttributes(voice, "a.ogg", "audio/ogg", 2048), true},
+		{"extension denied", global, newMediaAttributes(file, "setup.EXE", "application/octet-stream", 2048), true},
+		{"extension with dot denied", global, newMediaAttributes(file, "disk.iso", "", -1), true},
+		{"too large", global, newMediaAttributes(file, "a.zip", "application/zip", 200<<20), true},
+		{"unknown size passes", global, newMediaAttributes(file, "a.zip", "application/zip", -1), false},
+		{"mime allowed", photosOnly, newMediaAttributes(image, "a.png", "image/PNG; charset=binary", 2048), false},
+		{"mime not allowed", photosOnly, newMediaAttributes(file, "a.pdf", "application/pdf", 2048), true},
+		{"unknown mime passes before download", photosOnly, newMediaAttributes(file, "a.pdf", "", 2048), false},
+		{"too small", photosOnly, newMediaAttributes(image, "a.png", "image/png", 10), true},
+		{"room keeps global deny", photosOnly, newMediaAttributes(image, "a.iso", "image/png", 2048), true},
+	}
+	for _, tc := range cases {
+		reason := filterReason(tc.filter, tc.media)
+		if (reason != "") != tc.skipped {
+			t.Fatalf("%s: expected skipped=%v, got reason %q", tc.name, tc.skipped, reason)
+		}
+	}
+}
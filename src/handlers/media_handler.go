@@ -1,14 +1,17 @@
 package handlers
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
 	"encoding/gob"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
-	"path"
 	"reflect"
 	"strings"
 	"time"
@@ -24,9 +27,17 @@ import (
 type MediaHandler struct {
 	config        *config.Config
 	nextcloud     *NextcloudClient
+	storages      *Storages
 	mediaIDSecret []byte
 	as            *appservice.AppService
 	cryptoHelper  *CryptoHelper
+	rooms         *RoomResolver
+	moves         *PathMoves
+	revoked       *RevokedMedia
+	scanner       *ClamAVClient
+	replicator    *Replicator
+	quota         *QuotaMonitor
+	mappings      *mappingIndex
 }
 
 var nextcloudMediaStateEvent = event.Type{Type: "com.nextcloud-media-bridge.media", Class: event.StateEventType}
@@ -36,14 +47,51 @@ func init() {
 	gob.Register(&mediaState{})
 }
 
-func NewMediaHandler(cfg *config.Config, nextcloud *NextcloudClient, mediaIDSecret []byte, as *appservice.AppService, cryptoHelper *CryptoHelper) *MediaHandler {
-	return &MediaHandler{config: cfg, nextcloud: nextcloud, mediaIDSecret: mediaIDSecret, as: as, cryptoHelper: cryptoHelper}
+func NewMediaHandler(cfg *config.Config, storages *Storages, mediaIDSecret []byte, as *appservice.AppService, cryptoHelper *CryptoHelper, rooms *RoomResolver, moves *PathMoves, revoked *RevokedMedia, scanner *ClamAVClient) *MediaHandler {
+	h := &MediaHandler{config: cfg, nextcloud: storages.Nextcloud(), storages: storages, mediaIDSecret: mediaIDSecret, as: as, cryptoHelper: cryptoHelper, rooms: rooms, moves: moves, revoked: revoked, scanner: scanner,
+		replicator: NewReplicator(storages, cfg.Mirror.Retries), mappings: newMappingIndex()}
+	if cfg.Quota.Enabled {
+		h.quota = NewQuotaMonitor(storages, cfg.Quota.Interval, cfg.Quota.Thresholds)
+		h.quota.warn = h.warnQuota
+	}
+	return h
+}
+
+// StartQuotaMonitor refreshes the storage quotas and warns about them every
+// interval until ctx is done.
+func (h *MediaHandler) StartQuotaMonitor(ctx context.Context, interval time.Duration) {
+	if h.quota != nil {
+		h.quota.Start(ctx, interval)
+	}
+}
+
+// ServeQuotaMetrics serves the storage quotas as Prometheus metrics.
+func (h *MediaHandler) ServeQuotaMetrics(w http.ResponseWriter, r *http.Request) {
+	if h.quota == nil {
+		http.NotFound(w, r)
+		return
+	}
+	h.quota.ServeMetrics(w, r)
+}
+
+// StartReplication copies archived files to the mirror until ctx is done.
+func (h *MediaHandler) StartReplication(ctx context.Context) {
+	if h.replicator != nil {
+		h.replicator.Start(ctx)
+	}
 }
 
 func (h *MediaHandler) HandleMatrixEvent(ctx context.Context, as *appservice.AppService, evt *event.Event) error {
 	if evt.Type == event.EventRedaction {
 		return h.handleRedactionEvent(ctx, as, evt)
 	}
+	if evt.StateKey != nil {
+		h.rooms.HandleStateEvent(evt)
+		if evt.Type == event.StateRoomName && h.config.Matrix.MoveFoldersOnRename {
+			h.handleRoomRename(ctx, evt)
+		}
+		return nil
+	}
 	if evt.Type != event.EventMessage {
 		return nil
 	}
@@ -51,12 +99,13 @@ func (h *MediaHandler) HandleMatrixEvent(ctx context.Context, as *appservice.App
 		return nil
 	}
 	// Only process rooms that have a path template configured
-	roomIDStr := evt.RoomID.String()
-	pathTemplate, hasTemplate := h.config.Matrix.RoomPathTemplate[roomIDStr]
+	rule, hasTemplate := h.rooms.Resolve(ctx, evt.RoomID)
 	if !hasTemplate {
-		log.Printf("Skipping event in room %s (no path template configured)", roomIDStr)
+		log.Printf("Skipping event in room %s (no path template configured)", evt.RoomID.String())
 		return nil
 	}
+	pathTemplate := rule.Template
+	log.Printf("Room %s matched %s", evt.RoomID.String(), rule.Selector())
 
 	if err := evt.Content.ParseRaw(evt.Type); err != nil {
 		if err != event.ErrContentAlreadyParsed {
@@ -68,15 +117,113 @@ func (h *MediaHandler) HandleMatrixEvent(ctx context.Context, as *appservice.App
 	if msg != nil {
 		log.Printf("Message details: msgtype=%s url=%s hasFile=%v filename=%s", msg.MsgType, msg.URL, msg.File != nil, msg.GetFileName())
 	}
+	if msg != nil && h.isGalleryCommand(msg) {
+		h.sendGalleryLink(ctx, evt)
+		return nil
+	}
 	if msg == nil || !msg.MsgType.IsMedia() {
 		log.Printf("Skipping non-media message %s in room %s", evt.ID.String(), evt.RoomID.String())
 		return nil
 	}
 	if msg.RelatesTo != nil && msg.RelatesTo.Type == event.RelReplace {
-		log.Printf("Skipping edit event %s in room %s", evt.ID.String(), evt.RoomID.String())
+		return h.handleMediaEdit(ctx, rule, evt, msg)
+	}
+	storage, err := h.storages.Get(rule.Storage)
+	if err != nil {
+		return fmt.Errorf("invalid storage for %s: %w", rule.Selector(), err)
+	}
+	filter := h.roomFilter(rule)
+	filename := msg.GetFileName()
+	var infoMimeType string
+	infoSize := int64(-1)
+	if msg.Info != nil {
+		infoMimeType = msg.Info.MimeType
+		if msg.Info.Size > 0 {
+			infoSize = int64(msg.Info.Size)
+		}
+	}
+	if reason := filterReason(filter, newMediaAttributes(msg, filename, infoMimeType, infoSize)); reason != "" {
+		h.skipFilteredMedia(ctx, evt, filter, reason)
+		return nil
+	}
+	media, err := h.fetchMedia(ctx, evt, msg, filename, filter)
+	if err != nil || media == nil {
+		return err
+	}
+	mediaData, mimeType := media.Data, media.MimeType
+	if !h.scanMedia(ctx, evt, mediaData) {
+		return nil
+	}
+	if filename == "" {
+		filename = fmt.Sprintf("file_%d", time.Now().Unix())
+		log.Printf("Warning: No filename in message, using generated name: %s", filename)
+	}
+	mediaData, unstripped := h.stripImageMetadata(rule, evt, mimeType, mediaData)
+	template, err := utils.ParsePathTemplate(pathTemplate)
+	if err != nil {
+		return fmt.Errorf("invalid path template for %s: %w", rule.Selector(), err)
+	}
+	vars := h.templateVariables(ctx, template, evt, msg, filename, mimeType, mediaData)
+	log.Printf("Template variables: room=%s, user=%s, file=%s", vars["room"], vars["user"], vars["file"])
+
+	// Render the path template, values are sanitized by Render
+	nextcloudPath := template.Render(vars)
+	log.Printf("Uploading to %s path %s", storageName(rule.Storage), nextcloudPath)
+	finalPath, finalFilename, reused, err := h.uploadMedia(ctx, rule.Storage, storage, nextcloudPath, filename, mediaData, h.conflictNaming(rule, evt))
+	if errors.Is(err, ErrInsufficientStorage) {
+		// The message keeps its original media on the homeserver
+		log.Printf("Not archiving media %s in room %s: %v", evt.ID.String(), evt.RoomID.String(), err)
 		return nil
 	}
-	// Handle encrypted vs unencrypted media
+	if err != nil {
+		return err
+	}
+	h.annotateFile(ctx, storage, evt, msg, finalPath, finalFilename, mimeType, mediaData, reused)
+	h.replicator.Upload(rule.Storage, finalPath)
+
+	mediaRef := utils.MediaRef{
+		Path:     strings.TrimLeft(finalPath, "/"),
+		FileName: finalFilename,
+		MimeType: mimeType,
+		Storage:  rule.Storage,
+	}
+	// Try to edit the original message to replace the mxc:// URL
+	log.Printf("Attempting to edit original event %s to replace media URL", evt.ID.String())
+	mxc, err := h.sendMediaEdit(ctx, evt.RoomID, evt.Sender, evt.ID, msg, finalPath, mediaRef, mediaData)
+	if err != nil {
+		log.Printf("Failed to edit original message as user: %v", err)
+		return nil // Don't delete media if we couldn't edit the message
+	}
+
+	log.Printf("Successfully edited original message %s", evt.ID.String())
+	state := mediaState{Path: finalPath, FileName: finalFilename, MXC: mxc, Source: media.Source.String(), Encrypted: media.Encrypted, Storage: rule.Storage}
+	if originalPath := h.keepOriginal(ctx, rule, evt, msg, filename, mimeType, unstripped); originalPath != "" {
+		state.Originals = []string{originalPath}
+	}
+	h.storeMediaState(evt.RoomID, evt.ID, state)
+	if rule.Storage == "" {
+		h.shareToTalk(ctx, evt, msg, finalPath)
+	}
+
+	// Delete the original media from the Matrix homeserver to save disk space
+	// This happens after successful upload to Nextcloud and message replacement
+	h.deleteSourceMedia(ctx, media.Source)
+	return nil
+}
+
+// downloadedMedia is the attachment of a message after download and
+// decryption.
+type downloadedMedia struct {
+	Data      []byte
+	MimeType  string
+	Source    id.ContentURI // Where the media was downloaded from
+	Encrypted bool          // Source holds encrypted media
+}
+
+// fetchMedia downloads and, if needed, decrypts the attachment of msg and
+// applies the media filter. It returns nil without an error if the media is
+// skipped: filtered, already proxied or encrypted without E2EE support.
+func (h *MediaHandler) fetchMedia(ctx context.Context, evt *event.Event, msg *event.MessageEventContent, filename string, filter config.MediaFilter) (*downloadedMedia, error) {
 	var mediaData []byte
 	var parsedURL id.ContentURI
 	var mimeType string
@@ -85,7 +232,7 @@ func (h *MediaHandler) HandleMatrixEvent(ctx context.Context, as *appservice.App
 		// Encrypted media detected
 		if h.cryptoHelper == nil {
 			log.Printf("Skipping encrypted media (E2EE not enabled)")
-			return nil
+			return nil, nil
 		}
 
 		log.Printf("Processing encrypted media from %s", evt.Sender.String())
@@ -94,32 +241,36 @@ func (h *MediaHandler) HandleMatrixEvent(ctx context.Context, as *appservice.App
 		var err error
 		parsedURL, err = msg.File.URL.Parse()
 		if err != nil {
-			return fmt.Errorf("failed to parse encrypted media URL: %w", err)
+			return nil, fmt.Errorf("failed to parse encrypted media URL: %w", err)
 		}
 
 		// Download the encrypted file
 		client := h.as.BotClient()
 		encryptedResp, err := client.Download(ctx, parsedURL)
 		if err != nil {
-			return fmt.Errorf("failed to download encrypted media: %w", err)
+			return nil, fmt.Errorf("failed to download encrypted media: %w", err)
 		}
 		defer encryptedResp.Body.Close()
 
-		// Read encrypted data
-		encryptedData, err := io.ReadAll(encryptedResp.Body)
+		// Read encrypted data, which has the size of the decrypted file
+		encryptedData, tooLarge, err := readMedia(encryptedResp.Body, int64(filter.MaxSize))
 		if err != nil {
-			return fmt.Errorf("failed to read encrypted media: %w", err)
+			return nil, fmt.Errorf("failed to read encrypted media: %w", err)
+		}
+		if tooLarge {
+			h.skipFilteredMedia(ctx, evt, filter, fmt.Sprintf("the file is larger than %s", filter.MaxSize))
+			return nil, nil
 		}
 
 		// Prepare encryption info for decryption
 		if err := msg.File.PrepareForDecryption(); err != nil {
-			return fmt.Errorf("failed to prepare for decryption: %w", err)
+			return nil, fmt.Errorf("failed to prepare for decryption: %w", err)
 		}
 
 		// Decrypt the file
 		mediaData, err = msg.File.Decrypt(encryptedData)
 		if err != nil {
-			return fmt.Errorf("failed to decrypt media file: %w", err)
+			return nil, fmt.Errorf("failed to decrypt media file: %w", err)
 		}
 
 		log.Printf("Successfully decrypted media %s (%d bytes)", evt.ID.String(), len(mediaData))
@@ -132,37 +283,43 @@ func (h *MediaHandler) HandleMatrixEvent(ctx context.Context, as *appservice.App
 		// Unencrypted media
 		if msg.URL == "" {
 			log.Printf("Skipping media message without URL %s", evt.ID.String())
-			return nil
+			return nil, nil
 		}
 
 		var err error
 		parsedURL, err = msg.URL.Parse()
 		if err != nil {
-			return fmt.Errorf("failed to parse media URL: %w", err)
+			return nil, fmt.Errorf("failed to parse media URL: %w", err)
 		}
 
 		// Skip already-proxied media
-		if parsedURL.Homeserver == h.config.MediaProxy.ServerName {
-			if _, err := utils.DecodeMediaID(h.mediaIDSecret, parsedURL.FileID); err == nil {
-				log.Printf("Skipping already-proxied media %s (homeserver=%s)", evt.ID.String(), parsedURL.Homeserver)
-				return nil
-			}
-			log.Printf("Media URL homeserver matches proxy but media ID is not ours; continuing")
+		if h.isProxiedMedia(parsedURL) {
+			log.Printf("Skipping already-proxied media %s (homeserver=%s)", evt.ID.String(), parsedURL.Homeserver)
+			return nil, nil
 		}
 
 		// Download unencrypted media
-		client := as.BotClient()
+		client := h.as.BotClient()
 		log.Printf("Downloading media %s from %s", evt.ID.String(), msg.URL)
 		resp, err := client.Download(ctx, parsedURL)
 		if err != nil {
-			return fmt.Errorf("failed to download media: %w", err)
+			return nil, fmt.Errorf("failed to download media: %w", err)
 		}
 		defer resp.Body.Close()
+		if reason := filterReason(filter, newMediaAttributes(msg, filename, "", resp.ContentLength)); reason != "" {
+			h.skipFilteredMedia(ctx, evt, filter, reason)
+			return nil, nil
+		}
 
-		// Read media data
-		mediaData, err = io.ReadAll(resp.Body)
+		// Read media data. The Content-Length may be missing or wrong.
+		var tooLarge bool
+		mediaData, tooLarge, err = readMedia(resp.Body, int64(filter.MaxSize))
 		if err != nil {
-			return fmt.Errorf("failed to read media: %w", err)
+			return nil, fmt.Errorf("failed to read media: %w", err)
+		}
+		if tooLarge {
+			h.skipFilteredMedia(ctx, evt, filter, fmt.Sprintf("the file is larger than %s", filter.MaxSize))
+			return nil, nil
 		}
 
 		// Get MIME type from response or message
@@ -172,96 +329,72 @@ func (h *MediaHandler) HandleMatrixEvent(ctx context.Context, as *appservice.App
 		}
 	}
 
-	filename := msg.GetFileName()
-	if filename == "" {
-		filename = fmt.Sprintf("file_%d", time.Now().Unix())
-		log.Printf("Warning: No filename in message, using generated name: %s", filename)
+	filterMimeType := mimeType
+	if filterMimeType == "" {
+		filterMimeType = "application/octet-stream"
 	}
-	roomName := h.getRoomName(evt.RoomID)
-	roomSegment := utils.SanitizePathSegment(roomName)
-	userSegment := utils.SanitizePathSegment(utils.MatrixUserLocalpart(evt.Sender.String()))
-	fileSegment := utils.SanitizePathSegment(filename)
-
-	log.Printf("Template variables: room=%s, user=%s, file=%s", roomSegment, userSegment, fileSegment)
-
-	// Render the path template with sanitized values
-	eventTime := time.UnixMilli(evt.Timestamp).UTC()
-	nextcloudPath := utils.RenderPathTemplate(pathTemplate, roomSegment, userSegment, fileSegment, eventTime)
-	log.Printf("Uploading to Nextcloud path %s", nextcloudPath)
-	if err := h.nextcloud.EnsureDirectories(nextcloudPath); err != nil {
-		return fmt.Errorf("failed to create directories: %w", err)
+	if reason := filterReason(filter, newMediaAttributes(msg, filename, filterMimeType, int64(len(mediaData)))); reason != "" {
+		h.skipFilteredMedia(ctx, evt, filter, reason)
+		return nil, nil
 	}
+	return &downloadedMedia{Data: mediaData, MimeType: mimeType, Source: parsedURL, Encrypted: msg.File != nil}, nil
+}
 
-	finalPath := nextcloudPath
-	finalFilename := filename
-	uploadNeeded := true
-	contentLength := int64(len(mediaData))
+// readMedia reads a download of at most maxSize bytes, or without a limit if
+// maxSize is 0. It stops reading one byte after maxSize and reports the media
+// as too large, so oversized media is never buffered in full.
+func readMedia(body io.Reader, maxSize int64) ([]byte, bool, error) {
+	if maxSize <= 0 {
+		data, err := io.ReadAll(body)
+		return data, false, err
+	}
+	data, err := io.ReadAll(io.LimitReader(body, maxSize+1))
+	if err != nil {
+		return nil, false, err
+	}
+	return data, int64(len(data)) > maxSize, nil
+}
 
-	if exists, size, err := h.nextcloud.Stat(nextcloudPath); err != nil {
-		return fmt.Errorf("failed to check existing file: %w", err)
-	} else if exists {
-		if contentLength > 0 && size == contentLength {
-			log.Printf("Nextcloud file already exists with matching size, reusing path %s", nextcloudPath)
-			uploadNeeded = false
-		} else {
-			for i := 1; i <= 1000; i++ {
-				candidatePath, candidateName := addCounterSuffix(nextcloudPath, i)
-				exists, _, err := h.nextcloud.Stat(candidatePath)
-				if err != nil {
-					return fmt.Errorf("failed to check existing file: %w", err)
-				}
-				if !exists {
-					finalPath = candidatePath
-					finalFilename = candidateName
-					log.Printf("Nextcloud file exists, using new path %s", finalPath)
-					break
-				}
-			}
-			if finalPath == nextcloudPath {
-				return fmt.Errorf("failed to find available filename for %s", nextcloudPath)
-			}
-		}
+// isProxiedMedia reports whether a media URL points at a file already served
+// by the media proxy.
+func (h *MediaHandler) isProxiedMedia(uri id.ContentURI) bool {
+	if uri.Homeserver != h.config.MediaProxy.ServerName {
+		return false
 	}
-	if uploadNeeded {
-		// Upload from mediaData byte array
-		mediaReader := strings.NewReader(string(mediaData))
-		if err := h.nextcloud.UploadReader(finalPath, mediaReader, contentLength); err != nil {
-			return fmt.Errorf("failed to upload to nextcloud: %w", err)
-		}
+	if _, err := utils.DecodeMediaID(h.mediaIDSecret, uri.FileID); err != nil {
+		log.Printf("Media URL homeserver matches proxy but media ID is not ours; continuing")
+		return false
 	}
+	return true
+}
 
-	mediaID, err := utils.EncodeMediaID(h.mediaIDSecret, utils.MediaRef{
-		Path:     strings.TrimLeft(finalPath, "/"),
-		FileName: finalFilename,
-		MimeType: mimeType,
-	})
+// sendMediaEdit edits the target event as the sender so that it points at the
+// archived file served by the media proxy. It returns the proxy mxc:// URL.
+func (h *MediaHandler) sendMediaEdit(ctx context.Context, roomID id.RoomID, sender id.UserID, target id.EventID, msg *event.MessageEventContent, finalPath string, mediaRef utils.MediaRef, mediaData []byte) (string, error) {
+	mediaID, err := utils.EncodeMediaID(h.mediaIDSecret, mediaRef)
 	if err != nil {
-		return fmt.Errorf("failed to create media id: %w", err)
+		return "", fmt.Errorf("failed to create media id: %w", err)
 	}
 
 	mxc := id.ContentURI{Homeserver: h.config.MediaProxy.ServerName, FileID: mediaID}.String()
+	contentLength := int64(len(mediaData))
 
 	newInfo := msg.Info
 	if newInfo == nil {
 		newInfo = &event.FileInfo{}
 	}
-	newInfo.MimeType = mimeType
+	newInfo.MimeType = mediaRef.MimeType
 	if contentLength > 0 {
 		newInfo.Size = int(contentLength)
 	}
+	h.fillMediaInfo(newInfo, mediaData, mediaRef.MimeType, mediaRef)
 
 	// Generate Nextcloud web link if configured
-	var nextcloudLink string
-	if h.config.Nextcloud.WebURL != "" && !h.config.Nextcloud.DisableWebLink {
-		nextcloudLink = utils.GenerateNextcloudWebLink(h.config.Nextcloud.WebURL, finalPath)
-	}
-
-	// Try to edit the original message to replace the mxc:// URL
-	log.Printf("Attempting to edit original event %s to replace media URL", evt.ID.String())
+	nextcloudLink := h.webLink(mediaRef.Storage, finalPath)
 
 	// Prepare message bodies with optional Nextcloud link
 	editedBody := msg.Body
-	if editedBody == filename {
+	if editedBody == msg.GetFileName() {
 		editedBody = ""
 	}
 	if nextcloudLink != "" {
@@ -271,45 +404,62 @@ func (h *MediaHandler) HandleMatrixEvent(ctx context.Context, as *appservice.App
 	editContent := &event.MessageEventContent{
 		MsgType:  msg.MsgType,
 		Body:     "* " + editedBody, // Fallback for clients that don't support edits
-		FileName: finalFilename,
+		FileName: mediaRef.FileName,
 		URL:      id.ContentURIString(mxc),
 		Info:     newInfo,
 		RelatesTo: &event.RelatesTo{
 			Type:    event.RelReplace,
-			EventID: evt.ID,
+			EventID: target,
 		},
 		NewContent: &event.MessageEventContent{
 			MsgType:  msg.MsgType,
 			Body:     editedBody,
-			FileName: finalFilename,
+			FileName: mediaRef.FileName,
 			URL:      id.ContentURIString(mxc),
 			Info:     newInfo,
 		},
 	}
 
 	// Try to send as the original user (this might fail if we don't have permission)
-	intent := h.as.Intent(evt.Sender)
-	_, err = intent.SendMessageEvent(ctx, evt.RoomID, event.EventMessage, editContent)
-	if err != nil {
-		log.Printf("Failed to edit original message as user: %v", err)
-		return nil // Don't delete media if we couldn't edit the message
+	intent := h.as.Intent(sender)
+	if _, err := intent.SendMessageEvent(ctx, roomID, event.EventMessage, editContent); err != nil {
+		return "", err
 	}
+	return mxc, nil
+}
 
-	log.Printf("Successfully edited original message %s", evt.ID.String())
-	h.storeMediaState(evt.RoomID, evt.ID, finalPath, finalFilename, mxc)
-
-	// Delete the original media from the Matrix homeserver to save disk space
-	// This happens after successful upload to Nextcloud and message replacement
-	if h.config.Matrix.Admin.Enabled {
-		log.Printf("Deleting original media %s from homeserver %s", parsedURL.FileID, parsedURL.Homeserver)
-		if err := h.deleteLocalMedia(ctx, parsedURL.Homeserver, parsedURL.FileID); err != nil {
-			// Log error but don't fail the entire operation
-			// The media is already in Nextcloud and the message was edited successfully
-			log.Printf("Warning: failed to delete media from homeserver: %v", err)
+// webLink returns the link to a file in the web interface of the Nextcloud
+// storing it, or an empty string if links are disabled or the storage has no
+// web interface.
+func (h *MediaHandler) webLink(storage, filePath string) string {
+	if h.config.Nextcloud.DisableWebLink {
+		return ""
+	}
+	webURL := h.config.Nextcloud.WebURL
+	if storage != "" {
+		webURL = ""
+		if storageConfig := h.config.Storages[storage]; storageConfig.Type == config.StorageNextcloud {
+			webURL = storageConfig.WebURL
 		}
 	}
+	if webURL == "" {
+		return ""
+	}
+	return utils.GenerateNextcloudWebLink(webURL, filePath)
+}
 
-	return nil
+// deleteSourceMedia deletes media that has been archived from the Matrix
+// homeserver if the admin API is enabled.
+func (h *MediaHandler) deleteSourceMedia(ctx context.Context, source id.ContentURI) {
+	if !h.config.Matrix.Admin.Enabled {
+		return
+	}
+	log.Printf("Deleting original media %s from homeserver %s", source.FileID, source.Homeserver)
+	if err := h.deleteLocalMedia(ctx, source.Homeserver, source.FileID); err != nil {
+		// Log error but don't fail the entire operation
+		// The media is already in Nextcloud and the message was edited successfully
+		log.Printf("Warning: failed to delete media from homeserver: %v", err)
+	}
 }
 
 func (h *MediaHandler) handleRedactionEvent(ctx context.Context, as *appservice.AppService, evt *event.Event) error {
@@ -331,18 +481,25 @@ func (h *MediaHandler) handleRedactionEvent(ctx context.Context, as *appservice.
 	}
 	log.Printf("Redaction event %s targets %s", evt.ID.String(), redacts.String())
 
-	return h.deleteFromStateEvent(as, evt.RoomID, redacts)
+	return h.applyRedactionPolicy(ctx, evt, redacts)
 }
 
 type mediaState struct {
-	Path      string `json:"path"`
-	FileName  string `json:"filename,omitempty"`
-	MXC       string `json:"mxc,omitempty"`
-	Signature string `json:"signature"`
+	Path     string `json:"path"`
+	FileName string `json:"filename,omitempty"`
+	MXC      string `json:"mxc,omitempty"`
+	// Source is the homeserver mxc:// URL the archived media was downloaded
+	// from, used to recognise edits that keep the attachment.
+	Source    string `json:"source,omitempty"`
+	Encrypted bool   `json:"encrypted,omitempty"` // Source holds encrypted media
+	Storage   string `json:"storage,omitempty"`   // Storage backend holding the file, empty for Nextcloud
+	// Originals are the untouched images kept next to the stripped file by
+	// strip_metadata.originals_template, one per archived version.
+	Originals []string `json:"originals,omitempty"`
+	Signature string   `json:"signature"`
 }
 
-func (h *MediaHandler) storeMediaState(roomID id.RoomID, eventID id.EventID, filePath, filename, mxc string) {
-	content := mediaState{Path: filePath, FileName: filename, MXC: mxc}
+func (h *MediaHandler) storeMediaState(roomID id.RoomID, eventID id.EventID, content mediaState) {
 	if signature, err := h.signMediaState(content); err != nil {
 		log.Printf("Failed to sign Nextcloud state for event %s: %v", eventID.String(), err)
 		return
@@ -351,36 +508,57 @@ func (h *MediaHandler) storeMediaState(roomID id.RoomID, eventID id.EventID, fil
 	}
 	if _, err := h.as.BotClient().SendStateEvent(context.Background(), roomID, nextcloudMediaStateEvent, eventID.String(), content); err != nil {
 		log.Printf("Failed to store Nextcloud state for event %s: %v", eventID.String(), err)
+		return
 	}
+	h.mappings.put(storedMapping{RoomID: roomID, EventID: eventID, State: content, Timestamp: time.Now()})
 }
 
-func (h *MediaHandler) deleteFromStateEvent(as *appservice.AppService, roomID id.RoomID, eventID id.EventID) error {
-	client := as.BotClient()
+// clearMediaState removes the mapping of an event whose file is gone, by
+// replacing it with an empty state event.
+func (h *MediaHandler) clearMediaState(ctx context.Context, roomID id.RoomID, eventID id.EventID) {
+	if _, err := h.as.BotClient().SendStateEvent(ctx, roomID, nextcloudMediaStateEvent, eventID.String(), struct{}{}); err != nil {
+		log.Printf("Failed to clear Nextcloud state for event %s: %v", eventID.String(), err)
+		return
+	}
+	h.mappings.remove(roomID, eventID)
+}
+
+// loadMediaState returns the verified mapping stored for an event.
+func (h *MediaHandler) loadMediaState(roomID id.RoomID, eventID id.EventID) (mediaState, bool) {
 	var state mediaState
-	if err := client.StateEvent(context.Background(), roomID, nextcloudMediaStateEvent, eventID.String(), &state); err != nil {
+	if err := h.as.BotClient().StateEvent(context.Background(), roomID, nextcloudMediaStateEvent, eventID.String(), &state); err != nil {
 		log.Printf("No stored Nextcloud state for event %s: %v", eventID.String(), err)
-		return nil
+		return state, false
 	}
 	if state.Path == "" {
 		log.Printf("Stored Nextcloud state for event %s missing path", eventID.String())
-		return nil
+		return state, false
 	}
 	if state.Signature == "" {
 		log.Printf("Stored Nextcloud state for event %s missing signature", eventID.String())
-		return nil
+		return state, false
 	}
 	if ok, err := h.verifyMediaState(state); err != nil {
 		log.Printf("Failed to verify Nextcloud state for event %s: %v", eventID.String(), err)
-		return nil
+		return state, false
 	} else if !ok {
 		log.Printf("Invalid Nextcloud state signature for event %s", eventID.String())
-		return nil
+		return state, false
 	}
-	if err := h.nextcloud.DeleteFile(state.Path); err != nil {
-		return fmt.Errorf("failed to delete Nextcloud file %s: %w", state.Path, err)
+	return state, true
+}
+
+// currentPath returns where a file stored on the named storage is now,
+// following recorded folder moves if the file is no longer at its original
+// path.
+func (h *MediaHandler) currentPath(ctx context.Context, name string, storage Storage, filePath string) string {
+	if moved := h.moves.Resolve(name, filePath); moved != filePath {
+		if exists, _, err := storage.Stat(ctx, filePath); err == nil && !exists {
+			log.Printf("File %s was moved to %s", filePath, moved)
+			return moved
+		}
 	}
-	log.Printf("Deleted Nextcloud file %s for redacted event %s using stored state", state.Path, eventID.String())
-	return nil
+	return filePath
 }
 
 func (h *MediaHandler) signMediaState(state mediaState) (string, error) {
@@ -409,20 +587,134 @@ func (h *MediaHandler) getRoomName(roomID id.RoomID) string {
 	return strings.TrimPrefix(roomID.String(), "!")
 }
 
-func addCounterSuffix(remotePath string, counter int) (string, string) {
-	dir := path.Dir(remotePath)
-	base := path.Base(remotePath)
-	ext := path.Ext(base)
-	name := strings.TrimSuffix(base, ext)
-	newBase := fmt.Sprintf("%s_%d%s", name, counter, ext)
-	if dir == "." {
-		return newBase, newBase
+// roomVariables returns the template variables describing the room. The room
+// name falls back to the canonical alias and then the room ID.
+func (h *MediaHandler) roomVariables(ctx context.Context, template *utils.PathTemplate, roomID id.RoomID) map[string]string {
+	vars := map[string]string{
+		"room":    h.getRoomName(roomID),
+		"room_id": h.getRoomName(roomID),
+	}
+	if template.Uses("room_alias") || template.Uses("room_name") {
+		vars["room_alias"] = h.rooms.CanonicalAlias(ctx, roomID)
 	}
-	newPath := path.Join(dir, newBase)
-	if strings.HasPrefix(remotePath, "/") && !strings.HasPrefix(newPath, "/") {
-		newPath = "/" + newPath
+	if template.Uses("room_name") {
+		vars["room_name"] = roomDisplayName(h.rooms.RoomName(ctx, roomID), vars["room_alias"], vars["room_id"])
+	}
+	return vars
+}
+
+func roomDisplayName(name, alias, roomID string) string {
+	if name != "" {
+		return name
+	}
+	if alias != "" {
+		return alias
+	}
+	return roomID
+}
+
+// templateVariables collects the values for a path template. Variables that
+// need extra homeserver requests are only looked up if the template uses them.
+func (h *MediaHandler) templateVariables(ctx context.Context, template *utils.PathTemplate, evt *event.Event, msg *event.MessageEventContent, filename, mimeType string, mediaData []byte) map[string]string {
+	vars := utils.TimeTemplateVariables(time.UnixMilli(evt.Timestamp))
+	for key, value := range utils.FileTemplateVariables(filename) {
+		vars[key] = value
+	}
+	for key, value := range h.roomVariables(ctx, template, evt.RoomID) {
+		vars[key] = value
+	}
+	vars["user"] = utils.MatrixUserLocalpart(evt.Sender.String())
+	vars["sender_server"] = evt.Sender.Homeserver()
+	vars["msgtype"] = strings.TrimPrefix(string(msg.MsgType), "m.")
+	vars["mimetype_major"], _, _ = strings.Cut(mimeType, "/")
+	vars["event_id"] = strings.TrimPrefix(evt.ID.String(), "$")
+	if template.Uses("hash8") {
+		sum := sha256.Sum256(mediaData)
+		vars["hash8"] = hex.EncodeToString(sum[:])[:8]
+	}
+	if template.Uses("displayname") {
+		vars["displayname"] = h.rooms.DisplayName(ctx, evt.RoomID, evt.Sender)
+		if vars["displayname"] == "" {
+			vars["displayname"] = vars["user"]
+		}
+	}
+	return vars
+}
+
+// uploadNameAttempts is how often uploadMedia picks a new name when another
+// upload took the chosen one first.
+const uploadNameAttempts = 5
+
+// uploadMedia uploads data to remotePath of the named storage, creating
+// missing folders. An existing file with the same content is reused,
+// otherwise the conflict strategy of naming picks another name or replaces
+// the file. It returns the final path and file name and whether an existing
+// file was reused, or an error wrapping ErrInsufficientStorage if the data
+// does not fit into the quota.
+func (h *MediaHandler) uploadMedia(ctx context.Context, name string, storage Storage, remotePath, filename string, data []byte, naming conflictNaming) (string, string, bool, error) {
+	if err := h.quota.Check(ctx, name, int64(len(data))); err != nil {
+		return "", "", false, err
+	}
+	if err := storage.EnsureDirectories(ctx, remotePath); err != nil {
+		return "", "", false, fmt.Errorf("failed to create directories: %w", err)
+	}
+	contentLength := int64(len(data))
+
+	// Files kept after a redaction are not served, so they are not replaced
+	if naming.strategy == config.ConflictOverwrite && !h.revoked.IsRevoked(name, remotePath) {
+		err := storage.UploadReader(ctx, remotePath, bytes.NewReader(data), contentLength)
+		h.quota.Uploaded(name, contentLength, err)
+		if err != nil {
+			return "", "", false, uploadError(err)
+		}
+		return remotePath, filename, false, nil
+	}
+
+	finalPath := remotePath
+	finalFilename := filename
+	exists, reuse, err := h.storedCopy(ctx, name, storage, remotePath, data)
+	if err != nil {
+		return "", "", false, err
+	}
+	if exists && !reuse {
+		if finalPath, finalFilename, reuse, err = h.conflictPath(ctx, name, storage, remotePath, data, naming); err != nil {
+			return "", "", false, err
+		}
+	}
+	if reuse {
+		log.Printf("File already exists with the same content, reusing path %s", finalPath)
+		return finalPath, finalFilename, true, nil
+	}
+	if exists {
+		log.Printf("File exists, using new path %s", finalPath)
+	}
+	// Upload from the data byte array. The name is only taken when the upload
+	// is complete, so a concurrent upload may have taken it in the meantime.
+	err = storage.CreateFile(ctx, finalPath, bytes.NewReader(data), contentLength)
+	for attempt := 1; errors.Is(err, ErrExists) && attempt < uploadNameAttempts; attempt++ {
+		takenPath := finalPath
+		if finalPath, finalFilename, reuse, err = h.conflictPath(ctx, name, storage, remotePath, data, naming); err != nil {
+			return "", "", false, err
+		}
+		if reuse {
+			log.Printf("%s was stored by another upload of the same file, reusing path %s", takenPath, finalPath)
+			return finalPath, finalFilename, true, nil
+		}
+		log.Printf("%s was taken by another upload, using new path %s", takenPath, finalPath)
+		err = storage.CreateFile(ctx, finalPath, bytes.NewReader(data), contentLength)
+	}
+	h.quota.Uploaded(name, contentLength, err)
+	if err != nil {
+		return "", "", false, uploadError(err)
+	}
+	return finalPath, finalFilename, false, nil
+}
+
+func uploadError(err error) error {
+	if errors.Is(err, ErrInsufficientStorage) {
+		return fmt.Errorf("failed to upload file, the storage quota is exceeded: %w", err)
 	}
-	return newPath, newBase
+	return fmt.Errorf("failed to upload file: %w", err)
 }
 
 // deleteLocalMedia deletes media from the Matrix homeserver using Synapse admin API
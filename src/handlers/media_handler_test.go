@@ -1,9 +1,12 @@
 package handlers
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
+	"image"
+	"image/jpeg"
 	"io"
 	"net/http"
 	"net/http/httptest"
@@ -11,7 +14,6 @@ import (
 	"testing"
 	"time"
 
-	"maunium.net/go/mautrix/appservice"
 	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/id"
 
@@ -25,22 +27,17 @@ func TestHandleMatrixEvent(t *testing.T) {
 		roomID    = "!roomid:example.com"
 	)
 
-	var uploadedPath string
+	uploads := newFakeUploads()
 	var sentContent event.MessageEventContent
 
 	// Fake Nextcloud server
 	nt := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if uploads.serve(w, r) {
+			return
+		}
 		switch r.Method {
 		case "MKCOL":
 			w.WriteHeader(http.StatusCreated)
-		case "PUT":
-			uploadedPath = r.URL.Path
-			body, _ := io.ReadAll(r.Body)
-			_ = r.Body.Close()
-			if string(body) != mediaBody {
-				t.Fatalf("unexpected upload body: %s", string(body))
-			}
-			w.WriteHeader(http.StatusCreated)
 		default:
 			w.WriteHeader(http.StatusNotFound)
 		}
@@ -86,33 +83,14 @@ func TestHandleMatrixEvent(t *testing.T) {
 	}))
 	defer mt.Close()
 
-	registration := &appservice.Registration{
-		ID:              "nextcloud-media-bridge",
-		URL:             "http://localhost",
-		AppToken:        "app_token",
-		ServerToken:     "server_token",
-		SenderLocalpart: "bridge",
-	}
-
-	as, err := appservice.CreateFull(appservice.CreateOpts{
-		Registration:     registration,
-		HomeserverDomain: "example.com",
-		HomeserverURL:    mt.URL,
-		HostConfig:       appservice.HostConfig{Hostname: "127.0.0.1", Port: 0},
-	})
-	if err != nil {
-		t.Fatalf("failed to create appservice: %v", err)
-	}
-
 	cfg := &config.Config{}
 	cfg.Nextcloud.BaseURL = nt.URL
 	cfg.Nextcloud.Username = "testuser"
 	cfg.Nextcloud.Password = "testpass"
 	cfg.Matrix.RoomPathTemplate = map[string]string{roomID: "/media/${year}/ostsee/${user}/${file}"}
 	cfg.MediaProxy.ServerName = "media.example.com"
-	secret := []byte("secret")
 
-	handler := NewMediaHandler(cfg, NewNextcloudClient(cfg.Nextcloud.BaseURL, cfg.Nextcloud.Username, cfg.Nextcloud.Password), secret, as)
+	handler := newTestHandler(t, cfg, mt.URL, NewStorages(NewNextcloudClient(cfg.Nextcloud.BaseURL, cfg.Nextcloud.Username, cfg.Nextcloud.Password)))
 
 	content := event.MessageEventContent{
 		MsgType: event.MsgImage,
@@ -133,7 +111,7 @@ func TestHandleMatrixEvent(t *testing.T) {
 		},
 	}
 
-	if err := handler.HandleMatrixEvent(context.Background(), as, evt); err != nil {
+	if err := handler.HandleMatrixEvent(context.Background(), handler.as, evt); err != nil {
 		t.Fatalf("HandleMatrixEvent failed: %v", err)
 	}
 
@@ -144,7 +122,7 @@ func TestHandleMatrixEvent(t *testing.T) {
 		t.Fatalf("unexpected proxy url: %s", sentContent.URL)
 	}
 
-	decoded, err := utils.DecodeMediaID(secret, strings.TrimPrefix(string(sentContent.URL), "mxc://media.example.com/"))
+	decoded, err := utils.DecodeMediaID(testSecret, strings.TrimPrefix(string(sentContent.URL), "mxc://media.example.com/"))
 	if err != nil {
 		t.Fatalf("failed to decode proxy url: %v", err)
 	}
@@ -152,7 +130,259 @@ func TestHandleMatrixEvent(t *testing.T) {
 		t.Fatalf("unexpected decoded filename: %s", decoded.FileName)
 	}
 
-	if !strings.Contains(uploadedPath, fmt.Sprintf("/media/%d/ostsee/alice/image.jpg", eventTime.Year())) {
-		t.Fatalf("unexpected upload path: %s", uploadedPath)
+	uploadedPath := fmt.Sprintf("/media/%d/ostsee/alice/image.jpg", eventTime.Year())
+	if paths := uploads.paths(); len(paths) != 1 || paths[0] != uploadedPath {
+		t.Fatalf("unexpected upload paths: %v", paths)
+	}
+	if body := uploads.file(uploadedPath); body != mediaBody {
+		t.Fatalf("unexpected upload body: %s", body)
+	}
+}
+
+func TestHandleMatrixEventNextcloudTarget(t *testing.T) {
+	const roomID = "!finance:example.com"
+
+	// Fake Nextcloud servers of the default account and the room's target
+	uploads := map[string]*fakeUploads{"primary": newFakeUploads(), "finance": newFakeUploads()}
+	fakeNextcloud := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if user, _, _ := r.BasicAuth(); user != name {
+				t.Errorf("unexpected user %s on %s", user, name)
+			}
+			if uploads[name].serve(w, r) {
+				return
+			}
+			switch r.Method {
+			case "MKCOL":
+				w.WriteHeader(http.StatusCreated)
+			default:
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}))
+	}
+	primary := fakeNextcloud("primary")
+	defer primary.Close()
+	finance := fakeNextcloud("finance")
+	defer finance.Close()
+
+	var sentContent event.MessageEventContent
+	mt := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.Contains(r.URL.Path, "/media/download/"):
+			_, _ = w.Write([]byte("report"))
+		case strings.Contains(r.URL.Path, "/send/m.room.message/"):
+			payload, _ := io.ReadAll(r.Body)
+			_ = json.Unmarshal(payload, &sentContent)
+			_, _ = w.Write([]byte(`{"event_id":"$edit"}`))
+		default:
+			_, _ = w.Write([]byte(`{}`))
+		}
+	}))
+	defer mt.Close()
+
+	cfg := &config.Config{}
+	cfg.Nextcloud.BaseURL = primary.URL
+	cfg.Nextcloud.Username = "primary"
+	cfg.Nextcloud.WebURL = "https://cloud.example.com"
+	cfg.Storages = map[string]config.StorageConfig{
+		"finance": {Type: config.StorageNextcloud, URL: finance.URL, Username: "finance", Password: "pass", WebURL: "https://finance.example.com"},
+	}
+	cfg.Matrix.RoomRules = []config.RoomRule{{Room: roomID, Template: "/reports/${file}", Storage: "finance"}}
+	cfg.MediaProxy.ServerName = "media.example.com"
+
+	storages, err := OpenStorages(cfg, NewNextcloudClient(cfg.Nextcloud.BaseURL, cfg.Nextcloud.Username, "pass"))
+	if err != nil {
+		t.Fatalf("OpenStorages failed: %v", err)
+	}
+	handler := newTestHandler(t, cfg, mt.URL, storages)
+
+	raw, _ := json.Marshal(event.MessageEventContent{MsgType: event.MsgFile, Body: "q1.pdf", URL: "mxc://example.com/q1", Info: &event.FileInfo{MimeType: "application/pdf"}})
+	evt := &event.Event{
+		Type:      event.EventMessage,
+		RoomID:    id.RoomID(roomID),
+		ID:        id.EventID("$report"),
+		Sender:    id.UserID("@alice:example.com"),
+		Timestamp: time.Now().UnixMilli(),
+		Content:   event.Content{VeryRaw: raw},
+	}
+	if err := handler.HandleMatrixEvent(context.Background(), handler.as, evt); err != nil {
+		t.Fatalf("HandleMatrixEvent failed: %v", err)
+	}
+
+	if paths := uploads["primary"].paths(); len(paths) != 0 {
+		t.Fatalf("file was uploaded to the default Nextcloud: %v", paths)
+	}
+	if paths := uploads["finance"].paths(); len(paths) != 1 || paths[0] != "/reports/q1.pdf" {
+		t.Fatalf("unexpected upload to the target: %v", paths)
+	}
+	ref, err := utils.DecodeMediaID(testSecret, strings.TrimPrefix(string(sentContent.URL), "mxc://media.example.com/"))
+	if err != nil {
+		t.Fatalf("failed to decode proxy url: %v", err)
+	}
+	if ref.Storage != "finance" {
+		t.Fatalf("expected media ID to record the target, got %q", ref.Storage)
+	}
+	if !strings.Contains(sentContent.Body, "https://finance.example.com/") {
+		t.Fatalf("expected a link to the target's web interface: %s", sentContent.Body)
+	}
+}
+
+func TestHandleMatrixEventKeepsOriginalOnceArchived(t *testing.T) {
+	const roomID = "!roomid:example.com"
+	var encoded bytes.Buffer
+	if err := jpeg.Encode(&encoded, image.NewGray(image.Rect(0, 0, 2, 2)), nil); err != nil {
+		t.Fatalf("failed to encode: %v", err)
+	}
+	// A comment segment, which stripping removes
+	comment := "GPS! 54.3N 10.1E"
+	photo := append([]byte{0xFF, 0xD8, 0xFF, 0xFE, 0, byte(len(comment) + 2)}, comment...)
+	photo = append(photo, encoded.Bytes()[2:]...)
+
+	uploads := newFakeUploads()
+	nt := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if uploads.serve(w, r) {
+			return
+		}
+		switch r.Method {
+		case "MKCOL":
+			w.WriteHeader(http.StatusCreated)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer nt.Close()
+
+	editFails := true
+	var storedState mediaState
+	mt := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.Contains(r.URL.Path, "/media/download/"):
+			_, _ = w.Write(photo)
+		case strings.Contains(r.URL.Path, "/send/m.room.message/") && editFails:
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte(`{"errcode":"M_FORBIDDEN","error":"not allowed"}`))
+		case strings.Contains(r.URL.Path, "/send/m.room.message/"):
+			_, _ = w.Write([]byte(`{"event_id":"$edit"}`))
+		case strings.Contains(r.URL.Path, "/state/com.nextcloud-media-bridge.media/"):
+			_ = json.NewDecoder(r.Body).Decode(&storedState)
+			_, _ = w.Write([]byte(`{"event_id":"$state"}`))
+		default:
+			_, _ = w.Write([]byte(`{}`))
+		}
+	}))
+	defer mt.Close()
+
+	enabled := true
+	cfg := &config.Config{}
+	cfg.Matrix.RoomPathTemplate = map[string]string{roomID: "/media/${file}"}
+	cfg.Matrix.StripMetadata = config.MetadataStripping{Enabled: &enabled, OriginalsTemplate: "/originals/${file}"}
+	cfg.MediaProxy.ServerName = "media.example.com"
+	handler := newTestHandler(t, cfg, mt.URL, NewStorages(NewNextcloudClient(nt.URL, "user", "pass")))
+
+	raw, _ := json.Marshal(event.MessageEventContent{MsgType: event.MsgImage, Body: "photo.jpg", URL: "mxc://example.com/photo", Info: &event.FileInfo{MimeType: "image/jpeg"}})
+	evt := &event.Event{
+		Type:      event.EventMessage,
+		RoomID:    roomID,
+		ID:        "$photo",
+		Sender:    "@alice:example.com",
+		Timestamp: time.Now().UnixMilli(),
+		Content:   event.Content{VeryRaw: raw},
+	}
+	if err := handler.HandleMatrixEvent(context.Background(), handler.as, evt); err != nil {
+		t.Fatalf("HandleMatrixEvent failed: %v", err)
+	}
+	// No mapping records the original, so it must not be stored
+	if paths := uploads.paths(); len(paths) != 1 || paths[0] != "/media/photo.jpg" {
+		t.Fatalf("expected only the stripped file after the edit failed, got %v", paths)
+	}
+	if strings.Contains(uploads.file("/media/photo.jpg"), "GPS!") {
+		t.Fatalf("metadata was not stripped")
+	}
+
+	editFails = false
+	uploads = newFakeUploads()
+	if err := handler.HandleMatrixEvent(context.Background(), handler.as, evt); err != nil {
+		t.Fatalf("HandleMatrixEvent failed: %v", err)
+	}
+	if uploads.file("/originals/photo.jpg") != string(photo) {
+		t.Fatalf("expected the original to be kept, got %v", uploads.paths())
+	}
+	if len(storedState.Originals) != 1 || storedState.Originals[0] != "/originals/photo.jpg" {
+		t.Fatalf("expected the mapping to record the original, got %+v", storedState)
+	}
+}
+
+// racingStorage stores another file at the path of the first new file just
+// before it is created, like a concurrent upload picking the same name.
+type racingStorage struct {
+	Storage
+	raced bool
+}
+
+func (s *racingStorage) CreateFile(ctx context.Context, remotePath string, reader io.Reader, contentLength int64) error {
+	if !s.raced {
+		s.raced = true
+		if err := s.Storage.UploadReader(ctx, remotePath, strings.NewReader("other"), 5); err != nil {
+			return err
+		}
+	}
+	return s.Storage.CreateFile(ctx, remotePath, reader, contentLength)
+}
+
+func TestUploadMediaPicksNewNameAfterRace(t *testing.T) {
+	disk, err := NewLocalStorage(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage := &racingStorage{Storage: disk}
+	handler := &MediaHandler{}
+
+	finalPath, finalFilename, _, err := handler.uploadMedia(context.Background(), "disk", storage, "media/photo.jpg", "photo.jpg", []byte("photo"), conflictNaming{strategy: config.ConflictCounter})
+	if err != nil {
+		t.Fatalf("uploadMedia failed: %v", err)
+	}
+	if finalPath != "media/photo_1.jpg" || finalFilename != "photo_1.jpg" {
+		t.Fatalf("unexpected path %s (%s)", finalPath, finalFilename)
+	}
+	if data := readStored(t, disk, "media/photo.jpg"); data != "other" {
+		t.Fatalf("the other upload was overwritten: %q", data)
+	}
+	if data := readStored(t, disk, finalPath); data != "photo" {
+		t.Fatalf("unexpected content: %q", data)
+	}
+}
+
+// endlessReader returns zero bytes forever.
+type endlessReader struct{}
+
+func (endlessReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+func TestFetchMediaStopsAtMaxSize(t *testing.T) {
+	if _, tooLarge, err := readMedia(endlessReader{}, 1000); err != nil || !tooLarge {
+		t.Fatalf("expected an endless body to be too large, got %v: %v", tooLarge, err)
+	}
+
+	mt := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Streamed without a Content-Length
+		for i := 0; i < 100; i++ {
+			_, _ = w.Write(make([]byte, 1000))
+			w.(http.Flusher).Flush()
+		}
+	}))
+	defer mt.Close()
+	cfg := &config.Config{}
+	handler := newTestHandler(t, cfg, mt.URL, NewStorages(NewNextcloudClient("http://nextcloud.invalid", "user", "pass")))
+
+	evt := &event.Event{ID: "$large", RoomID: "!roomid:example.com", Sender: "@alice:example.com"}
+	msg := &event.MessageEventContent{MsgType: event.MsgFile, Body: "large.bin", URL: "mxc://example.com/large"}
+	media, err := handler.fetchMedia(context.Background(), evt, msg, "large.bin", config.MediaFilter{MaxSize: 10000})
+	if err != nil || media != nil {
+		t.Fatalf("expected media above max_size to be skipped, got %v: %v", media, err)
+	}
+	if media, err = handler.fetchMedia(context.Background(), evt, msg, "large.bin", config.MediaFilter{}); err != nil || len(media.Data) != 100000 {
+		t.Fatalf("expected media without max_size to be read, got %v", err)
 	}
 }
@@ -0,0 +1,57 @@
+package handlers
+
+import (
+	"log"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"nextcloud-media-bridge/src/utils"
+)
+
+// fillMediaInfo adds the dimensions, blurhash and duration of the archived
+// file where the sender did not provide them, and links a thumbnail rendered
+// by the proxy for images larger than the thumbnail size.
+func (h *MediaHandler) fillMediaInfo(info *event.FileInfo, mediaData []byte, mimeType string, ref utils.MediaRef) {
+	analysis := utils.AnalyzeMedia(mediaData, mimeType)
+	if info.Width == 0 || info.Height == 0 {
+		if analysis.Width > 0 && analysis.Height > 0 {
+			info.Width, info.Height = analysis.Width, analysis.Height
+		}
+	}
+	if analysis.BlurHash != "" {
+		if info.Blurhash == "" {
+			info.Blurhash = analysis.BlurHash
+		}
+		if info.AnoaBlurhash == "" {
+			info.AnoaBlurhash = analysis.BlurHash
+		}
+	}
+	if info.Duration == 0 && analysis.Duration > 0 {
+		info.Duration = int(analysis.Duration.Milliseconds())
+	}
+
+	thumbnails := h.config.MediaProxy.Thumbnails
+	if !thumbnails.Enabled || analysis.Image == nil {
+		return
+	}
+	bounds := analysis.Image.Bounds()
+	width, height := utils.ThumbnailSize(bounds.Dx(), bounds.Dy(), thumbnails.MaxWidth, thumbnails.MaxHeight)
+	if width == bounds.Dx() && height == bounds.Dy() {
+		// The image is small enough to be its own thumbnail
+		return
+	}
+	ref.Thumbnail = true
+	thumbnailID, err := utils.EncodeMediaID(h.mediaIDSecret, ref)
+	if err != nil {
+		log.Printf("Failed to create thumbnail media id for %s: %v", ref.Path, err)
+		return
+	}
+	info.ThumbnailURL = id.ContentURI{Homeserver: h.config.MediaProxy.ServerName, FileID: thumbnailID}.CUString()
+	info.ThumbnailFile = nil
+	info.ThumbnailInfo = &event.FileInfo{MimeType: "image/jpeg", Width: width, Height: height}
+	if analysis.BlurHash != "" {
+		info.ThumbnailInfo.Blurhash = analysis.BlurHash
+		info.ThumbnailInfo.AnoaBlurhash = analysis.BlurHash
+	}
+}
@@ -0,0 +1,74 @@
+package handlers
+
+import (
+	"context"
+	"log"
+	"net/http"
+
+	"maunium.net/go/mautrix/event"
+
+	"nextcloud-media-bridge/src/config"
+	"nextcloud-media-bridge/src/utils"
+)
+
+// stripImageMetadata removes location and device metadata from JPEG, PNG and
+// WebP images if enabled for the room, and returns the data to archive. If an
+// originals template is configured the untouched image is returned as well, to
+// be stored with keepOriginal once the stripped file is archived and the
+// message points at it. Other media and images that fail to parse are returned
+// unchanged.
+func (h *MediaHandler) stripImageMetadata(rule config.RoomRule, evt *event.Event, mimeType string, mediaData []byte) ([]byte, []byte) {
+	settings := h.config.Matrix.StripMetadata.Merge(rule.StripMetadata)
+	if !settings.IsEnabled() {
+		return mediaData, nil
+	}
+	if mimeType == "" {
+		mimeType = http.DetectContentType(mediaData)
+	}
+	if !utils.IsStrippableImage(mimeType) {
+		return mediaData, nil
+	}
+	stripped, changed, err := utils.StripImageMetadata(mediaData)
+	if err != nil {
+		log.Printf("Warning: Failed to strip metadata from %s (%s), archiving unchanged: %v", evt.ID.String(), mimeType, err)
+		return mediaData, nil
+	}
+	if !changed {
+		return mediaData, nil
+	}
+	log.Printf("Stripped image metadata from %s (%d -> %d bytes)", evt.ID.String(), len(mediaData), len(stripped))
+	if settings.OriginalsTemplate == "" {
+		return stripped, nil
+	}
+	return stripped, mediaData
+}
+
+// keepOriginal uploads the untouched image returned by stripImageMetadata to
+// the originals template and returns its path, so the mapping can record it.
+// It is only called once the mapping will be stored, so no original is left
+// behind that redactions and reconciliation cannot find. Nothing is kept for
+// nil data or if the upload fails.
+func (h *MediaHandler) keepOriginal(ctx context.Context, rule config.RoomRule, evt *event.Event, msg *event.MessageEventContent, filename, mimeType string, unstripped []byte) string {
+	if unstripped == nil {
+		return ""
+	}
+	settings := h.config.Matrix.StripMetadata.Merge(rule.StripMetadata)
+	template, err := utils.ParsePathTemplate(settings.OriginalsTemplate)
+	if err != nil {
+		log.Printf("Warning: Invalid originals template for %s: %v", rule.Selector(), err)
+		return ""
+	}
+	vars := h.templateVariables(ctx, template, evt, msg, filename, mimeType, unstripped)
+	storage, err := h.storages.Get(rule.Storage)
+	var originalPath string
+	if err == nil {
+		originalPath, _, _, err = h.uploadMedia(ctx, rule.Storage, storage, template.Render(vars), filename, unstripped, h.conflictNaming(rule, evt))
+	}
+	if err != nil {
+		log.Printf("Warning: Failed to keep original of %s: %v", evt.ID.String(), err)
+		return ""
+	}
+	log.Printf("Kept original with metadata at %s", originalPath)
+	h.replicator.Upload(rule.Storage, originalPath)
+	return originalPath
+}
@@ -0,0 +1,164 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"path"
+	"strings"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"nextcloud-media-bridge/src/utils"
+)
+
+// maxPostAnalysisSize limits the size of Nextcloud files downloaded to read
+// their dimensions, blurhash and duration before they are posted.
+const maxPostAnalysisSize = 50 << 20
+
+// postNextcloudFile sends a file of the named storage to a room as a message
+// from the bot whose URL points at the media proxy. The caption is added to
+// the body. It returns the new event and its mxc:// URL, or an empty event ID
+// without an error if the virus scanner found the file infected.
+func (h *MediaHandler) postNextcloudFile(ctx context.Context, roomID id.RoomID, name string, file RemoteFile, caption string) (id.EventID, string, error) {
+	storage, err := h.storages.Get(name)
+	if err != nil {
+		return "", "", err
+	}
+	filename := path.Base(file.Path)
+	mimeType := file.ContentType
+	if mimeType == "" {
+		mimeType = mime.TypeByExtension(path.Ext(filename))
+	}
+	if mimeType == "" {
+		mimeType = "application/octet-stream"
+	}
+	msgType := fileMsgType(mimeType)
+
+	var data []byte
+	if msgType != event.MsgFile && file.Size <= maxPostAnalysisSize {
+		if data, err = h.downloadNextcloudFile(ctx, storage, file.Path); err != nil {
+			return "", "", err
+		}
+	}
+	if h.scanner != nil {
+		clean, err := h.scanNextcloudFile(ctx, storage, file.Path, data)
+		if err != nil {
+			return "", "", err
+		}
+		if !clean {
+			log.Printf("Not posting infected Nextcloud file %s to room %s", file.Path, roomID)
+			return "", "", nil
+		}
+	}
+
+	ref := utils.MediaRef{
+		Path:     strings.TrimLeft(file.Path, "/"),
+		FileName: filename,
+		MimeType: mimeType,
+		Version:  etagVersion(file.ETag),
+		Storage:  name,
+	}
+	mediaID, err := utils.EncodeMediaID(h.mediaIDSecret, ref)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to create media id: %w", err)
+	}
+	mxc := id.ContentURI{Homeserver: h.config.MediaProxy.ServerName, FileID: mediaID}.String()
+	info := &event.FileInfo{MimeType: mimeType, Size: int(file.Size)}
+	if data != nil {
+		h.fillMediaInfo(info, data, mimeType, ref)
+	}
+
+	body := caption
+	if link := h.webLink(name, "/"+ref.Path); link != "" {
+		link = "View in Nextcloud: " + link
+		if body != "" {
+			body += "\n\n"
+		}
+		body += link
+	}
+	if body == "" {
+		body = filename
+	}
+	content := &event.MessageEventContent{
+		MsgType:  msgType,
+		Body:     body,
+		FileName: filename,
+		URL:      id.ContentURIString(mxc),
+		Info:     info,
+	}
+	resp, err := h.as.BotIntent().SendMessageEvent(ctx, roomID, event.EventMessage, content)
+	if err != nil {
+		return "", "", err
+	}
+	return resp.EventID, mxc, nil
+}
+
+func (h *MediaHandler) downloadNextcloudFile(ctx context.Context, storage Storage, remotePath string) ([]byte, error) {
+	file, err := storage.Download(ctx, remotePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Body.Close()
+	data, err := io.ReadAll(file.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file: %w", err)
+	}
+	return data, nil
+}
+
+// scanNextcloudFile scans a stored file, streaming it from the storage if it
+// was not downloaded yet. If clamd fails the configured fail policy decides.
+func (h *MediaHandler) scanNextcloudFile(ctx context.Context, storage Storage, remotePath string, data []byte) (bool, error) {
+	var reader io.Reader = bytes.NewReader(data)
+	if data == nil {
+		file, err := storage.Download(ctx, remotePath)
+		if err != nil {
+			return false, err
+		}
+		defer file.Body.Close()
+		reader = file.Body
+	}
+	result, err := h.scanner.Scan(ctx, reader)
+	if err != nil {
+		if h.config.Antivirus.FailPolicy == "open" {
+			log.Printf("Warning: Virus scan of Nextcloud file %s failed, posting unscanned (fail_policy=open): %v", remotePath, err)
+			return true, nil
+		}
+		return false, fmt.Errorf("virus scan failed: %w", err)
+	}
+	if result.Infected {
+		log.Printf("SECURITY: Virus scanner detected %s in Nextcloud file %s", result.Signature, remotePath)
+	}
+	return !result.Infected, nil
+}
+
+// fileMsgType picks the message type for a file from its MIME type.
+func fileMsgType(mimeType string) event.MessageType {
+	switch major, _, _ := strings.Cut(mimeType, "/"); major {
+	case "image":
+		return event.MsgImage
+	case "video":
+		return event.MsgVideo
+	case "audio":
+		return event.MsgAudio
+	default:
+		return event.MsgFile
+	}
+}
+
+// etagVersion derives a media version from an ETag, so clients do not show a
+// cached copy of a file that was changed and posted again.
+func etagVersion(etag string) string {
+	if etag == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(etag))
+	return hex.EncodeToString(sum[:])[:8]
+}
@@ -1,12 +1,16 @@
 package handlers
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 
 	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix"
 	"maunium.net/go/mautrix/mediaproxy"
 
 	"nextcloud-media-bridge/src/config"
@@ -14,12 +18,16 @@ import (
 )
 
 type MediaProxy struct {
-	proxy     *mediaproxy.MediaProxy
-	secretKey []byte
-	nextcloud *NextcloudClient
+	proxy      *mediaproxy.MediaProxy
+	secretKey  []byte
+	storages   *Storages
+	moves      *PathMoves
+	revoked    *RevokedMedia
+	thumbnails *ThumbnailCache
 }
 
-func NewMediaProxy(cfg *config.Config, nextcloud *NextcloudClient, secretKey []byte) (*MediaProxy, error) {
+func NewMediaProxy(cfg *config.Config, storages *Storages, secretKey []byte, moves *PathMoves, revoked *RevokedMedia) (*MediaProxy, error) {
+	thumbnails := NewThumbnailCache(thumbnailCacheSize)
 	mp, err := mediaproxy.NewFromConfig(mediaproxy.BasicConfig{
 		ServerName:        cfg.MediaProxy.ServerName,
 		ServerKey:         cfg.MediaProxy.ServerKey,
@@ -30,25 +38,113 @@ func NewMediaProxy(cfg *config.Config, nextcloud *NextcloudClient, secretKey []b
 		if err != nil {
 			return nil, mediaproxy.ErrInvalidMediaIDSyntax
 		}
-		log.Printf("Media proxy download: %s", ref.Path)
-		resp, err := nextcloud.DownloadFile(ref.Path)
+		media, err := openMedia(ctx, cfg, storages, moves, revoked, thumbnails, ref)
 		if err != nil {
 			return nil, err
 		}
-		contentType := ref.MimeType
-		if contentType == "" {
-			contentType = resp.Header.Get("Content-Type")
-		}
-		return &mediaproxy.GetMediaResponseData{
-			Reader:        resp.Body,
-			ContentType:   contentType,
-			ContentLength: resp.ContentLength,
-		}, nil
+		return media, nil
 	})
 	if err != nil {
 		return nil, fmt.Errorf("failed to initialize media proxy: %w", err)
 	}
-	return &MediaProxy{proxy: mp, secretKey: secretKey, nextcloud: nextcloud}, nil
+	return &MediaProxy{proxy: mp, secretKey: secretKey, storages: storages, moves: moves, revoked: revoked, thumbnails: thumbnails}, nil
+}
+
+// openMedia opens the archived file of a media reference, following folder
+// moves, or renders its thumbnail unless it is in the thumbnail cache.
+func openMedia(ctx context.Context, cfg *config.Config, storages *Storages, moves *PathMoves, revoked *RevokedMedia, thumbnails *ThumbnailCache, ref utils.MediaRef) (*mediaproxy.GetMediaResponseData, error) {
+	if revoked.IsRefRevoked(ref, moves) {
+		log.Printf("Media proxy download: %s was revoked", ref.Path)
+		return nil, mautrix.MNotFound.WithMessage("Media was removed")
+	}
+	if ref.Thumbnail {
+		if thumbnail, ok := thumbnails.Get(ref); ok {
+			return thumbnailResponse(thumbnail), nil
+		}
+	}
+	storage, err := storages.Get(ref.Storage)
+	if err != nil {
+		log.Printf("Media proxy download: %s: %v", ref.Path, err)
+		return nil, mautrix.MNotFound.WithMessage("Media storage is not available")
+	}
+	log.Printf("Media proxy download: %s from %s", ref.Path, storageName(ref.Storage))
+	file, err := storage.Download(ctx, ref.Path)
+	if errors.Is(err, ErrNotFound) {
+		// The folder may have been moved after a room rename
+		if moved := moves.Resolve(ref.Storage, ref.Path); moved != ref.Path {
+			log.Printf("Media proxy download: %s moved to %s", ref.Path, moved)
+			file, err = storage.Download(ctx, moved)
+		}
+	}
+	if mirror := storages.Mirror(); mirror != nil && storageUnavailable(err) {
+		// Serve the backup while the storage fails. A file the storage
+		// reports as missing was deleted there and is not served. Moves are
+		// replicated, so the mirror copy is at the resolved path.
+		if mirrored, mirrorErr := mirror.Download(ctx, MirrorPath(ref.Storage, moves.Resolve(ref.Storage, ref.Path))); mirrorErr == nil {
+			log.Printf("Media proxy download: %s from %s failed (%v), serving the mirror copy", ref.Path, storageName(ref.Storage), err)
+			file, err = mirrored, nil
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if ref.Thumbnail {
+		thumbnail, err := renderThumbnail(cfg, file)
+		if err != nil {
+			return nil, err
+		}
+		thumbnails.Add(ref, thumbnail)
+		return thumbnailResponse(thumbnail), nil
+	}
+	contentType := ref.MimeType
+	if contentType == "" {
+		contentType = file.ContentType
+	}
+	return &mediaproxy.GetMediaResponseData{
+		Reader:        file.Body,
+		ContentType:   contentType,
+		ContentLength: file.ContentLength,
+	}, nil
+}
+
+// storageUnavailable reports whether err means that a storage could not
+// answer a request, because of a network error, a server error or maintenance
+// mode, rather than refusing it or reporting the file as missing.
+func storageUnavailable(err error) bool {
+	if err == nil || errors.Is(err, ErrNotFound) {
+		return false
+	}
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.Maintenance || statusErr.StatusCode >= http.StatusInternalServerError
+	}
+	return true
+}
+
+// renderThumbnail scales the downloaded image to the configured thumbnail size.
+func renderThumbnail(cfg *config.Config, file *StoredFile) ([]byte, error) {
+	defer file.Body.Close()
+	data, err := io.ReadAll(file.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read image for thumbnail: %w", err)
+	}
+	img, err := utils.DecodeImage(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode image for thumbnail: %w", err)
+	}
+	thumbnail, _, err := utils.EncodeThumbnail(img, cfg.MediaProxy.Thumbnails.MaxWidth, cfg.MediaProxy.Thumbnails.MaxHeight)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode thumbnail: %w", err)
+	}
+	return thumbnail, nil
+}
+
+func thumbnailResponse(thumbnail []byte) *mediaproxy.GetMediaResponseData {
+	return &mediaproxy.GetMediaResponseData{
+		Reader:        io.NopCloser(bytes.NewReader(thumbnail)),
+		ContentType:   "image/jpeg",
+		ContentLength: int64(len(thumbnail)),
+	}
 }
 
 func (mp *MediaProxy) RegisterRoutes(router *http.ServeMux, log zerolog.Logger) {
@@ -0,0 +1,246 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"nextcloud-media-bridge/src/config"
+	"nextcloud-media-bridge/src/utils"
+)
+
+// redactionAuditRecord is one line of the redaction audit log.
+type redactionAuditRecord struct {
+	Time        time.Time `json:"time"`
+	RoomID      string    `json:"room_id"`
+	EventID     string    `json:"event_id"`
+	RedactionID string    `json:"redaction_id"`
+	RedactedBy  string    `json:"redacted_by"`
+	Reason      string    `json:"reason,omitempty"`
+	Action      string    `json:"action"`
+	Path        string    `json:"path"`
+	Destination string    `json:"destination,omitempty"`
+	Shared      bool      `json:"shared,omitempty"` // Left alone for other messages
+	Error       string    `json:"error,omitempty"`
+	Warning     string    `json:"warning,omitempty"` // Applied, but not completely
+}
+
+var auditLogMu sync.Mutex
+
+// applyRedactionPolicy handles the archived file of a redacted event and the
+// originals kept next to it according to the room's redaction policy, and
+// audit-logs the outcome. Files the mappings of other messages point at are
+// left alone; only the media reference of the event is revoked then, unless
+// another message uses the same one. The mapping is cleared once no file is
+// left where it points.
+func (h *MediaHandler) applyRedactionPolicy(ctx context.Context, evt *event.Event, redacts id.EventID) error {
+	state, ok := h.loadMediaState(evt.RoomID, redacts)
+	if !ok {
+		return nil
+	}
+	policy := h.redactionPolicy(ctx, evt.RoomID)
+	files := append([]string{state.Path}, state.Originals...)
+	shared, err := h.redactFiles(ctx, evt, redacts, policy, state.Storage, files)
+	fileShared := slices.Contains(shared, state.Path)
+	if policy.Action == config.RedactionKeep || fileShared {
+		// The link of the event stops working even where its file stays
+		ref := storedMapping{EventID: redacts, State: state}.ref(h.mediaIDSecret)
+		if !fileShared || !h.sharedRef(ctx, evt.RoomID, redacts, ref) {
+			err = errors.Join(err, h.revoked.RevokeRef(ctx, ref))
+		}
+	}
+	// The mapping of a kept file stays, so the file still counts as in use
+	if err == nil && (policy.Action != config.RedactionKeep || fileShared) {
+		h.clearMediaState(ctx, evt.RoomID, redacts)
+	}
+	return err
+}
+
+// sharedRef reports whether the mapping of another message has the same
+// media reference, so revoking it would break that message too. The
+// reference is counted as shared if the mappings cannot be read.
+func (h *MediaHandler) sharedRef(ctx context.Context, roomID id.RoomID, eventID id.EventID, ref utils.MediaRef) bool {
+	mappings, err := h.sharingMappings(ctx, roomID, eventID, ref.Storage, ref.Path)
+	if err != nil {
+		log.Printf("Warning: %v, treating the media of %s as shared", err, eventID)
+		return true
+	}
+	for _, mapping := range mappings {
+		if mapping.ref(h.mediaIDSecret) == ref {
+			return true
+		}
+	}
+	return false
+}
+
+// redactionPolicy returns the redaction policy of a room.
+func (h *MediaHandler) redactionPolicy(ctx context.Context, roomID id.RoomID) config.RedactionPolicy {
+	rule, _ := h.rooms.Resolve(ctx, roomID)
+	policy := h.config.Matrix.Redaction.Merge(rule.Redaction)
+	if policy.Action == "" {
+		policy.Action = config.RedactionDelete
+	}
+	return policy
+}
+
+// redactFiles applies the redaction policy to files of a redacted event,
+// writing one audit record per file. Files the mappings of other messages
+// point at are left alone and returned. It continues after a failure and
+// returns the errors of all files that failed.
+func (h *MediaHandler) redactFiles(ctx context.Context, evt *event.Event, redacts id.EventID, policy config.RedactionPolicy, name string, files []string) ([]string, error) {
+	storage, err := h.storages.Get(name)
+	if err != nil {
+		return nil, fmt.Errorf("invalid storage of event %s: %w", redacts.String(), err)
+	}
+	var reason string
+	if content := evt.Content.AsRedaction(); content != nil {
+		reason = content.Reason
+	}
+	// Only Nextcloud has a trash bin; other storages delete right away
+	nextcloud, isNextcloud := storage.(*NextcloudClient)
+	var shared []string
+	var errs []error
+	for _, filePath := range files {
+		record := redactionAuditRecord{
+			Time:        time.Now().UTC(),
+			RoomID:      evt.RoomID.String(),
+			EventID:     redacts.String(),
+			RedactionID: evt.ID.String(),
+			RedactedBy:  evt.Sender.String(),
+			Reason:      reason,
+			Action:      policy.Action,
+			Path:        h.currentPath(ctx, name, storage, filePath),
+		}
+		if h.sharedPath(ctx, evt.RoomID, redacts, name, filePath) {
+			record.Shared = true
+			shared = append(shared, filePath)
+			h.writeRedactionAudit(record)
+			continue
+		}
+		var err error
+		switch policy.Action {
+		case config.RedactionKeep:
+			err = h.revoked.Revoke(ctx, name, record.Path)
+		case config.RedactionMove:
+			record.Destination, err = h.moveRedactedFile(ctx, evt, redacts, storage, record.Path, policy.MoveTemplate)
+		case config.RedactionTrash:
+			err = storage.DeleteFile(ctx, record.Path)
+		default:
+			var deleted time.Time
+			if !isNextcloud {
+				err = storage.DeleteFile(ctx, record.Path)
+			} else if deleted, err = nextcloud.DeleteToTrash(ctx, record.Path); err == nil {
+				// A copy left in the trash bin expires on its own, so the
+				// file still counts as deleted
+				if purgeErr := nextcloud.PurgeFromTrash(ctx, record.Path, deleted); purgeErr != nil {
+					record.Warning = "not purged from the trash bin: " + purgeErr.Error()
+				}
+			}
+		}
+		if err != nil {
+			record.Error = err.Error()
+			errs = append(errs, fmt.Errorf("failed to apply redaction policy %s to %s: %w", policy.Action, record.Path, err))
+		} else if policy.Action == config.RedactionMove {
+			h.replicator.Move(name, record.Path, record.Destination)
+		} else if policy.Action != config.RedactionKeep {
+			h.replicator.Delete(name, record.Path)
+		}
+		h.writeRedactionAudit(record)
+	}
+	return shared, errors.Join(errs...)
+}
+
+// moveRedactedFile moves a file to the rendered move template and returns the
+// destination. A counter is added to the name if the destination exists.
+func (h *MediaHandler) moveRedactedFile(ctx context.Context, evt *event.Event, redacts id.EventID, storage Storage, filePath, moveTemplate string) (string, error) {
+	template, err := utils.ParsePathTemplate(moveTemplate)
+	if err != nil {
+		return "", fmt.Errorf("invalid move template: %w", err)
+	}
+	vars := utils.TimeTemplateVariables(time.UnixMilli(evt.Timestamp))
+	for key, value := range utils.FileTemplateVariables(path.Base(filePath)) {
+		vars[key] = value
+	}
+	for key, value := range h.roomVariables(ctx, template, evt.RoomID) {
+		vars[key] = value
+	}
+	vars["event_id"] = strings.TrimPrefix(redacts.String(), "$")
+	if template.Uses("user") || template.Uses("displayname") || template.Uses("sender_server") {
+		// The redacted event keeps its sender
+		if original, err := h.as.BotClient().GetEvent(ctx, evt.RoomID, redacts); err == nil {
+			vars["user"] = utils.MatrixUserLocalpart(original.Sender.String())
+			vars["sender_server"] = original.Sender.Homeserver()
+			if template.Uses("displayname") {
+				vars["displayname"] = h.rooms.DisplayName(ctx, evt.RoomID, original.Sender)
+			}
+		}
+	}
+
+	return h.moveToFreePath(ctx, storage, filePath, template.Render(vars))
+}
+
+// moveToFreePath moves a file to destination, adding a counter to the name if
+// the destination exists, and returns where the file is now.
+func (h *MediaHandler) moveToFreePath(ctx context.Context, storage Storage, filePath, destination string) (string, error) {
+	if err := storage.EnsureDirectories(ctx, destination); err != nil {
+		return "", fmt.Errorf("failed to create directories: %w", err)
+	}
+	if exists, _, err := storage.Stat(ctx, destination); err != nil {
+		return "", fmt.Errorf("failed to check existing file: %w", err)
+	} else if exists {
+		if destination, _, _, err = h.freePath(ctx, "", storage, destination, nil); err != nil {
+			return "", err
+		}
+	}
+	if err := storage.Move(ctx, filePath, destination); err != nil {
+		return "", err
+	}
+	return destination, nil
+}
+
+// writeRedactionAudit logs a redaction and appends it to the audit log file
+// if one is configured.
+func (h *MediaHandler) writeRedactionAudit(record redactionAuditRecord) {
+	outcome := "ok"
+	if record.Shared {
+		outcome = "left alone, shared with other messages"
+	} else if record.Error != "" {
+		outcome = "failed: " + record.Error
+	} else if record.Warning != "" {
+		outcome = "ok, " + record.Warning
+	}
+	log.Printf("AUDIT: redaction %s by %s of event %s in room %s: %s %s %s",
+		record.RedactionID, record.RedactedBy, record.EventID, record.RoomID, record.Action, record.Path, outcome)
+
+	auditPath := h.config.Matrix.RedactionAuditLog
+	if auditPath == "" {
+		return
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		log.Printf("Warning: failed to encode audit record: %v", err)
+		return
+	}
+	auditLogMu.Lock()
+	defer auditLogMu.Unlock()
+	file, err := os.OpenFile(auditPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		log.Printf("Warning: failed to open audit log %s: %v", auditPath, err)
+		return
+	}
+	defer file.Close()
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		log.Printf("Warning: failed to write audit log %s: %v", auditPath, err)
+	}
+}
@@ -0,0 +1,428 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"maunium.net/go/mautrix/event"
+
+	"nextcloud-media-bridge/src/config"
+)
+
+func TestApplyRedactionPolicy(t *testing.T) {
+	const roomID = "!roomid:example.com"
+	cases := []struct {
+		action   string
+		requests []string
+	}{
+		{config.RedactionDelete, []string{
+			"DELETE /remote.php/dav/files/bridge/media/alice/photo.jpg",
+			"PROPFIND /remote.php/dav/trashbin/bridge/trash/photo.jpg.d199",
+			"PROPFIND /remote.php/dav/trashbin/bridge/trash/photo.jpg.d200",
+			"DELETE /remote.php/dav/trashbin/bridge/trash/photo.jpg.d200",
+		}},
+		{config.RedactionTrash, []string{
+			"DELETE /remote.php/dav/files/bridge/media/alice/photo.jpg",
+		}},
+		{config.RedactionMove, []string{
+			"HEAD /remote.php/dav/files/bridge/.redacted/2024/roomid_example.com/photo.jpg",
+			"MOVE /remote.php/dav/files/bridge/media/alice/photo.jpg -> /remote.php/dav/files/bridge/.redacted/2024/roomid_example.com/photo.jpg",
+		}},
+		{config.RedactionKeep, nil},
+	}
+	for _, tc := range cases {
+		t.Run(tc.action, func(t *testing.T) {
+			var mu sync.Mutex
+			var requests []string
+			var handler *MediaHandler
+
+			nt := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method == "MKCOL" {
+					w.WriteHeader(http.StatusCreated)
+					return
+				}
+				request := r.Method + " " + r.URL.Path
+				if destination := r.Header.Get("Destination"); destination != "" {
+					request += " -> " + strings.TrimPrefix(destination, "http://"+r.Host)
+				}
+				mu.Lock()
+				requests = append(requests, request)
+				mu.Unlock()
+				switch {
+				case r.Method == "PROPFIND" && strings.HasSuffix(r.URL.Path, "/trash/photo.jpg.d200"):
+					w.WriteHeader(http.StatusMultiStatus)
+					_, _ = w.Write([]byte(`<?xml version="1.0"?><d:multistatus xmlns:d="DAV:" xmlns:nc="http://nextcloud.org/ns">` +
+						`<d:response><d:href>/remote.php/dav/trashbin/bridge/trash/photo.jpg.d200</d:href><d:propstat><d:prop><nc:trashbin-original-location>media/alice/photo.jpg</nc:trashbin-original-location></d:prop></d:propstat></d:response>` +
+						`</d:multistatus>`))
+				case r.Method == "PROPFIND":
+					w.WriteHeader(http.StatusNotFound)
+				case r.Method == http.MethodDelete && strings.HasPrefix(r.URL.Path, "/remote.php/dav/files/"):
+					// Deleted at the server time 200, naming the trash bin copy
+					w.Header().Set("Date", time.Unix(200, 0).UTC().Format(http.TimeFormat))
+					w.WriteHeader(http.StatusNoContent)
+				case r.Method == http.MethodHead:
+					w.WriteHeader(http.StatusNotFound)
+				case r.Method == "MOVE":
+					w.WriteHeader(http.StatusCreated)
+				default:
+					w.WriteHeader(http.StatusNoContent)
+				}
+			}))
+			defer nt.Close()
+
+			mt := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if strings.Contains(r.URL.Path, "/state/com.nextcloud-media-bridge.media/") {
+					state := mediaState{Path: "/media/alice/photo.jpg", FileName: "photo.jpg"}
+					state.Signature, _ = handler.signMediaState(state)
+					_ = json.NewEncoder(w).Encode(state)
+					return
+				}
+				_, _ = w.Write([]byte(`{}`))
+			}))
+			defer mt.Close()
+
+			auditLog := filepath.Join(t.TempDir(), "audit.log")
+			cfg := &config.Config{}
+			cfg.Matrix.RoomPathTemplate = map[string]string{roomID: "/media/${user}/${file}"}
+			cfg.Matrix.Redaction = config.RedactionPolicy{Action: tc.action, MoveTemplate: "/.redacted/${year}/${room}/${file}"}
+			cfg.Matrix.RedactionAuditLog = auditLog
+			handler = newTestHandler(t, cfg, mt.URL, NewStorages(NewNextcloudClient(nt.URL+"/remote.php/dav/files/bridge", "bridge", "pass")))
+
+			redaction := &event.Event{
+				Type:      event.EventRedaction,
+				ID:        "$redaction",
+				RoomID:    roomID,
+				Sender:    "@mod:example.com",
+				Timestamp: time.Date(2024, 5, 20, 12, 0, 0, 0, time.UTC).UnixMilli(),
+				Content:   event.Content{VeryRaw: json.RawMessage(`{"redacts":"$original","reason":"spam"}`)},
+			}
+			if err := handler.HandleMatrixEvent(context.Background(), handler.as, redaction); err != nil {
+				t.Fatalf("HandleMatrixEvent failed: %v", err)
+			}
+
+			if strings.Join(requests, "\n") != strings.Join(tc.requests, "\n") {
+				t.Fatalf("unexpected Nextcloud requests:\n%s", strings.Join(requests, "\n"))
+			}
+			if handler.revoked.IsRevoked("", "media/alice/photo.jpg") != (tc.action == config.RedactionKeep) {
+				t.Fatalf("unexpected revocation state for %s", tc.action)
+			}
+
+			data, err := os.ReadFile(auditLog)
+			if err != nil {
+				t.Fatalf("failed to read audit log: %v", err)
+			}
+			var record redactionAuditRecord
+			if err := json.Unmarshal(data, &record); err != nil {
+				t.Fatalf("invalid audit record %q: %v", data, err)
+			}
+			if record.Action != tc.action || record.EventID != "$original" || record.RedactedBy != "@mod:example.com" || record.Reason != "spam" || record.Error != "" {
+				t.Fatalf("unexpected audit record %+v", record)
+			}
+		})
+	}
+}
+
+func TestApplyRedactionPolicyDeletesOriginals(t *testing.T) {
+	const roomID = "!roomid:example.com"
+	var mu sync.Mutex
+	var deleted []string
+	var cleared bool
+	var handler *MediaHandler
+
+	nt := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if r.Method == http.MethodDelete {
+			deleted = append(deleted, r.URL.Path)
+			if strings.Contains(r.URL.Path, "/failing/") {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer nt.Close()
+
+	originals := []string{"/originals/alice/photo.jpg", "/failing/photo.jpg"}
+	mt := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if strings.Contains(r.URL.Path, "/state/com.nextcloud-media-bridge.media/") {
+			if r.Method == http.MethodPut {
+				cleared = true
+				_, _ = w.Write([]byte(`{"event_id":"$state"}`))
+				return
+			}
+			state := mediaState{Path: "/media/alice/photo.jpg", FileName: "photo.jpg", Originals: originals}
+			state.Signature, _ = handler.signMediaState(state)
+			_ = json.NewEncoder(w).Encode(state)
+			return
+		}
+		_, _ = w.Write([]byte(`{}`))
+	}))
+	defer mt.Close()
+
+	cfg := &config.Config{}
+	cfg.Matrix.RoomPathTemplate = map[string]string{roomID: "/media/${user}/${file}"}
+	cfg.Matrix.Redaction = config.RedactionPolicy{Action: config.RedactionTrash}
+	handler = newTestHandler(t, cfg, mt.URL, NewStorages(NewNextcloudClient(nt.URL+"/remote.php/dav/files/bridge", "bridge", "pass")))
+
+	redaction := &event.Event{
+		Type:    event.EventRedaction,
+		ID:      "$redaction",
+		RoomID:  roomID,
+		Sender:  "@mod:example.com",
+		Content: event.Content{VeryRaw: json.RawMessage(`{"redacts":"$original"}`)},
+	}
+	if err := handler.applyRedactionPolicy(context.Background(), redaction, "$original"); err == nil {
+		t.Fatalf("expected the failed original to be reported")
+	}
+	expected := []string{
+		"/remote.php/dav/files/bridge/media/alice/photo.jpg",
+		"/remote.php/dav/files/bridge/originals/alice/photo.jpg",
+		"/remote.php/dav/files/bridge/failing/photo.jpg",
+	}
+	if strings.Join(deleted, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("expected the file and its originals to be deleted, got %v", deleted)
+	}
+	if cleared {
+		t.Fatalf("mapping must be kept while an original is left")
+	}
+
+	// Once all originals are handled the mapping is cleared
+	originals = originals[:1]
+	deleted = nil
+	if err := handler.applyRedactionPolicy(context.Background(), redaction, "$original"); err != nil {
+		t.Fatalf("applyRedactionPolicy failed: %v", err)
+	}
+	if !cleared || len(deleted) != 2 {
+		t.Fatalf("expected mapping to be cleared after deleting %v", deleted)
+	}
+}
+
+func TestApplyRedactionPolicySharedFile(t *testing.T) {
+	const roomID = "!roomid:example.com"
+	for _, action := range []string{config.RedactionDelete, config.RedactionKeep} {
+		t.Run(action, func(t *testing.T) {
+			var mu sync.Mutex
+			var requests []string
+			var cleared bool
+			var handler *MediaHandler
+
+			nt := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				defer mu.Unlock()
+				requests = append(requests, r.Method+" "+r.URL.Path)
+				w.WriteHeader(http.StatusNoContent)
+			}))
+			defer nt.Close()
+
+			// The file was reused for another message with the same content
+			redacted := mediaState{Path: "/media/alice/photo.jpg", FileName: "photo.jpg"}
+			other := mediaState{Path: "/media/alice/photo.jpg", FileName: "copy.jpg"}
+			mt := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				defer mu.Unlock()
+				switch {
+				case strings.Contains(r.URL.Path, "/state/com.nextcloud-media-bridge.media/") && r.Method == http.MethodPut:
+					cleared = true
+					_, _ = w.Write([]byte(`{"event_id":"$state"}`))
+				case strings.Contains(r.URL.Path, "/state/com.nextcloud-media-bridge.media/"):
+					state := redacted
+					state.Signature, _ = handler.signMediaState(state)
+					_ = json.NewEncoder(w).Encode(state)
+				case strings.HasSuffix(r.URL.Path, "/joined_rooms"):
+					_, _ = w.Write([]byte(`{"joined_rooms":["` + roomID + `"]}`))
+				case strings.HasSuffix(r.URL.Path, "/state"):
+					state := other
+					state.Signature, _ = handler.signMediaState(state)
+					_ = json.NewEncoder(w).Encode([]map[string]any{{"type": nextcloudMediaStateEvent.Type, "state_key": "$other", "content": state, "event_id": "$s", "sender": "@bridge:example.com"}})
+				default:
+					_, _ = w.Write([]byte(`{}`))
+				}
+			}))
+			defer mt.Close()
+
+			cfg := &config.Config{}
+			cfg.Matrix.Redaction = config.RedactionPolicy{Action: action}
+			handler = newTestHandler(t, cfg, mt.URL, NewStorages(NewNextcloudClient(nt.URL+"/remote.php/dav/files/bridge", "bridge", "pass")))
+
+			redaction := &event.Event{
+				Type:    event.EventRedaction,
+				ID:      "$redaction",
+				RoomID:  roomID,
+				Sender:  "@mod:example.com",
+				Content: event.Content{VeryRaw: json.RawMessage(`{"redacts":"$original"}`)},
+			}
+			if err := handler.applyRedactionPolicy(context.Background(), redaction, "$original"); err != nil {
+				t.Fatalf("applyRedactionPolicy failed: %v", err)
+			}
+			for _, request := range requests {
+				if !strings.HasPrefix(request, http.MethodHead+" ") {
+					t.Fatalf("expected the shared file to be left alone, got %v", requests)
+				}
+			}
+			if !cleared {
+				t.Fatalf("expected the mapping of the redacted event to be cleared")
+			}
+			// Only the link of the redacted event stops working
+			if handler.revoked.IsRevoked("", "media/alice/photo.jpg") {
+				t.Fatalf("the shared file must not be revoked")
+			}
+			if !handler.revoked.IsRefRevoked(storedMapping{State: redacted}.ref(handler.mediaIDSecret), handler.moves) {
+				t.Fatalf("expected the media of the redacted event to be revoked")
+			}
+			if handler.revoked.IsRefRevoked(storedMapping{State: other}.ref(handler.mediaIDSecret), handler.moves) {
+				t.Fatalf("the media of the other message must still be served")
+			}
+		})
+	}
+}
+
+func TestApplyRedactionPolicyUnreadableRoom(t *testing.T) {
+	const (
+		roomID   = "!roomid:example.com"
+		brokenID = "!broken:example.com"
+	)
+	cases := []struct {
+		name    string
+		storage string // Storage of the rule of the unreadable room
+		deleted bool
+	}{
+		{"other storage", "disk", true},
+		{"same storage", "", false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var mu sync.Mutex
+			var deleted []string
+			var handler *MediaHandler
+
+			nt := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				defer mu.Unlock()
+				if r.Method == http.MethodDelete {
+					deleted = append(deleted, r.URL.Path)
+				}
+				w.WriteHeader(http.StatusNoContent)
+			}))
+			defer nt.Close()
+
+			mt := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch {
+				case strings.Contains(r.URL.Path, "/state/com.nextcloud-media-bridge.media/") && r.Method == http.MethodPut:
+					_, _ = w.Write([]byte(`{"event_id":"$state"}`))
+				case strings.Contains(r.URL.Path, "/state/com.nextcloud-media-bridge.media/"):
+					state := mediaState{Path: "/media/alice/photo.jpg", FileName: "photo.jpg"}
+					state.Signature, _ = handler.signMediaState(state)
+					_ = json.NewEncoder(w).Encode(state)
+				case strings.HasSuffix(r.URL.Path, "/joined_rooms"):
+					_, _ = w.Write([]byte(`{"joined_rooms":["` + roomID + `","` + brokenID + `"]}`))
+				case strings.HasSuffix(r.URL.Path, brokenID+"/state"):
+					w.WriteHeader(http.StatusInternalServerError)
+					_, _ = w.Write([]byte(`{"errcode":"M_UNKNOWN","error":"broken"}`))
+				case strings.HasSuffix(r.URL.Path, "/state"):
+					_, _ = w.Write([]byte(`[]`))
+				default:
+					_, _ = w.Write([]byte(`{}`))
+				}
+			}))
+			defer mt.Close()
+
+			cfg := &config.Config{}
+			cfg.Matrix.RoomRules = []config.RoomRule{{Room: brokenID, Template: "/other/${file}", Storage: tc.storage}}
+			cfg.Matrix.Redaction = config.RedactionPolicy{Action: config.RedactionTrash}
+			handler = newTestHandler(t, cfg, mt.URL, NewStorages(NewNextcloudClient(nt.URL+"/remote.php/dav/files/bridge", "bridge", "pass")))
+
+			redaction := &event.Event{
+				Type:    event.EventRedaction,
+				ID:      "$redaction",
+				RoomID:  roomID,
+				Sender:  "@mod:example.com",
+				Content: event.Content{VeryRaw: json.RawMessage(`{"redacts":"$original"}`)},
+			}
+			if err := handler.applyRedactionPolicy(context.Background(), redaction, "$original"); err != nil {
+				t.Fatalf("applyRedactionPolicy failed: %v", err)
+			}
+			// Only a room archiving to the same storage may share the file
+			if (len(deleted) == 1) != tc.deleted {
+				t.Fatalf("expected deleted %v, got %v", tc.deleted, deleted)
+			}
+		})
+	}
+}
+
+func TestApplyRedactionPolicyPurgeFailure(t *testing.T) {
+	const roomID = "!roomid:example.com"
+	var cleared bool
+	var handler *MediaHandler
+
+	nt := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == "PROPFIND":
+			w.WriteHeader(http.StatusMultiStatus)
+			_, _ = w.Write([]byte(`<?xml version="1.0"?><d:multistatus xmlns:d="DAV:" xmlns:nc="http://nextcloud.org/ns">` +
+				`<d:response><d:href>` + r.URL.Path + `</d:href><d:propstat><d:prop><nc:trashbin-original-location>media/alice/photo.jpg</nc:trashbin-original-location></d:prop></d:propstat></d:response>` +
+				`</d:multistatus>`))
+		case strings.HasPrefix(r.URL.Path, "/remote.php/dav/trashbin/"):
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer nt.Close()
+
+	mt := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.Contains(r.URL.Path, "/state/com.nextcloud-media-bridge.media/") && r.Method == http.MethodPut:
+			cleared = true
+			_, _ = w.Write([]byte(`{"event_id":"$state"}`))
+		case strings.Contains(r.URL.Path, "/state/com.nextcloud-media-bridge.media/"):
+			state := mediaState{Path: "/media/alice/photo.jpg", FileName: "photo.jpg"}
+			state.Signature, _ = handler.signMediaState(state)
+			_ = json.NewEncoder(w).Encode(state)
+		default:
+			_, _ = w.Write([]byte(`{}`))
+		}
+	}))
+	defer mt.Close()
+
+	auditLog := filepath.Join(t.TempDir(), "audit.log")
+	cfg := &config.Config{}
+	cfg.Matrix.RedactionAuditLog = auditLog
+	handler = newTestHandler(t, cfg, mt.URL, NewStorages(NewNextcloudClient(nt.URL+"/remote.php/dav/files/bridge", "bridge", "pass")))
+
+	redaction := &event.Event{
+		Type:    event.EventRedaction,
+		ID:      "$redaction",
+		RoomID:  roomID,
+		Sender:  "@mod:example.com",
+		Content: event.Content{VeryRaw: json.RawMessage(`{"redacts":"$original"}`)},
+	}
+	// The file is gone from its folder, so the redaction is applied
+	if err := handler.applyRedactionPolicy(context.Background(), redaction, "$original"); err != nil {
+		t.Fatalf("applyRedactionPolicy failed: %v", err)
+	}
+	if !cleared {
+		t.Fatalf("expected the mapping to be cleared")
+	}
+	data, err := os.ReadFile(auditLog)
+	if err != nil {
+		t.Fatalf("failed to read audit log: %v", err)
+	}
+	var record redactionAuditRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		t.Fatalf("invalid audit record %q: %v", data, err)
+	}
+	if record.Error != "" || !strings.Contains(record.Warning, "trash bin") {
+		t.Fatalf("expected a warning about the trash bin, got %+v", record)
+	}
+}
@@ -0,0 +1,53 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+)
+
+// scanMedia scans downloaded media before it is uploaded and reports whether
+// it may be archived. Infected media is never archived; if clamd fails the
+// configured fail policy decides.
+func (h *MediaHandler) scanMedia(ctx context.Context, evt *event.Event, mediaData []byte) bool {
+	if h.scanner == nil {
+		return true
+	}
+	result, err := h.scanner.Scan(ctx, bytes.NewReader(mediaData))
+	if err != nil {
+		if h.config.Antivirus.FailPolicy == "open" {
+			log.Printf("Warning: Virus scan of media %s failed, archiving unscanned (fail_policy=open): %v", evt.ID.String(), err)
+			return true
+		}
+		log.Printf("Virus scan of media %s failed, not archiving (fail_policy=closed): %v", evt.ID.String(), err)
+		return false
+	}
+	if !result.Infected {
+		log.Printf("Virus scan of media %s: clean", evt.ID.String())
+		return true
+	}
+
+	log.Printf("SECURITY: Infected media %s from %s in room %s: %s", evt.ID.String(), evt.Sender.String(), evt.RoomID.String(), result.Signature)
+	switch h.config.Antivirus.OnInfected {
+	case "ignore":
+	case "redact":
+		reason := fmt.Sprintf("Virus scanner detected %s", result.Signature)
+		if _, err := h.as.BotClient().RedactEvent(ctx, evt.RoomID, evt.ID, mautrix.ReqRedact{Reason: reason}); err != nil {
+			log.Printf("Failed to redact infected media %s: %v", evt.ID.String(), err)
+		}
+	default:
+		content := &event.MessageEventContent{
+			MsgType: event.MsgNotice,
+			Body:    fmt.Sprintf("Warning: the virus scanner detected %s in this file. It was not archived to Nextcloud.", result.Signature),
+		}
+		content.SetReply(evt)
+		if _, err := h.as.BotIntent().SendMessageEvent(ctx, evt.RoomID, event.EventMessage, content); err != nil {
+			log.Printf("Failed to flag infected media %s: %v", evt.ID.String(), err)
+		}
+	}
+	return false
+}
@@ -1,6 +1,8 @@
 package handlers
 
 import (
+	"context"
+	"encoding/xml"
 	"fmt"
 	"io"
 	"log"
@@ -14,12 +16,27 @@ import (
 	"time"
 )
 
+// RemoteFile describes an entry returned by List.
+type RemoteFile struct {
+	Path         string
+	IsDir        bool
+	Size         int64
+	ETag         string
+	ContentType  string
+	LastModified time.Time
+}
+
 type NextcloudClient struct {
 	BaseURL  string
 	Username string
 	Password string
-	client   *http.Client
-	dirCache sync.Map // Cache for created directories to avoid redundant MKCOL requests
+	// MaxRetries is how often a failed request is retried, RetryDelay the
+	// base of the backoff between retries.
+	MaxRetries int
+	RetryDelay time.Duration
+	client     *http.Client
+	dirCache   sync.Map // Cache for created directories to avoid redundant MKCOL requests
+	tagCache   sync.Map // Cache of system tag IDs by name
 }
 
 func NewNextcloudClient(baseURL, username, password string) *NextcloudClient {
@@ -36,24 +53,26 @@ func NewNextcloudClient(baseURL, username, password string) *NextcloudClient {
 	}
 
 	return &NextcloudClient{
-		BaseURL:  baseURL,
-		Username: username,
-		Password: password,
-		client:   client,
+		BaseURL:    baseURL,
+		Username:   username,
+		Password:   password,
+		MaxRetries: defaultMaxRetries,
+		RetryDelay: defaultRetryDelay,
+		client:     client,
 	}
 }
 
-func (c *NextcloudClient) UploadFile(remotePath, localPath string) error {
+func (c *NextcloudClient) UploadFile(ctx context.Context, remotePath, localPath string) error {
 	file, err := os.Open(localPath)
 	if err != nil {
 		return fmt.Errorf("failed to open file: %w", err)
 	}
 	defer file.Close()
 
-	return c.UploadReader(remotePath, file, 0)
+	return c.UploadReader(ctx, remotePath, file, 0)
 }
 
-func (c *NextcloudClient) CreateDirectory(remotePath string) error {
+func (c *NextcloudClient) CreateDirectory(ctx context.Context, remotePath string) error {
 	// Check cache first to avoid redundant MKCOL requests
 	if _, cached := c.dirCache.Load(remotePath); cached {
 		return nil
@@ -61,23 +80,22 @@ func (c *NextcloudClient) CreateDirectory(remotePath string) error {
 
 	start := time.Now()
 
-	req, err := http.NewRequest("MKCOL", c.buildURL(remotePath), nil)
+	req, err := http.NewRequestWithContext(ctx, "MKCOL", c.buildURL(remotePath), nil)
 	if err != nil {
 		return fmt.Errorf("failed to create directory request: %w", err)
 	}
-	req.SetBasicAuth(c.Username, c.Password)
 
-	resp, err := c.client.Do(req)
+	resp, err := c.do(req)
 	if err != nil {
 		return fmt.Errorf("failed to create directory: %w", err)
 	}
-	defer resp.Body.Close()
 
 	log.Printf("Nextcloud MKCOL path=%s status=%d duration=%s", remotePath, resp.StatusCode, time.Since(start))
 
 	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusConflict && resp.StatusCode != http.StatusMethodNotAllowed {
-		return fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+		return statusError(resp, remotePath)
 	}
+	resp.Body.Close()
 
 	// Cache successful directory creation
 	c.dirCache.Store(remotePath, true)
@@ -85,71 +103,67 @@ func (c *NextcloudClient) CreateDirectory(remotePath string) error {
 	return nil
 }
 
-func (c *NextcloudClient) UploadReader(remotePath string, reader io.Reader, contentLength int64) error {
-	start := time.Now()
-	log.Printf("Nextcloud upload start path=%s content_length=%d", remotePath, contentLength)
-
-	req, err := http.NewRequest("PUT", c.buildURL(remotePath), reader)
-	if err != nil {
-		return fmt.Errorf("failed to create request: %w", err)
-	}
-	if contentLength > 0 {
-		req.ContentLength = contentLength
-	}
-	req.SetBasicAuth(c.Username, c.Password)
-
-	resp, err := c.client.Do(req)
-	if err != nil {
-		return fmt.Errorf("failed to upload file: %w", err)
-	}
-	defer resp.Body.Close()
-
-	log.Printf("Nextcloud upload finished path=%s status=%d duration=%s", remotePath, resp.StatusCode, time.Since(start))
-
-	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusNoContent {
-		return fmt.Errorf("unexpected status code: %d", resp.StatusCode)
-	}
+// UploadReader stores a file, replacing an existing one as a new version of
+// the same Nextcloud file, see upload.
+func (c *NextcloudClient) UploadReader(ctx context.Context, remotePath string, reader io.Reader, contentLength int64) error {
+	return c.upload(ctx, remotePath, reader, contentLength, true)
+}
 
-	return nil
+// CreateFile stores a new file like UploadReader, but fails with an error
+// wrapping ErrExists if the path is taken. The file is uploaded to a
+// temporary name and renamed once it is complete, see upload.
+func (c *NextcloudClient) CreateFile(ctx context.Context, remotePath string, reader io.Reader, contentLength int64) error {
+	return c.upload(ctx, remotePath, reader, contentLength, false)
 }
 
-func (c *NextcloudClient) DownloadFile(remotePath string) (*http.Response, error) {
-	req, err := http.NewRequest("GET", c.buildURL(remotePath), nil)
+func (c *NextcloudClient) DownloadFile(ctx context.Context, remotePath string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", c.buildURL(remotePath), nil)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
-	req.SetBasicAuth(c.Username, c.Password)
 
-	resp, err := c.client.Do(req)
+	resp, err := c.do(req)
 	if err != nil {
 		return nil, fmt.Errorf("failed to download file: %w", err)
 	}
-	if resp.StatusCode != http.StatusOK {
+	if resp.StatusCode == http.StatusNotFound {
 		resp.Body.Close()
-		return nil, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, remotePath)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, statusError(resp, remotePath)
 	}
 	return resp, nil
 }
 
-func (c *NextcloudClient) Stat(remotePath string) (bool, int64, error) {
-	req, err := http.NewRequest("HEAD", c.buildURL(remotePath), nil)
+// Download opens a file for reading.
+func (c *NextcloudClient) Download(ctx context.Context, remotePath string) (*StoredFile, error) {
+	resp, err := c.DownloadFile(ctx, remotePath)
+	if err != nil {
+		return nil, err
+	}
+	return &StoredFile{Body: resp.Body, ContentLength: resp.ContentLength, ContentType: resp.Header.Get("Content-Type")}, nil
+}
+
+func (c *NextcloudClient) Stat(ctx context.Context, remotePath string) (bool, int64, error) {
+	req, err := http.NewRequestWithContext(ctx, "HEAD", c.buildURL(remotePath), nil)
 	if err != nil {
 		return false, 0, fmt.Errorf("failed to create stat request: %w", err)
 	}
-	req.SetBasicAuth(c.Username, c.Password)
 
-	resp, err := c.client.Do(req)
+	resp, err := c.do(req)
 	if err != nil {
 		return false, 0, fmt.Errorf("failed to stat file: %w", err)
 	}
-	defer resp.Body.Close()
 
 	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
 		return false, 0, nil
 	}
 	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
-		return false, 0, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+		return false, 0, statusError(resp, remotePath)
 	}
+	resp.Body.Close()
 
 	contentLength := int64(-1)
 	if lengthHeader := resp.Header.Get("Content-Length"); lengthHeader != "" {
@@ -161,29 +175,248 @@ func (c *NextcloudClient) Stat(remotePath string) (bool, int64, error) {
 	return true, contentLength, nil
 }
 
-func (c *NextcloudClient) DeleteFile(remotePath string) error {
-	req, err := http.NewRequest("DELETE", c.buildURL(remotePath), nil)
+func (c *NextcloudClient) DeleteFile(ctx context.Context, remotePath string) error {
+	_, err := c.DeleteToTrash(ctx, remotePath)
+	return err
+}
+
+// DeleteToTrash deletes a file like DeleteFile and returns the server time of
+// the deletion, which names its copy in the trash bin. The time is zero if
+// the file was already gone.
+func (c *NextcloudClient) DeleteToTrash(ctx context.Context, remotePath string) (time.Time, error) {
+	req, err := http.NewRequestWithContext(ctx, "DELETE", c.buildURL(remotePath), nil)
 	if err != nil {
-		return fmt.Errorf("failed to create delete request: %w", err)
+		return time.Time{}, fmt.Errorf("failed to create delete request: %w", err)
 	}
-	req.SetBasicAuth(c.Username, c.Password)
 
-	resp, err := c.client.Do(req)
+	resp, err := c.do(req)
 	if err != nil {
-		return fmt.Errorf("failed to delete file: %w", err)
+		return time.Time{}, fmt.Errorf("failed to delete file: %w", err)
 	}
-	defer resp.Body.Close()
 
 	if resp.StatusCode == http.StatusNotFound {
-		return nil
+		resp.Body.Close()
+		return time.Time{}, nil
 	}
 	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
-		return fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+		return time.Time{}, statusError(resp, remotePath)
+	}
+	resp.Body.Close()
+
+	deleted, err := http.ParseTime(resp.Header.Get("Date"))
+	if err != nil {
+		deleted = time.Now()
+	}
+	return deleted, nil
+}
+
+// Move renames a file or folder with WebDAV MOVE. Existing targets are never
+// overwritten; a 412 status is reported as an error.
+func (c *NextcloudClient) Move(ctx context.Context, sourcePath, destinationPath string) error {
+	req, err := http.NewRequestWithContext(ctx, "MOVE", c.buildURL(sourcePath), nil)
+	if err != nil {
+		return fmt.Errorf("failed to create move request: %w", err)
+	}
+	req.Header.Set("Destination", c.buildURL(destinationPath))
+	req.Header.Set("Overwrite", "F")
+
+	resp, err := c.do(req)
+	if err != nil {
+		return fmt.Errorf("failed to move file: %w", err)
 	}
 
+	log.Printf("Nextcloud MOVE path=%s destination=%s status=%d", sourcePath, destinationPath, resp.StatusCode)
+
+	if err := transferError(resp, sourcePath, destinationPath); err != nil {
+		return err
+	}
+
+	// Directories below the old path no longer exist
+	source := strings.Trim(sourcePath, "/")
+	c.dirCache.Range(func(key, _ any) bool {
+		cached := strings.Trim(key.(string), "/")
+		if cached == source || strings.HasPrefix(cached, source+"/") {
+			c.dirCache.Delete(key)
+		}
+		return true
+	})
 	return nil
 }
 
+// Copy copies a file or folder with WebDAV COPY. Existing targets are never
+// overwritten; a 412 status is reported as an error.
+func (c *NextcloudClient) Copy(ctx context.Context, sourcePath, destinationPath string) error {
+	req, err := http.NewRequestWithContext(ctx, "COPY", c.buildURL(sourcePath), nil)
+	if err != nil {
+		return fmt.Errorf("failed to create copy request: %w", err)
+	}
+	req.Header.Set("Destination", c.buildURL(destinationPath))
+	req.Header.Set("Overwrite", "F")
+
+	resp, err := c.do(req)
+	if err != nil {
+		return fmt.Errorf("failed to copy file: %w", err)
+	}
+
+	log.Printf("Nextcloud COPY path=%s destination=%s status=%d", sourcePath, destinationPath, resp.StatusCode)
+
+	return transferError(resp, sourcePath, destinationPath)
+}
+
+// transferError checks the response of a MOVE or COPY and closes its body.
+func transferError(resp *http.Response, sourcePath, destinationPath string) error {
+	switch resp.StatusCode {
+	case http.StatusCreated, http.StatusNoContent:
+		resp.Body.Close()
+		return nil
+	case http.StatusNotFound:
+		resp.Body.Close()
+		return fmt.Errorf("%w: %s", ErrNotFound, sourcePath)
+	case http.StatusPreconditionFailed:
+		resp.Body.Close()
+		return fmt.Errorf("destination %s %w", destinationPath, ErrExists)
+	}
+	return statusError(resp, sourcePath)
+}
+
+type propfindResponse struct {
+	Responses []struct {
+		Href     string `xml:"href"`
+		Propstat []struct {
+			Status string `xml:"status"`
+			Prop   struct {
+				ResourceType struct {
+					Collection *struct{} `xml:"collection"`
+				} `xml:"resourcetype"`
+				ContentLength string `xml:"getcontentlength"`
+				ContentType   string `xml:"getcontenttype"`
+				ETag          string `xml:"getetag"`
+				LastModified  string `xml:"getlastmodified"`
+			} `xml:"prop"`
+		} `xml:"propstat"`
+	} `xml:"response"`
+}
+
+const propfindListBody = `<?xml version="1.0" encoding="UTF-8"?>
+<d:propfind xmlns:d="DAV:">
+  <d:prop>
+    <d:resourcetype/>
+    <d:getcontentlength/>
+    <d:getcontenttype/>
+    <d:getetag/>
+    <d:getlastmodified/>
+  </d:prop>
+</d:propfind>`
+
+// List returns the direct children of a folder using a Depth 1 PROPFIND.
+// Paths in the result are relative to the base URL, like the input path.
+func (c *NextcloudClient) List(ctx context.Context, remotePath string) ([]RemoteFile, error) {
+	req, err := http.NewRequestWithContext(ctx, "PROPFIND", c.buildURL(remotePath), strings.NewReader(propfindListBody))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create propfind request: %w", err)
+	}
+	req.Header.Set("Depth", "1")
+	req.Header.Set("Content-Type", "application/xml; charset=utf-8")
+
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list folder: %w", err)
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, remotePath)
+	}
+	if resp.StatusCode != http.StatusMultiStatus {
+		return nil, statusError(resp, remotePath)
+	}
+	defer resp.Body.Close()
+
+	var multistatus propfindResponse
+	if err := xml.NewDecoder(resp.Body).Decode(&multistatus); err != nil {
+		return nil, fmt.Errorf("failed to parse propfind response: %w", err)
+	}
+
+	self := strings.Trim(remotePath, "/")
+	var files []RemoteFile
+	for _, entry := range multistatus.Responses {
+		entryPath, err := c.relativePath(entry.Href)
+		if err != nil {
+			return nil, err
+		}
+		if entryPath == self {
+			continue
+		}
+		file := RemoteFile{Path: entryPath}
+		for _, propstat := range entry.Propstat {
+			if !strings.Contains(propstat.Status, " 200 ") {
+				continue
+			}
+			prop := propstat.Prop
+			file.IsDir = prop.ResourceType.Collection != nil
+			file.ETag = prop.ETag
+			file.ContentType = prop.ContentType
+			if prop.ContentLength != "" {
+				file.Size, _ = strconv.ParseInt(prop.ContentLength, 10, 64)
+			}
+			if prop.LastModified != "" {
+				file.LastModified, _ = http.ParseTime(prop.LastModified)
+			}
+		}
+		files = append(files, file)
+	}
+	return files, nil
+}
+
+// relativePath converts a PROPFIND href into a path relative to the base URL.
+func (c *NextcloudClient) relativePath(href string) (string, error) {
+	base, err := url.Parse(c.BaseURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid base URL: %w", err)
+	}
+	parsedHref, err := url.Parse(href)
+	if err != nil {
+		return "", fmt.Errorf("invalid href %q: %w", href, err)
+	}
+	hrefPath := strings.Trim(parsedHref.Path, "/")
+	basePath := strings.Trim(base.Path, "/")
+	if basePath != "" {
+		if hrefPath != basePath && !strings.HasPrefix(hrefPath, basePath+"/") {
+			return "", fmt.Errorf("href %q is outside of base URL", href)
+		}
+		hrefPath = strings.Trim(strings.TrimPrefix(hrefPath, basePath), "/")
+	}
+	return hrefPath, nil
+}
+
+// CheckConnection issues a Depth 0 PROPFIND on the base URL to verify that the
+// WebDAV endpoint is reachable and accepts the configured credentials.
+func (c *NextcloudClient) CheckConnection(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, "PROPFIND", c.buildURL(""), nil)
+	if err != nil {
+		return fmt.Errorf("failed to create propfind request: %w", err)
+	}
+	req.Header.Set("Depth", "0")
+
+	resp, err := c.do(req)
+	if err != nil {
+		return fmt.Errorf("failed to reach nextcloud: %w", err)
+	}
+
+	switch resp.StatusCode {
+	case http.StatusMultiStatus, http.StatusOK:
+		resp.Body.Close()
+		return nil
+	case http.StatusUnauthorized, http.StatusForbidden:
+		resp.Body.Close()
+		return fmt.Errorf("credentials rejected (status %d)", resp.StatusCode)
+	case http.StatusNotFound:
+		resp.Body.Close()
+		return fmt.Errorf("WebDAV path not found (status %d)", resp.StatusCode)
+	default:
+		return statusError(resp, "")
+	}
+}
+
 func (c *NextcloudClient) buildURL(remotePath string) string {
 	base := strings.TrimRight(c.BaseURL, "/")
 	trimmed := strings.TrimLeft(remotePath, "/")
@@ -197,7 +430,7 @@ func (c *NextcloudClient) buildURL(remotePath string) string {
 	return base + "/" + strings.Join(parts, "/")
 }
 
-func (c *NextcloudClient) EnsureDirectories(remotePath string) error {
+func (c *NextcloudClient) EnsureDirectories(ctx context.Context, remotePath string) error {
 	trimmed := strings.TrimLeft(remotePath, "/")
 	dirs := strings.Split(path.Dir(trimmed), "/")
 	current := ""
@@ -210,7 +443,7 @@ func (c *NextcloudClient) EnsureDirectories(remotePath string) error {
 		} else {
 			current = current + "/" + dir
 		}
-		if err := c.CreateDirectory(current); err != nil {
+		if err := c.CreateDirectory(ctx, current); err != nil {
 			return err
 		}
 	}
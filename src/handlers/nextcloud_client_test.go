@@ -1,23 +1,112 @@
 package handlers
 
 import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
-func TestNextcloudClientUploadAndDownload(t *testing.T) {
-	var uploadedBody string
+// fakeUploads answers the requests of uploads for fake Nextcloud servers
+// like Nextcloud: PUT of a temporary file with its OC-Checksum, PROPFIND to
+// check it, MOVE to the final path and DELETE after a failure. Replaced files
+// are written with a PUT to their final path.
+type fakeUploads struct {
+	lock  sync.Mutex
+	files map[string]string // Content by URL path
+	puts  int
+}
+
+func newFakeUploads() *fakeUploads {
+	return &fakeUploads{files: map[string]string{}}
+}
+
+// serve handles PUT, and PROPFIND, MOVE and DELETE of temporary files. It
+// returns false for other requests.
+func (f *fakeUploads) serve(w http.ResponseWriter, r *http.Request) bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	temp := strings.HasPrefix(path.Base(r.URL.Path), uploadTempPrefix)
+	switch {
+	case r.Method == "PUT":
+		f.puts++
+		body, _ := io.ReadAll(r.Body)
+		if checksum := r.Header.Get("OC-Checksum"); checksum != "" && checksum != sha1Checksum(string(body)) {
+			w.WriteHeader(http.StatusBadRequest)
+			return true
+		}
+		f.files[r.URL.Path] = string(body)
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == "PROPFIND" && temp:
+		content, ok := f.files[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return true
+		}
+		w.WriteHeader(http.StatusMultiStatus)
+		fmt.Fprintf(w, `<?xml version="1.0"?><d:multistatus xmlns:d="DAV:" xmlns:oc="http://owncloud.org/ns"><d:response><d:href>%s</d:href>`+
+			`<d:propstat><d:prop><d:getcontentlength>%d</d:getcontentlength><oc:checksums><oc:checksum>%s MD5:0</oc:checksum></oc:checksums></d:prop>`+
+			`<d:status>HTTP/1.1 200 OK</d:status></d:propstat></d:response></d:multistatus>`, r.URL.Path, len(content), sha1Checksum(content))
+	case r.Method == "MOVE" && temp:
+		destination, _ := url.Parse(r.Header.Get("Destination"))
+		if _, exists := f.files[destination.Path]; exists && r.Header.Get("Overwrite") == "F" {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return true
+		}
+		f.files[destination.Path] = f.files[r.URL.Path]
+		delete(f.files, r.URL.Path)
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == "DELETE" && temp:
+		delete(f.files, r.URL.Path)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		return false
+	}
+	return true
+}
 
+// paths returns the sorted paths of all stored files.
+func (f *fakeUploads) paths() []string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	paths := make([]string, 0, len(f.files))
+	for filePath := range f.files {
+		paths = append(paths, filePath)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+func (f *fakeUploads) file(filePath string) string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.files[filePath]
+}
+
+func sha1Checksum(content string) string {
+	sum := sha1.Sum([]byte(content))
+	return "SHA1:" + hex.EncodeToString(sum[:])
+}
+
+func TestNextcloudClientUploadAndDownload(t *testing.T) {
+	uploads := newFakeUploads()
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if uploads.serve(w, r) {
+			return
+		}
 		switch r.Method {
-		case "PUT":
-			body, _ := io.ReadAll(r.Body)
-			_ = r.Body.Close()
-			uploadedBody = string(body)
-			w.WriteHeader(http.StatusCreated)
 		case "GET":
 			w.WriteHeader(http.StatusOK)
 			_, _ = w.Write([]byte("downloaded"))
@@ -38,16 +127,19 @@ func TestNextcloudClientUploadAndDownload(t *testing.T) {
 	defer os.Remove(tmp.Name())
 
 	client := NewNextcloudClient(server.URL, "user", "pass")
-	if err := client.EnsureDirectories("media/2026/room/user/file.txt"); err != nil {
+	if err := client.EnsureDirectories(context.Background(), "media/2026/room/user/file.txt"); err != nil {
 		t.Fatalf("EnsureDirectories failed: %v", err)
 	}
-	if err := client.UploadFile("media/2026/room/user/file.txt", tmp.Name()); err != nil {
+	if err := client.UploadFile(context.Background(), "media/2026/room/user/file.txt", tmp.Name()); err != nil {
 		t.Fatalf("UploadFile failed: %v", err)
 	}
-	if uploadedBody != "uploaded" {
-		t.Fatalf("unexpected upload body: %s", uploadedBody)
+	if paths := uploads.paths(); len(paths) != 1 || paths[0] != "/media/2026/room/user/file.txt" {
+		t.Fatalf("expected the file at the final path, got %v", paths)
 	}
-	resp, err := client.DownloadFile("media/2026/room/user/file.txt")
+	if body := uploads.file("/media/2026/room/user/file.txt"); body != "uploaded" {
+		t.Fatalf("unexpected upload body: %s", body)
+	}
+	resp, err := client.DownloadFile(context.Background(), "media/2026/room/user/file.txt")
 	if err != nil {
 		t.Fatalf("DownloadFile failed: %v", err)
 	}
@@ -57,3 +149,173 @@ func TestNextcloudClientUploadAndDownload(t *testing.T) {
 		t.Fatalf("unexpected download body: %s", string(data))
 	}
 }
+
+func TestNextcloudClientCreateFile(t *testing.T) {
+	uploads := newFakeUploads()
+	truncate := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if truncate && r.Method == "PROPFIND" {
+			// The server stored less than was sent
+			w.WriteHeader(http.StatusMultiStatus)
+			_, _ = w.Write([]byte(`<?xml version="1.0"?><d:multistatus xmlns:d="DAV:"><d:response><d:href>/x</d:href>` +
+				`<d:propstat><d:prop><d:getcontentlength>3</d:getcontentlength></d:prop><d:status>HTTP/1.1 200 OK</d:status></d:propstat></d:response></d:multistatus>`))
+			return
+		}
+		uploads.serve(w, r)
+	}))
+	defer server.Close()
+	client := NewNextcloudClient(server.URL, "user", "pass")
+	ctx := context.Background()
+
+	if err := client.CreateFile(ctx, "photos/a.jpg", strings.NewReader("first"), 5); err != nil {
+		t.Fatalf("CreateFile failed: %v", err)
+	}
+	if err := client.CreateFile(ctx, "photos/a.jpg", strings.NewReader("second"), 6); !errors.Is(err, ErrExists) {
+		t.Fatalf("expected ErrExists, got %v", err)
+	}
+	if err := client.UploadReader(ctx, "photos/a.jpg", strings.NewReader("replaced"), 8); err != nil {
+		t.Fatalf("UploadReader failed: %v", err)
+	}
+	truncate = true
+	if err := client.CreateFile(ctx, "photos/b.jpg", strings.NewReader("content"), 7); err == nil || !strings.Contains(err.Error(), "incomplete") {
+		t.Fatalf("expected incomplete upload to fail, got %v", err)
+	}
+	// Failed uploads leave no temporary files behind
+	if paths := uploads.paths(); len(paths) != 1 || uploads.file("/photos/a.jpg") != "replaced" {
+		t.Fatalf("unexpected files %v", paths)
+	}
+}
+
+func TestNextcloudClientReplaceKeepsFile(t *testing.T) {
+	uploads := newFakeUploads()
+	var moves []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "MOVE" {
+			moves = append(moves, r.URL.Path+" Overwrite: "+r.Header.Get("Overwrite"))
+		}
+		uploads.serve(w, r)
+	}))
+	defer server.Close()
+	client := NewNextcloudClient(server.URL, "user", "pass")
+	ctx := context.Background()
+
+	if err := client.CreateFile(ctx, "photos/a.jpg", strings.NewReader("first"), 5); err != nil {
+		t.Fatalf("CreateFile failed: %v", err)
+	}
+	moves = nil
+	// Nextcloud deletes the target of a MOVE with "Overwrite: T", which
+	// would give the file a new ID and lose its versions and shares
+	if err := client.UploadReader(ctx, "photos/a.jpg", strings.NewReader("second"), 6); err != nil {
+		t.Fatalf("UploadReader failed: %v", err)
+	}
+	if len(moves) != 0 {
+		t.Fatalf("expected the file to be replaced without MOVE, got %v", moves)
+	}
+	if paths := uploads.paths(); len(paths) != 1 || uploads.file("/photos/a.jpg") != "second" {
+		t.Fatalf("unexpected files %v", paths)
+	}
+}
+
+func TestNextcloudClientRetries(t *testing.T) {
+	var puts, moves int
+	uploads := newFakeUploads()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "PUT" {
+			puts++
+			switch puts {
+			case 1:
+				w.Header().Set("Retry-After", "0")
+				w.WriteHeader(http.StatusTooManyRequests)
+				return
+			case 2:
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			}
+		}
+		if uploads.serve(w, r) {
+			return
+		}
+		if r.Method == "MOVE" {
+			moves++
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	defer server.Close()
+
+	client := NewNextcloudClient(server.URL, "user", "pass")
+	client.RetryDelay = time.Millisecond
+	if err := client.UploadReader(context.Background(), "file.txt", strings.NewReader("content"), 7); err != nil {
+		t.Fatalf("UploadReader failed: %v", err)
+	}
+	if puts != 3 || uploads.file("/file.txt") != "content" {
+		t.Fatalf("expected 3 attempts uploading the whole body, got %d: %v", puts, uploads.paths())
+	}
+	// A MOVE may have been applied before the gateway failed
+	if err := client.Move(context.Background(), "a.txt", "b.txt"); err == nil {
+		t.Fatalf("expected MOVE to fail")
+	}
+	if moves != 1 {
+		t.Fatalf("expected MOVE not to be retried, got %d attempts", moves)
+	}
+}
+
+func TestNextcloudClientTypedErrors(t *testing.T) {
+	statuses := map[string]int{
+		"missing":  http.StatusNotFound,
+		"conflict": http.StatusConflict,
+		"locked":   http.StatusLocked,
+		"full":     http.StatusInsufficientStorage,
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		folder, _, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+		if folder == "maintenance" {
+			w.Header().Set("X-Nextcloud-Maintenance-Mode", "1")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(statuses[folder])
+	}))
+	defer server.Close()
+
+	client := NewNextcloudClient(server.URL, "user", "pass")
+	client.MaxRetries = 1
+	client.RetryDelay = time.Millisecond
+	expected := map[string]error{
+		"missing":     ErrNotFound,
+		"conflict":    ErrConflict,
+		"locked":      ErrLocked,
+		"full":        ErrInsufficientStorage,
+		"maintenance": ErrMaintenance,
+	}
+	for folder, target := range expected {
+		err := client.UploadReader(context.Background(), folder+"/file.txt", strings.NewReader("x"), 1)
+		if !errors.Is(err, target) {
+			t.Fatalf("expected %v for %s, got %v", target, folder, err)
+		}
+	}
+	_, _, err := client.Stat(context.Background(), "maintenance/file.txt")
+	var statusErr *StatusError
+	if !errors.As(err, &statusErr) || !statusErr.Maintenance || statusErr.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected maintenance status error, got %v", err)
+	}
+}
+
+func TestNextcloudClientCancelsRetries(t *testing.T) {
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	client := NewNextcloudClient(server.URL, "user", "pass")
+	client.RetryDelay = time.Hour
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := client.DownloadFile(ctx, "file.txt"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the wait for a retry to be cancelled, got %v", err)
+	}
+	if attempts != 1 {
+		t.Fatalf("expected a single attempt, got %d", attempts)
+	}
+}
@@ -0,0 +1,163 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// BridgePropertyNamespace is the XML namespace of the WebDAV properties the
+// bridge stores on archived files.
+const BridgePropertyNamespace = "https://github.com/muellni/nextcloud-media-bridge/ns"
+
+// davRootURL returns the URL of the Nextcloud DAV root (…/remote.php/dav),
+// derived from the files base URL.
+func (c *NextcloudClient) davRootURL() (string, error) {
+	base, err := url.Parse(c.BaseURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid base URL: %w", err)
+	}
+	for _, marker := range []string{"/remote.php/dav/", "/remote.php/webdav"} {
+		if index := strings.Index(base.Path, marker); index >= 0 {
+			base.Path = base.Path[:index] + "/remote.php/dav"
+			base.RawPath = ""
+			return strings.TrimRight(base.String(), "/"), nil
+		}
+	}
+	return "", fmt.Errorf("base URL %q is not a Nextcloud WebDAV URL", c.BaseURL)
+}
+
+// SetProperties stores custom WebDAV properties in BridgePropertyNamespace on
+// a file using PROPPATCH. Nextcloud keeps them as dead properties.
+func (c *NextcloudClient) SetProperties(ctx context.Context, remotePath string, properties map[string]string) error {
+	names := make([]string, 0, len(properties))
+	for name := range properties {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var body bytes.Buffer
+	body.WriteString(`<?xml version="1.0" encoding="UTF-8"?>` + "\n")
+	fmt.Fprintf(&body, `<d:propertyupdate xmlns:d="DAV:" xmlns:mb="%s"><d:set><d:prop>`, BridgePropertyNamespace)
+	for _, name := range names {
+		fmt.Fprintf(&body, "<mb:%s>", name)
+		if err := xml.EscapeText(&body, []byte(properties[name])); err != nil {
+			return err
+		}
+		fmt.Fprintf(&body, "</mb:%s>", name)
+	}
+	body.WriteString(`</d:prop></d:set></d:propertyupdate>`)
+
+	req, err := http.NewRequestWithContext(ctx, "PROPPATCH", c.buildURL(remotePath), &body)
+	if err != nil {
+		return fmt.Errorf("failed to create proppatch request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/xml; charset=utf-8")
+
+	resp, err := c.do(req)
+	if err != nil {
+		return fmt.Errorf("failed to set properties: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("%w: %s", ErrNotFound, remotePath)
+	}
+	if resp.StatusCode != http.StatusMultiStatus {
+		return statusError(resp, remotePath)
+	}
+	// PROPPATCH reports failures per property inside the multistatus
+	responseBody, _ := io.ReadAll(resp.Body)
+	var multistatus struct {
+		Statuses []string `xml:"response>propstat>status"`
+	}
+	if err := xml.Unmarshal(responseBody, &multistatus); err != nil {
+		return fmt.Errorf("failed to parse proppatch response: %w", err)
+	}
+	for _, status := range multistatus.Statuses {
+		if !strings.Contains(status, " 200 ") {
+			return fmt.Errorf("property update rejected: %s", status)
+		}
+	}
+	return nil
+}
+
+// FileID returns the Nextcloud file ID (oc:fileid) of a file, needed for the
+// comments and system tags endpoints.
+func (c *NextcloudClient) FileID(ctx context.Context, remotePath string) (string, error) {
+	body := `<?xml version="1.0" encoding="UTF-8"?>
+<d:propfind xmlns:d="DAV:" xmlns:oc="http://owncloud.org/ns">
+  <d:prop><oc:fileid/></d:prop>
+</d:propfind>`
+	req, err := http.NewRequestWithContext(ctx, "PROPFIND", c.buildURL(remotePath), strings.NewReader(body))
+	if err != nil {
+		return "", fmt.Errorf("failed to create propfind request: %w", err)
+	}
+	req.Header.Set("Depth", "0")
+	req.Header.Set("Content-Type", "application/xml; charset=utf-8")
+
+	resp, err := c.do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to get file id: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return "", fmt.Errorf("%w: %s", ErrNotFound, remotePath)
+	}
+	if resp.StatusCode != http.StatusMultiStatus {
+		return "", statusError(resp, remotePath)
+	}
+	var multistatus struct {
+		FileIDs []string `xml:"response>propstat>prop>fileid"`
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&multistatus); err != nil {
+		return "", fmt.Errorf("failed to parse propfind response: %w", err)
+	}
+	for _, fileID := range multistatus.FileIDs {
+		if fileID != "" {
+			return fileID, nil
+		}
+	}
+	return "", fmt.Errorf("no file id returned for %s", remotePath)
+}
+
+// AddComment adds a comment to a file through the Nextcloud comments DAV
+// endpoint. The comment is shown in the file's activity sidebar.
+func (c *NextcloudClient) AddComment(ctx context.Context, fileID, message string) error {
+	root, err := c.davRootURL()
+	if err != nil {
+		return err
+	}
+	payload, err := json.Marshal(map[string]string{
+		"actorType": "users",
+		"verb":      "comment",
+		"message":   message,
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, root+"/comments/files/"+url.PathEscape(fileID), bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("failed to create comment request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.do(req)
+	if err != nil {
+		return fmt.Errorf("failed to add comment: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		return statusError(resp, "comments/files/"+fileID)
+	}
+	return nil
+}
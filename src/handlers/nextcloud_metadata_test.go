@@ -0,0 +1,97 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNextcloudClientMetadata(t *testing.T) {
+	var proppatchBody string
+	var comment map[string]string
+	var commentPath string
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/remote.php/dav/files/bridge/", func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		switch r.Method {
+		case "PROPPATCH":
+			proppatchBody = string(body)
+			w.WriteHeader(http.StatusMultiStatus)
+			_, _ = w.Write([]byte(`<?xml version="1.0"?><d:multistatus xmlns:d="DAV:"><d:response><d:href>/x</d:href><d:propstat><d:prop/><d:status>HTTP/1.1 200 OK</d:status></d:propstat></d:response></d:multistatus>`))
+		case "PROPFIND":
+			if !strings.Contains(string(body), "fileid") {
+				t.Errorf("propfind does not request fileid: %s", body)
+			}
+			w.WriteHeader(http.StatusMultiStatus)
+			_, _ = w.Write([]byte(`<?xml version="1.0"?><d:multistatus xmlns:d="DAV:" xmlns:oc="http://owncloud.org/ns"><d:response><d:href>/x</d:href><d:propstat><d:prop><oc:fileid>4711</oc:fileid></d:prop><d:status>HTTP/1.1 200 OK</d:status></d:propstat></d:response></d:multistatus>`))
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	})
+	mux.HandleFunc("/remote.php/dav/comments/files/", func(w http.ResponseWriter, r *http.Request) {
+		commentPath = r.URL.Path
+		_ = json.NewDecoder(r.Body).Decode(&comment)
+		w.WriteHeader(http.StatusCreated)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	client := NewNextcloudClient(server.URL+"/remote.php/dav/files/bridge", "user", "pass")
+	annotation := mediaAnnotation{
+		Sender:   "@alice:example.org",
+		RoomID:   "!room:example.org",
+		RoomName: "Holidays",
+		EventID:  "$event",
+		Caption:  "Sunset <3 & friends",
+	}
+	if err := client.SetProperties(context.Background(), "media/photo.jpg", annotation.Properties()); err != nil {
+		t.Fatalf("SetProperties failed: %v", err)
+	}
+	if !strings.Contains(proppatchBody, "<mb:caption>Sunset &lt;3 &amp; friends</mb:caption>") {
+		t.Fatalf("caption not escaped in proppatch body: %s", proppatchBody)
+	}
+	if !strings.Contains(proppatchBody, `xmlns:mb="`+BridgePropertyNamespace+`"`) {
+		t.Fatalf("missing namespace in proppatch body: %s", proppatchBody)
+	}
+	if strings.Contains(proppatchBody, "sender_name") {
+		t.Fatalf("empty property should be left out: %s", proppatchBody)
+	}
+
+	fileID, err := client.FileID(context.Background(), "media/photo.jpg")
+	if err != nil {
+		t.Fatalf("FileID failed: %v", err)
+	}
+	if fileID != "4711" {
+		t.Fatalf("unexpected file id %q", fileID)
+	}
+	if err := client.AddComment(context.Background(), fileID, annotation.Comment()); err != nil {
+		t.Fatalf("AddComment failed: %v", err)
+	}
+	if commentPath != "/remote.php/dav/comments/files/4711" {
+		t.Fatalf("unexpected comment path %q", commentPath)
+	}
+	if comment["actorType"] != "users" || comment["verb"] != "comment" {
+		t.Fatalf("unexpected comment payload %v", comment)
+	}
+	if !strings.Contains(comment["message"], "Posted by @alice:example.org in Holidays") || !strings.Contains(comment["message"], "Sunset <3 & friends") {
+		t.Fatalf("unexpected comment message %q", comment["message"])
+	}
+}
+
+func TestNextcloudClientSetPropertiesRejected(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusMultiStatus)
+		_, _ = w.Write([]byte(`<?xml version="1.0"?><d:multistatus xmlns:d="DAV:"><d:response><d:href>/x</d:href><d:propstat><d:prop/><d:status>HTTP/1.1 403 Forbidden</d:status></d:propstat></d:response></d:multistatus>`))
+	}))
+	defer server.Close()
+
+	client := NewNextcloudClient(server.URL+"/remote.php/dav/files/bridge", "user", "pass")
+	if err := client.SetProperties(context.Background(), "photo.jpg", map[string]string{"sender": "@alice:example.org"}); err == nil {
+		t.Fatal("expected rejected property update to fail")
+	}
+}
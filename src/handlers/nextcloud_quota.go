@@ -0,0 +1,96 @@
+package handlers
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Quota is the storage quota of a WebDAV account as reported by the
+// quota-used-bytes and quota-available-bytes properties of RFC 4331.
+type Quota struct {
+	Used      int64
+	Available int64 // -1 if the quota is unlimited or unknown
+}
+
+// Limited reports whether the account has a quota.
+func (q Quota) Limited() bool {
+	return q.Available >= 0
+}
+
+// UsedPercent returns the share of the quota in use, or 0 without a quota.
+func (q Quota) UsedPercent() float64 {
+	if !q.Limited() || q.Used+q.Available <= 0 {
+		return 0
+	}
+	return float64(q.Used) * 100 / float64(q.Used+q.Available)
+}
+
+const propfindQuotaBody = `<?xml version="1.0" encoding="UTF-8"?>
+<d:propfind xmlns:d="DAV:">
+  <d:prop>
+    <d:quota-available-bytes/>
+    <d:quota-used-bytes/>
+  </d:prop>
+</d:propfind>`
+
+type propfindQuotaResponse struct {
+	Responses []struct {
+		Propstat []struct {
+			Status string `xml:"status"`
+			Prop   struct {
+				Available string `xml:"quota-available-bytes"`
+				Used      string `xml:"quota-used-bytes"`
+			} `xml:"prop"`
+		} `xml:"propstat"`
+	} `xml:"response"`
+}
+
+// Quota returns the quota of the folder at the base URL with a Depth 0
+// PROPFIND. Nextcloud reports negative available bytes for unlimited or not
+// yet computed quotas; they are returned as -1.
+func (c *NextcloudClient) Quota(ctx context.Context) (Quota, error) {
+	req, err := http.NewRequestWithContext(ctx, "PROPFIND", c.buildURL(""), strings.NewReader(propfindQuotaBody))
+	if err != nil {
+		return Quota{}, fmt.Errorf("failed to create propfind request: %w", err)
+	}
+	req.Header.Set("Depth", "0")
+	req.Header.Set("Content-Type", "application/xml; charset=utf-8")
+
+	resp, err := c.do(req)
+	if err != nil {
+		return Quota{}, fmt.Errorf("failed to query quota: %w", err)
+	}
+	if resp.StatusCode != http.StatusMultiStatus {
+		return Quota{}, statusError(resp, "")
+	}
+	defer resp.Body.Close()
+
+	var multistatus propfindQuotaResponse
+	if err := xml.NewDecoder(resp.Body).Decode(&multistatus); err != nil {
+		return Quota{}, fmt.Errorf("failed to parse propfind response: %w", err)
+	}
+	quota := Quota{Available: -1}
+	found := false
+	for _, entry := range multistatus.Responses {
+		for _, propstat := range entry.Propstat {
+			if !strings.Contains(propstat.Status, " 200 ") {
+				continue
+			}
+			if used, err := strconv.ParseInt(propstat.Prop.Used, 10, 64); err == nil {
+				quota.Used = used
+				found = true
+			}
+			if available, err := strconv.ParseInt(propstat.Prop.Available, 10, 64); err == nil && available >= 0 {
+				quota.Available = available
+			}
+		}
+	}
+	if !found {
+		return Quota{}, fmt.Errorf("server does not report quota-used-bytes")
+	}
+	return quota, nil
+}
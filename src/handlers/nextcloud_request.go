@@ -0,0 +1,195 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Errors for the failures callers can act on, wrapped in the errors of
+// Nextcloud requests. Other storage backends wrap ErrNotFound and ErrExists
+// as well.
+var (
+	ErrNotFound            = errors.New("not found")
+	ErrExists              = errors.New("already exists")       // 412, the destination of a move, copy or new file is taken
+	ErrConflict            = errors.New("conflict")             // 409, e.g. a missing parent folder
+	ErrLocked              = errors.New("locked")               // 423, the file is being written
+	ErrInsufficientStorage = errors.New("insufficient storage") // 507, the quota is exceeded
+	ErrMaintenance         = errors.New("nextcloud is in maintenance mode")
+)
+
+const (
+	defaultMaxRetries = 4
+	defaultRetryDelay = time.Second
+	// maxRetryWait is the longest wait before a retry. Responses asking to
+	// wait longer with Retry-After are returned as errors right away.
+	maxRetryWait = 2 * time.Minute
+)
+
+// StatusError is a response of Nextcloud with an unexpected status code. It
+// wraps the error of its status, like ErrNotFound, so errors.Is works.
+type StatusError struct {
+	Method      string
+	Path        string
+	StatusCode  int
+	Maintenance bool          // The server is in maintenance mode
+	RetryAfter  time.Duration // Wait requested with Retry-After, if any
+}
+
+func (e *StatusError) Error() string {
+	if e.Maintenance {
+		return fmt.Sprintf("unexpected status code: %d (maintenance mode)", e.StatusCode)
+	}
+	return fmt.Sprintf("unexpected status code: %d", e.StatusCode)
+}
+
+func (e *StatusError) Unwrap() error {
+	switch {
+	case e.Maintenance:
+		return ErrMaintenance
+	case e.StatusCode == http.StatusNotFound:
+		return ErrNotFound
+	case e.StatusCode == http.StatusConflict:
+		return ErrConflict
+	case e.StatusCode == http.StatusLocked:
+		return ErrLocked
+	case e.StatusCode == http.StatusInsufficientStorage:
+		return ErrInsufficientStorage
+	}
+	return nil
+}
+
+// statusError returns the error for an unexpected response and closes its
+// body.
+func statusError(resp *http.Response, remotePath string) error {
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 8<<10))
+	return newStatusError(resp, remotePath, body)
+}
+
+// newStatusError returns the error for an unexpected response whose body was
+// read already.
+func newStatusError(resp *http.Response, remotePath string, body []byte) *StatusError {
+	return &StatusError{
+		Method:     resp.Request.Method,
+		Path:       remotePath,
+		StatusCode: resp.StatusCode,
+		// WebDAV and OCS report maintenance mode in the body
+		Maintenance: resp.StatusCode == http.StatusServiceUnavailable &&
+			(isMaintenance(resp) || strings.Contains(strings.ToLower(string(body)), "maintenance mode")),
+		RetryAfter: retryAfter(resp),
+	}
+}
+
+func isMaintenance(resp *http.Response) bool {
+	return resp.Header.Get("X-Nextcloud-Maintenance-Mode") == "1"
+}
+
+// retryAfter parses the Retry-After header in seconds or as an HTTP date.
+func retryAfter(resp *http.Response) time.Duration {
+	value := resp.Header.Get("Retry-After")
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		if wait := time.Until(date); wait > 0 {
+			return wait
+		}
+	}
+	return 0
+}
+
+// idempotentMethods are retried after network errors and gateway errors.
+// Others are only retried when Nextcloud refused the request with 429 or 503,
+// so a MOVE or POST is never applied twice.
+var idempotentMethods = map[string]bool{
+	http.MethodGet:    true,
+	http.MethodHead:   true,
+	http.MethodPut:    true,
+	http.MethodDelete: true,
+	"MKCOL":           true,
+	"PROPFIND":        true,
+	"PROPPATCH":       true,
+}
+
+// do sends an authenticated request. Requests refused with 429 or 503 are
+// retried with jittered exponential backoff, waiting at least as long as
+// Retry-After asks; idempotent requests are also retried after network
+// errors and 502 or 504 responses. Requests whose body cannot be read again
+// are sent once. The last response is returned for the caller to check.
+func (c *NextcloudClient) do(req *http.Request) (*http.Response, error) {
+	req.SetBasicAuth(c.Username, c.Password)
+	replayable := req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req.Body = body
+		}
+		resp, err := c.client.Do(req)
+
+		var wait time.Duration
+		var reason string
+		switch {
+		case err != nil:
+			if req.Context().Err() != nil || !idempotentMethods[req.Method] {
+				return nil, err
+			}
+			reason = err.Error()
+		case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable:
+			wait = retryAfter(resp)
+			reason = resp.Status
+			if isMaintenance(resp) {
+				reason += " (maintenance mode)"
+			}
+		case idempotentMethods[req.Method] && (resp.StatusCode == http.StatusBadGateway || resp.StatusCode == http.StatusGatewayTimeout):
+			reason = resp.Status
+		default:
+			return resp, nil
+		}
+		if wait == 0 {
+			wait = c.backoff(attempt)
+		}
+		if attempt >= c.MaxRetries || !replayable || wait > maxRetryWait {
+			return resp, err
+		}
+		if resp != nil {
+			_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+			resp.Body.Close()
+		}
+
+		log.Printf("Nextcloud %s %s failed: %s, retrying in %s (attempt %d of %d)", req.Method, req.URL.Path, reason, wait.Round(time.Millisecond), attempt+1, c.MaxRetries)
+		timer := time.NewTimer(wait)
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// backoff returns a random wait between half and all of RetryDelay doubled
+// for each attempt, so clients failing at the same time do not retry at the
+// same time.
+func (c *NextcloudClient) backoff(attempt int) time.Duration {
+	if c.RetryDelay <= 0 {
+		return 0
+	}
+	limit := c.RetryDelay << attempt
+	if limit <= 0 || limit > maxRetryWait {
+		limit = maxRetryWait
+	}
+	return limit/2 + rand.N(limit/2+1)
+}
@@ -0,0 +1,184 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// SystemTag is a Nextcloud collaborative (system) tag.
+type SystemTag struct {
+	ID   string
+	Name string
+}
+
+// SystemTags lists the system tags visible to the bridge user.
+func (c *NextcloudClient) SystemTags(ctx context.Context) ([]SystemTag, error) {
+	root, err := c.davRootURL()
+	if err != nil {
+		return nil, err
+	}
+	body := `<?xml version="1.0" encoding="UTF-8"?>
+<d:propfind xmlns:d="DAV:" xmlns:oc="http://owncloud.org/ns">
+  <d:prop><oc:id/><oc:display-name/></d:prop>
+</d:propfind>`
+	req, err := http.NewRequestWithContext(ctx, "PROPFIND", root+"/systemtags/", strings.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create propfind request: %w", err)
+	}
+	req.Header.Set("Depth", "1")
+	req.Header.Set("Content-Type", "application/xml; charset=utf-8")
+
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list system tags: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusMultiStatus {
+		return nil, statusError(resp, "systemtags")
+	}
+	var multistatus struct {
+		Responses []struct {
+			ID   string `xml:"propstat>prop>id"`
+			Name string `xml:"propstat>prop>display-name"`
+		} `xml:"response"`
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&multistatus); err != nil {
+		return nil, fmt.Errorf("failed to parse propfind response: %w", err)
+	}
+	tags := make([]SystemTag, 0, len(multistatus.Responses))
+	for _, response := range multistatus.Responses {
+		// The collection itself is listed without an ID
+		if response.ID == "" {
+			continue
+		}
+		tags = append(tags, SystemTag{ID: response.ID, Name: response.Name})
+	}
+	return tags, nil
+}
+
+// CreateSystemTag creates a visible, assignable system tag and returns its ID.
+func (c *NextcloudClient) CreateSystemTag(ctx context.Context, name string) (string, error) {
+	root, err := c.davRootURL()
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(map[string]any{
+		"name":           name,
+		"userVisible":    true,
+		"userAssignable": true,
+		"canAssign":      true,
+	})
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, root+"/systemtags/", bytes.NewReader(payload))
+	if err != nil {
+		return "", fmt.Errorf("failed to create tag request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to create system tag: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		return "", statusError(resp, "systemtags")
+	}
+	// The new tag's URL ends with its ID
+	location := resp.Header.Get("Content-Location")
+	if location == "" {
+		return "", fmt.Errorf("no tag id returned for %q", name)
+	}
+	return path.Base(location), nil
+}
+
+// SystemTagID returns the ID of the system tag with the given name, creating
+// the tag if it does not exist yet. IDs are cached for the client's lifetime.
+func (c *NextcloudClient) SystemTagID(ctx context.Context, name string) (string, error) {
+	if cached, ok := c.tagCache.Load(name); ok {
+		return cached.(string), nil
+	}
+	if tagID, ok, err := c.lookupSystemTag(ctx, name); err != nil || ok {
+		return tagID, err
+	}
+	tagID, err := c.CreateSystemTag(ctx, name)
+	if errors.Is(err, ErrConflict) {
+		// The tag exists but was not listed, because another upload created
+		// it in the meantime or it is invisible or restricted. Admins see
+		// those tags in the listing.
+		existingID, ok, listErr := c.lookupSystemTag(ctx, name)
+		if listErr != nil {
+			return "", listErr
+		}
+		if !ok {
+			return "", fmt.Errorf("system tag %q exists but is not visible to the bridge user: %w", name, err)
+		}
+		return existingID, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	c.tagCache.Store(name, tagID)
+	return tagID, nil
+}
+
+// lookupSystemTag lists the system tags into the cache and returns the ID of
+// the tag with the given name, if it is listed.
+func (c *NextcloudClient) lookupSystemTag(ctx context.Context, name string) (string, bool, error) {
+	tags, err := c.SystemTags(ctx)
+	if err != nil {
+		return "", false, err
+	}
+	for _, tag := range tags {
+		c.tagCache.Store(tag.Name, tag.ID)
+	}
+	if cached, ok := c.tagCache.Load(name); ok {
+		return cached.(string), true, nil
+	}
+	return "", false, nil
+}
+
+// AssignSystemTag tags a file. Assigning a tag the file already has succeeds.
+func (c *NextcloudClient) AssignSystemTag(ctx context.Context, fileID, tagID string) error {
+	root, err := c.davRootURL()
+	if err != nil {
+		return err
+	}
+	target := root + "/systemtags-relations/files/" + url.PathEscape(fileID) + "/" + url.PathEscape(tagID)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, target, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create tag assignment request: %w", err)
+	}
+
+	resp, err := c.do(req)
+	if err != nil {
+		return fmt.Errorf("failed to assign system tag: %w", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusCreated, http.StatusNoContent, http.StatusConflict:
+		return nil
+	case http.StatusNotFound:
+		// The tag was deleted in Nextcloud, look it up again next time
+		c.tagCache.Range(func(name, id any) bool {
+			if id == tagID {
+				c.tagCache.Delete(name)
+			}
+			return true
+		})
+		return fmt.Errorf("%w: tag %s or file %s", ErrNotFound, tagID, fileID)
+	}
+	return statusError(resp, "systemtags-relations/files/"+fileID)
+}
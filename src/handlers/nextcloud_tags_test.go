@@ -0,0 +1,105 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNextcloudClientSystemTags(t *testing.T) {
+	var created []string
+	var assigned []string
+	listings := 0
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/remote.php/dav/systemtags/", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "PROPFIND":
+			listings++
+			w.WriteHeader(http.StatusMultiStatus)
+			_, _ = w.Write([]byte(`<?xml version="1.0"?><d:multistatus xmlns:d="DAV:" xmlns:oc="http://owncloud.org/ns">` +
+				`<d:response><d:href>/remote.php/dav/systemtags/</d:href><d:propstat><d:prop/><d:status>HTTP/1.1 200 OK</d:status></d:propstat></d:response>` +
+				`<d:response><d:href>/remote.php/dav/systemtags/3</d:href><d:propstat><d:prop><oc:id>3</oc:id><oc:display-name>matrix</oc:display-name></d:prop><d:status>HTTP/1.1 200 OK</d:status></d:propstat></d:response>` +
+				`</d:multistatus>`))
+		case http.MethodPost:
+			var payload map[string]any
+			_ = json.NewDecoder(r.Body).Decode(&payload)
+			created = append(created, payload["name"].(string))
+			w.Header().Set("Content-Location", "/remote.php/dav/systemtags/9")
+			w.WriteHeader(http.StatusCreated)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	})
+	mux.HandleFunc("/remote.php/dav/systemtags-relations/files/", func(w http.ResponseWriter, r *http.Request) {
+		assigned = append(assigned, strings.TrimPrefix(r.URL.Path, "/remote.php/dav/systemtags-relations/files/"))
+		if strings.HasSuffix(r.URL.Path, "/3") {
+			// Already assigned
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	client := NewNextcloudClient(server.URL+"/remote.php/dav/files/bridge", "user", "pass")
+	existing, err := client.SystemTagID(context.Background(), "matrix")
+	if err != nil || existing != "3" {
+		t.Fatalf("expected existing tag 3, got %q (%v)", existing, err)
+	}
+	createdID, err := client.SystemTagID(context.Background(), "room:Holidays")
+	if err != nil || createdID != "9" {
+		t.Fatalf("expected created tag 9, got %q (%v)", createdID, err)
+	}
+	if _, err := client.SystemTagID(context.Background(), "room:Holidays"); err != nil {
+		t.Fatalf("cached lookup failed: %v", err)
+	}
+	if listings != 2 || len(created) != 1 || created[0] != "room:Holidays" {
+		t.Fatalf("unexpected requests: %d listings, created %v", listings, created)
+	}
+
+	for _, tagID := range []string{existing, createdID} {
+		if err := client.AssignSystemTag(context.Background(), "4711", tagID); err != nil {
+			t.Fatalf("AssignSystemTag(%s) failed: %v", tagID, err)
+		}
+	}
+	if strings.Join(assigned, ",") != "4711/3,4711/9" {
+		t.Fatalf("unexpected assignments %v", assigned)
+	}
+}
+
+func TestNextcloudClientSystemTagCreatedConcurrently(t *testing.T) {
+	listings := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "PROPFIND":
+			listings++
+			tags := ""
+			if listings > 1 {
+				// Created by someone else after the first listing
+				tags = `<d:response><d:href>/remote.php/dav/systemtags/5</d:href><d:propstat><d:prop><oc:id>5</oc:id><oc:display-name>room:Holidays</oc:display-name></d:prop><d:status>HTTP/1.1 200 OK</d:status></d:propstat></d:response>`
+			}
+			w.WriteHeader(http.StatusMultiStatus)
+			_, _ = w.Write([]byte(`<?xml version="1.0"?><d:multistatus xmlns:d="DAV:" xmlns:oc="http://owncloud.org/ns">` + tags + `</d:multistatus>`))
+		case http.MethodPost:
+			w.WriteHeader(http.StatusConflict)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}))
+	defer server.Close()
+
+	client := NewNextcloudClient(server.URL+"/remote.php/dav/files/bridge", "user", "pass")
+	tagID, err := client.SystemTagID(context.Background(), "room:Holidays")
+	if err != nil || tagID != "5" {
+		t.Fatalf("expected existing tag 5, got %q (%v)", tagID, err)
+	}
+	if _, err := client.SystemTagID(context.Background(), "room:Hidden"); !errors.Is(err, ErrConflict) {
+		t.Fatalf("expected a conflict for a tag that is not listed, got %v", err)
+	}
+}
@@ -0,0 +1,235 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// TalkMessage is a chat message of a Nextcloud Talk conversation.
+type TalkMessage struct {
+	ID               int64  `json:"id"`
+	ActorType        string `json:"actorType"`
+	ActorID          string `json:"actorId"`
+	ActorDisplayName string `json:"actorDisplayName"`
+	Timestamp        int64  `json:"timestamp"`
+	Message          string `json:"message"`
+	SystemMessage    string `json:"systemMessage"`
+	// MessageParameters is an object, or an empty array if the message has
+	// no parameters.
+	MessageParameters json.RawMessage `json:"messageParameters"`
+}
+
+// TalkFile is a file shared into a Talk conversation.
+type TalkFile struct {
+	Name     string      `json:"name"`
+	Path     string      `json:"path"` // Relative to the files of the bridge's Nextcloud user
+	MimeType string      `json:"mimetype"`
+	Size     json.Number `json:"size"`
+	ETag     string      `json:"etag"`
+}
+
+// File returns the file shared by the message, or nil if it shares none.
+func (m TalkMessage) File() *TalkFile {
+	if len(m.MessageParameters) == 0 || m.MessageParameters[0] != '{' {
+		return nil
+	}
+	var parameters map[string]struct {
+		Type string `json:"type"`
+		TalkFile
+	}
+	if err := json.Unmarshal(m.MessageParameters, &parameters); err != nil {
+		return nil
+	}
+	file, ok := parameters["file"]
+	if !ok || file.Type != "file" || file.Path == "" {
+		return nil
+	}
+	return &file.TalkFile
+}
+
+// Caption returns the text sent with a shared file, without the placeholder
+// Talk uses for the file.
+func (m TalkMessage) Caption() string {
+	return strings.TrimSpace(strings.ReplaceAll(m.Message, "{file}", ""))
+}
+
+// ocsURL returns the URL of an OCS API endpoint on the Nextcloud server of
+// the base URL.
+func (c *NextcloudClient) ocsURL(endpoint string) (string, error) {
+	base, err := url.Parse(c.BaseURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid base URL: %w", err)
+	}
+	index := strings.Index(base.Path, "/remote.php/")
+	if index < 0 {
+		return "", fmt.Errorf("base URL %q is not a Nextcloud WebDAV URL", c.BaseURL)
+	}
+	base.Path = base.Path[:index] + "/ocs/v2.php/" + strings.TrimLeft(endpoint, "/")
+	base.RawPath = ""
+	base.RawQuery = ""
+	return base.String(), nil
+}
+
+// ocsRequest sends an OCS API request and decodes the data of the response
+// into result, if it is not nil. A 304 Not Modified response leaves result
+// untouched.
+func (c *NextcloudClient) ocsRequest(ctx context.Context, method, endpoint string, query url.Values, form url.Values, result any) error {
+	target, err := c.ocsURL(endpoint)
+	if err != nil {
+		return err
+	}
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+	var body io.Reader
+	if form != nil {
+		body = strings.NewReader(form.Encode())
+	}
+	req, err := http.NewRequestWithContext(ctx, method, target, body)
+	if err != nil {
+		return fmt.Errorf("failed to create OCS request: %w", err)
+	}
+	req.Header.Set("OCS-APIRequest", "true")
+	req.Header.Set("Accept", "application/json")
+	if form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+
+	resp, err := c.do(req)
+	if err != nil {
+		return fmt.Errorf("OCS request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified {
+		return nil
+	}
+	var envelope struct {
+		OCS struct {
+			Meta struct {
+				StatusCode int    `json:"statuscode"`
+				Message    string `json:"message"`
+			} `json:"meta"`
+			Data json.RawMessage `json:"data"`
+		} `json:"ocs"`
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read OCS response: %w", err)
+	}
+	decodeErr := json.Unmarshal(data, &envelope)
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		statusErr := newStatusError(resp, endpoint, data)
+		if envelope.OCS.Meta.Message != "" {
+			return fmt.Errorf("%w: %s", statusErr, envelope.OCS.Meta.Message)
+		}
+		return statusErr
+	}
+	if decodeErr != nil {
+		return fmt.Errorf("failed to parse OCS response: %w", decodeErr)
+	}
+	if result != nil && len(envelope.OCS.Data) > 0 {
+		if err := json.Unmarshal(envelope.OCS.Data, result); err != nil {
+			return fmt.Errorf("failed to parse OCS response: %w", err)
+		}
+	}
+	return nil
+}
+
+// TalkMessages returns the messages of a Talk conversation newer than
+// lastKnownID, oldest first, without waiting for new ones.
+func (c *NextcloudClient) TalkMessages(ctx context.Context, token string, lastKnownID int64) ([]TalkMessage, error) {
+	query := url.Values{
+		"lookIntoFuture":     {"1"},
+		"lastKnownMessageId": {strconv.FormatInt(lastKnownID, 10)},
+		"timeout":            {"0"},
+		"limit":              {"100"},
+		"setReadMarker":      {"0"},
+	}
+	var messages []TalkMessage
+	if err := c.ocsRequest(ctx, http.MethodGet, "apps/spreed/api/v1/chat/"+url.PathEscape(token), query, nil, &messages); err != nil {
+		return nil, fmt.Errorf("failed to fetch messages of Talk conversation %s: %w", token, err)
+	}
+	return messages, nil
+}
+
+// LatestTalkMessageID returns the ID of the newest message of a Talk
+// conversation, or 0 if it has none.
+func (c *NextcloudClient) LatestTalkMessageID(ctx context.Context, token string) (int64, error) {
+	query := url.Values{
+		"lookIntoFuture": {"0"},
+		"limit":          {"1"},
+		"setReadMarker":  {"0"},
+	}
+	var messages []TalkMessage
+	if err := c.ocsRequest(ctx, http.MethodGet, "apps/spreed/api/v1/chat/"+url.PathEscape(token), query, nil, &messages); err != nil {
+		return 0, fmt.Errorf("failed to fetch messages of Talk conversation %s: %w", token, err)
+	}
+	var latest int64
+	for _, message := range messages {
+		if message.ID > latest {
+			latest = message.ID
+		}
+	}
+	return latest, nil
+}
+
+// ShareToTalk shares a file into a Talk conversation, where it is posted as
+// a message with the caption, if Talk supports captions.
+func (c *NextcloudClient) ShareToTalk(ctx context.Context, remotePath, token, caption string) error {
+	userPath, err := c.userPath(remotePath)
+	if err != nil {
+		return err
+	}
+	form := url.Values{
+		"path":      {userPath},
+		"shareType": {"10"}, // Talk conversation
+		"shareWith": {token},
+	}
+	if caption != "" {
+		metadata, err := json.Marshal(map[string]string{"caption": caption})
+		if err != nil {
+			return err
+		}
+		form.Set("talkMetaData", string(metadata))
+	}
+	if err := c.ocsRequest(ctx, http.MethodPost, "apps/files_sharing/api/v1/shares", nil, form, nil); err != nil {
+		return fmt.Errorf("failed to share %s into Talk conversation %s: %w", remotePath, token, err)
+	}
+	return nil
+}
+
+// userPath converts a path relative to the base URL into a path relative to
+// the files of the Nextcloud user.
+func (c *NextcloudClient) userPath(remotePath string) (string, error) {
+	_, prefix, err := c.filesRoot()
+	if err != nil {
+		return "", err
+	}
+	return "/" + strings.Trim(path.Join(prefix, strings.Trim(remotePath, "/")), "/"), nil
+}
+
+// basePath converts a path relative to the files of the Nextcloud user into
+// a path relative to the base URL. It fails for files outside of the folder
+// the base URL points at.
+func (c *NextcloudClient) basePath(userPath string) (string, error) {
+	_, prefix, err := c.filesRoot()
+	if err != nil {
+		return "", err
+	}
+	userPath = strings.Trim(userPath, "/")
+	if prefix == "" {
+		return userPath, nil
+	}
+	if !strings.HasPrefix(userPath, prefix+"/") {
+		return "", fmt.Errorf("%s is outside of the base URL folder %s", userPath, prefix)
+	}
+	return strings.TrimPrefix(userPath, prefix+"/"), nil
+}
@@ -0,0 +1,79 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTalkMessageFile(t *testing.T) {
+	var messages []TalkMessage
+	payload := `[
+		{"id": 1, "message": "hello", "messageParameters": []},
+		{"id": 2, "message": "{file}", "messageParameters": {"file": {"type": "file", "id": "42", "name": "photo.jpg", "path": "Talk/photo.jpg", "mimetype": "image/jpeg", "size": 1234}}},
+		{"id": 3, "message": "{mention-user1} look", "messageParameters": {"mention-user1": {"type": "user", "id": "alice", "name": "Alice"}}},
+		{"id": 4, "message": "Holiday {file}", "messageParameters": {"file": {"type": "file", "name": "clip.mp4", "path": "Talk/clip.mp4", "size": "99"}}}
+	]`
+	if err := json.Unmarshal([]byte(payload), &messages); err != nil {
+		t.Fatalf("failed to parse messages: %v", err)
+	}
+	if messages[0].File() != nil || messages[2].File() != nil {
+		t.Fatalf("expected no file for messages without a file parameter")
+	}
+	file := messages[1].File()
+	if file == nil || file.Path != "Talk/photo.jpg" || file.MimeType != "image/jpeg" || file.Size.String() != "1234" {
+		t.Fatalf("unexpected file %+v", file)
+	}
+	if messages[1].Caption() != "" {
+		t.Fatalf("expected no caption, got %q", messages[1].Caption())
+	}
+	if file := messages[3].File(); file == nil || file.Size.String() != "99" || messages[3].Caption() != "Holiday" {
+		t.Fatalf("unexpected file %+v with caption %q", file, messages[3].Caption())
+	}
+}
+
+func TestNextcloudClientShareToTalk(t *testing.T) {
+	var form map[string][]string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/ocs/v2.php/apps/files_sharing/api/v1/shares" || r.Header.Get("OCS-APIRequest") != "true" {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		}
+		_ = r.ParseForm()
+		form = r.PostForm
+		_, _ = w.Write([]byte(`{"ocs":{"meta":{"status":"ok","statuscode":200},"data":{"id":"7"}}}`))
+	}))
+	defer server.Close()
+
+	client := NewNextcloudClient(server.URL+"/remote.php/dav/files/bridge/Matrix", "bridge", "pass")
+	if err := client.ShareToTalk(context.Background(), "/media/photo.jpg", "a1b2c3d4", "Shared by Alice in Matrix"); err != nil {
+		t.Fatalf("ShareToTalk failed: %v", err)
+	}
+	if form["path"][0] != "/Matrix/media/photo.jpg" || form["shareType"][0] != "10" || form["shareWith"][0] != "a1b2c3d4" {
+		t.Fatalf("unexpected share form %v", form)
+	}
+	if form["talkMetaData"][0] != `{"caption":"Shared by Alice in Matrix"}` {
+		t.Fatalf("unexpected talk metadata %q", form["talkMetaData"][0])
+	}
+
+	if base, err := client.basePath("Matrix/Talk/clip.mp4"); err != nil || base != "Talk/clip.mp4" {
+		t.Fatalf("unexpected base path %q (%v)", base, err)
+	}
+	if _, err := client.basePath("Talk/clip.mp4"); err == nil {
+		t.Fatalf("expected files outside of the base URL folder to be rejected")
+	}
+}
+
+func TestNextcloudClientTalkMessagesError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write([]byte(`{"ocs":{"meta":{"status":"failure","statuscode":404,"message":"Conversation not found"},"data":[]}}`))
+	}))
+	defer server.Close()
+
+	client := NewNextcloudClient(server.URL+"/remote.php/dav/files/bridge", "bridge", "pass")
+	if _, err := client.TalkMessages(context.Background(), "missing", 1); err == nil {
+		t.Fatalf("expected an error for an unknown conversation")
+	}
+}
@@ -0,0 +1,116 @@
+package handlers
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// filesRoot returns the Nextcloud user whose files the base URL points at and
+// the folder inside their files the base URL points at, without slashes.
+func (c *NextcloudClient) filesRoot() (string, string, error) {
+	base, err := url.Parse(c.BaseURL)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid base URL: %w", err)
+	}
+	basePath := strings.Trim(base.Path, "/")
+	if index := strings.Index(basePath, "remote.php/dav/files/"); index >= 0 {
+		rest := basePath[index+len("remote.php/dav/files/"):]
+		user, prefix, _ := strings.Cut(rest, "/")
+		return user, prefix, nil
+	}
+	if index := strings.Index(basePath, "remote.php/webdav"); index >= 0 {
+		return c.Username, strings.Trim(basePath[index+len("remote.php/webdav"):], "/"), nil
+	}
+	return "", "", fmt.Errorf("base URL %q is not a Nextcloud WebDAV URL", c.BaseURL)
+}
+
+// trashNameSlack is how many seconds after the deletion time a trash bin
+// entry may be named, since Nextcloud counts up while the name is taken.
+const trashNameSlack = 2
+
+// PurgeFromTrash permanently deletes the copy of a file that DeleteFile moved
+// to the trash bin at the server time deleted. Nextcloud names it after the
+// file and the deletion time, so only the entries of the few seconds around
+// that time are checked instead of listing the trash bin. It succeeds without
+// doing anything if the trash bin is disabled or holds no such copy.
+func (c *NextcloudClient) PurgeFromTrash(ctx context.Context, remotePath string, deleted time.Time) error {
+	if deleted.IsZero() {
+		return nil
+	}
+	root, err := c.davRootURL()
+	if err != nil {
+		return err
+	}
+	user, prefix, err := c.filesRoot()
+	if err != nil {
+		return err
+	}
+	location := strings.Trim(path.Join(prefix, strings.Trim(remotePath, "/")), "/")
+	trash := root + "/trashbin/" + url.PathEscape(user) + "/trash/"
+	for timestamp := deleted.Unix() - 1; timestamp <= deleted.Unix()+trashNameSlack; timestamp++ {
+		entry := trash + url.PathEscape(path.Base(location)+".d"+strconv.FormatInt(timestamp, 10))
+		found, err := c.trashLocation(ctx, entry)
+		if err != nil {
+			return err
+		}
+		if strings.Trim(found, "/") != location {
+			continue
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodDelete, entry, nil)
+		if err != nil {
+			return fmt.Errorf("failed to create delete request: %w", err)
+		}
+		resp, err := c.do(req)
+		if err != nil {
+			return fmt.Errorf("failed to purge from trash bin: %w", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+			return statusError(resp, "trashbin")
+		}
+		return nil
+	}
+	return nil
+}
+
+// trashLocation returns the original location of a trash bin entry, or ""
+// if there is no such entry.
+func (c *NextcloudClient) trashLocation(ctx context.Context, entry string) (string, error) {
+	body := `<?xml version="1.0" encoding="UTF-8"?>
+<d:propfind xmlns:d="DAV:" xmlns:nc="http://nextcloud.org/ns">
+  <d:prop><nc:trashbin-original-location/></d:prop>
+</d:propfind>`
+	req, err := http.NewRequestWithContext(ctx, "PROPFIND", entry, strings.NewReader(body))
+	if err != nil {
+		return "", fmt.Errorf("failed to create propfind request: %w", err)
+	}
+	req.Header.Set("Depth", "0")
+	req.Header.Set("Content-Type", "application/xml; charset=utf-8")
+
+	resp, err := c.do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to check trash bin: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return "", nil
+	}
+	if resp.StatusCode != http.StatusMultiStatus {
+		return "", statusError(resp, "trashbin")
+	}
+	var multistatus struct {
+		Location string `xml:"response>propstat>prop>trashbin-original-location"`
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&multistatus); err != nil {
+		return "", fmt.Errorf("failed to parse propfind response: %w", err)
+	}
+	return multistatus.Location, nil
+}
@@ -0,0 +1,216 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// uploadTempPrefix starts the names of files being uploaded. They are hidden
+// and end in .part, so Nextcloud clients ignore them.
+const uploadTempPrefix = ".upload-"
+
+// upload writes a file atomically. A new file is uploaded to a hidden
+// temporary name next to remotePath, its size and checksum are checked, and it
+// is renamed with MOVE. An interrupted upload never leaves a partial file at
+// remotePath, and two uploads cannot take the same name.
+//
+// A file that may be replaced is uploaded to remotePath directly instead. A
+// MOVE with "Overwrite: T" deletes the existing file first, which would give
+// it a new file ID and lose its versions, comments, tags and shares. Nextcloud
+// writes a PUT atomically itself, rejects it if its size or checksum does not
+// match, and keeps the previous content as a version.
+func (c *NextcloudClient) upload(ctx context.Context, remotePath string, reader io.Reader, contentLength int64, overwrite bool) error {
+	start := time.Now()
+	log.Printf("Nextcloud upload start path=%s content_length=%d", remotePath, contentLength)
+
+	checksum, size, err := uploadChecksum(reader)
+	if err != nil {
+		return fmt.Errorf("failed to read file: %w", err)
+	}
+	if size >= 0 {
+		contentLength = size
+	}
+	if overwrite {
+		if err := c.put(ctx, remotePath, reader, contentLength, checksum); err != nil {
+			return err
+		}
+		log.Printf("Nextcloud upload finished path=%s duration=%s", remotePath, time.Since(start))
+		return nil
+	}
+	tempPath := uploadTempPath(remotePath)
+	if err := c.put(ctx, tempPath, reader, contentLength, checksum); err != nil {
+		return err
+	}
+	err = c.verifyUpload(ctx, tempPath, contentLength, checksum)
+	if err == nil {
+		err = c.Move(ctx, tempPath, remotePath)
+	}
+	if err != nil {
+		// The temporary file must not outlive a canceled request
+		if deleteErr := c.DeleteFile(context.WithoutCancel(ctx), tempPath); deleteErr != nil {
+			log.Printf("Warning: failed to delete temporary upload %s: %v", tempPath, deleteErr)
+		}
+		return err
+	}
+
+	log.Printf("Nextcloud upload finished path=%s duration=%s", remotePath, time.Since(start))
+	return nil
+}
+
+// put uploads a file with PUT. Nextcloud rejects the upload if its content
+// does not match the OC-Checksum header.
+func (c *NextcloudClient) put(ctx context.Context, remotePath string, reader io.Reader, contentLength int64, checksum string) error {
+	req, err := http.NewRequestWithContext(ctx, "PUT", c.buildURL(remotePath), reader)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	if contentLength > 0 {
+		req.ContentLength = contentLength
+	}
+	if checksum != "" {
+		req.Header.Set("OC-Checksum", checksum)
+	}
+
+	resp, err := c.do(req)
+	if err != nil {
+		return fmt.Errorf("failed to upload file: %w", err)
+	}
+
+	log.Printf("Nextcloud PUT path=%s status=%d", remotePath, resp.StatusCode)
+
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusNoContent {
+		return statusError(resp, remotePath)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+const propfindUploadBody = `<?xml version="1.0" encoding="UTF-8"?>
+<d:propfind xmlns:d="DAV:" xmlns:oc="http://owncloud.org/ns">
+  <d:prop>
+    <d:getcontentlength/>
+    <oc:checksums/>
+  </d:prop>
+</d:propfind>`
+
+type propfindUploadResponse struct {
+	Responses []struct {
+		Propstat []struct {
+			Status string `xml:"status"`
+			Prop   struct {
+				ContentLength string   `xml:"getcontentlength"`
+				Checksums     []string `xml:"checksums>checksum"`
+			} `xml:"prop"`
+		} `xml:"propstat"`
+	} `xml:"response"`
+}
+
+// verifyUpload checks the size of an uploaded file and, if the server
+// reports checksums like Nextcloud does, its SHA1 checksum. Unknown sizes and
+// checksums are not checked.
+func (c *NextcloudClient) verifyUpload(ctx context.Context, remotePath string, contentLength int64, checksum string) error {
+	if contentLength <= 0 && checksum == "" {
+		return nil
+	}
+	req, err := http.NewRequestWithContext(ctx, "PROPFIND", c.buildURL(remotePath), strings.NewReader(propfindUploadBody))
+	if err != nil {
+		return fmt.Errorf("failed to create propfind request: %w", err)
+	}
+	req.Header.Set("Depth", "0")
+	req.Header.Set("Content-Type", "application/xml; charset=utf-8")
+
+	resp, err := c.do(req)
+	if err != nil {
+		return fmt.Errorf("failed to check upload: %w", err)
+	}
+	if resp.StatusCode != http.StatusMultiStatus {
+		return statusError(resp, remotePath)
+	}
+	defer resp.Body.Close()
+
+	var multistatus propfindUploadResponse
+	if err := xml.NewDecoder(resp.Body).Decode(&multistatus); err != nil {
+		return fmt.Errorf("failed to parse propfind response: %w", err)
+	}
+	for _, entry := range multistatus.Responses {
+		for _, propstat := range entry.Propstat {
+			if !strings.Contains(propstat.Status, " 200 ") {
+				continue
+			}
+			prop := propstat.Prop
+			if size, err := strconv.ParseInt(prop.ContentLength, 10, 64); err == nil && contentLength > 0 && size != contentLength {
+				return fmt.Errorf("upload of %s is incomplete: %d of %d bytes stored", remotePath, size, contentLength)
+			}
+			if stored := findChecksum(prop.Checksums, checksum); stored != "" && !strings.EqualFold(stored, checksum) {
+				return fmt.Errorf("checksum of upload %s is %s, expected %s", remotePath, stored, checksum)
+			}
+		}
+	}
+	return nil
+}
+
+// findChecksum returns the checksum of the same type as expected among the
+// space separated checksums Nextcloud stores, like "SHA1:ab12 MD5:cd34".
+func findChecksum(checksums []string, expected string) string {
+	kind, _, ok := strings.Cut(expected, ":")
+	if !ok {
+		return ""
+	}
+	for _, list := range checksums {
+		for _, checksum := range strings.Fields(list) {
+			if storedKind, _, _ := strings.Cut(checksum, ":"); strings.EqualFold(storedKind, kind) {
+				return checksum
+			}
+		}
+	}
+	return ""
+}
+
+// uploadChecksum returns the OC-Checksum header value and size of the
+// remaining content of a seekable reader, which is rewound afterwards. Other
+// readers are streamed without a checksum and a size of -1 is returned.
+func uploadChecksum(reader io.Reader) (string, int64, error) {
+	seeker, ok := reader.(io.ReadSeeker)
+	if !ok {
+		return "", -1, nil
+	}
+	offset, err := seeker.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return "", -1, err
+	}
+	hash := sha1.New()
+	size, err := io.Copy(hash, seeker)
+	if err != nil {
+		return "", -1, err
+	}
+	if _, err := seeker.Seek(offset, io.SeekStart); err != nil {
+		return "", -1, err
+	}
+	return "SHA1:" + hex.EncodeToString(hash.Sum(nil)), size, nil
+}
+
+// uploadTempPath returns a hidden temporary path in the folder of remotePath,
+// like "photos/.upload-<uuid>.part".
+func uploadTempPath(remotePath string) string {
+	var id [16]byte
+	_, _ = rand.Read(id[:])
+	id[6] = id[6]&0x0f | 0x40 // Version 4
+	id[8] = id[8]&0x3f | 0x80 // RFC 4122 variant
+	name := fmt.Sprintf("%s%x-%x-%x-%x-%x.part", uploadTempPrefix, id[0:4], id[4:6], id[6:8], id[8:10], id[10:])
+	dir := path.Dir(strings.TrimLeft(remotePath, "/"))
+	if dir == "." {
+		return name
+	}
+	return dir + "/" + name
+}
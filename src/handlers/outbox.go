@@ -0,0 +1,187 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/id"
+
+	"nextcloud-media-bridge/src/utils"
+)
+
+// outboxAccountData is the bot account data type storing posted outbox files.
+const outboxAccountData = "com.nextcloud-media-bridge.outbox"
+
+type outboxContent struct {
+	Files map[string]string `json:"files"`
+}
+
+// OutboxWatcher posts files dropped into the outbox folder of a bridged room
+// to the room. The ETags of handled files are persisted in the bot's account
+// data, so a file is only posted again if its content changes.
+type OutboxWatcher struct {
+	handler *MediaHandler
+
+	mu     sync.Mutex
+	posted map[string]string // outboxKey of the file -> ETag
+}
+
+func NewOutboxWatcher(handler *MediaHandler) *OutboxWatcher {
+	return &OutboxWatcher{handler: handler, posted: map[string]string{}}
+}
+
+// Load reads the handled files from account data.
+func (w *OutboxWatcher) Load(ctx context.Context) error {
+	var content outboxContent
+	if err := w.handler.as.BotClient().GetAccountData(ctx, outboxAccountData, &content); err != nil {
+		if errors.Is(err, mautrix.MNotFound) {
+			return nil
+		}
+		return fmt.Errorf("failed to load outbox state: %w", err)
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if content.Files != nil {
+		w.posted = content.Files
+	}
+	log.Printf("Loaded %d handled outbox file(s)", len(w.posted))
+	return nil
+}
+
+// Start polls the outbox folders every interval until ctx is done.
+func (w *OutboxWatcher) Start(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := w.Poll(ctx); err != nil {
+			log.Printf("Warning: outbox poll failed: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Poll lists the outbox folder of every bridged room the bot has joined and
+// posts new and changed files. Missing folders are created. It returns the
+// number of posted files.
+func (w *OutboxWatcher) Poll(ctx context.Context) (int, error) {
+	h := w.handler
+	template, err := utils.ParsePathTemplate(h.config.Outbox.Template)
+	if err != nil {
+		return 0, fmt.Errorf("invalid outbox template: %w", err)
+	}
+	joined, err := h.as.BotIntent().JoinedRooms(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to fetch joined rooms: %w", err)
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	posted, changed := 0, false
+	for _, roomID := range joined.JoinedRooms {
+		rule, ok := h.rooms.Resolve(ctx, roomID)
+		if !ok {
+			continue
+		}
+		storage, err := h.storages.Get(rule.Storage)
+		if err != nil {
+			log.Printf("Warning: invalid storage for room %s: %v", roomID, err)
+			continue
+		}
+		folder := strings.Trim(template.Render(h.roomVariables(ctx, template, roomID)), "/")
+		files, err := storage.List(ctx, folder)
+		if errors.Is(err, ErrNotFound) {
+			log.Printf("Creating outbox folder %s for room %s", folder, roomID)
+			if err := storage.EnsureDirectories(ctx, folder+"/"); err != nil {
+				log.Printf("Warning: failed to create outbox folder %s: %v", folder, err)
+			}
+			continue
+		}
+		if errors.Is(err, ErrMaintenance) {
+			// Every other folder would fail as well
+			log.Printf("Warning: %s, postponing outbox poll", err)
+			break
+		}
+		if err != nil {
+			log.Printf("Warning: failed to list outbox folder %s: %v", folder, err)
+			continue
+		}
+		sort.Slice(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+
+		present := make(map[string]bool, len(files))
+		for _, file := range files {
+			// Hidden files include partial uploads
+			if file.IsDir || strings.HasPrefix(path.Base(file.Path), ".") {
+				continue
+			}
+			present[outboxKey(rule.Storage, file.Path)] = true
+			if etag, ok := w.posted[outboxKey(rule.Storage, file.Path)]; ok && etag == file.ETag {
+				continue
+			}
+			sent, err := w.postFile(ctx, roomID, rule.Storage, file)
+			if errors.Is(err, ErrLocked) {
+				log.Printf("Outbox file %s is locked, probably still being uploaded; posting it next time", file.Path)
+				continue
+			}
+			if err != nil {
+				log.Printf("Warning: failed to post outbox file %s to room %s: %v", file.Path, roomID, err)
+				continue
+			}
+			w.posted[outboxKey(rule.Storage, file.Path)] = file.ETag
+			changed = true
+			if sent {
+				posted++
+			}
+		}
+		// Forget removed files, so a file dropped again under the same name is posted
+		for key := range w.posted {
+			if path.Dir(key) == outboxKey(rule.Storage, folder) && !present[key] {
+				delete(w.posted, key)
+				changed = true
+			}
+		}
+	}
+	if changed {
+		content := outboxContent{Files: w.posted}
+		if err := h.as.BotClient().SetAccountData(ctx, outboxAccountData, content); err != nil {
+			return posted, fmt.Errorf("failed to store outbox state: %w", err)
+		}
+	}
+	return posted, nil
+}
+
+// postFile sends an outbox file to the room and stores the mapping of the new
+// event. It returns false without an error if the file was not posted because
+// the virus scanner found it infected.
+func (w *OutboxWatcher) postFile(ctx context.Context, roomID id.RoomID, name string, file RemoteFile) (bool, error) {
+	h := w.handler
+	eventID, mxc, err := h.postNextcloudFile(ctx, roomID, name, file, "")
+	if err != nil || eventID == "" {
+		return false, err
+	}
+	log.Printf("Posted outbox file %s to room %s as event %s", file.Path, roomID, eventID)
+	h.storeMediaState(roomID, eventID, mediaState{Path: "/" + file.Path, FileName: path.Base(file.Path), MXC: mxc, Storage: name})
+	h.replicator.Upload(name, file.Path)
+	return true, nil
+}
+
+// outboxKey identifies an outbox file in the handled files. Files in Nextcloud
+// are keyed by their path, those in other storages by storage name and path.
+func outboxKey(name, filePath string) string {
+	if name == "" {
+		return filePath
+	}
+	return name + ":" + filePath
+}
@@ -0,0 +1,135 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"maunium.net/go/mautrix/event"
+
+	"nextcloud-media-bridge/src/config"
+	"nextcloud-media-bridge/src/utils"
+)
+
+func TestOutboxWatcherPoll(t *testing.T) {
+	const roomID = "!roomid:example.com"
+	var mu sync.Mutex
+	etag := `"v1"`
+	var sent []event.MessageEventContent
+	var mappings []string
+	var accountData string
+
+	nt := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch r.Method {
+		case "PROPFIND":
+			if r.URL.Path != "/bridge-media/roomid_example.com/outbox" {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.WriteHeader(http.StatusMultiStatus)
+			_, _ = w.Write([]byte(`<?xml version="1.0"?><d:multistatus xmlns:d="DAV:">` +
+				`<d:response><d:href>/bridge-media/roomid_example.com/outbox/</d:href><d:propstat><d:prop><d:resourcetype><d:collection/></d:resourcetype></d:prop><d:status>HTTP/1.1 200 OK</d:status></d:propstat></d:response>` +
+				`<d:response><d:href>/bridge-media/roomid_example.com/outbox/report.pdf</d:href><d:propstat><d:prop><d:getcontentlength>4</d:getcontentlength><d:getcontenttype>application/pdf</d:getcontenttype><d:getetag>` + etag + `</d:getetag></d:prop><d:status>HTTP/1.1 200 OK</d:status></d:propstat></d:response>` +
+				`<d:response><d:href>/bridge-media/roomid_example.com/outbox/.photo.jpg.part</d:href><d:propstat><d:prop><d:getcontentlength>4</d:getcontentlength><d:getetag>"p"</d:getetag></d:prop><d:status>HTTP/1.1 200 OK</d:status></d:propstat></d:response>` +
+				`</d:multistatus>`))
+		default:
+			t.Errorf("unexpected Nextcloud request %s %s", r.Method, r.URL.Path)
+		}
+	}))
+	defer nt.Close()
+
+	mt := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/joined_rooms"):
+			_, _ = w.Write([]byte(`{"joined_rooms":["` + roomID + `"]}`))
+		case strings.Contains(r.URL.Path, "/account_data/"+outboxAccountData):
+			body, _ := io.ReadAll(r.Body)
+			accountData = string(body)
+			_, _ = w.Write([]byte(`{}`))
+		case strings.Contains(r.URL.Path, "/send/m.room.message/"):
+			var content event.MessageEventContent
+			_ = json.NewDecoder(r.Body).Decode(&content)
+			sent = append(sent, content)
+			_, _ = w.Write([]byte(`{"event_id":"$posted"}`))
+		case strings.Contains(r.URL.Path, "/state/com.nextcloud-media-bridge.media/"):
+			mappings = append(mappings, r.URL.Path)
+			_, _ = w.Write([]byte(`{"event_id":"$state"}`))
+		default:
+			_, _ = w.Write([]byte(`{}`))
+		}
+	}))
+	defer mt.Close()
+
+	cfg := &config.Config{}
+	cfg.Matrix.RoomPathTemplate = map[string]string{roomID: "/media/${file}"}
+	cfg.MediaProxy.ServerName = "media.example.com"
+	cfg.Outbox.Template = "/bridge-media/${room}/outbox"
+	handler := newTestHandler(t, cfg, mt.URL, NewStorages(NewNextcloudClient(nt.URL, "user", "pass")))
+	watcher := NewOutboxWatcher(handler)
+
+	posted, err := watcher.Poll(context.Background())
+	if err != nil {
+		t.Fatalf("Poll failed: %v", err)
+	}
+	if posted != 1 || len(sent) != 1 {
+		t.Fatalf("expected one posted file, got %d (%d messages)", posted, len(sent))
+	}
+	msg := sent[0]
+	if msg.MsgType != event.MsgFile || msg.FileName != "report.pdf" || msg.Info.MimeType != "application/pdf" || msg.Info.Size != 4 {
+		t.Fatalf("unexpected message %+v", msg)
+	}
+	uri, err := msg.URL.Parse()
+	if err != nil || uri.Homeserver != "media.example.com" {
+		t.Fatalf("unexpected media URL %q", msg.URL)
+	}
+	ref, err := utils.DecodeMediaID(testSecret, uri.FileID)
+	if err != nil || ref.Path != "bridge-media/roomid_example.com/outbox/report.pdf" {
+		t.Fatalf("unexpected media ref %+v: %v", ref, err)
+	}
+	if len(mappings) != 1 || !strings.Contains(mappings[0], "posted") {
+		t.Fatalf("expected mapping of the posted event, got %v", mappings)
+	}
+	if !strings.Contains(accountData, "report.pdf") {
+		t.Fatalf("expected posted file to be tracked, got %s", accountData)
+	}
+
+	// Unchanged files are not posted again
+	if posted, err = watcher.Poll(context.Background()); err != nil || posted != 0 {
+		t.Fatalf("expected no file on second poll, got %d: %v", posted, err)
+	}
+
+	// A new ETag means new content
+	mu.Lock()
+	etag = `"v2"`
+	mu.Unlock()
+	if posted, err = watcher.Poll(context.Background()); err != nil || posted != 1 {
+		t.Fatalf("expected the changed file to be posted again, got %d: %v", posted, err)
+	}
+	if len(sent) != 2 {
+		t.Fatalf("expected two messages, got %d", len(sent))
+	}
+}
+
+func TestFileMsgType(t *testing.T) {
+	tests := map[string]event.MessageType{
+		"image/png":       event.MsgImage,
+		"video/mp4":       event.MsgVideo,
+		"audio/ogg":       event.MsgAudio,
+		"application/pdf": event.MsgFile,
+		"":                event.MsgFile,
+	}
+	for mimeType, expected := range tests {
+		if got := fileMsgType(mimeType); got != expected {
+			t.Errorf("fileMsgType(%q) = %s, want %s", mimeType, got, expected)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/appservice"
+)
+
+// pathMovesAccountData is the bot account data type storing folder moves.
+const pathMovesAccountData = "com.nextcloud-media-bridge.path_moves"
+
+const maxPathMoveHops = 16
+
+// pathMovesContent keeps the moves of the default Nextcloud account in Moves,
+// where releases before named storages stored all moves.
+type pathMovesContent struct {
+	Moves    map[string]string            `json:"moves"`
+	Storages map[string]map[string]string `json:"storages,omitempty"`
+}
+
+// PathMoves remembers folders the bridge has moved in Nextcloud, so media IDs
+// and stored state that still carry the old path can be resolved. Moves are
+// recorded per storage, since the same folder path on another storage was not
+// moved. The moves are persisted in the bot's account data.
+type PathMoves struct {
+	as *appservice.AppService
+
+	mu    sync.RWMutex
+	moves map[string]map[string]string // storage name -> old folder -> new folder, both without leading slash
+	// writeMu is held from taking a snapshot until it is stored, so a slower
+	// write of an older snapshot never replaces a newer one.
+	writeMu sync.Mutex
+}
+
+func NewPathMoves(as *appservice.AppService) *PathMoves {
+	return &PathMoves{as: as, moves: map[string]map[string]string{}}
+}
+
+// Load reads the stored moves from account data.
+func (m *PathMoves) Load(ctx context.Context) error {
+	var content pathMovesContent
+	if err := m.as.BotClient().GetAccountData(ctx, pathMovesAccountData, &content); err != nil {
+		if errors.Is(err, mautrix.MNotFound) {
+			return nil
+		}
+		return fmt.Errorf("failed to load path moves: %w", err)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	moves := map[string]map[string]string{}
+	for name, storageMoves := range content.Storages {
+		moves[name] = storageMoves
+	}
+	if content.Moves != nil {
+		moves[""] = content.Moves
+	}
+	m.moves = moves
+	count := 0
+	for _, storageMoves := range m.moves {
+		count += len(storageMoves)
+	}
+	log.Printf("Loaded %d folder move(s)", count)
+	return nil
+}
+
+// Record stores a completed folder move on the named storage.
+func (m *PathMoves) Record(ctx context.Context, storage, oldPath, newPath string) error {
+	oldPath = strings.Trim(oldPath, "/")
+	newPath = strings.Trim(newPath, "/")
+	m.writeMu.Lock()
+	defer m.writeMu.Unlock()
+	m.mu.Lock()
+	if m.moves[storage] == nil {
+		m.moves[storage] = map[string]string{}
+	}
+	// The destination holds live files again, so it must not be redirected
+	delete(m.moves[storage], newPath)
+	m.moves[storage][oldPath] = newPath
+	content := pathMovesContent{Moves: map[string]string{}}
+	for name, storageMoves := range m.moves {
+		copied := make(map[string]string, len(storageMoves))
+		for from, to := range storageMoves {
+			copied[from] = to
+		}
+		if name == "" {
+			content.Moves = copied
+			continue
+		}
+		if content.Storages == nil {
+			content.Storages = map[string]map[string]string{}
+		}
+		content.Storages[name] = copied
+	}
+	m.mu.Unlock()
+	if err := m.as.BotClient().SetAccountData(ctx, pathMovesAccountData, content); err != nil {
+		return fmt.Errorf("failed to store path moves: %w", err)
+	}
+	return nil
+}
+
+// Resolve returns the current location of a file on the named storage whose
+// folder may have been moved, or the path unchanged if no move applies. A nil
+// receiver is valid.
+func (m *PathMoves) Resolve(storage, remotePath string) string {
+	if m == nil {
+		return remotePath
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	leadingSlash := strings.HasPrefix(remotePath, "/")
+	current := strings.Trim(remotePath, "/")
+	for hop := 0; hop < maxPathMoveHops; hop++ {
+		from, to, ok := longestPrefix(m.moves[storage], current)
+		if !ok {
+			break
+		}
+		current = to + strings.TrimPrefix(current, from)
+	}
+	if leadingSlash {
+		return "/" + current
+	}
+	return current
+}
+
+func longestPrefix(moves map[string]string, remotePath string) (string, string, bool) {
+	var bestFrom, bestTo string
+	for from, to := range moves {
+		if (remotePath == from || strings.HasPrefix(remotePath, from+"/")) && len(from) > len(bestFrom) {
+			bestFrom, bestTo = from, to
+		}
+	}
+	return bestFrom, bestTo, bestFrom != ""
+}
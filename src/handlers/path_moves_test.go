@@ -0,0 +1,157 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPathMovesResolve(t *testing.T) {
+	moves := &PathMoves{moves: map[string]map[string]string{
+		"": {
+			"media/Old Name":          "media/New Name",
+			"media/New Name/2024":     "media/New Name/archive",
+			"media/Chained":           "media/Chained 2",
+			"media/Chained 2":         "media/Chained 3",
+			"media/Old Name Extended": "media/Other",
+		},
+		"s3": {
+			"media/Old Name": "media/S3 Name",
+		},
+	}}
+	cases := map[string]string{
+		"/media/Old Name/2024/a.jpg":     "/media/New Name/archive/a.jpg",
+		"/media/Old Name/2025/a.jpg":     "/media/New Name/2025/a.jpg",
+		"/media/Old Name Extended/a.jpg": "/media/Other/a.jpg",
+		"media/Chained/a.jpg":            "media/Chained 3/a.jpg",
+		"/media/Unrelated/a.jpg":         "/media/Unrelated/a.jpg",
+	}
+	for input, expected := range cases {
+		if got := moves.Resolve("", input); got != expected {
+			t.Fatalf("Resolve(%q) = %q, expected %q", input, got, expected)
+		}
+	}
+	// Moves only apply to the storage they were recorded for
+	if got := moves.Resolve("s3", "/media/Old Name/2024/a.jpg"); got != "/media/S3 Name/2024/a.jpg" {
+		t.Fatalf("Resolve on s3 = %q", got)
+	}
+	if got := moves.Resolve("local", "/media/Old Name/a.jpg"); got != "/media/Old Name/a.jpg" {
+		t.Fatalf("Resolve on a storage without moves changed path to %q", got)
+	}
+	var nilMoves *PathMoves
+	if got := nilMoves.Resolve("", "/a/b"); got != "/a/b" {
+		t.Fatalf("nil Resolve changed path to %q", got)
+	}
+}
+
+func TestPathMovesLoadAndRecord(t *testing.T) {
+	var mu sync.Mutex
+	// Account data written before moves were kept per storage
+	stored := `{"moves":{"media/Old":"media/New"}}`
+	mt := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if !strings.Contains(r.URL.Path, "/account_data/"+pathMovesAccountData) {
+			_, _ = w.Write([]byte(`{}`))
+			return
+		}
+		if r.Method == http.MethodPut {
+			body, _ := io.ReadAll(r.Body)
+			stored = string(body)
+		}
+		_, _ = w.Write([]byte(stored))
+	}))
+	defer mt.Close()
+
+	as := newTestAppService(t, mt.URL)
+	moves := NewPathMoves(as)
+	if err := moves.Load(context.Background()); err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if got := moves.Resolve("", "/media/Old/a.jpg"); got != "/media/New/a.jpg" {
+		t.Fatalf("legacy move not loaded for Nextcloud, got %q", got)
+	}
+	if err := moves.Record(context.Background(), "s3", "/media/Old", "/media/S3"); err != nil {
+		t.Fatalf("Record failed: %v", err)
+	}
+
+	reloaded := NewPathMoves(as)
+	if err := reloaded.Load(context.Background()); err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if got := reloaded.Resolve("", "/media/Old/a.jpg"); got != "/media/New/a.jpg" {
+		t.Fatalf("Nextcloud move changed by a move on s3, got %q", got)
+	}
+	if got := reloaded.Resolve("s3", "/media/Old/a.jpg"); got != "/media/S3/a.jpg" {
+		t.Fatalf("s3 move not stored, got %q", got)
+	}
+	var content pathMovesContent
+	mu.Lock()
+	_ = json.Unmarshal([]byte(stored), &content)
+	mu.Unlock()
+	if content.Moves["media/Old"] != "media/New" || content.Storages["s3"]["media/Old"] != "media/S3" {
+		t.Fatalf("unexpected stored moves %+v", content)
+	}
+}
+
+func TestPathMovesRecordKeepsConcurrentMoves(t *testing.T) {
+	var mu sync.Mutex
+	stored := `{}`
+	puts := 0
+	release := make(chan struct{})
+	mt := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut {
+			_, _ = w.Write([]byte(`{}`))
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		puts++
+		first := puts == 1
+		mu.Unlock()
+		// The first write arrives after the second move was recorded
+		if first {
+			<-release
+		}
+		mu.Lock()
+		stored = string(body)
+		mu.Unlock()
+		_, _ = w.Write([]byte(`{}`))
+	}))
+	defer mt.Close()
+
+	moves := NewPathMoves(newTestAppService(t, mt.URL))
+	done := make(chan error, 2)
+	go func() { done <- moves.Record(context.Background(), "", "/media/A", "/media/B") }()
+	for {
+		mu.Lock()
+		started := puts == 1
+		mu.Unlock()
+		if started {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	go func() { done <- moves.Record(context.Background(), "", "/media/C", "/media/D") }()
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	for i := 0; i < 2; i++ {
+		if err := <-done; err != nil {
+			t.Fatalf("Record failed: %v", err)
+		}
+	}
+
+	var content pathMovesContent
+	mu.Lock()
+	_ = json.Unmarshal([]byte(stored), &content)
+	mu.Unlock()
+	if content.Moves["media/A"] != "media/B" || content.Moves["media/C"] != "media/D" {
+		t.Fatalf("a concurrent move was lost: %+v", content)
+	}
+}
@@ -0,0 +1,304 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// QuotaReporter is implemented by storage backends that report the quota of
+// their account.
+type QuotaReporter interface {
+	Quota(ctx context.Context) (Quota, error)
+}
+
+// QuotaMonitor caches the quotas of the storage backends, refuses uploads
+// that do not fit and reports usage crossing the warning thresholds.
+type QuotaMonitor struct {
+	storages   *Storages
+	maxAge     time.Duration
+	thresholds []int
+	// warn is called when the usage of a storage rises above a threshold.
+	warn func(ctx context.Context, name string, quota Quota, threshold int)
+
+	lock   sync.Mutex
+	states map[string]*quotaState
+}
+
+type quotaState struct {
+	quota   Quota
+	fetched time.Time
+	warned  int   // Highest threshold the usage was reported above
+	refused int64 // Uploads refused because they did not fit
+}
+
+// NewQuotaMonitor returns a monitor that uses queried quotas for maxAge and
+// warns at the given percentages of the quota used.
+func NewQuotaMonitor(storages *Storages, maxAge time.Duration, thresholds []int) *QuotaMonitor {
+	thresholds = append([]int(nil), thresholds...)
+	sort.Ints(thresholds)
+	return &QuotaMonitor{storages: storages, maxAge: maxAge, thresholds: thresholds, states: map[string]*quotaState{}}
+}
+
+// Quota returns the cached quota of a storage backend, querying it if the
+// cached value is older than maxAge. It returns false for backends that do
+// not report quotas.
+func (m *QuotaMonitor) Quota(ctx context.Context, name string) (Quota, bool, error) {
+	return m.quota(ctx, name, false)
+}
+
+func (m *QuotaMonitor) quota(ctx context.Context, name string, refresh bool) (Quota, bool, error) {
+	storage, err := m.storages.Get(name)
+	if err != nil {
+		return Quota{}, false, err
+	}
+	reporter, ok := storage.(QuotaReporter)
+	if !ok {
+		return Quota{}, false, nil
+	}
+	m.lock.Lock()
+	state := m.state(name)
+	if !refresh && !state.fetched.IsZero() && time.Since(state.fetched) < m.maxAge {
+		quota := state.quota
+		m.lock.Unlock()
+		return quota, true, nil
+	}
+	m.lock.Unlock()
+
+	quota, err := reporter.Quota(ctx)
+	if err != nil {
+		return Quota{}, true, err
+	}
+	m.lock.Lock()
+	state.quota, state.fetched = quota, time.Now()
+	m.lock.Unlock()
+	return quota, true, nil
+}
+
+// Check returns an error wrapping ErrInsufficientStorage if size bytes do not
+// fit into the quota of a storage backend. Uploads are allowed if the quota
+// cannot be queried; Nextcloud still refuses them when it is full.
+func (m *QuotaMonitor) Check(ctx context.Context, name string, size int64) error {
+	if m == nil {
+		return nil
+	}
+	quota, ok, err := m.Quota(ctx, name)
+	if err != nil {
+		log.Printf("Warning: failed to query quota of %s: %v", storageName(name), err)
+		return nil
+	}
+	if !ok || !quota.Limited() || size <= quota.Available {
+		return nil
+	}
+	m.lock.Lock()
+	m.state(name).refused++
+	m.lock.Unlock()
+	return fmt.Errorf("%w: %s needed, %s available in %s", ErrInsufficientStorage, formatByteSize(size), formatByteSize(quota.Available), storageName(name))
+}
+
+// Uploaded updates the cached quota after an upload of size bytes. Uploads
+// refused with 507 Insufficient Storage mark the storage as full until the
+// quota is queried again.
+func (m *QuotaMonitor) Uploaded(name string, size int64, err error) {
+	if m == nil {
+		return
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	state, ok := m.states[name]
+	if !ok || state.fetched.IsZero() {
+		return
+	}
+	switch {
+	case err == nil && state.quota.Limited():
+		state.quota.Used += size
+		state.quota.Available = max(state.quota.Available-size, 0)
+	case err == nil:
+		state.quota.Used += size
+	case errors.Is(err, ErrInsufficientStorage):
+		state.refused++
+		state.quota.Available = 0
+	}
+}
+
+// Refresh queries the quotas of all storage backends that report one and
+// warns about those whose usage rose above a threshold since the last
+// refresh.
+func (m *QuotaMonitor) Refresh(ctx context.Context) {
+	for _, name := range m.storages.Names() {
+		quota, ok, err := m.quota(ctx, name, true)
+		if err != nil {
+			log.Printf("Warning: failed to query quota of %s: %v", storageName(name), err)
+			continue
+		}
+		if !ok || !quota.Limited() {
+			continue
+		}
+		if threshold := m.crossedThreshold(name, quota); threshold > 0 {
+			log.Printf("Warning: %s uses %.0f%% of its quota (%s of %s)", storageName(name), quota.UsedPercent(), formatByteSize(quota.Used), formatByteSize(quota.Used+quota.Available))
+			if m.warn != nil {
+				m.warn(ctx, name, quota, threshold)
+			}
+		}
+	}
+}
+
+// crossedThreshold returns the highest threshold the usage is above if it was
+// not reported yet, or 0. Falling below a threshold allows warning about it
+// again.
+func (m *QuotaMonitor) crossedThreshold(name string, quota Quota) int {
+	reached := 0
+	for _, threshold := range m.thresholds {
+		if quota.UsedPercent() >= float64(threshold) {
+			reached = threshold
+		}
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	state := m.state(name)
+	warned := state.warned
+	state.warned = reached
+	if reached > warned {
+		return reached
+	}
+	return 0
+}
+
+// Start refreshes the quotas every interval until ctx is done.
+func (m *QuotaMonitor) Start(ctx context.Context, interval time.Duration) {
+	m.Refresh(ctx)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			m.Refresh(ctx)
+		}
+	}
+}
+
+// ServeMetrics writes the cached quotas in the Prometheus text format.
+func (m *QuotaMonitor) ServeMetrics(w http.ResponseWriter, r *http.Request) {
+	m.lock.Lock()
+	names := make([]string, 0, len(m.states))
+	for name := range m.states {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var metrics strings.Builder
+	gauge := func(metric, help string, value func(*quotaState) (int64, bool)) {
+		fmt.Fprintf(&metrics, "# HELP %s %s\n# TYPE %s gauge\n", metric, help, metric)
+		for _, name := range names {
+			if v, ok := value(m.states[name]); ok {
+				fmt.Fprintf(&metrics, "%s{storage=%q} %d\n", metric, metricsStorageName(name), v)
+			}
+		}
+	}
+	gauge("nextcloud_media_bridge_quota_used_bytes", "Bytes used in the storage account.", func(state *quotaState) (int64, bool) {
+		return state.quota.Used, !state.fetched.IsZero()
+	})
+	gauge("nextcloud_media_bridge_quota_available_bytes", "Bytes available in the storage account, if it has a quota.", func(state *quotaState) (int64, bool) {
+		return state.quota.Available, !state.fetched.IsZero() && state.quota.Limited()
+	})
+	fmt.Fprintf(&metrics, "# HELP %s %s\n# TYPE %s counter\n", "nextcloud_media_bridge_quota_refused_uploads_total", "Uploads refused because they did not fit into the quota.", "nextcloud_media_bridge_quota_refused_uploads_total")
+	for _, name := range names {
+		fmt.Fprintf(&metrics, "nextcloud_media_bridge_quota_refused_uploads_total{storage=%q} %d\n", metricsStorageName(name), m.states[name].refused)
+	}
+	m.lock.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_, _ = w.Write([]byte(metrics.String()))
+}
+
+// state returns the state of a storage backend. The lock must be held.
+func (m *QuotaMonitor) state(name string) *quotaState {
+	state, ok := m.states[name]
+	if !ok {
+		state = &quotaState{}
+		m.states[name] = state
+	}
+	return state
+}
+
+func metricsStorageName(name string) string {
+	if name == "" {
+		return "nextcloud"
+	}
+	return name
+}
+
+// formatByteSize formats a size with decimal units, e.g. "1.5 GB".
+func formatByteSize(size int64) string {
+	const unit = 1000
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	value, prefix := float64(size)/unit, 0
+	for value >= unit && prefix < 4 {
+		value /= unit
+		prefix++
+	}
+	return fmt.Sprintf("%.1f %cB", value, "kMGTP"[prefix])
+}
+
+// warnQuota tells the rooms archiving to a storage backend that its quota is
+// almost used up, mentioning the room admins.
+func (h *MediaHandler) warnQuota(ctx context.Context, name string, quota Quota, threshold int) {
+	joined, err := h.as.BotIntent().JoinedRooms(ctx)
+	if err != nil {
+		log.Printf("Warning: failed to fetch joined rooms for quota warning: %v", err)
+		return
+	}
+	for _, roomID := range joined.JoinedRooms {
+		rule, ok := h.rooms.Resolve(ctx, roomID)
+		if !ok || rule.Storage != name {
+			continue
+		}
+		admins := h.roomAdmins(ctx, roomID)
+		body := fmt.Sprintf("The storage this room archives media to is %d%% full (%s of %s used). New files will not be archived once it is full.",
+			threshold, formatByteSize(quota.Used), formatByteSize(quota.Used+quota.Available))
+		if len(admins) > 0 {
+			mentions := make([]string, len(admins))
+			for i, admin := range admins {
+				mentions[i] = admin.String()
+			}
+			body = strings.Join(mentions, ", ") + ": " + body
+		}
+		content := &event.MessageEventContent{
+			MsgType:  event.MsgNotice,
+			Body:     body,
+			Mentions: &event.Mentions{UserIDs: admins},
+		}
+		if _, err := h.as.BotIntent().SendMessageEvent(ctx, roomID, event.EventMessage, content); err != nil {
+			log.Printf("Failed to send quota warning to room %s: %v", roomID, err)
+		}
+	}
+}
+
+// roomAdmins returns the users with power level 100 or more, except the bot.
+func (h *MediaHandler) roomAdmins(ctx context.Context, roomID id.RoomID) []id.UserID {
+	levels, err := h.as.BotIntent().PowerLevels(ctx, roomID)
+	if err != nil {
+		log.Printf("Warning: failed to read power levels of room %s: %v", roomID, err)
+		return nil
+	}
+	var admins []id.UserID
+	for userID, level := range levels.Users {
+		if level >= 100 && userID != h.as.BotMXID() {
+			admins = append(admins, userID)
+		}
+	}
+	sort.Slice(admins, func(i, j int) bool { return admins[i] < admins[j] })
+	return admins
+}
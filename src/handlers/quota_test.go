@@ -0,0 +1,125 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newQuotaServer returns a WebDAV server reporting the quota in used and
+// available, and counts the quota queries.
+func newQuotaServer(t *testing.T, used, available *int64, queries *int) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "PROPFIND" || r.Header.Get("Depth") != "0" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		*queries++
+		w.WriteHeader(http.StatusMultiStatus)
+		fmt.Fprintf(w, `<?xml version="1.0"?>
+<d:multistatus xmlns:d="DAV:"><d:response><d:href>/remote.php/dav/files/bridge/</d:href>
+<d:propstat><d:prop><d:quota-used-bytes>%d</d:quota-used-bytes><d:quota-available-bytes>%d</d:quota-available-bytes></d:prop>
+<d:status>HTTP/1.1 200 OK</d:status></d:propstat></d:response></d:multistatus>`, *used, *available)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestNextcloudClientQuota(t *testing.T) {
+	used, available, queries := int64(600), int64(400), 0
+	server := newQuotaServer(t, &used, &available, &queries)
+	client := NewNextcloudClient(server.URL+"/remote.php/dav/files/bridge", "bridge", "pass")
+
+	quota, err := client.Quota(context.Background())
+	if err != nil {
+		t.Fatalf("Quota failed: %v", err)
+	}
+	if quota.Used != 600 || quota.Available != 400 || quota.UsedPercent() != 60 {
+		t.Fatalf("unexpected quota: %+v", quota)
+	}
+	// Nextcloud reports -3 for unlimited quotas
+	available = -3
+	if quota, err = client.Quota(context.Background()); err != nil || quota.Limited() {
+		t.Fatalf("expected unlimited quota, got %+v: %v", quota, err)
+	}
+}
+
+func TestQuotaMonitor(t *testing.T) {
+	used, available, queries := int64(700), int64(300), 0
+	server := newQuotaServer(t, &used, &available, &queries)
+	storages := NewStorages(NewNextcloudClient(server.URL, "bridge", "pass"))
+	disk, err := NewLocalStorage(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	storages.Add("disk", disk)
+
+	monitor := NewQuotaMonitor(storages, time.Hour, []int{90, 80})
+	var warnings []int
+	monitor.warn = func(ctx context.Context, name string, quota Quota, threshold int) {
+		warnings = append(warnings, threshold)
+	}
+	ctx := context.Background()
+
+	if err := monitor.Check(ctx, "", 300); err != nil {
+		t.Fatalf("expected upload to fit: %v", err)
+	}
+	if err := monitor.Check(ctx, "", 301); !errors.Is(err, ErrInsufficientStorage) {
+		t.Fatalf("expected upload to be refused, got %v", err)
+	}
+	if err := monitor.Check(ctx, "disk", 1<<40); err != nil {
+		t.Fatalf("expected storage without quota to accept uploads: %v", err)
+	}
+	if queries != 1 {
+		t.Fatalf("expected the quota to be cached, got %d queries", queries)
+	}
+
+	// Uploads are accounted for until the next query
+	monitor.Uploaded("", 250, nil)
+	if err := monitor.Check(ctx, "", 51); !errors.Is(err, ErrInsufficientStorage) {
+		t.Fatalf("expected upload not to fit after another upload, got %v", err)
+	}
+	monitor.Refresh(ctx)
+	if err := monitor.Check(ctx, "", 51); err != nil {
+		t.Fatalf("expected refreshed quota to be used: %v", err)
+	}
+	monitor.Uploaded("", 10, fmt.Errorf("failed to upload: %w", ErrInsufficientStorage))
+	if err := monitor.Check(ctx, "", 1); !errors.Is(err, ErrInsufficientStorage) {
+		t.Fatalf("expected storage to be full after 507, got %v", err)
+	}
+
+	used, available = 850, 150
+	monitor.Refresh(ctx)
+	monitor.Refresh(ctx)
+	used, available = 950, 50
+	monitor.Refresh(ctx)
+	used, available = 500, 500
+	monitor.Refresh(ctx)
+	used, available = 820, 180
+	monitor.Refresh(ctx)
+	if fmt.Sprint(warnings) != "[80 90 80]" {
+		t.Fatalf("unexpected warnings: %v", warnings)
+	}
+
+	recorder := httptest.NewRecorder()
+	monitor.ServeMetrics(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	metrics := recorder.Body.String()
+	for _, line := range []string{
+		`nextcloud_media_bridge_quota_used_bytes{storage="nextcloud"} 820`,
+		`nextcloud_media_bridge_quota_available_bytes{storage="nextcloud"} 180`,
+		`nextcloud_media_bridge_quota_refused_uploads_total{storage="nextcloud"} 4`,
+	} {
+		if !strings.Contains(metrics, line+"\n") {
+			t.Fatalf("missing %q in metrics:\n%s", line, metrics)
+		}
+	}
+	if strings.Contains(metrics, `storage="disk"`) {
+		t.Fatalf("expected no metrics for storage without quota:\n%s", metrics)
+	}
+}
@@ -0,0 +1,349 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"path"
+	"strings"
+	"time"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"nextcloud-media-bridge/src/utils"
+)
+
+// Reconcile actions.
+const (
+	reconcileEdit    = "edit"
+	reconcileRedact  = "redact"
+	reconcileRestore = "restore"
+)
+
+// storedMapping is a verified event-to-path mapping read from room state.
+type storedMapping struct {
+	RoomID    id.RoomID
+	EventID   id.EventID
+	State     mediaState
+	Timestamp time.Time // When the mapping was stored
+}
+
+// folderListings checks whether files exist with one listing per folder.
+type folderListings struct {
+	storages *Storages
+	folders  map[string]map[string]bool // storage name and folder -> files
+	roots    map[string]error           // storage name -> error listing its root
+}
+
+func (l *folderListings) exists(ctx context.Context, name, remotePath string) (bool, error) {
+	storage, err := l.storages.Get(name)
+	if err != nil {
+		return false, err
+	}
+	remotePath = strings.Trim(remotePath, "/")
+	folder := path.Dir(remotePath)
+	if folder == "." {
+		folder = ""
+	}
+	key := name + "\x00" + folder
+	files, ok := l.folders[key]
+	if !ok {
+		listing, err := storage.List(ctx, folder)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return false, err
+		}
+		if err != nil && folder != "" {
+			// A missing root, e.g. an unmounted disk, hides every folder
+			if err := l.rootListable(ctx, name, storage); err != nil {
+				return false, fmt.Errorf("folder %s is missing and the root of %s cannot be listed: %w", folder, storageName(name), err)
+			}
+		}
+		files = make(map[string]bool, len(listing))
+		for _, file := range listing {
+			files[file.Path] = true
+		}
+		l.folders[key] = files
+	}
+	return files[remotePath], nil
+}
+
+// rootListable lists the root folder of a storage once per run.
+func (l *folderListings) rootListable(ctx context.Context, name string, storage Storage) error {
+	err, ok := l.roots[name]
+	if !ok {
+		_, err = storage.List(ctx, "")
+		l.roots[name] = err
+	}
+	return err
+}
+
+// StartReconciler runs Reconcile every interval until ctx is done.
+func (h *MediaHandler) StartReconciler(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := h.Reconcile(ctx); err != nil {
+				log.Printf("Warning: reconciliation failed: %v", err)
+			}
+		}
+	}
+}
+
+// Reconcile checks that the files of all stored mappings in joined rooms
+// still exist in Nextcloud and applies the configured action to messages
+// whose file was deleted there. It returns the number of missing files. If
+// more files are missing than reconcile.max_actions, none are acted on.
+func (h *MediaHandler) Reconcile(ctx context.Context) (int, error) {
+	joined, err := h.as.BotIntent().JoinedRooms(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to fetch joined rooms: %w", err)
+	}
+	listings := &folderListings{storages: h.storages, folders: map[string]map[string]bool{}, roots: map[string]error{}}
+	checked := 0
+	var missing []storedMapping
+	for _, roomID := range joined.JoinedRooms {
+		mappings, err := h.roomMappings(ctx, roomID)
+		if err != nil {
+			log.Printf("Warning: failed to read mappings of room %s: %v", roomID, err)
+			continue
+		}
+		for _, mapping := range mappings {
+			checked++
+			found, err := listings.exists(ctx, mapping.State.Storage, mapping.State.Path)
+			if err == nil && !found {
+				if moved := h.moves.Resolve(mapping.State.Storage, mapping.State.Path); moved != mapping.State.Path {
+					found, err = listings.exists(ctx, mapping.State.Storage, moved)
+				}
+			}
+			if errors.Is(err, ErrMaintenance) {
+				return len(missing), fmt.Errorf("reconciliation stopped: %w", err)
+			}
+			if err != nil {
+				// Never act on files whose existence is unknown
+				log.Printf("Warning: failed to check file %s in %s: %v", mapping.State.Path, storageName(mapping.State.Storage), err)
+				continue
+			}
+			if !found {
+				missing = append(missing, mapping)
+			}
+		}
+	}
+	log.Printf("Reconciliation checked %d archived file(s), %d missing", checked, len(missing))
+	if limit := h.config.Reconcile.MaxActions; limit > 0 && len(missing) > limit {
+		return len(missing), fmt.Errorf("reconciliation stopped: %d files are missing, more than reconcile.max_actions (%d); check the storages or raise the limit to handle them", len(missing), limit)
+	}
+	for _, mapping := range missing {
+		h.handleMissingFile(ctx, mapping)
+	}
+	return len(missing), nil
+}
+
+// roomMappings returns the verified mappings stored in a room's state.
+func (h *MediaHandler) roomMappings(ctx context.Context, roomID id.RoomID) ([]storedMapping, error) {
+	events, err := h.as.BotClient().StateAsArray(ctx, roomID)
+	if err != nil {
+		return nil, err
+	}
+	var mappings []storedMapping
+	for _, evt := range events {
+		if evt.Type.Type != nextcloudMediaStateEvent.Type || evt.StateKey == nil {
+			continue
+		}
+		var state mediaState
+		if err := json.Unmarshal(evt.Content.VeryRaw, &state); err != nil || state.Path == "" {
+			continue
+		}
+		if ok, err := h.verifyMediaState(state); err != nil || !ok {
+			log.Printf("Ignoring Nextcloud state for event %s with invalid signature", *evt.StateKey)
+			continue
+		}
+		mappings = append(mappings, storedMapping{RoomID: roomID, EventID: id.EventID(*evt.StateKey), State: state, Timestamp: time.UnixMilli(evt.Timestamp)})
+	}
+	return mappings, nil
+}
+
+// handleMissingFile applies the reconcile action to a message whose file was
+// deleted in Nextcloud. The mapping is cleared unless the file was restored,
+// and the originals kept next to the file are deleted with it.
+func (h *MediaHandler) handleMissingFile(ctx context.Context, mapping storedMapping) {
+	original, err := h.as.BotClient().GetEvent(ctx, mapping.RoomID, mapping.EventID)
+	if err != nil {
+		log.Printf("Warning: failed to fetch event %s for missing file %s: %v", mapping.EventID, mapping.State.Path, err)
+		return
+	}
+	if redaction := original.Unsigned.RedactedBecause; redaction != nil {
+		// The redaction policy failed for some originals, try them again
+		if len(mapping.State.Originals) > 0 {
+			redaction.RoomID = mapping.RoomID
+			_ = redaction.Content.ParseRaw(event.EventRedaction)
+			if _, err := h.redactFiles(ctx, redaction, mapping.EventID, h.redactionPolicy(ctx, mapping.RoomID), mapping.State.Storage, mapping.State.Originals); err != nil {
+				log.Printf("Warning: keeping mapping of redacted event %s: %v", mapping.EventID, err)
+				return
+			}
+		}
+		log.Printf("Clearing mapping of redacted event %s", mapping.EventID)
+		h.clearMediaState(ctx, mapping.RoomID, mapping.EventID)
+		return
+	}
+
+	action := h.config.Reconcile.Action
+	log.Printf("Nextcloud file %s of event %s in room %s is missing, action %s", mapping.State.Path, mapping.EventID, mapping.RoomID, action)
+	if action == reconcileRestore {
+		err := h.restoreMissingFile(ctx, mapping, original)
+		if err == nil {
+			log.Printf("Restored Nextcloud file %s from %s", mapping.State.Path, mapping.State.Source)
+			return
+		}
+		log.Printf("Failed to restore Nextcloud file %s, editing the message instead: %v", mapping.State.Path, err)
+		action = reconcileEdit
+	}
+
+	// The file is gone for good, so the mirror copy goes too
+	h.replicator.Delete(mapping.State.Storage, h.moves.Resolve(mapping.State.Storage, mapping.State.Path))
+	h.deleteOriginals(ctx, mapping)
+	h.clearMediaState(ctx, mapping.RoomID, mapping.EventID)
+	switch action {
+	case reconcileRedact:
+		_, err = h.as.BotClient().RedactEvent(ctx, mapping.RoomID, mapping.EventID, mautrix.ReqRedact{Reason: "File was deleted in Nextcloud"})
+	default:
+		err = h.sendRemovedNotice(ctx, mapping, original.Sender)
+	}
+	if err != nil {
+		log.Printf("Warning: failed to %s message %s of missing file %s: %v", action, mapping.EventID, mapping.State.Path, err)
+	}
+}
+
+// deleteOriginals deletes the originals kept next to a file that was deleted
+// in Nextcloud, so the metadata stripped from the file does not outlive it.
+func (h *MediaHandler) deleteOriginals(ctx context.Context, mapping storedMapping) {
+	if len(mapping.State.Originals) == 0 {
+		return
+	}
+	storage, err := h.storages.Get(mapping.State.Storage)
+	if err != nil {
+		log.Printf("Warning: failed to delete originals of %s: %v", mapping.State.Path, err)
+		return
+	}
+	for _, filePath := range mapping.State.Originals {
+		filePath = h.currentPath(ctx, mapping.State.Storage, storage, filePath)
+		if err := storage.DeleteFile(ctx, filePath); err != nil && !errors.Is(err, ErrNotFound) {
+			log.Printf("Warning: failed to delete original %s of missing file %s: %v", filePath, mapping.State.Path, err)
+			continue
+		}
+		log.Printf("Deleted original %s of missing file %s", filePath, mapping.State.Path)
+		h.replicator.Delete(mapping.State.Storage, filePath)
+	}
+}
+
+// restoreMissingFile archives the media still stored on the homeserver again
+// like a new upload: it is scanned, stripped of metadata and uploaded with the
+// room's conflict strategy. If the archived path was taken by another file in
+// the meantime, the message is edited to point at the restored file.
+func (h *MediaHandler) restoreMissingFile(ctx context.Context, mapping storedMapping, original *event.Event) error {
+	if mapping.State.Source == "" {
+		return fmt.Errorf("no source media recorded")
+	}
+	if mapping.State.Encrypted {
+		return fmt.Errorf("source media is encrypted")
+	}
+	source, err := id.ContentURIString(mapping.State.Source).Parse()
+	if err != nil {
+		return fmt.Errorf("invalid source media URL: %w", err)
+	}
+	if err := original.Content.ParseRaw(original.Type); err != nil && !errors.Is(err, event.ErrContentAlreadyParsed) {
+		return fmt.Errorf("failed to parse event: %w", err)
+	}
+	msg := original.Content.AsMessage()
+	if msg == nil {
+		return fmt.Errorf("event is not a message")
+	}
+	storage, err := h.storages.Get(mapping.State.Storage)
+	if err != nil {
+		return err
+	}
+	rule, _ := h.rooms.Resolve(ctx, mapping.RoomID)
+	filter := h.roomFilter(rule)
+
+	resp, err := h.as.BotClient().Download(ctx, source)
+	if err != nil {
+		return fmt.Errorf("failed to download source media: %w", err)
+	}
+	defer resp.Body.Close()
+	data, tooLarge, err := readMedia(resp.Body, int64(filter.MaxSize))
+	if err != nil {
+		return fmt.Errorf("failed to read source media: %w", err)
+	}
+	if tooLarge {
+		return fmt.Errorf("source media is larger than %s", filter.MaxSize)
+	}
+	if !h.scanMedia(ctx, original, data) {
+		return fmt.Errorf("source media did not pass the virus scan")
+	}
+	mimeType := resp.Header.Get("Content-Type")
+	filePath := h.moves.Resolve(mapping.State.Storage, mapping.State.Path)
+	filename := path.Base(filePath)
+	data, unstripped := h.stripImageMetadata(rule, original, mimeType, data)
+	finalPath, finalFilename, reused, err := h.uploadMedia(ctx, mapping.State.Storage, storage, filePath, filename, data, h.conflictNaming(rule, original))
+	if err != nil {
+		return err
+	}
+	h.annotateFile(ctx, storage, original, msg, finalPath, finalFilename, mimeType, data, reused)
+	h.replicator.Upload(mapping.State.Storage, finalPath)
+
+	state := mapping.State
+	if finalPath != filePath {
+		log.Printf("Path %s was taken by another file, restored to %s", filePath, finalPath)
+		mediaRef := utils.MediaRef{
+			Path:     strings.TrimLeft(finalPath, "/"),
+			FileName: finalFilename,
+			MimeType: mimeType,
+			Storage:  mapping.State.Storage,
+		}
+		mxc, err := h.sendMediaEdit(ctx, mapping.RoomID, original.Sender, mapping.EventID, msg, finalPath, mediaRef, data)
+		if err != nil {
+			return fmt.Errorf("failed to edit message to the restored file: %w", err)
+		}
+		state.Path, state.FileName, state.MXC = finalPath, finalFilename, mxc
+	}
+	originalPath := h.keepOriginal(ctx, rule, original, msg, filename, mimeType, unstripped)
+	if originalPath != "" {
+		state.Originals = append(state.Originals, originalPath)
+	}
+	if originalPath != "" || finalPath != filePath {
+		h.storeMediaState(mapping.RoomID, mapping.EventID, state)
+	}
+	return nil
+}
+
+// sendRemovedNotice edits the message as its sender to say that the file was
+// removed.
+func (h *MediaHandler) sendRemovedNotice(ctx context.Context, mapping storedMapping, sender id.UserID) error {
+	filename := mapping.State.FileName
+	if filename == "" {
+		filename = path.Base(mapping.State.Path)
+	}
+	body := fmt.Sprintf("The file %s was deleted in Nextcloud.", filename)
+	content := &event.MessageEventContent{
+		MsgType: event.MsgText,
+		Body:    "* " + body,
+		RelatesTo: &event.RelatesTo{
+			Type:    event.RelReplace,
+			EventID: mapping.EventID,
+		},
+		NewContent: &event.MessageEventContent{
+			MsgType: event.MsgText,
+			Body:    body,
+		},
+	}
+	_, err := h.as.Intent(sender).SendMessageEvent(ctx, mapping.RoomID, event.EventMessage, content)
+	return err
+}
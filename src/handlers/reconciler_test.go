@@ -0,0 +1,220 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"image"
+	"image/jpeg"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"maunium.net/go/mautrix/event"
+
+	"nextcloud-media-bridge/src/config"
+)
+
+func TestReconcile(t *testing.T) {
+	const roomID = "!roomid:example.com"
+	for _, action := range []string{reconcileEdit, reconcileRedact, reconcileRestore} {
+		t.Run(action, func(t *testing.T) {
+			var mu sync.Mutex
+			var listed []string
+			uploads := newFakeUploads()
+			var cleared []string
+			var edit *event.MessageEventContent
+			var redacted string
+			var deleted []string
+			var handler *MediaHandler
+
+			nt := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if uploads.serve(w, r) {
+					return
+				}
+				mu.Lock()
+				defer mu.Unlock()
+				switch r.Method {
+				case http.MethodHead:
+					w.WriteHeader(http.StatusNotFound)
+				case "PROPFIND":
+					listed = append(listed, r.URL.Path)
+					w.WriteHeader(http.StatusMultiStatus)
+					_, _ = w.Write([]byte(`<?xml version="1.0"?><d:multistatus xmlns:d="DAV:">` +
+						`<d:response><d:href>/media/alice/</d:href><d:propstat><d:prop><d:resourcetype><d:collection/></d:resourcetype></d:prop><d:status>HTTP/1.1 200 OK</d:status></d:propstat></d:response>` +
+						`<d:response><d:href>/media/alice/present.jpg</d:href><d:propstat><d:prop><d:getcontentlength>3</d:getcontentlength></d:prop><d:status>HTTP/1.1 200 OK</d:status></d:propstat></d:response>` +
+						`</d:multistatus>`))
+				case "MKCOL":
+					w.WriteHeader(http.StatusCreated)
+				case http.MethodDelete:
+					deleted = append(deleted, r.URL.Path)
+					w.WriteHeader(http.StatusNoContent)
+				}
+			}))
+			defer nt.Close()
+
+			mt := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				defer mu.Unlock()
+				switch {
+				case strings.HasSuffix(r.URL.Path, "/joined_rooms"):
+					_, _ = w.Write([]byte(`{"joined_rooms":["` + roomID + `"]}`))
+				case strings.HasSuffix(r.URL.Path, "/state") && r.Method == http.MethodGet:
+					var events []map[string]any
+					for eventID, filePath := range map[string]string{"$present": "/media/alice/present.jpg", "$missing": "/media/alice/missing.jpg"} {
+						state := mediaState{Path: filePath, FileName: strings.TrimPrefix(filePath, "/media/alice/"), Source: "mxc://example.com/" + strings.TrimPrefix(eventID, "$")}
+						if eventID == "$missing" {
+							state.Originals = []string{"/originals/missing.jpg"}
+						}
+						state.Signature, _ = handler.signMediaState(state)
+						events = append(events, map[string]any{"type": nextcloudMediaStateEvent.Type, "state_key": eventID, "content": state, "event_id": "$s" + eventID, "sender": "@bridge:example.com"})
+					}
+					events = append(events, map[string]any{"type": nextcloudMediaStateEvent.Type, "state_key": "$cleared", "content": map[string]any{}, "event_id": "$s3", "sender": "@bridge:example.com"})
+					_ = json.NewEncoder(w).Encode(events)
+				case strings.Contains(r.URL.Path, "/state/com.nextcloud-media-bridge.media/"):
+					body, _ := io.ReadAll(r.Body)
+					if string(body) == "{}" {
+						cleared = append(cleared, r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:])
+					}
+					_, _ = w.Write([]byte(`{"event_id":"$state"}`))
+				case strings.Contains(r.URL.Path, "/event/"):
+					_, _ = w.Write([]byte(`{"type":"m.room.message","sender":"@alice:example.com","event_id":"$missing","room_id":"` + roomID + `","content":{}}`))
+				case strings.Contains(r.URL.Path, "/redact/"):
+					redacted = r.URL.Path
+					_, _ = w.Write([]byte(`{"event_id":"$redaction"}`))
+				case strings.Contains(r.URL.Path, "/send/m.room.message/"):
+					_ = json.NewDecoder(r.Body).Decode(&edit)
+					_, _ = w.Write([]byte(`{"event_id":"$edit"}`))
+				case strings.Contains(r.URL.Path, "/media/download/"):
+					w.Header().Set("Content-Type", "image/jpeg")
+					_, _ = w.Write(jpegWithExif(t))
+				default:
+					_, _ = w.Write([]byte(`{}`))
+				}
+			}))
+			defer mt.Close()
+
+			cfg := &config.Config{}
+			cfg.Reconcile.Action = action
+			stripMetadata := true
+			cfg.Matrix.StripMetadata.Enabled = &stripMetadata
+			handler = newTestHandler(t, cfg, mt.URL, NewStorages(NewNextcloudClient(nt.URL, "user", "pass")))
+
+			missing, err := handler.Reconcile(context.Background())
+			if err != nil {
+				t.Fatalf("Reconcile failed: %v", err)
+			}
+			if missing != 1 {
+				t.Fatalf("expected 1 missing file, got %d", missing)
+			}
+			if len(listed) != 1 || listed[0] != "/media/alice" {
+				t.Fatalf("expected one listing of the folder, got %v", listed)
+			}
+
+			switch action {
+			case reconcileEdit:
+				if edit == nil || edit.RelatesTo.EventID != "$missing" || !strings.Contains(edit.NewContent.Body, "missing.jpg was deleted") {
+					t.Fatalf("unexpected edit %+v", edit)
+				}
+			case reconcileRedact:
+				if !strings.Contains(redacted, "/redact/$missing/") && !strings.Contains(redacted, "/redact/%24missing/") {
+					t.Fatalf("expected redaction of $missing, got %q", redacted)
+				}
+			case reconcileRestore:
+				if paths := uploads.paths(); len(paths) != 1 || paths[0] != "/media/alice/missing.jpg" || edit != nil {
+					t.Fatalf("expected restore upload only, got uploads %v edit %+v", paths, edit)
+				}
+				if restored := uploads.file("/media/alice/missing.jpg"); !strings.HasPrefix(restored, "\xff\xd8") || strings.Contains(restored, "Exif") {
+					t.Fatalf("expected the restored image to be stripped of metadata, got %q", restored)
+				}
+				if len(cleared) != 0 || len(deleted) != 0 {
+					t.Fatalf("restored mapping must be kept, cleared %v deleted %v", cleared, deleted)
+				}
+				return
+			}
+			if len(cleared) != 1 || !strings.Contains(cleared[0], "missing") {
+				t.Fatalf("expected mapping of $missing to be cleared, got %v", cleared)
+			}
+			if len(deleted) != 1 || deleted[0] != "/originals/missing.jpg" {
+				t.Fatalf("expected the original to be deleted, got %v", deleted)
+			}
+		})
+	}
+}
+
+func TestReconcileSafeguards(t *testing.T) {
+	const roomID = "!roomid:example.com"
+	var mu sync.Mutex
+	var handler *MediaHandler
+	var cleared int
+
+	mt := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/joined_rooms"):
+			_, _ = w.Write([]byte(`{"joined_rooms":["` + roomID + `"]}`))
+		case strings.HasSuffix(r.URL.Path, "/state") && r.Method == http.MethodGet:
+			var events []map[string]any
+			for _, eventID := range []string{"$one", "$two"} {
+				state := mediaState{Path: "/media/room/" + strings.TrimPrefix(eventID, "$") + ".jpg", Storage: "disk"}
+				state.Signature, _ = handler.signMediaState(state)
+				events = append(events, map[string]any{"type": nextcloudMediaStateEvent.Type, "state_key": eventID, "content": state, "event_id": "$s" + eventID, "sender": "@bridge:example.com"})
+			}
+			_ = json.NewEncoder(w).Encode(events)
+		case strings.Contains(r.URL.Path, "/state/com.nextcloud-media-bridge.media/"):
+			cleared++
+			_, _ = w.Write([]byte(`{"event_id":"$state"}`))
+		default:
+			_, _ = w.Write([]byte(`{}`))
+		}
+	}))
+	defer mt.Close()
+
+	// The disk is not mounted, so its root is missing as well
+	root := filepath.Join(t.TempDir(), "disk")
+	disk, err := NewLocalStorage(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	storages := NewStorages(NewNextcloudClient(mt.URL, "user", "pass"))
+	storages.Add("disk", disk)
+	cfg := &config.Config{}
+	cfg.Reconcile.Action = reconcileEdit
+	cfg.Reconcile.MaxActions = 1
+	handler = newTestHandler(t, cfg, mt.URL, storages)
+
+	missing, err := handler.Reconcile(context.Background())
+	if err != nil || missing != 0 || cleared != 0 {
+		t.Fatalf("expected files under a missing root to be left alone, got %d missing, %d cleared: %v", missing, cleared, err)
+	}
+
+	// With the root back, both files are missing, which is more than allowed
+	if err := os.MkdirAll(root, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	missing, err = handler.Reconcile(context.Background())
+	if err == nil || missing != 2 || cleared != 0 {
+		t.Fatalf("expected the run to stop before acting, got %d missing, %d cleared: %v", missing, cleared, err)
+	}
+}
+
+// jpegWithExif returns a JPEG with an EXIF block that is not only an
+// orientation, so metadata stripping removes it.
+func jpegWithExif(t *testing.T) []byte {
+	t.Helper()
+	var encoded bytes.Buffer
+	if err := jpeg.Encode(&encoded, image.NewRGBA(image.Rect(0, 0, 1, 1)), nil); err != nil {
+		t.Fatal(err)
+	}
+	exif := []byte("Exif\x00\x00MM\x00\x2a\x00\x00\x00\x08\x00\x00")
+	segment := append([]byte{0xFF, 0xE1, byte((len(exif) + 2) >> 8), byte(len(exif) + 2)}, exif...)
+	data := append([]byte{}, encoded.Bytes()[:2]...)
+	data = append(data, segment...)
+	return append(data, encoded.Bytes()[2:]...)
+}
@@ -0,0 +1,358 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"path"
+	"strings"
+	"time"
+)
+
+// replicationQueueSize is the number of changes waiting for the mirror before
+// new copies are dropped. Dropped copies are found by verify-replicas;
+// deletes and moves wait for room instead, because verify-replicas does not
+// find mirror copies that should be gone.
+const replicationQueueSize = 1000
+
+// Replicator copies archived files to the mirror storage in the background.
+// Each copy is read back and compared with the SHA-256 hash of the original.
+type Replicator struct {
+	storages *Storages
+	mirror   Storage
+	retries  int
+	backoff  time.Duration
+	jobs     chan replicationJob
+}
+
+// replicationJob is a change to apply to the mirror. Without a destination
+// the file at path is copied, or deleted if remove is set.
+type replicationJob struct {
+	storage     string
+	path        string
+	destination string
+	remove      bool
+}
+
+// NewReplicator returns a replicator for the mirror of storages, or nil if no
+// mirror is configured. Failed copies are attempted retries times.
+func NewReplicator(storages *Storages, retries int) *Replicator {
+	mirror := storages.Mirror()
+	if mirror == nil {
+		return nil
+	}
+	if retries <= 0 {
+		retries = 3
+	}
+	return &Replicator{storages: storages, mirror: mirror, retries: retries, backoff: 5 * time.Second, jobs: make(chan replicationJob, replicationQueueSize)}
+}
+
+// MirrorPath returns the path of a file in the mirror. Files in Nextcloud keep
+// their path, those in other storages are stored below the storage name.
+func MirrorPath(name, filePath string) string {
+	filePath = strings.TrimLeft(filePath, "/")
+	if name == "" {
+		return filePath
+	}
+	return path.Join(name, filePath)
+}
+
+// Start applies queued changes to the mirror until ctx is done.
+func (r *Replicator) Start(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case job := <-r.jobs:
+			r.apply(ctx, job)
+		}
+	}
+}
+
+// Upload queues copying a file that was uploaded or changed.
+func (r *Replicator) Upload(name, filePath string) {
+	r.enqueue(replicationJob{storage: name, path: filePath})
+}
+
+// Delete queues deleting a file from the mirror.
+func (r *Replicator) Delete(name, filePath string) {
+	r.enqueue(replicationJob{storage: name, path: filePath, remove: true})
+}
+
+// Move queues moving a file or folder in the mirror.
+func (r *Replicator) Move(name, sourcePath, destinationPath string) {
+	r.enqueue(replicationJob{storage: name, path: sourcePath, destination: destinationPath})
+}
+
+func (r *Replicator) enqueue(job replicationJob) {
+	if r == nil {
+		return
+	}
+	select {
+	case r.jobs <- job:
+		return
+	default:
+	}
+	if !job.remove && job.destination == "" {
+		log.Printf("Warning: Replication queue is full, not mirroring %s", job.path)
+		return
+	}
+	log.Printf("Warning: Replication queue is full, waiting to mirror the change to %s", job.path)
+	r.jobs <- job
+}
+
+func (r *Replicator) apply(ctx context.Context, job replicationJob) {
+	source := MirrorPath(job.storage, job.path)
+	var err error
+	switch {
+	case job.remove:
+		err = r.mirror.DeleteFile(ctx, source)
+	case job.destination != "":
+		destination := MirrorPath(job.storage, job.destination)
+		if err = r.mirror.EnsureDirectories(ctx, destination); err == nil {
+			err = r.mirror.Move(ctx, source, destination)
+		}
+		if errors.Is(err, ErrNotFound) {
+			// Never mirrored; verify-replicas copies it to the new place
+			log.Printf("Warning: %s of %s is not in the mirror, not moving it", job.path, storageName(job.storage))
+			return
+		}
+	default:
+		_, err = r.replicateWithRetries(ctx, job)
+	}
+	if err != nil {
+		log.Printf("Warning: Failed to mirror %s of %s: %v", job.path, storageName(job.storage), err)
+	}
+}
+
+func (r *Replicator) replicateWithRetries(ctx context.Context, job replicationJob) (bool, error) {
+	var err error
+	for attempt := 1; attempt <= r.retries; attempt++ {
+		var copied bool
+		if copied, err = r.Replicate(ctx, job.storage, job.path); err == nil {
+			if copied {
+				log.Printf("Mirrored %s of %s", job.path, storageName(job.storage))
+			}
+			return copied, nil
+		}
+		if attempt == r.retries {
+			break
+		}
+		log.Printf("Mirroring %s failed (attempt %d of %d): %v", job.path, attempt, r.retries, err)
+		select {
+		case <-ctx.Done():
+			return false, ctx.Err()
+		case <-time.After(time.Duration(attempt) * r.backoff):
+		}
+	}
+	return false, err
+}
+
+// Replicate copies a file to the mirror unless the mirror already has the
+// same content, and checks the copy against the hash of the original. It
+// returns whether the file was copied.
+func (r *Replicator) Replicate(ctx context.Context, name, filePath string) (bool, error) {
+	storage, err := r.storages.Get(name)
+	if err != nil {
+		return false, err
+	}
+	data, err := readStoredFile(ctx, storage, filePath)
+	if err != nil {
+		return false, err
+	}
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+
+	mirrorPath := MirrorPath(name, filePath)
+	if mirrored, err := hashStoredFile(ctx, r.mirror, mirrorPath); err == nil && mirrored == hash {
+		return false, nil
+	} else if err != nil && !errors.Is(err, ErrNotFound) {
+		return false, fmt.Errorf("failed to read mirror copy: %w", err)
+	}
+	if err := copyVerified(ctx, r.mirror, mirrorPath, data, hash); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Restore copies a file from the mirror back to its storage.
+func (r *Replicator) Restore(ctx context.Context, name, filePath string) error {
+	storage, err := r.storages.Get(name)
+	if err != nil {
+		return err
+	}
+	data, err := readStoredFile(ctx, r.mirror, MirrorPath(name, filePath))
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(data)
+	return copyVerified(ctx, storage, filePath, data, hex.EncodeToString(sum[:]))
+}
+
+// ReplicaStatus is the state of a file and its mirror copy.
+type ReplicaStatus string
+
+const (
+	ReplicaInSync         ReplicaStatus = "in sync"
+	ReplicaMissing        ReplicaStatus = "missing in mirror"
+	ReplicaDiffers        ReplicaStatus = "differs from mirror"
+	ReplicaPrimaryMissing ReplicaStatus = "only in mirror"
+	ReplicaLost           ReplicaStatus = "missing everywhere"
+)
+
+// Check compares a file with its mirror copy by hash.
+func (r *Replicator) Check(ctx context.Context, name, filePath string) (ReplicaStatus, error) {
+	storage, err := r.storages.Get(name)
+	if err != nil {
+		return "", err
+	}
+	primary, err := hashStoredFile(ctx, storage, filePath)
+	primaryMissing := errors.Is(err, ErrNotFound)
+	if err != nil && !primaryMissing {
+		return "", fmt.Errorf("failed to read %s: %w", filePath, err)
+	}
+	mirrored, err := hashStoredFile(ctx, r.mirror, MirrorPath(name, filePath))
+	mirrorMissing := errors.Is(err, ErrNotFound)
+	if err != nil && !mirrorMissing {
+		return "", fmt.Errorf("failed to read mirror copy of %s: %w", filePath, err)
+	}
+	switch {
+	case primaryMissing && mirrorMissing:
+		return ReplicaLost, nil
+	case primaryMissing:
+		return ReplicaPrimaryMissing, nil
+	case mirrorMissing:
+		return ReplicaMissing, nil
+	case primary != mirrored:
+		return ReplicaDiffers, nil
+	}
+	return ReplicaInSync, nil
+}
+
+// copyVerified uploads data and reads it back to compare it with hash.
+func copyVerified(ctx context.Context, storage Storage, filePath string, data []byte, hash string) error {
+	if err := storage.EnsureDirectories(ctx, filePath); err != nil {
+		return fmt.Errorf("failed to create directories: %w", err)
+	}
+	if err := storage.UploadReader(ctx, filePath, bytes.NewReader(data), int64(len(data))); err != nil {
+		return fmt.Errorf("failed to upload copy: %w", err)
+	}
+	copied, err := hashStoredFile(ctx, storage, filePath)
+	if err != nil {
+		return fmt.Errorf("failed to read back copy: %w", err)
+	}
+	if copied != hash {
+		return fmt.Errorf("hash of copy %s does not match original %s", copied, hash)
+	}
+	return nil
+}
+
+func readStoredFile(ctx context.Context, storage Storage, filePath string) ([]byte, error) {
+	file, err := storage.Download(ctx, filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Body.Close()
+	return io.ReadAll(file.Body)
+}
+
+// hashStoredFile returns the hex SHA-256 hash of a stored file.
+func hashStoredFile(ctx context.Context, storage Storage, filePath string) (string, error) {
+	file, err := storage.Download(ctx, filePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Body.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file.Body); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// ReplicaReport is the result of comparing archived files with the mirror.
+type ReplicaReport struct {
+	Checked   int
+	Divergent []ReplicaDivergence
+	Failed    int // Files or rooms that could not be compared
+}
+
+// ReplicaDivergence is an archived file that differs from its mirror copy.
+type ReplicaDivergence struct {
+	Storage  string
+	Path     string
+	Status   ReplicaStatus
+	Repaired bool
+	Error    string
+}
+
+// VerifyReplicas compares the files of all stored mappings in joined rooms
+// with their mirror copies. With repair, files missing or different in the
+// mirror are copied again, and files only in the mirror are restored.
+func (h *MediaHandler) VerifyReplicas(ctx context.Context, repair bool) (ReplicaReport, error) {
+	var report ReplicaReport
+	if h.replicator == nil {
+		return report, fmt.Errorf("no mirror configured")
+	}
+	joined, err := h.as.BotIntent().JoinedRooms(ctx)
+	if err != nil {
+		return report, fmt.Errorf("failed to fetch joined rooms: %w", err)
+	}
+	seen := map[string]bool{}
+	for _, roomID := range joined.JoinedRooms {
+		mappings, err := h.roomMappings(ctx, roomID)
+		if err != nil {
+			log.Printf("Warning: failed to read mappings of room %s: %v", roomID, err)
+			report.Failed++
+			continue
+		}
+		for _, mapping := range mappings {
+			storage, err := h.storages.Get(mapping.State.Storage)
+			if err != nil {
+				log.Printf("Warning: invalid storage of event %s: %v", mapping.EventID, err)
+				report.Failed++
+				continue
+			}
+			filePath := h.currentPath(ctx, mapping.State.Storage, storage, mapping.State.Path)
+			key := mapping.State.Storage + "\x00" + strings.TrimLeft(filePath, "/")
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			report.Checked++
+			h.verifyReplica(ctx, &report, mapping.State.Storage, filePath, repair)
+		}
+	}
+	return report, nil
+}
+
+func (h *MediaHandler) verifyReplica(ctx context.Context, report *ReplicaReport, name, filePath string, repair bool) {
+	status, err := h.replicator.Check(ctx, name, filePath)
+	if err != nil {
+		log.Printf("Warning: failed to compare %s of %s with the mirror: %v", filePath, storageName(name), err)
+		report.Failed++
+		return
+	}
+	if status == ReplicaInSync {
+		return
+	}
+	divergence := ReplicaDivergence{Storage: name, Path: filePath, Status: status}
+	if repair && status != ReplicaLost {
+		if status == ReplicaPrimaryMissing {
+			err = h.replicator.Restore(ctx, name, filePath)
+		} else {
+			_, err = h.replicator.Replicate(ctx, name, filePath)
+		}
+		if err != nil {
+			divergence.Error = err.Error()
+		} else {
+			divergence.Repaired = true
+		}
+	}
+	report.Divergent = append(report.Divergent, divergence)
+}
@@ -0,0 +1,235 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"nextcloud-media-bridge/src/config"
+	"nextcloud-media-bridge/src/utils"
+)
+
+// newMirroredStorages returns storages with a local storage "disk" that rooms
+// archive to and a local mirror "backup".
+func newMirroredStorages(t *testing.T) (*Storages, Storage, Storage) {
+	t.Helper()
+	disk, err := NewLocalStorage(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	backup, err := NewLocalStorage(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The Nextcloud account is unreachable and fails without retries
+	nextcloud := NewNextcloudClient("http://127.0.0.1:1", "user", "pass")
+	nextcloud.MaxRetries = 0
+	storages := NewStorages(nextcloud)
+	storages.Add("disk", disk)
+	storages.Add("backup", backup)
+	if err := storages.SetMirror("backup"); err != nil {
+		t.Fatal(err)
+	}
+	return storages, disk, backup
+}
+
+func storeFile(t *testing.T, storage Storage, filePath, content string) {
+	t.Helper()
+	if err := storage.EnsureDirectories(context.Background(), filePath); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.UploadReader(context.Background(), filePath, strings.NewReader(content), int64(len(content))); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReplicator(t *testing.T) {
+	storages, disk, backup := newMirroredStorages(t)
+	replicator := NewReplicator(storages, 1)
+	ctx := context.Background()
+
+	storeFile(t, disk, "/media/room/photo.jpg", "photo")
+	replicator.Upload("disk", "/media/room/photo.jpg")
+	replicator.apply(ctx, <-replicator.jobs)
+	if data := readStored(t, backup, "disk/media/room/photo.jpg"); data != "photo" {
+		t.Fatalf("unexpected mirror copy: %q", data)
+	}
+	if status, err := replicator.Check(context.Background(), "disk", "/media/room/photo.jpg"); err != nil || status != ReplicaInSync {
+		t.Fatalf("unexpected status %q: %v", status, err)
+	}
+	if copied, err := replicator.Replicate(context.Background(), "disk", "/media/room/photo.jpg"); err != nil || copied {
+		t.Fatalf("expected an unchanged file not to be copied again: %v %v", copied, err)
+	}
+
+	storeFile(t, disk, "/media/room/photo.jpg", "edited")
+	if status, _ := replicator.Check(context.Background(), "disk", "/media/room/photo.jpg"); status != ReplicaDiffers {
+		t.Fatalf("expected changed file to differ, got %q", status)
+	}
+
+	// Room renames move whole folders
+	if err := disk.Move(context.Background(), "media/room", "media/renamed"); err != nil {
+		t.Fatal(err)
+	}
+	replicator.Move("disk", "media/room", "media/renamed")
+	replicator.apply(ctx, <-replicator.jobs)
+	if data := readStored(t, backup, "disk/media/renamed/photo.jpg"); data != "photo" {
+		t.Fatalf("unexpected mirror copy after move: %q", data)
+	}
+
+	if err := disk.DeleteFile(context.Background(), "media/renamed/photo.jpg"); err != nil {
+		t.Fatal(err)
+	}
+	if status, _ := replicator.Check(context.Background(), "disk", "media/renamed/photo.jpg"); status != ReplicaPrimaryMissing {
+		t.Fatalf("expected file only in mirror, got %q", status)
+	}
+	if err := replicator.Restore(context.Background(), "disk", "media/renamed/photo.jpg"); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	if data := readStored(t, disk, "media/renamed/photo.jpg"); data != "photo" {
+		t.Fatalf("unexpected restored file: %q", data)
+	}
+
+	replicator.Delete("disk", "media/renamed/photo.jpg")
+	replicator.apply(ctx, <-replicator.jobs)
+	if status, _ := replicator.Check(context.Background(), "disk", "media/renamed/photo.jpg"); status != ReplicaMissing {
+		t.Fatalf("expected file missing in mirror, got %q", status)
+	}
+	if status, _ := replicator.Check(context.Background(), "disk", "media/other.jpg"); status != ReplicaLost {
+		t.Fatalf("expected file missing everywhere, got %q", status)
+	}
+}
+
+// corruptingStorage changes every uploaded file.
+type corruptingStorage struct {
+	Storage
+}
+
+func (s corruptingStorage) UploadReader(ctx context.Context, remotePath string, reader io.Reader, contentLength int64) error {
+	return s.Storage.UploadReader(ctx, remotePath, io.MultiReader(reader, strings.NewReader("!")), 0)
+}
+
+func TestReplicatorVerifiesCopies(t *testing.T) {
+	storages, disk, backup := newMirroredStorages(t)
+	storages.Add("backup", corruptingStorage{backup})
+	if err := storages.SetMirror("backup"); err != nil {
+		t.Fatal(err)
+	}
+	storeFile(t, disk, "media/file.txt", "content")
+	if _, err := NewReplicator(storages, 1).Replicate(context.Background(), "disk", "media/file.txt"); err == nil || !strings.Contains(err.Error(), "does not match") {
+		t.Fatalf("expected hash mismatch, got %v", err)
+	}
+}
+
+func TestOpenMediaFallsBackToMirror(t *testing.T) {
+	storages, _, backup := newMirroredStorages(t)
+	storeFile(t, backup, MirrorPath("", "/media/file.txt"), "backup copy")
+
+	media, err := openMedia(context.Background(), &config.Config{}, storages, nil, nil, nil, utils.MediaRef{Path: "media/file.txt", MimeType: "text/plain"})
+	if err != nil {
+		t.Fatalf("openMedia failed: %v", err)
+	}
+	defer media.Reader.Close()
+	if data, _ := io.ReadAll(media.Reader); string(data) != "backup copy" {
+		t.Fatalf("unexpected media: %q", data)
+	}
+	if _, err := openMedia(context.Background(), &config.Config{}, storages, nil, nil, nil, utils.MediaRef{Path: "media/other.txt"}); err == nil {
+		t.Fatalf("expected a file missing everywhere to fail")
+	}
+
+	// A file the storage reports as missing was deleted and is not served
+	storeFile(t, backup, MirrorPath("disk", "media/deleted.txt"), "backup copy")
+	if _, err := openMedia(context.Background(), &config.Config{}, storages, nil, nil, nil, utils.MediaRef{Path: "media/deleted.txt", Storage: "disk"}); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected a deleted file not to be served from the mirror, got %v", err)
+	}
+}
+
+func TestStorageUnavailable(t *testing.T) {
+	cases := []struct {
+		err  error
+		want bool
+	}{
+		{nil, false},
+		{fmt.Errorf("%w: media/file.txt", ErrNotFound), false},
+		{&StatusError{StatusCode: http.StatusNotFound}, false},
+		{&StatusError{StatusCode: http.StatusForbidden}, false},
+		{&StatusError{StatusCode: http.StatusBadGateway}, true},
+		{&StatusError{StatusCode: http.StatusServiceUnavailable, Maintenance: true}, true},
+		{fmt.Errorf("failed to download file: %w", errors.New("connection refused")), true},
+	}
+	for _, tc := range cases {
+		if got := storageUnavailable(tc.err); got != tc.want {
+			t.Errorf("storageUnavailable(%v) = %v, want %v", tc.err, got, tc.want)
+		}
+	}
+}
+
+func TestVerifyReplicas(t *testing.T) {
+	const roomID = "!roomid:example.com"
+	storages, disk, backup := newMirroredStorages(t)
+	storeFile(t, disk, "media/synced.jpg", "synced")
+	storeFile(t, backup, "disk/media/synced.jpg", "synced")
+	storeFile(t, disk, "media/unmirrored.jpg", "unmirrored")
+	storeFile(t, disk, "media/changed.jpg", "new")
+	storeFile(t, backup, "disk/media/changed.jpg", "old")
+	storeFile(t, backup, "disk/media/deleted.jpg", "deleted")
+
+	var handler *MediaHandler
+	mt := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/joined_rooms"):
+			_, _ = w.Write([]byte(`{"joined_rooms":["` + roomID + `"]}`))
+		case strings.HasSuffix(r.URL.Path, "/state"):
+			var events []map[string]any
+			for _, name := range []string{"synced", "unmirrored", "changed", "deleted", "lost"} {
+				state := mediaState{Path: "/media/" + name + ".jpg", FileName: name + ".jpg", Storage: "disk"}
+				state.Signature, _ = handler.signMediaState(state)
+				events = append(events, map[string]any{"type": nextcloudMediaStateEvent.Type, "state_key": "$" + name, "content": state, "event_id": "$s" + name, "sender": "@bridge:example.com"})
+			}
+			_ = json.NewEncoder(w).Encode(events)
+		default:
+			_, _ = w.Write([]byte(`{}`))
+		}
+	}))
+	defer mt.Close()
+	cfg := &config.Config{}
+	handler = newTestHandler(t, cfg, mt.URL, storages)
+
+	report, err := handler.VerifyReplicas(context.Background(), true)
+	if err != nil {
+		t.Fatalf("VerifyReplicas failed: %v", err)
+	}
+	if report.Checked != 5 || report.Failed != 0 {
+		t.Fatalf("unexpected report: %+v", report)
+	}
+	statuses := map[string]ReplicaDivergence{}
+	for _, divergence := range report.Divergent {
+		statuses[divergence.Path] = divergence
+	}
+	expected := map[string]ReplicaStatus{
+		"/media/unmirrored.jpg": ReplicaMissing,
+		"/media/changed.jpg":    ReplicaDiffers,
+		"/media/deleted.jpg":    ReplicaPrimaryMissing,
+		"/media/lost.jpg":       ReplicaLost,
+	}
+	if len(statuses) != len(expected) {
+		t.Fatalf("unexpected divergence: %+v", report.Divergent)
+	}
+	for filePath, status := range expected {
+		divergence := statuses[filePath]
+		if divergence.Status != status || divergence.Repaired != (status != ReplicaLost) {
+			t.Fatalf("unexpected divergence of %s: %+v", filePath, divergence)
+		}
+	}
+	if data := readStored(t, backup, "disk/media/changed.jpg"); data != "new" {
+		t.Fatalf("expected mirror copy to be repaired, got %q", data)
+	}
+	if data := readStored(t, disk, "media/deleted.jpg"); data != "deleted" {
+		t.Fatalf("expected file to be restored from the mirror, got %q", data)
+	}
+}
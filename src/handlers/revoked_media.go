@@ -0,0 +1,162 @@
+package handlers
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/appservice"
+
+	"nextcloud-media-bridge/src/utils"
+)
+
+// revokedMediaAccountData is the bot account data type storing revoked files.
+const revokedMediaAccountData = "com.nextcloud-media-bridge.revoked_media"
+
+// revokedMediaContent keeps the revoked files of the default Nextcloud
+// account in Paths, where releases before named storages stored all revoked
+// files.
+type revokedMediaContent struct {
+	Paths    []string            `json:"paths"`
+	Storages map[string][]string `json:"storages,omitempty"`
+	Media    []utils.MediaRef    `json:"media,omitempty"`
+}
+
+// RevokedMedia remembers archived files the media proxy must no longer serve,
+// because their message was redacted but the file was kept. Files are
+// recorded per storage, since the same path on another storage is a different
+// file. A file still used by other messages is not revoked; only the media
+// reference of the redacted message is. The list is persisted in the bot's
+// account data.
+type RevokedMedia struct {
+	as *appservice.AppService
+
+	mu    sync.RWMutex
+	paths map[string]map[string]bool // storage name -> path without leading slash
+	media map[utils.MediaRef]bool    // without Thumbnail
+	// writeMu is held from taking a snapshot until it is stored, so a slower
+	// write of an older snapshot never replaces a newer one.
+	writeMu sync.Mutex
+}
+
+func NewRevokedMedia(as *appservice.AppService) *RevokedMedia {
+	return &RevokedMedia{as: as, paths: map[string]map[string]bool{}, media: map[utils.MediaRef]bool{}}
+}
+
+// Load reads the revoked files from account data.
+func (r *RevokedMedia) Load(ctx context.Context) error {
+	var content revokedMediaContent
+	if err := r.as.BotClient().GetAccountData(ctx, revokedMediaAccountData, &content); err != nil {
+		if errors.Is(err, mautrix.MNotFound) {
+			return nil
+		}
+		return fmt.Errorf("failed to load revoked media: %w", err)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	count := 0
+	add := func(storage string, paths []string) {
+		if r.paths[storage] == nil {
+			r.paths[storage] = map[string]bool{}
+		}
+		for _, revoked := range paths {
+			r.paths[storage][strings.Trim(revoked, "/")] = true
+			count++
+		}
+	}
+	add("", content.Paths)
+	for name, paths := range content.Storages {
+		add(name, paths)
+	}
+	for _, ref := range content.Media {
+		r.media[ref] = true
+	}
+	log.Printf("Loaded %d revoked file(s) and %d revoked media reference(s)", count, len(content.Media))
+	return nil
+}
+
+// Revoke stops the media proxy from serving a file of the named storage.
+func (r *RevokedMedia) Revoke(ctx context.Context, storage, remotePath string) error {
+	r.mu.Lock()
+	if r.paths[storage] == nil {
+		r.paths[storage] = map[string]bool{}
+	}
+	r.paths[storage][strings.Trim(remotePath, "/")] = true
+	r.mu.Unlock()
+	return r.store(ctx)
+}
+
+// RevokeRef stops the media proxy from serving a media reference and its
+// thumbnail, while other references to the same file are still served.
+func (r *RevokedMedia) RevokeRef(ctx context.Context, ref utils.MediaRef) error {
+	ref.Thumbnail = false
+	r.mu.Lock()
+	r.media[ref] = true
+	r.mu.Unlock()
+	return r.store(ctx)
+}
+
+func (r *RevokedMedia) store(ctx context.Context) error {
+	r.writeMu.Lock()
+	defer r.writeMu.Unlock()
+	r.mu.RLock()
+	content := revokedMediaContent{Paths: []string{}}
+	for name, storagePaths := range r.paths {
+		paths := make([]string, 0, len(storagePaths))
+		for revoked := range storagePaths {
+			paths = append(paths, revoked)
+		}
+		sort.Strings(paths)
+		if name == "" {
+			content.Paths = paths
+			continue
+		}
+		if content.Storages == nil {
+			content.Storages = map[string][]string{}
+		}
+		content.Storages[name] = paths
+	}
+	for ref := range r.media {
+		content.Media = append(content.Media, ref)
+	}
+	r.mu.RUnlock()
+	slices.SortFunc(content.Media, func(a, b utils.MediaRef) int {
+		return cmp.Or(cmp.Compare(a.Storage, b.Storage), cmp.Compare(a.Path, b.Path), cmp.Compare(a.FileName, b.FileName), cmp.Compare(a.Version, b.Version))
+	})
+	if err := r.as.BotClient().SetAccountData(ctx, revokedMediaAccountData, content); err != nil {
+		return fmt.Errorf("failed to store revoked media: %w", err)
+	}
+	return nil
+}
+
+// IsRevoked reports whether a file of the named storage must not be served. A
+// nil receiver is valid and revokes nothing.
+func (r *RevokedMedia) IsRevoked(storage, remotePath string) bool {
+	if r == nil {
+		return false
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.paths[storage][strings.Trim(remotePath, "/")]
+}
+
+// IsRefRevoked reports whether a media reference or its file must not be
+// served. Files are revoked where they were when their message was redacted,
+// which is the moved path if their folder was moved after a room rename.
+func (r *RevokedMedia) IsRefRevoked(ref utils.MediaRef, moves *PathMoves) bool {
+	if r == nil {
+		return false
+	}
+	ref.Thumbnail = false
+	r.mu.RLock()
+	revokedRef := r.media[ref]
+	r.mu.RUnlock()
+	return revokedRef || r.IsRevoked(ref.Storage, ref.Path) || r.IsRevoked(ref.Storage, moves.Resolve(ref.Storage, ref.Path))
+}
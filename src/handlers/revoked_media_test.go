@@ -0,0 +1,39 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"maunium.net/go/mautrix"
+
+	"nextcloud-media-bridge/src/utils"
+)
+
+func TestRevokedMediaFollowsMoves(t *testing.T) {
+	moves := &PathMoves{moves: map[string]map[string]string{
+		"": {"media/Old Room": "media/New Room"},
+	}}
+	// Redacted after the rename, so the moved path was revoked
+	revoked := &RevokedMedia{paths: map[string]map[string]bool{
+		"": {"media/New Room/photo.jpg": true},
+	}}
+
+	ref := utils.MediaRef{Path: "/media/Old Room/photo.jpg", FileName: "photo.jpg"}
+	if !revoked.IsRefRevoked(ref, moves) {
+		t.Fatalf("expected the moved file to be revoked")
+	}
+	// The same path on another storage is a different file
+	ref.Storage = "s3"
+	if revoked.IsRefRevoked(ref, moves) {
+		t.Fatalf("expected the file on another storage to be served")
+	}
+
+	// The proxy refuses the revoked file without looking it up
+	ref.Storage = ""
+	_, err := openMedia(context.Background(), nil, nil, moves, revoked, nil, ref)
+	var respErr mautrix.RespError
+	if !errors.As(err, &respErr) || respErr.ErrCode != mautrix.MNotFound.ErrCode {
+		t.Fatalf("expected M_NOT_FOUND, got %v", err)
+	}
+}
@@ -15,64 +15,97 @@ import (
 type RoomManager struct {
 	config *config.Config
 	as     *appservice.AppService
+	rooms  *RoomResolver
 }
 
-func NewRoomManager(cfg *config.Config, as *appservice.AppService) *RoomManager {
-	return &RoomManager{config: cfg, as: as}
+func NewRoomManager(cfg *config.Config, as *appservice.AppService, rooms *RoomResolver) *RoomManager {
+	return &RoomManager{config: cfg, as: as, rooms: rooms}
+}
+
+// configuredRooms returns the rooms named in config (room templates, room
+// rules, spaces themselves and rooms linked to Talk) followed by the rooms
+// discovered in spaces.
+func (rm *RoomManager) configuredRooms() []id.RoomID {
+	var rooms []id.RoomID
+	for roomID := range rm.config.Matrix.RoomPathTemplate {
+		rooms = append(rooms, id.RoomID(roomID))
+	}
+	for _, rule := range rm.config.Matrix.RoomRules {
+		if rule.Room != "" {
+			rooms = append(rooms, id.RoomID(rule.Room))
+		}
+		if rule.Space != "" {
+			// Joining the space lets the bot read the hierarchy of private spaces
+			rooms = append(rooms, id.RoomID(rule.Space))
+		}
+	}
+	if rm.config.Talk.Enabled {
+		for _, link := range rm.config.Talk.Rooms {
+			rooms = append(rooms, id.RoomID(link.Room))
+		}
+	}
+	return rooms
 }
 
 // JoinConfiguredRooms attempts to join all configured rooms at startup
 func (rm *RoomManager) JoinConfiguredRooms(ctx context.Context) {
-	if len(rm.config.Matrix.RoomPathTemplate) == 0 {
-		log.Printf("No rooms configured in room_path_template")
+	configured := rm.configuredRooms()
+	if len(configured) == 0 {
+		log.Printf("No rooms configured in room_path_template or room_rules")
 		return
 	}
 
-	intent := rm.as.BotIntent()
-	botMXID := rm.as.BotMXID()
-
-	log.Printf("Attempting to join %d configured room(s)", len(rm.config.Matrix.RoomPathTemplate))
-
-	for roomID := range rm.config.Matrix.RoomPathTemplate {
-		parsedRoomID := id.RoomID(roomID)
+	log.Printf("Attempting to join %d configured room(s)", len(configured))
+	joined, err := rm.joinedRooms(ctx)
+	if err != nil {
+		log.Printf("Warning: Failed to fetch joined rooms: %v", err)
+		return
+	}
+	for _, roomID := range configured {
+		rm.joinRoom(ctx, joined, roomID)
+	}
 
-		// Check if already joined
-		joined, err := rm.isJoined(ctx, intent, parsedRoomID)
-		if err != nil {
-			log.Printf("Warning: Failed to check membership for room %s: %v", roomID, err)
-			continue
-		}
+	spaceRooms := rm.rooms.SpaceRooms(ctx)
+	if len(spaceRooms) > 0 {
+		log.Printf("Attempting to join %d room(s) discovered in configured spaces", len(spaceRooms))
+	}
+	for _, roomID := range spaceRooms {
+		rm.joinRoom(ctx, joined, roomID)
+	}
+}
 
-		if joined {
-			log.Printf("Already in room %s", roomID)
-			continue
-		}
+func (rm *RoomManager) joinRoom(ctx context.Context, joined map[id.RoomID]bool, roomID id.RoomID) {
+	if joined[roomID] {
+		log.Printf("Already in room %s", roomID)
+		return
+	}
 
-		// Try to join the room
-		log.Printf("Attempting to join room %s", roomID)
-		_, err = intent.JoinRoomByID(ctx, parsedRoomID)
-		if err != nil {
-			// Check if it's a permission error (room is private/invite-only)
-			if httpErr, ok := err.(mautrix.HTTPError); ok {
-				if httpErr.RespError != nil {
-					errCode := httpErr.RespError.ErrCode
-					if errCode == "M_FORBIDDEN" || errCode == "M_NOT_FOUND" {
-						log.Printf("Warning: Cannot join room %s - room is private or doesn't exist. Bot user %s needs to be invited manually.",
-							roomID, botMXID.String())
-						continue
-					}
+	// Try to join the room
+	log.Printf("Attempting to join room %s", roomID)
+	_, err := rm.as.BotIntent().JoinRoomByID(ctx, roomID)
+	if err != nil {
+		// Check if it's a permission error (room is private/invite-only)
+		if httpErr, ok := err.(mautrix.HTTPError); ok {
+			if httpErr.RespError != nil {
+				errCode := httpErr.RespError.ErrCode
+				if errCode == "M_FORBIDDEN" || errCode == "M_NOT_FOUND" {
+					log.Printf("Warning: Cannot join room %s - room is private or doesn't exist. Bot user %s needs to be invited manually.",
+						roomID, rm.as.BotMXID().String())
+					return
 				}
 			}
-			log.Printf("Warning: Failed to join room %s: %v - Bot may need to be invited.", roomID, err)
-		} else {
-			log.Printf("Successfully joined room %s", roomID)
 		}
+		log.Printf("Warning: Failed to join room %s: %v - Bot may need to be invited.", roomID, err)
+		return
 	}
+	joined[roomID] = true
+	log.Printf("Successfully joined room %s", roomID)
 }
 
 // StartRoomMonitor periodically checks if the bot is still in configured rooms
+// and joins rooms that were added to configured spaces since the last check.
 func (rm *RoomManager) StartRoomMonitor(ctx context.Context, checkInterval time.Duration) {
-	if len(rm.config.Matrix.RoomPathTemplate) == 0 {
+	if len(rm.configuredRooms()) == 0 {
 		return
 	}
 
@@ -90,37 +123,34 @@ func (rm *RoomManager) StartRoomMonitor(ctx context.Context, checkInterval time.
 }
 
 func (rm *RoomManager) checkRoomMembership(ctx context.Context) {
-	intent := rm.as.BotIntent()
-
-	for roomID := range rm.config.Matrix.RoomPathTemplate {
-		parsedRoomID := id.RoomID(roomID)
-
-		joined, err := rm.isJoined(ctx, intent, parsedRoomID)
-		if err != nil {
-			log.Printf("Warning: Failed to check membership for room %s: %v", roomID, err)
-			continue
-		}
+	joined, err := rm.joinedRooms(ctx)
+	if err != nil {
+		log.Printf("Warning: Failed to fetch joined rooms: %v", err)
+		return
+	}
 
-		if !joined {
+	for _, roomID := range rm.configuredRooms() {
+		if !joined[roomID] {
 			log.Printf("Warning: Bridge is NOT in configured room %s! Media uploads will be skipped. Invite bot user @%s to this room.",
 				roomID, rm.as.BotMXID().String())
 		}
 	}
+
+	for _, roomID := range rm.rooms.SpaceRooms(ctx) {
+		if !joined[roomID] {
+			rm.joinRoom(ctx, joined, roomID)
+		}
+	}
 }
 
-func (rm *RoomManager) isJoined(ctx context.Context, intent *appservice.IntentAPI, roomID id.RoomID) (bool, error) {
-	// Get joined rooms
-	joinedResp, err := intent.JoinedRooms(ctx)
+func (rm *RoomManager) joinedRooms(ctx context.Context) (map[id.RoomID]bool, error) {
+	joinedResp, err := rm.as.BotIntent().JoinedRooms(ctx)
 	if err != nil {
-		return false, err
+		return nil, err
 	}
-
-	// Check if our room is in the list
-	for _, joined := range joinedResp.JoinedRooms {
-		if joined == roomID {
-			return true, nil
-		}
+	joined := make(map[id.RoomID]bool, len(joinedResp.JoinedRooms))
+	for _, roomID := range joinedResp.JoinedRooms {
+		joined[roomID] = true
 	}
-
-	return false, nil
+	return joined, nil
 }
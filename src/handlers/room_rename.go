@@ -0,0 +1,144 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"log"
+	"path"
+
+	"maunium.net/go/mautrix/event"
+
+	"nextcloud-media-bridge/src/utils"
+)
+
+// roomVariableNames are the template variables that only depend on the room.
+var roomVariableNames = map[string]bool{"room": true, "room_id": true, "room_name": true, "room_alias": true}
+
+// handleRoomRename moves the folders named after ${room_name} when a room's
+// m.room.name changes. Only the first folder segment that uses ${room_name}
+// is moved; folders before it that use other variables (such as ${year}) are
+// found by listing their parent.
+func (h *MediaHandler) handleRoomRename(ctx context.Context, evt *event.Event) {
+	rule, ok := h.rooms.Resolve(ctx, evt.RoomID)
+	if !ok {
+		return
+	}
+	template, err := utils.ParsePathTemplate(rule.Template)
+	if err != nil || !template.Uses("room_name") {
+		return
+	}
+	segments := template.Segments()
+	index := -1
+	for i, segment := range segments[:len(segments)-1] {
+		if segment.Uses("room_name") {
+			index = i
+			break
+		}
+	}
+	if index < 0 {
+		log.Printf("Room %s renamed, but ${room_name} is not part of a folder in its template", evt.RoomID.String())
+		return
+	}
+	for _, variable := range segments[index].Variables() {
+		if !roomVariableNames[variable] {
+			log.Printf("Room %s renamed, but its folder also uses ${%s}; not moving folders", evt.RoomID.String(), variable)
+			return
+		}
+	}
+
+	if err := evt.Content.ParseRaw(evt.Type); err != nil && err != event.ErrContentAlreadyParsed {
+		log.Printf("Failed to parse room name event %s: %v", evt.ID.String(), err)
+		return
+	}
+	newContent, _ := evt.Content.Parsed.(*event.RoomNameEventContent)
+	var oldContent event.RoomNameEventContent
+	if evt.Unsigned.PrevContent != nil {
+		if err := evt.Unsigned.PrevContent.ParseRaw(evt.Type); err != nil && err != event.ErrContentAlreadyParsed {
+			log.Printf("Failed to parse previous room name of event %s: %v", evt.ID.String(), err)
+			return
+		}
+		if parsed, ok := evt.Unsigned.PrevContent.Parsed.(*event.RoomNameEventContent); ok {
+			oldContent = *parsed
+		}
+	}
+
+	vars := h.roomVariables(ctx, template, evt.RoomID)
+	newVars := copyVariables(vars)
+	oldVars := copyVariables(vars)
+	if newContent != nil {
+		newVars["room_name"] = roomDisplayName(newContent.Name, vars["room_alias"], vars["room_id"])
+	}
+	oldVars["room_name"] = roomDisplayName(oldContent.Name, vars["room_alias"], vars["room_id"])
+	oldFolder := segments[index].Render(oldVars)
+	newFolder := segments[index].Render(newVars)
+	if oldFolder == newFolder {
+		return
+	}
+
+	storage, err := h.storages.Get(rule.Storage)
+	if err != nil {
+		log.Printf("Room %s renamed, but its storage is invalid: %v", evt.RoomID.String(), err)
+		return
+	}
+	log.Printf("Room %s renamed, moving folders %s to %s", evt.RoomID.String(), oldFolder, newFolder)
+	for _, parent := range h.expandFolders(ctx, storage, segments[:index], vars) {
+		source := path.Join(parent, oldFolder)
+		destination := path.Join(parent, newFolder)
+		if err := storage.Move(ctx, source, destination); err != nil {
+			if !errors.Is(err, ErrNotFound) {
+				log.Printf("Warning: Failed to move %s to %s: %v", source, destination, err)
+			}
+			continue
+		}
+		h.replicator.Move(rule.Storage, source, destination)
+		if err := h.moves.Record(ctx, rule.Storage, source, destination); err != nil {
+			log.Printf("Warning: Moved %s to %s but failed to record it: %v", source, destination, err)
+		}
+	}
+}
+
+// expandFolders returns all existing folders matching the given template
+// segments. Segments using only room variables are rendered, others are
+// matched against every subfolder of their parent.
+func (h *MediaHandler) expandFolders(ctx context.Context, storage Storage, segments []*utils.PathTemplate, vars map[string]string) []string {
+	folders := []string{""}
+	for _, segment := range segments {
+		static := true
+		for _, variable := range segment.Variables() {
+			if !roomVariableNames[variable] {
+				static = false
+			}
+		}
+		if static {
+			for i := range folders {
+				folders[i] = path.Join(folders[i], segment.Render(vars))
+			}
+			continue
+		}
+		var expanded []string
+		for _, folder := range folders {
+			entries, err := storage.List(ctx, folder)
+			if err != nil {
+				if !errors.Is(err, ErrNotFound) {
+					log.Printf("Warning: Failed to list %s: %v", folder, err)
+				}
+				continue
+			}
+			for _, entry := range entries {
+				if entry.IsDir {
+					expanded = append(expanded, entry.Path)
+				}
+			}
+		}
+		folders = expanded
+	}
+	return folders
+}
+
+func copyVariables(vars map[string]string) map[string]string {
+	copied := make(map[string]string, len(vars))
+	for key, value := range vars {
+		copied[key] = value
+	}
+	return copied
+}
@@ -0,0 +1,327 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"log"
+	"path"
+	"sync"
+	"time"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/appservice"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"nextcloud-media-bridge/src/config"
+)
+
+const (
+	roomCacheTTL   = 10 * time.Minute
+	joinedRoomsTTL = time.Minute
+)
+
+type cachedAliases struct {
+	aliases []id.RoomAlias
+	fetched time.Time
+}
+
+type stateCacheKey struct {
+	roomID    id.RoomID
+	eventType string
+	stateKey  string
+}
+
+type cachedValue struct {
+	value   string
+	fetched time.Time
+}
+
+// RoomResolver decides which room rule applies to a room. Exact room IDs are
+// matched from config alone; alias, space and default rules need room state
+// and only apply to rooms the bot has joined.
+type RoomResolver struct {
+	config *config.Config
+	as     *appservice.AppService
+
+	mu            sync.Mutex
+	aliases       map[id.RoomID]cachedAliases
+	stateValues   map[stateCacheKey]cachedValue // room names and member display names
+	spaceRooms    map[id.RoomID]int             // child room -> index into RoomRules
+	spacesFetched time.Time
+	joinedRooms   map[id.RoomID]bool
+	joinedFetched time.Time
+}
+
+func NewRoomResolver(cfg *config.Config, as *appservice.AppService) *RoomResolver {
+	return &RoomResolver{
+		config:      cfg,
+		as:          as,
+		aliases:     map[id.RoomID]cachedAliases{},
+		stateValues: map[stateCacheKey]cachedValue{},
+	}
+}
+
+// Resolve returns the rule for a room. Rooms from room_path_template are
+// returned as a rule with only Room and Template set.
+func (r *RoomResolver) Resolve(ctx context.Context, roomID id.RoomID) (config.RoomRule, bool) {
+	if template, ok := r.config.Matrix.RoomPathTemplate[roomID.String()]; ok {
+		return config.RoomRule{Room: roomID.String(), Template: template}, true
+	}
+	for _, rule := range r.config.Matrix.RoomRules {
+		if rule.Room == roomID.String() {
+			return rule, true
+		}
+	}
+	if !r.hasDynamicRules() || !r.isJoined(ctx, roomID) {
+		return config.RoomRule{}, false
+	}
+
+	if r.hasRuleKind(func(rule config.RoomRule) bool { return rule.Alias != "" }) {
+		aliases := r.roomAliases(ctx, roomID)
+		for _, rule := range r.config.Matrix.RoomRules {
+			if rule.Alias == "" {
+				continue
+			}
+			for _, alias := range aliases {
+				if matched, _ := path.Match(rule.Alias, alias.String()); matched {
+					return rule, true
+				}
+			}
+		}
+	}
+
+	if index, ok := r.spaceRules(ctx)[roomID]; ok {
+		return r.config.Matrix.RoomRules[index], true
+	}
+
+	if r.config.Matrix.DefaultPathTemplate != "" {
+		return config.RoomRule{Template: r.config.Matrix.DefaultPathTemplate}, true
+	}
+	return config.RoomRule{}, false
+}
+
+// SpaceRooms returns all rooms found in the hierarchies of configured spaces.
+func (r *RoomResolver) SpaceRooms(ctx context.Context) []id.RoomID {
+	spaceRooms := r.spaceRules(ctx)
+	rooms := make([]id.RoomID, 0, len(spaceRooms))
+	for roomID := range spaceRooms {
+		rooms = append(rooms, roomID)
+	}
+	return rooms
+}
+
+// CanonicalAlias returns the canonical alias of a room, or an empty string if
+// it has none or the bot cannot read the room state.
+func (r *RoomResolver) CanonicalAlias(ctx context.Context, roomID id.RoomID) string {
+	if aliases := r.roomAliases(ctx, roomID); len(aliases) > 0 {
+		return aliases[0].String()
+	}
+	return ""
+}
+
+// RoomName returns the m.room.name of a room, or an empty string if it has none.
+func (r *RoomResolver) RoomName(ctx context.Context, roomID id.RoomID) string {
+	return r.cachedStateValue(ctx, stateCacheKey{roomID: roomID, eventType: event.StateRoomName.Type}, func() (string, error) {
+		var content event.RoomNameEventContent
+		err := r.as.BotClient().StateEvent(ctx, roomID, event.StateRoomName, "", &content)
+		return content.Name, err
+	})
+}
+
+// DisplayName returns the display name a user has in a room, or an empty
+// string if none is set.
+func (r *RoomResolver) DisplayName(ctx context.Context, roomID id.RoomID, userID id.UserID) string {
+	return r.cachedStateValue(ctx, stateCacheKey{roomID: roomID, eventType: event.StateMember.Type, stateKey: userID.String()}, func() (string, error) {
+		var member event.MemberEventContent
+		err := r.as.BotClient().StateEvent(ctx, roomID, event.StateMember, userID.String(), &member)
+		return member.Displayname, err
+	})
+}
+
+// cachedStateValue returns a value derived from a state event, fetching it if
+// it is not cached or the cache entry is older than roomCacheTTL. Missing
+// state is cached as an empty value.
+func (r *RoomResolver) cachedStateValue(ctx context.Context, key stateCacheKey, fetch func() (string, error)) string {
+	r.mu.Lock()
+	cached, ok := r.stateValues[key]
+	r.mu.Unlock()
+	if ok && time.Since(cached.fetched) < roomCacheTTL {
+		return cached.value
+	}
+
+	value, err := fetch()
+	if err != nil {
+		if !errors.Is(err, mautrix.MNotFound) {
+			log.Printf("Warning: Failed to fetch %s/%s in room %s: %v", key.eventType, key.stateKey, key.roomID.String(), err)
+			return cached.value
+		}
+		value = ""
+	}
+
+	r.mu.Lock()
+	r.stateValues[key] = cachedValue{value: value, fetched: time.Now()}
+	r.mu.Unlock()
+	return value
+}
+
+// HandleStateEvent drops cached state that the event makes stale.
+func (r *RoomResolver) HandleStateEvent(evt *event.Event) {
+	if evt.StateKey == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.stateValues, stateCacheKey{roomID: evt.RoomID, eventType: evt.Type.Type, stateKey: *evt.StateKey})
+	switch evt.Type {
+	case event.StateCanonicalAlias:
+		delete(r.aliases, evt.RoomID)
+	case event.StateSpaceChild:
+		for _, rule := range r.config.Matrix.RoomRules {
+			if rule.Space == evt.RoomID.String() {
+				r.spacesFetched = time.Time{}
+				break
+			}
+		}
+	case event.StateMember:
+		if id.UserID(*evt.StateKey) == r.as.BotMXID() {
+			r.joinedFetched = time.Time{}
+		}
+	}
+}
+
+func (r *RoomResolver) hasRuleKind(match func(config.RoomRule) bool) bool {
+	for _, rule := range r.config.Matrix.RoomRules {
+		if match(rule) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *RoomResolver) hasDynamicRules() bool {
+	return r.config.Matrix.DefaultPathTemplate != "" ||
+		r.hasRuleKind(func(rule config.RoomRule) bool { return rule.Alias != "" || rule.Space != "" })
+}
+
+// isJoined reports whether the bot has joined a room. The joined rooms are
+// fetched without holding the lock, so a slow homeserver does not block
+// other lookups.
+func (r *RoomResolver) isJoined(ctx context.Context, roomID id.RoomID) bool {
+	r.mu.Lock()
+	joined := r.joinedRooms[roomID]
+	fresh := r.joinedRooms != nil && time.Since(r.joinedFetched) <= joinedRoomsTTL
+	r.mu.Unlock()
+	if fresh {
+		return joined
+	}
+
+	resp, err := r.as.BotIntent().JoinedRooms(ctx)
+	if err != nil {
+		log.Printf("Warning: Failed to fetch joined rooms: %v", err)
+		return joined
+	}
+	joinedRooms := make(map[id.RoomID]bool, len(resp.JoinedRooms))
+	for _, room := range resp.JoinedRooms {
+		joinedRooms[room] = true
+	}
+
+	r.mu.Lock()
+	r.joinedRooms = joinedRooms
+	r.joinedFetched = time.Now()
+	r.mu.Unlock()
+	return joinedRooms[roomID]
+}
+
+func (r *RoomResolver) roomAliases(ctx context.Context, roomID id.RoomID) []id.RoomAlias {
+	r.mu.Lock()
+	cached, ok := r.aliases[roomID]
+	r.mu.Unlock()
+	if ok && time.Since(cached.fetched) < roomCacheTTL {
+		return cached.aliases
+	}
+
+	var content event.CanonicalAliasEventContent
+	var aliases []id.RoomAlias
+	if err := r.as.BotClient().StateEvent(ctx, roomID, event.StateCanonicalAlias, "", &content); err != nil {
+		if !errors.Is(err, mautrix.MNotFound) {
+			log.Printf("Warning: Failed to fetch canonical alias for room %s: %v", roomID.String(), err)
+		}
+	} else {
+		if content.Alias != "" {
+			aliases = append(aliases, content.Alias)
+		}
+		aliases = append(aliases, content.AltAliases...)
+	}
+
+	r.mu.Lock()
+	r.aliases[roomID] = cachedAliases{aliases: aliases, fetched: time.Now()}
+	r.mu.Unlock()
+	return aliases
+}
+
+// spaceRules maps every room in a configured space hierarchy to the first
+// space rule containing it. The hierarchy is refreshed every roomCacheTTL or
+// when a m.space.child event changes a configured space. Like isJoined, it
+// fetches the hierarchies without holding the lock.
+func (r *RoomResolver) spaceRules(ctx context.Context) map[id.RoomID]int {
+	r.mu.Lock()
+	previousRooms := r.spaceRooms
+	fresh := previousRooms != nil && time.Since(r.spacesFetched) < roomCacheTTL
+	r.mu.Unlock()
+	if fresh {
+		return previousRooms
+	}
+
+	spaceRooms := map[id.RoomID]int{}
+	for index, rule := range r.config.Matrix.RoomRules {
+		if rule.Space == "" {
+			continue
+		}
+		children, err := r.fetchSpaceChildren(ctx, id.RoomID(rule.Space))
+		if err != nil {
+			log.Printf("Warning: Failed to fetch hierarchy of space %s: %v", rule.Space, err)
+			// Keep what we knew about this space rather than dropping its rooms
+			for roomID, previous := range previousRooms {
+				if previous == index {
+					if _, exists := spaceRooms[roomID]; !exists {
+						spaceRooms[roomID] = index
+					}
+				}
+			}
+			continue
+		}
+		for _, roomID := range children {
+			if _, exists := spaceRooms[roomID]; !exists {
+				spaceRooms[roomID] = index
+			}
+		}
+	}
+	r.mu.Lock()
+	r.spaceRooms = spaceRooms
+	r.spacesFetched = time.Now()
+	r.mu.Unlock()
+	return spaceRooms
+}
+
+func (r *RoomResolver) fetchSpaceChildren(ctx context.Context, spaceID id.RoomID) ([]id.RoomID, error) {
+	var rooms []id.RoomID
+	req := &mautrix.ReqHierarchy{Limit: 100}
+	for {
+		resp, err := r.as.BotClient().Hierarchy(ctx, spaceID, req)
+		if err != nil {
+			return nil, err
+		}
+		for _, room := range resp.Rooms {
+			// Subspaces are walked by the hierarchy API but hold no media themselves
+			if room.RoomID == spaceID || room.RoomType == event.RoomTypeSpace {
+				continue
+			}
+			rooms = append(rooms, room.RoomID)
+		}
+		if resp.NextBatch == "" {
+			return rooms, nil
+		}
+		req.From = resp.NextBatch
+	}
+}
@@ -0,0 +1,116 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"nextcloud-media-bridge/src/config"
+)
+
+func TestRoomResolverPrecedence(t *testing.T) {
+	mt := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := r.URL.RawPath
+		if path == "" {
+			path = r.URL.Path
+		}
+		switch {
+		case strings.HasSuffix(path, "/joined_rooms"):
+			_, _ = w.Write([]byte(`{"joined_rooms":["!exact:example.com","!proj:example.com","!child:example.com","!spaced:example.com","!other:example.com"]}`))
+		case strings.Contains(path, "/state/m.room.canonical_alias"):
+			if strings.Contains(path, "proj") || strings.Contains(path, "child") {
+				_, _ = w.Write([]byte(`{"alias":"#proj-alpha:example.com"}`))
+				return
+			}
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"errcode":"M_NOT_FOUND","error":"not found"}`))
+		case strings.HasSuffix(path, "/hierarchy"):
+			_, _ = w.Write([]byte(`{"rooms":[` +
+				`{"room_id":"!space:example.com","room_type":"m.space","children_state":[]},` +
+				`{"room_id":"!child:example.com","children_state":[]},` +
+				`{"room_id":"!spaced:example.com","children_state":[]}]}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"errcode":"M_UNRECOGNIZED","error":"unknown"}`))
+		}
+	}))
+	defer mt.Close()
+
+	as := newTestAppService(t, mt.URL)
+
+	cfg := &config.Config{}
+	cfg.Matrix.RoomPathTemplate = map[string]string{"!exact:example.com": "/exact/${file}"}
+	cfg.Matrix.RoomRules = []config.RoomRule{
+		{Space: "!space:example.com", Template: "/space/${file}"},
+		{Alias: "#proj-*:example.com", Template: "/proj/${file}"},
+	}
+	cfg.Matrix.DefaultPathTemplate = "/default/${file}"
+	resolver := NewRoomResolver(cfg, as)
+
+	cases := map[string]string{
+		"!exact:example.com":    "/exact/${file}",
+		"!proj:example.com":     "/proj/${file}",
+		"!child:example.com":    "/proj/${file}", // alias rules take precedence over space rules
+		"!spaced:example.com":   "/space/${file}",
+		"!other:example.com":    "/default/${file}",
+		"!unjoined:example.com": "",
+	}
+	for roomID, expected := range cases {
+		rule, ok := resolver.Resolve(context.Background(), id.RoomID(roomID))
+		if expected == "" {
+			if ok {
+				t.Fatalf("%s: expected no match, got %s", roomID, rule.Selector())
+			}
+			continue
+		}
+		if !ok || rule.Template != expected {
+			t.Fatalf("%s: expected template %s, got %q (matched=%v)", roomID, expected, rule.Template, ok)
+		}
+	}
+
+	spaceRooms := resolver.SpaceRooms(context.Background())
+	if len(spaceRooms) != 2 {
+		t.Fatalf("expected 2 rooms discovered in space, got %v", spaceRooms)
+	}
+}
+
+func TestRoomResolverFetchesWithoutLock(t *testing.T) {
+	release := make(chan struct{})
+	mt := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/joined_rooms") {
+			<-release
+			_, _ = w.Write([]byte(`{"joined_rooms":["!joined:example.com"]}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"alias":"#proj-alpha:example.com"}`))
+	}))
+	defer mt.Close()
+	defer close(release)
+
+	as := newTestAppService(t, mt.URL)
+	cfg := &config.Config{}
+	cfg.Matrix.DefaultPathTemplate = "/default/${file}"
+	resolver := NewRoomResolver(cfg, as)
+	// The appservice creates its clients lazily without locking
+	as.BotIntent()
+
+	go resolver.Resolve(context.Background(), "!joined:example.com")
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		stateKey := ""
+		resolver.HandleStateEvent(&event.Event{Type: event.StateCanonicalAlias, RoomID: "!joined:example.com", StateKey: &stateKey})
+		resolver.CanonicalAlias(context.Background(), "!joined:example.com")
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("lookups blocked while the joined rooms were fetched")
+	}
+}
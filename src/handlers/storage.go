@@ -0,0 +1,151 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+
+	"nextcloud-media-bridge/src/config"
+)
+
+// Storage is a backend archived files are stored in. Paths are relative to the
+// root of the backend; leading slashes are ignored. Requests are canceled with
+// their context.
+type Storage interface {
+	// EnsureDirectories creates the missing parent folders of a path.
+	EnsureDirectories(ctx context.Context, remotePath string) error
+	// UploadReader stores a file, replacing an existing one. A contentLength
+	// of 0 means unknown.
+	UploadReader(ctx context.Context, remotePath string, reader io.Reader, contentLength int64) error
+	// CreateFile stores a new file like UploadReader, but fails with an
+	// error wrapping ErrExists if the path is taken. Partial uploads never
+	// appear at remotePath.
+	CreateFile(ctx context.Context, remotePath string, reader io.Reader, contentLength int64) error
+	// Stat reports whether a file exists and its size, -1 if unknown.
+	Stat(ctx context.Context, remotePath string) (bool, int64, error)
+	// Download opens a file. Missing files return an error wrapping
+	// ErrNotFound.
+	Download(ctx context.Context, remotePath string) (*StoredFile, error)
+	// DeleteFile deletes a file. Deleting a missing file is not an error.
+	DeleteFile(ctx context.Context, remotePath string) error
+	// Move renames a file or folder without overwriting the destination.
+	Move(ctx context.Context, sourcePath, destinationPath string) error
+	// Copy copies a file without overwriting the destination.
+	Copy(ctx context.Context, sourcePath, destinationPath string) error
+	// List returns the direct children of a folder. Missing folders return
+	// an error wrapping ErrNotFound.
+	List(ctx context.Context, remotePath string) ([]RemoteFile, error)
+}
+
+// StoredFile is a file opened for reading with Storage.Download.
+type StoredFile struct {
+	Body          io.ReadCloser
+	ContentLength int64 // -1 if unknown
+	ContentType   string
+}
+
+// Storages holds the Nextcloud account, the configured storage backends by
+// name and the mirror archived files are replicated to.
+type Storages struct {
+	nextcloud *NextcloudClient
+	named     map[string]Storage
+	mirror    Storage
+}
+
+func NewStorages(nextcloud *NextcloudClient) *Storages {
+	return &Storages{nextcloud: nextcloud, named: map[string]Storage{}}
+}
+
+// OpenStorages creates the storage backends configured in storages.
+func OpenStorages(cfg *config.Config, nextcloud *NextcloudClient) (*Storages, error) {
+	storages := NewStorages(nextcloud)
+	for name, storageConfig := range cfg.Storages {
+		storage, err := NewStorage(storageConfig)
+		if err != nil {
+			return nil, fmt.Errorf("storage %s: %w", name, err)
+		}
+		storages.Add(name, storage)
+	}
+	if cfg.Mirror.Enabled {
+		if err := storages.SetMirror(cfg.Mirror.Storage); err != nil {
+			return nil, fmt.Errorf("mirror: %w", err)
+		}
+	}
+	return storages, nil
+}
+
+// NewStorage creates a storage backend from its configuration.
+func NewStorage(storageConfig config.StorageConfig) (Storage, error) {
+	switch storageConfig.Type {
+	case config.StorageNextcloud:
+		return NewNextcloudClient(storageConfig.URL, storageConfig.Username, storageConfig.Password), nil
+	case config.StorageWebDAV:
+		return NewWebDAVStorage(storageConfig.URL, storageConfig.Username, storageConfig.Password), nil
+	case config.StorageLocal:
+		return NewLocalStorage(storageConfig.Path)
+	case config.StorageS3:
+		return NewS3Storage(storageConfig.Endpoint, storageConfig.Region, storageConfig.Bucket, storageConfig.Prefix, storageConfig.AccessKey, storageConfig.SecretKey), nil
+	default:
+		return nil, fmt.Errorf("unknown storage type %q", storageConfig.Type)
+	}
+}
+
+// Add registers a storage backend under a name.
+func (s *Storages) Add(name string, storage Storage) {
+	s.named[name] = storage
+}
+
+// Get returns the storage backend with the given name. The empty name is the
+// Nextcloud account.
+func (s *Storages) Get(name string) (Storage, error) {
+	if name == "" {
+		return s.nextcloud, nil
+	}
+	storage, ok := s.named[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown storage %q", name)
+	}
+	return storage, nil
+}
+
+// Names returns the names of all storage backends, starting with the empty
+// name of the Nextcloud account.
+func (s *Storages) Names() []string {
+	names := make([]string, 0, len(s.named)+1)
+	for name := range s.named {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return append([]string{""}, names...)
+}
+
+// Nextcloud returns the primary Nextcloud account, the one Talk conversations
+// are linked to.
+func (s *Storages) Nextcloud() *NextcloudClient {
+	return s.nextcloud
+}
+
+// SetMirror makes the named storage backend the mirror.
+func (s *Storages) SetMirror(name string) error {
+	storage, ok := s.named[name]
+	if !ok {
+		return fmt.Errorf("unknown storage %q", name)
+	}
+	s.mirror = storage
+	return nil
+}
+
+// Mirror returns the storage backend archived files are replicated to, or nil
+// if there is none.
+func (s *Storages) Mirror() Storage {
+	return s.mirror
+}
+
+// storageName describes a storage backend in log messages.
+func storageName(name string) string {
+	if name == "" {
+		return "Nextcloud"
+	}
+	return "storage " + name
+}
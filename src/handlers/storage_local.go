@@ -0,0 +1,274 @@
+package handlers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// LocalStorage stores files in a directory on the bridge's filesystem.
+type LocalStorage struct {
+	root string
+}
+
+func NewLocalStorage(root string) (*LocalStorage, error) {
+	if root == "" {
+		return nil, fmt.Errorf("no path configured")
+	}
+	absolute, err := filepath.Abs(root)
+	if err != nil {
+		return nil, fmt.Errorf("invalid path %s: %w", root, err)
+	}
+	return &LocalStorage{root: absolute}, nil
+}
+
+// filePath returns the location of a path below the root. Cleaning the path
+// as an absolute one drops leading "..", so no path leads out of the root.
+func (s *LocalStorage) filePath(remotePath string) string {
+	cleaned := path.Clean("/" + strings.TrimLeft(remotePath, "/"))
+	return filepath.Join(s.root, filepath.FromSlash(cleaned))
+}
+
+func (s *LocalStorage) EnsureDirectories(ctx context.Context, remotePath string) error {
+	target := s.filePath(remotePath)
+	if strings.HasSuffix(remotePath, "/") {
+		return os.MkdirAll(target, 0o755)
+	}
+	return os.MkdirAll(filepath.Dir(target), 0o755)
+}
+
+// UploadReader writes to a temporary file next to the target and renames it,
+// so readers never see a partial file.
+func (s *LocalStorage) UploadReader(ctx context.Context, remotePath string, reader io.Reader, contentLength int64) error {
+	target := s.filePath(remotePath)
+	temp, err := writeTemp(target, reader)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp)
+	if err := os.Rename(temp, target); err != nil {
+		return fmt.Errorf("failed to write file: %w", err)
+	}
+	return nil
+}
+
+// CreateFile writes to a temporary file like UploadReader and links it to
+// the target, which fails if the target exists. Filesystems without hard
+// links get the content copied to a file created exclusively instead.
+func (s *LocalStorage) CreateFile(ctx context.Context, remotePath string, reader io.Reader, contentLength int64) error {
+	target := s.filePath(remotePath)
+	temp, err := writeTemp(target, reader)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp)
+	err = os.Link(temp, target)
+	if errors.Is(err, errors.ErrUnsupported) || errors.Is(err, fs.ErrPermission) {
+		err = copyExclusive(temp, target)
+	}
+	if errors.Is(err, fs.ErrExist) {
+		return fmt.Errorf("%s %w", remotePath, ErrExists)
+	} else if err != nil {
+		return fmt.Errorf("failed to write file: %w", err)
+	}
+	return nil
+}
+
+// copyExclusive copies source to target, which must not exist. A partial
+// target is removed.
+func copyExclusive(source, target string) error {
+	in, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(target)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(target)
+		return err
+	}
+	return nil
+}
+
+// writeTemp writes the content of reader to a hidden temporary file next to
+// target and returns its name.
+func writeTemp(target string, reader io.Reader) (string, error) {
+	temp, err := os.CreateTemp(filepath.Dir(target), uploadTempPrefix+"*.part")
+	if err != nil {
+		return "", fmt.Errorf("failed to create file: %w", err)
+	}
+	if _, err := io.Copy(temp, reader); err != nil {
+		temp.Close()
+		os.Remove(temp.Name())
+		return "", fmt.Errorf("failed to write file: %w", err)
+	}
+	if err := temp.Close(); err != nil {
+		os.Remove(temp.Name())
+		return "", fmt.Errorf("failed to write file: %w", err)
+	}
+	return temp.Name(), nil
+}
+
+func (s *LocalStorage) Stat(ctx context.Context, remotePath string) (bool, int64, error) {
+	target := s.filePath(remotePath)
+	info, err := os.Stat(target)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, 0, nil
+	}
+	if err != nil {
+		return false, 0, fmt.Errorf("failed to stat file: %w", err)
+	}
+	return true, info.Size(), nil
+}
+
+func (s *LocalStorage) Download(ctx context.Context, remotePath string) (*StoredFile, error) {
+	target := s.filePath(remotePath)
+	file, err := os.Open(target)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, remotePath)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to stat file: %w", err)
+	}
+	if info.IsDir() {
+		file.Close()
+		return nil, fmt.Errorf("%s is a folder", remotePath)
+	}
+	return &StoredFile{Body: file, ContentLength: info.Size(), ContentType: mime.TypeByExtension(path.Ext(target))}, nil
+}
+
+// DeleteFile removes a single file and refuses folders, so a wrong path
+// never takes a tree of files with it.
+func (s *LocalStorage) DeleteFile(ctx context.Context, remotePath string) error {
+	target := s.filePath(remotePath)
+	info, err := os.Lstat(target)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to stat file: %w", err)
+	}
+	if info.IsDir() {
+		return fmt.Errorf("%s is a folder", remotePath)
+	}
+	if err := os.Remove(target); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to delete file: %w", err)
+	}
+	return nil
+}
+
+func (s *LocalStorage) Move(ctx context.Context, sourcePath, destinationPath string) error {
+	source, destination, err := s.transferPaths(sourcePath, destinationPath)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(destination), 0o755); err != nil {
+		return fmt.Errorf("failed to create directories: %w", err)
+	}
+	if err := os.Rename(source, destination); err != nil {
+		return fmt.Errorf("failed to move file: %w", err)
+	}
+	return nil
+}
+
+func (s *LocalStorage) Copy(ctx context.Context, sourcePath, destinationPath string) error {
+	source, destination, err := s.transferPaths(sourcePath, destinationPath)
+	if err != nil {
+		return err
+	}
+	in, err := os.Open(source)
+	if err != nil {
+		return fmt.Errorf("failed to open file: %w", err)
+	}
+	defer in.Close()
+	if err := os.MkdirAll(filepath.Dir(destination), 0o755); err != nil {
+		return fmt.Errorf("failed to create directories: %w", err)
+	}
+	out, err := os.OpenFile(destination, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if errors.Is(err, fs.ErrExist) {
+		return fmt.Errorf("destination %s %w", destinationPath, ErrExists)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to create file: %w", err)
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(destination)
+		return fmt.Errorf("failed to copy file: %w", err)
+	}
+	return out.Close()
+}
+
+// transferPaths resolves the paths of a move or copy. The source must exist
+// and the destination must not.
+func (s *LocalStorage) transferPaths(sourcePath, destinationPath string) (string, string, error) {
+	source := s.filePath(sourcePath)
+	destination := s.filePath(destinationPath)
+	if _, err := os.Stat(source); errors.Is(err, fs.ErrNotExist) {
+		return "", "", fmt.Errorf("%w: %s", ErrNotFound, sourcePath)
+	}
+	if _, err := os.Stat(destination); err == nil {
+		return "", "", fmt.Errorf("destination %s %w", destinationPath, ErrExists)
+	}
+	return source, destination, nil
+}
+
+func (s *LocalStorage) List(ctx context.Context, remotePath string) ([]RemoteFile, error) {
+	target := s.filePath(remotePath)
+	entries, err := os.ReadDir(target)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, remotePath)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to list folder: %w", err)
+	}
+	folder := strings.Trim(remotePath, "/")
+	files := make([]RemoteFile, 0, len(entries))
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		file := RemoteFile{
+			Path:         path.Join(folder, entry.Name()),
+			IsDir:        entry.IsDir(),
+			LastModified: info.ModTime(),
+		}
+		if !file.IsDir {
+			file.Size = info.Size()
+			file.ContentType = mime.TypeByExtension(path.Ext(entry.Name()))
+			file.ETag = localETag(info)
+		}
+		files = append(files, file)
+	}
+	return files, nil
+}
+
+// localETag derives an ETag from the size and modification time of a file.
+func localETag(info fs.FileInfo) string {
+	sum := sha256.Sum256([]byte(strconv.FormatInt(info.Size(), 10) + ":" + strconv.FormatInt(info.ModTime().UnixNano(), 10)))
+	return `"` + hex.EncodeToString(sum[:8]) + `"`
+}
@@ -0,0 +1,475 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// s3UnsignedPayload is the payload hash of requests whose body is not signed.
+const s3UnsignedPayload = "UNSIGNED-PAYLOAD"
+
+// S3Storage stores files as objects in an S3 bucket, addressed path-style so
+// S3-compatible servers such as MinIO work without DNS setup. Requests are
+// signed with AWS Signature Version 4.
+//
+// S3 has no folders: EnsureDirectories only creates an empty marker object
+// for paths ending in a slash, so empty folders can be listed, and moving a
+// folder copies every object below it.
+type S3Storage struct {
+	Endpoint  string
+	Region    string
+	Bucket    string
+	Prefix    string
+	AccessKey string
+	SecretKey string
+	client    *http.Client
+}
+
+func NewS3Storage(endpoint, region, bucket, prefix, accessKey, secretKey string) *S3Storage {
+	if region == "" {
+		region = "us-east-1"
+	}
+	return &S3Storage{
+		Endpoint:  strings.TrimRight(endpoint, "/"),
+		Region:    region,
+		Bucket:    bucket,
+		Prefix:    strings.Trim(prefix, "/"),
+		AccessKey: accessKey,
+		SecretKey: secretKey,
+		client:    &http.Client{Timeout: 10 * time.Minute},
+	}
+}
+
+// key returns the object key of a path.
+func (s *S3Storage) key(remotePath string) string {
+	trimmed := strings.Trim(remotePath, "/")
+	if s.Prefix == "" {
+		return trimmed
+	}
+	if trimmed == "" {
+		return s.Prefix
+	}
+	return s.Prefix + "/" + trimmed
+}
+
+// relativePath converts an object key back into a path.
+func (s *S3Storage) relativePath(key string) string {
+	if s.Prefix != "" {
+		key = strings.TrimPrefix(key, s.Prefix+"/")
+	}
+	return strings.Trim(key, "/")
+}
+
+// objectURL returns the URL of an object, with the query string already in
+// canonical form.
+func (s *S3Storage) objectURL(key, query string) string {
+	target := s.Endpoint + "/" + s3Escape(s.Bucket, false)
+	if key != "" {
+		target += "/" + s3Escape(key, false)
+	}
+	if query != "" {
+		target += "?" + query
+	}
+	return target
+}
+
+// do signs and sends a request.
+func (s *S3Storage) do(ctx context.Context, method, key, query string, body io.Reader, contentLength int64, header http.Header) (*http.Response, error) {
+	if body != nil && contentLength == 0 {
+		// An empty reader would be sent chunked, which S3 rejects
+		body = http.NoBody
+	}
+	req, err := http.NewRequestWithContext(ctx, method, s.objectURL(key, query), body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if body != nil {
+		req.ContentLength = contentLength
+	}
+	req.Header.Set("X-Amz-Content-Sha256", s3UnsignedPayload)
+	s.sign(req, time.Now())
+	return s.client.Do(req)
+}
+
+// sign adds an AWS Signature Version 4 Authorization header to req, signing
+// the host and every header already set.
+func (s *S3Storage) sign(req *http.Request, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	payloadHash := req.Header.Get("X-Amz-Content-Sha256")
+	if payloadHash == "" {
+		payloadHash = s3UnsignedPayload
+	}
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		s3CanonicalQuery(req.URL.RawQuery),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + s.Region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	signingKey := s3HMAC([]byte("AWS4"+s.SecretKey), date)
+	signingKey = s3HMAC(signingKey, s.Region)
+	signingKey = s3HMAC(signingKey, "s3")
+	signingKey = s3HMAC(signingKey, "aws4_request")
+	signature := hex.EncodeToString(s3HMAC(signingKey, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", s.AccessKey, scope, signedHeaders, signature))
+}
+
+func s3HMAC(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3Escape percent-encodes everything but unreserved characters, as SigV4
+// requires. Slashes are kept unless encodeSlash is set.
+func s3Escape(value string, encodeSlash bool) string {
+	var escaped strings.Builder
+	for _, b := range []byte(value) {
+		switch {
+		case 'A' <= b && b <= 'Z', 'a' <= b && b <= 'z', '0' <= b && b <= '9', b == '-', b == '.', b == '_', b == '~':
+			escaped.WriteByte(b)
+		case b == '/' && !encodeSlash:
+			escaped.WriteByte(b)
+		default:
+			fmt.Fprintf(&escaped, "%%%02X", b)
+		}
+	}
+	return escaped.String()
+}
+
+// s3Query builds a canonical query string from unescaped parameters.
+func s3Query(parameters map[string]string) string {
+	pairs := make([]string, 0, len(parameters))
+	for name, value := range parameters {
+		pairs = append(pairs, s3Escape(name, true)+"="+s3Escape(value, true))
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
+
+// s3CanonicalQuery sorts an already escaped query string.
+func s3CanonicalQuery(rawQuery string) string {
+	if rawQuery == "" {
+		return ""
+	}
+	pairs := strings.Split(rawQuery, "&")
+	for i, pair := range pairs {
+		if !strings.Contains(pair, "=") {
+			pairs[i] = pair + "="
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
+
+func (s *S3Storage) EnsureDirectories(ctx context.Context, remotePath string) error {
+	if !strings.HasSuffix(remotePath, "/") {
+		return nil
+	}
+	return s.UploadReader(ctx, remotePath, bytes.NewReader(nil), 0)
+}
+
+// UploadReader stores an object. S3 only stores complete objects, so no
+// temporary name is needed.
+func (s *S3Storage) UploadReader(ctx context.Context, remotePath string, reader io.Reader, contentLength int64) error {
+	return s.put(ctx, remotePath, reader, contentLength, http.Header{})
+}
+
+// CreateFile stores an object with a conditional write, which S3 refuses
+// with 412 if the object exists.
+func (s *S3Storage) CreateFile(ctx context.Context, remotePath string, reader io.Reader, contentLength int64) error {
+	return s.put(ctx, remotePath, reader, contentLength, http.Header{"If-None-Match": {"*"}})
+}
+
+func (s *S3Storage) put(ctx context.Context, remotePath string, reader io.Reader, contentLength int64, header http.Header) error {
+	start := time.Now()
+	key := s.key(remotePath)
+	if strings.HasSuffix(remotePath, "/") {
+		key += "/"
+	}
+	if contentLength <= 0 {
+		// S3 needs the length up front
+		data, err := io.ReadAll(reader)
+		if err != nil {
+			return fmt.Errorf("failed to read file: %w", err)
+		}
+		reader, contentLength = bytes.NewReader(data), int64(len(data))
+	}
+	if contentType := mime.TypeByExtension(path.Ext(key)); contentType != "" {
+		header.Set("Content-Type", contentType)
+	}
+	resp, err := s.do(ctx, http.MethodPut, key, "", reader, contentLength, header)
+	if err != nil {
+		return fmt.Errorf("failed to upload file: %w", err)
+	}
+	defer resp.Body.Close()
+
+	log.Printf("S3 upload finished key=%s status=%d duration=%s", key, resp.StatusCode, time.Since(start))
+
+	if resp.StatusCode == http.StatusPreconditionFailed {
+		return fmt.Errorf("%s %w", remotePath, ErrExists)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (s *S3Storage) Stat(ctx context.Context, remotePath string) (bool, int64, error) {
+	resp, err := s.do(ctx, http.MethodHead, s.key(remotePath), "", nil, 0, nil)
+	if err != nil {
+		return false, 0, fmt.Errorf("failed to stat file: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return false, 0, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return false, 0, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+	return true, resp.ContentLength, nil
+}
+
+func (s *S3Storage) Download(ctx context.Context, remotePath string) (*StoredFile, error) {
+	resp, err := s.do(ctx, http.MethodGet, s.key(remotePath), "", nil, 0, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download file: %w", err)
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, remotePath)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, statusError(resp, remotePath)
+	}
+	return &StoredFile{Body: resp.Body, ContentLength: resp.ContentLength, ContentType: resp.Header.Get("Content-Type")}, nil
+}
+
+func (s *S3Storage) DeleteFile(ctx context.Context, remotePath string) error {
+	return s.deleteKey(ctx, s.key(remotePath))
+}
+
+func (s *S3Storage) deleteKey(ctx context.Context, key string) error {
+	resp, err := s.do(ctx, http.MethodDelete, key, "", nil, 0, nil)
+	if err != nil {
+		return fmt.Errorf("failed to delete file: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (s *S3Storage) Copy(ctx context.Context, sourcePath, destinationPath string) error {
+	if exists, _, err := s.Stat(ctx, destinationPath); err != nil {
+		return err
+	} else if exists {
+		return fmt.Errorf("destination %s %w", destinationPath, ErrExists)
+	}
+	return s.copyKey(ctx, s.key(sourcePath), s.key(destinationPath))
+}
+
+func (s *S3Storage) copyKey(ctx context.Context, source, destination string) error {
+	header := http.Header{}
+	header.Set("X-Amz-Copy-Source", "/"+s3Escape(s.Bucket, false)+"/"+s3Escape(source, false))
+	resp, err := s.do(ctx, http.MethodPut, destination, "", nil, 0, header)
+	if err != nil {
+		return fmt.Errorf("failed to copy file: %w", err)
+	}
+	defer resp.Body.Close()
+
+	log.Printf("S3 copy key=%s destination=%s status=%d", source, destination, resp.StatusCode)
+
+	if resp.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("%w: %s", ErrNotFound, source)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+	// A copy can fail after the 200 status was sent
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read copy response: %w", err)
+	}
+	if bytes.Contains(body, []byte("<Error>")) {
+		return fmt.Errorf("copy failed: %s", body)
+	}
+	return nil
+}
+
+// Move copies a file, or every object below a folder, to the destination and
+// deletes the source.
+func (s *S3Storage) Move(ctx context.Context, sourcePath, destinationPath string) error {
+	exists, _, err := s.Stat(ctx, sourcePath)
+	if err != nil {
+		return err
+	}
+	if exists {
+		if err := s.Copy(ctx, sourcePath, destinationPath); err != nil {
+			return err
+		}
+		return s.DeleteFile(ctx, sourcePath)
+	}
+
+	sourcePrefix := s.key(sourcePath) + "/"
+	destinationPrefix := s.key(destinationPath) + "/"
+	objects, _, err := s.listObjects(ctx, sourcePrefix, "")
+	if err != nil {
+		return err
+	}
+	if len(objects) == 0 {
+		return fmt.Errorf("%w: %s", ErrNotFound, sourcePath)
+	}
+	if existing, _, err := s.listObjects(ctx, destinationPrefix, "/"); err != nil {
+		return err
+	} else if len(existing) > 0 {
+		return fmt.Errorf("destination %s %w", destinationPath, ErrExists)
+	}
+	for _, object := range objects {
+		destination := destinationPrefix + strings.TrimPrefix(object.Key, sourcePrefix)
+		if err := s.copyKey(ctx, object.Key, destination); err != nil {
+			return err
+		}
+		if err := s.deleteKey(ctx, object.Key); err != nil {
+			return err
+		}
+	}
+	log.Printf("S3 moved %d object(s) from %s to %s", len(objects), sourcePrefix, destinationPrefix)
+	return nil
+}
+
+type s3Object struct {
+	Key          string `xml:"Key"`
+	LastModified string `xml:"LastModified"`
+	ETag         string `xml:"ETag"`
+	Size         int64  `xml:"Size"`
+}
+
+type s3ListResult struct {
+	IsTruncated           bool       `xml:"IsTruncated"`
+	NextContinuationToken string     `xml:"NextContinuationToken"`
+	Contents              []s3Object `xml:"Contents"`
+	CommonPrefixes        []struct {
+		Prefix string `xml:"Prefix"`
+	} `xml:"CommonPrefixes"`
+}
+
+// listObjects lists the objects whose key starts with prefix with
+// ListObjectsV2. With a delimiter, keys below the next delimiter are grouped
+// into the returned common prefixes.
+func (s *S3Storage) listObjects(ctx context.Context, prefix, delimiter string) ([]s3Object, []string, error) {
+	var objects []s3Object
+	var prefixes []string
+	token := ""
+	for {
+		parameters := map[string]string{"list-type": "2", "prefix": prefix}
+		if delimiter != "" {
+			parameters["delimiter"] = delimiter
+		}
+		if token != "" {
+			parameters["continuation-token"] = token
+		}
+		resp, err := s.do(ctx, http.MethodGet, "", s3Query(parameters), nil, 0, nil)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to list folder: %w", err)
+		}
+		var result s3ListResult
+		if resp.StatusCode != http.StatusOK {
+			err = fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+		} else if decodeErr := xml.NewDecoder(resp.Body).Decode(&result); decodeErr != nil {
+			err = fmt.Errorf("failed to parse list response: %w", decodeErr)
+		}
+		resp.Body.Close()
+		if err != nil {
+			return nil, nil, err
+		}
+		objects = append(objects, result.Contents...)
+		for _, commonPrefix := range result.CommonPrefixes {
+			prefixes = append(prefixes, commonPrefix.Prefix)
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return objects, prefixes, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+// List returns the objects and folders directly below a folder. A folder
+// without objects does not exist.
+func (s *S3Storage) List(ctx context.Context, remotePath string) ([]RemoteFile, error) {
+	prefix := s.key(remotePath)
+	if prefix != "" {
+		prefix += "/"
+	}
+	objects, prefixes, err := s.listObjects(ctx, prefix, "/")
+	if err != nil {
+		return nil, err
+	}
+	if prefix != "" && len(objects) == 0 && len(prefixes) == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, remotePath)
+	}
+	var files []RemoteFile
+	for _, folder := range prefixes {
+		files = append(files, RemoteFile{Path: s.relativePath(folder), IsDir: true})
+	}
+	for _, object := range objects {
+		if object.Key == prefix {
+			// Folder marker
+			continue
+		}
+		file := RemoteFile{
+			Path:        s.relativePath(object.Key),
+			Size:        object.Size,
+			ETag:        object.ETag,
+			ContentType: mime.TypeByExtension(path.Ext(object.Key)),
+		}
+		file.LastModified, _ = time.Parse(time.RFC3339, object.LastModified)
+		files = append(files, file)
+	}
+	return files, nil
+}
@@ -0,0 +1,246 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"nextcloud-media-bridge/src/config"
+	"nextcloud-media-bridge/src/utils"
+)
+
+func TestStorageBackends(t *testing.T) {
+	t.Run("local", func(t *testing.T) {
+		storage, err := NewLocalStorage(t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		exerciseStorage(t, storage)
+	})
+	t.Run("s3", func(t *testing.T) {
+		server := newFakeS3(t)
+		defer server.Close()
+		exerciseStorage(t, NewS3Storage(server.URL, "", "media", "bridge", "access", "secret"))
+	})
+}
+
+// exerciseStorage runs the operations the bridge uses against a storage.
+func exerciseStorage(t *testing.T, storage Storage) {
+	t.Helper()
+	if err := storage.EnsureDirectories(context.Background(), "/media/room/photo.jpg"); err != nil {
+		t.Fatalf("EnsureDirectories failed: %v", err)
+	}
+	if err := storage.UploadReader(context.Background(), "/media/room/photo.jpg", strings.NewReader("photo"), 5); err != nil {
+		t.Fatalf("UploadReader failed: %v", err)
+	}
+	// Unknown length
+	if err := storage.UploadReader(context.Background(), "media/room/notes.txt", strings.NewReader("notes"), 0); err != nil {
+		t.Fatalf("UploadReader without length failed: %v", err)
+	}
+
+	if exists, size, err := storage.Stat(context.Background(), "media/room/photo.jpg"); err != nil || !exists || size != 5 {
+		t.Fatalf("unexpected stat: %v %d %v", exists, size, err)
+	}
+	if exists, _, err := storage.Stat(context.Background(), "media/room/missing.jpg"); err != nil || exists {
+		t.Fatalf("unexpected stat of missing file: %v %v", exists, err)
+	}
+	if data := readStored(t, storage, "media/room/notes.txt"); data != "notes" {
+		t.Fatalf("unexpected content: %q", data)
+	}
+
+	if err := storage.Copy(context.Background(), "media/room/photo.jpg", "media/room/copy.jpg"); err != nil {
+		t.Fatalf("Copy failed: %v", err)
+	}
+	if err := storage.Copy(context.Background(), "media/room/photo.jpg", "media/room/copy.jpg"); !errors.Is(err, ErrExists) {
+		t.Fatalf("expected Copy to refuse overwriting, got %v", err)
+	}
+	if err := storage.CreateFile(context.Background(), "media/room/new.jpg", strings.NewReader("new"), 3); err != nil {
+		t.Fatalf("CreateFile failed: %v", err)
+	}
+	if err := storage.CreateFile(context.Background(), "media/room/new.jpg", strings.NewReader("other"), 5); !errors.Is(err, ErrExists) {
+		t.Fatalf("expected CreateFile to refuse overwriting, got %v", err)
+	}
+	if data := readStored(t, storage, "media/room/new.jpg"); data != "new" {
+		t.Fatalf("unexpected content after refused CreateFile: %q", data)
+	}
+	if err := storage.DeleteFile(context.Background(), "media/room/new.jpg"); err != nil {
+		t.Fatalf("DeleteFile failed: %v", err)
+	}
+	if err := storage.EnsureDirectories(context.Background(), "media/room/sub/moved.jpg"); err != nil {
+		t.Fatalf("EnsureDirectories failed: %v", err)
+	}
+	if err := storage.Move(context.Background(), "media/room/copy.jpg", "media/room/sub/moved.jpg"); err != nil {
+		t.Fatalf("Move failed: %v", err)
+	}
+	if err := storage.Move(context.Background(), "media/room/copy.jpg", "media/room/sub/again.jpg"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound moving a missing file, got %v", err)
+	}
+
+	files, err := storage.List(context.Background(), "media/room")
+	if err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+	var listed []string
+	for _, file := range files {
+		entry := file.Path
+		if file.IsDir {
+			entry += "/"
+		} else if file.ETag == "" {
+			t.Fatalf("missing ETag for %s", file.Path)
+		}
+		listed = append(listed, entry)
+	}
+	sort.Strings(listed)
+	if strings.Join(listed, ",") != "media/room/notes.txt,media/room/photo.jpg,media/room/sub/" {
+		t.Fatalf("unexpected listing: %v", listed)
+	}
+	if _, err := storage.List(context.Background(), "media/other"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound listing a missing folder, got %v", err)
+	}
+
+	// Room renames move whole folders
+	if err := storage.Move(context.Background(), "media/room", "media/renamed"); err != nil {
+		t.Fatalf("folder Move failed: %v", err)
+	}
+	if data := readStored(t, storage, "media/renamed/sub/moved.jpg"); data != "photo" {
+		t.Fatalf("unexpected content after folder move: %q", data)
+	}
+
+	if err := storage.DeleteFile(context.Background(), "media/renamed/photo.jpg"); err != nil {
+		t.Fatalf("DeleteFile failed: %v", err)
+	}
+	if err := storage.DeleteFile(context.Background(), "media/renamed/photo.jpg"); err != nil {
+		t.Fatalf("deleting a missing file failed: %v", err)
+	}
+	if _, err := storage.Download(context.Background(), "media/renamed/photo.jpg"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func readStored(t *testing.T, storage Storage, remotePath string) string {
+	t.Helper()
+	file, err := storage.Download(context.Background(), remotePath)
+	if err != nil {
+		t.Fatalf("Download of %s failed: %v", remotePath, err)
+	}
+	defer file.Body.Close()
+	data, err := io.ReadAll(file.Body)
+	if err != nil {
+		t.Fatalf("failed to read %s: %v", remotePath, err)
+	}
+	return string(data)
+}
+
+func TestLocalStorageStaysInRoot(t *testing.T) {
+	root := t.TempDir()
+	storage, err := NewLocalStorage(filepath.Join(root, "media"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.EnsureDirectories(context.Background(), "../outside.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.UploadReader(context.Background(), "../outside.txt", bytes.NewReader([]byte("x")), 1); err != nil {
+		t.Fatalf("UploadReader failed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "outside.txt")); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("file was written outside of the root")
+	}
+	if data := readStored(t, storage, "room/../../outside.txt"); data != "x" {
+		t.Fatalf("unexpected content: %q", data)
+	}
+}
+
+func TestLocalStorageDeletesOnlyFiles(t *testing.T) {
+	storage, err := NewLocalStorage(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.EnsureDirectories(context.Background(), "media/room/photo.jpg"); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.UploadReader(context.Background(), "media/room/photo.jpg", strings.NewReader("photo"), 5); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.DeleteFile(context.Background(), "media/room"); err == nil {
+		t.Fatalf("expected deleting a folder to fail")
+	}
+	if data := readStored(t, storage, "media/room/photo.jpg"); data != "photo" {
+		t.Fatalf("unexpected content: %q", data)
+	}
+	if err := storage.DeleteFile(context.Background(), "media/room/missing.jpg"); err != nil {
+		t.Fatalf("expected deleting a missing file to succeed, got %v", err)
+	}
+}
+
+func TestOpenMediaFromStorage(t *testing.T) {
+	storage, err := NewLocalStorage(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.EnsureDirectories(context.Background(), "media/file.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.UploadReader(context.Background(), "media/file.txt", strings.NewReader("from disk"), 9); err != nil {
+		t.Fatal(err)
+	}
+	storages := NewStorages(NewNextcloudClient("http://127.0.0.1:1", "user", "pass"))
+	storages.Add("disk", storage)
+	cfg := &config.Config{}
+
+	media, err := openMedia(context.Background(), cfg, storages, nil, nil, nil, utils.MediaRef{Path: "media/file.txt", MimeType: "text/plain", Storage: "disk"})
+	if err != nil {
+		t.Fatalf("openMedia failed: %v", err)
+	}
+	defer media.Reader.Close()
+	data, _ := io.ReadAll(media.Reader)
+	if string(data) != "from disk" || media.ContentType != "text/plain" || media.ContentLength != 9 {
+		t.Fatalf("unexpected media: %q %s %d", data, media.ContentType, media.ContentLength)
+	}
+
+	if _, err := openMedia(context.Background(), cfg, storages, nil, nil, nil, utils.MediaRef{Path: "media/file.txt", Storage: "removed"}); err == nil {
+		t.Fatalf("expected unknown storage to fail")
+	}
+}
+
+func TestOpenStorages(t *testing.T) {
+	cfg := &config.Config{Storages: map[string]config.StorageConfig{
+		"dav":     {Type: config.StorageWebDAV, URL: "https://dav.example.com/media"},
+		"disk":    {Type: config.StorageLocal, Path: t.TempDir()},
+		"finance": {Type: config.StorageNextcloud, URL: "https://finance.example.com/remote.php/dav/files/bridge", Username: "bridge", Password: "pass"},
+		"minio":   {Type: config.StorageS3, Endpoint: "http://minio:9000", Bucket: "media", AccessKey: "a", SecretKey: "s"},
+	}}
+	nextcloud := NewNextcloudClient("https://cloud.example.com/remote.php/dav/files/bridge", "bridge", "pass")
+	storages, err := OpenStorages(cfg, nextcloud)
+	if err != nil {
+		t.Fatalf("OpenStorages failed: %v", err)
+	}
+	if storage, _ := storages.Get(""); storage != Storage(nextcloud) {
+		t.Fatalf("expected the default storage to be Nextcloud")
+	}
+	if storage, _ := storages.Get("dav"); storage == nil {
+		t.Fatalf("missing WebDAV storage")
+	} else if _, ok := storage.(*NextcloudClient); ok {
+		t.Fatalf("WebDAV storage must not offer Nextcloud features")
+	}
+	if storage, _ := storages.Get("finance"); storage == nil {
+		t.Fatalf("missing Nextcloud target")
+	} else if _, ok := storage.(*NextcloudClient); !ok {
+		t.Fatalf("Nextcloud target must offer Nextcloud features")
+	}
+	if _, err := storages.Get("missing"); err == nil {
+		t.Fatalf("expected unknown storage to fail")
+	}
+
+	cfg.Storages["ftp"] = config.StorageConfig{Type: "ftp"}
+	if _, err := OpenStorages(cfg, nextcloud); err == nil {
+		t.Fatalf("expected unknown storage type to fail")
+	}
+}
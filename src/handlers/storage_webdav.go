@@ -0,0 +1,64 @@
+package handlers
+
+import (
+	"context"
+	"io"
+)
+
+// WebDAVStorage stores files on any WebDAV server. It only uses plain WebDAV,
+// so Nextcloud features such as tags, comments and the trash bin are not
+// available for rooms archiving to it.
+type WebDAVStorage struct {
+	client *NextcloudClient
+}
+
+func NewWebDAVStorage(baseURL, username, password string) *WebDAVStorage {
+	return &WebDAVStorage{client: NewNextcloudClient(baseURL, username, password)}
+}
+
+func (s *WebDAVStorage) EnsureDirectories(ctx context.Context, remotePath string) error {
+	return s.client.EnsureDirectories(ctx, remotePath)
+}
+
+func (s *WebDAVStorage) UploadReader(ctx context.Context, remotePath string, reader io.Reader, contentLength int64) error {
+	return s.client.UploadReader(ctx, remotePath, reader, contentLength)
+}
+
+func (s *WebDAVStorage) CreateFile(ctx context.Context, remotePath string, reader io.Reader, contentLength int64) error {
+	return s.client.CreateFile(ctx, remotePath, reader, contentLength)
+}
+
+func (s *WebDAVStorage) Stat(ctx context.Context, remotePath string) (bool, int64, error) {
+	return s.client.Stat(ctx, remotePath)
+}
+
+func (s *WebDAVStorage) Download(ctx context.Context, remotePath string) (*StoredFile, error) {
+	return s.client.Download(ctx, remotePath)
+}
+
+func (s *WebDAVStorage) DeleteFile(ctx context.Context, remotePath string) error {
+	return s.client.DeleteFile(ctx, remotePath)
+}
+
+func (s *WebDAVStorage) Move(ctx context.Context, sourcePath, destinationPath string) error {
+	return s.client.Move(ctx, sourcePath, destinationPath)
+}
+
+func (s *WebDAVStorage) Copy(ctx context.Context, sourcePath, destinationPath string) error {
+	return s.client.Copy(ctx, sourcePath, destinationPath)
+}
+
+func (s *WebDAVStorage) List(ctx context.Context, remotePath string) ([]RemoteFile, error) {
+	return s.client.List(ctx, remotePath)
+}
+
+// CheckConnection verifies that the server is reachable and accepts the
+// credentials.
+func (s *WebDAVStorage) CheckConnection(ctx context.Context) error {
+	return s.client.CheckConnection(ctx)
+}
+
+// Quota returns the quota of the account, if the server reports one.
+func (s *WebDAVStorage) Quota(ctx context.Context) (Quota, error) {
+	return s.client.Quota(ctx)
+}
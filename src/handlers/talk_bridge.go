@@ -0,0 +1,212 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// talkAccountData is the bot account data type storing the last handled
+// message of each Talk conversation.
+const talkAccountData = "com.nextcloud-media-bridge.talk"
+
+type talkContent struct {
+	LastMessages map[string]int64 `json:"last_messages"`
+}
+
+// TalkBridge posts files shared in Nextcloud Talk conversations to the linked
+// Matrix rooms. The last handled message of each conversation is persisted in
+// the bot's account data, so no file is posted twice.
+type TalkBridge struct {
+	handler *MediaHandler
+
+	mu           sync.Mutex
+	lastMessages map[string]int64 // conversation token -> last handled message ID
+}
+
+func NewTalkBridge(handler *MediaHandler) *TalkBridge {
+	return &TalkBridge{handler: handler, lastMessages: map[string]int64{}}
+}
+
+// Load reads the last handled messages from account data.
+func (b *TalkBridge) Load(ctx context.Context) error {
+	var content talkContent
+	if err := b.handler.as.BotClient().GetAccountData(ctx, talkAccountData, &content); err != nil {
+		if errors.Is(err, mautrix.MNotFound) {
+			return nil
+		}
+		return fmt.Errorf("failed to load Talk state: %w", err)
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if content.LastMessages != nil {
+		b.lastMessages = content.LastMessages
+	}
+	return nil
+}
+
+// Start polls the Talk conversations every interval until ctx is done.
+func (b *TalkBridge) Start(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := b.Poll(ctx); err != nil {
+			log.Printf("Warning: Talk poll failed: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Poll fetches new messages of every linked Talk conversation and posts the
+// files shared in them to the Matrix room. Conversations seen for the first
+// time start at their newest message, so history is not posted. It returns
+// the number of posted files.
+func (b *TalkBridge) Poll(ctx context.Context) (int, error) {
+	h := b.handler
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	posted, changed := 0, false
+	for _, link := range h.config.Talk.Rooms {
+		last, ok := b.lastMessages[link.Token]
+		if !ok {
+			latest, err := h.nextcloud.LatestTalkMessageID(ctx, link.Token)
+			if err != nil {
+				log.Printf("Warning: %v", err)
+				continue
+			}
+			b.lastMessages[link.Token] = latest
+			changed = true
+			continue
+		}
+		messages, err := h.nextcloud.TalkMessages(ctx, link.Token, last)
+		if err != nil {
+			log.Printf("Warning: %v", err)
+			continue
+		}
+		for _, message := range messages {
+			if message.ID <= last {
+				continue
+			}
+			sent, err := b.postMessage(ctx, id.RoomID(link.Room), link.Token, message)
+			if err != nil && talkRetryable(err) {
+				// Retry from this message on the next poll
+				log.Printf("Warning: failed to post file of Talk message %d in %s to room %s: %v", message.ID, link.Token, link.Room, err)
+				break
+			} else if err != nil {
+				// Retrying would block the conversation for good
+				log.Printf("Warning: skipping file of Talk message %d in %s for room %s: %v", message.ID, link.Token, link.Room, err)
+			}
+			if sent {
+				posted++
+			}
+			last = message.ID
+			b.lastMessages[link.Token] = last
+			changed = true
+		}
+	}
+	if changed {
+		content := talkContent{LastMessages: b.lastMessages}
+		if err := h.as.BotClient().SetAccountData(ctx, talkAccountData, content); err != nil {
+			return posted, fmt.Errorf("failed to store Talk state: %w", err)
+		}
+	}
+	return posted, nil
+}
+
+// talkRetryable reports whether posting a Talk file failed for a reason that
+// may go away, such as maintenance, a server error or a network problem.
+// Client errors like a deleted file or a forbidden room are permanent.
+func talkRetryable(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.Maintenance || statusErr.StatusCode == http.StatusTooManyRequests || statusErr.StatusCode >= http.StatusInternalServerError
+	}
+	var httpErr mautrix.HTTPError
+	if errors.As(err, &httpErr) && httpErr.Response != nil {
+		return httpErr.Response.StatusCode == http.StatusTooManyRequests || httpErr.Response.StatusCode >= http.StatusInternalServerError
+	}
+	return !errors.Is(err, ErrNotFound)
+}
+
+// postMessage posts the file shared by a Talk message to the room. Messages
+// without a file, system messages and files shared by the bridge itself are
+// skipped.
+func (b *TalkBridge) postMessage(ctx context.Context, roomID id.RoomID, token string, message TalkMessage) (bool, error) {
+	h := b.handler
+	file := message.File()
+	if file == nil || message.SystemMessage != "" {
+		return false, nil
+	}
+	if message.ActorType == "users" && message.ActorID == h.nextcloud.Username {
+		// Shared from Matrix by the bridge
+		return false, nil
+	}
+	remotePath, err := h.nextcloud.basePath(file.Path)
+	if err != nil {
+		log.Printf("Skipping Talk file %s: %v", file.Path, err)
+		return false, nil
+	}
+	size, _ := file.Size.Int64()
+	caption := fmt.Sprintf("Shared by %s in Nextcloud Talk", message.ActorDisplayName)
+	if text := message.Caption(); text != "" {
+		caption += ":\n" + text
+	}
+	eventID, _, err := h.postNextcloudFile(ctx, roomID, "", RemoteFile{Path: remotePath, Size: size, ContentType: file.MimeType, ETag: file.ETag}, caption)
+	if err != nil || eventID == "" {
+		return false, err
+	}
+	log.Printf("Posted Talk file %s from conversation %s to room %s as event %s", remotePath, token, roomID, eventID)
+	return true, nil
+}
+
+// talkToken returns the token of the Talk conversation linked to a room, or
+// an empty string if there is none.
+func (h *MediaHandler) talkToken(roomID id.RoomID) string {
+	if !h.config.Talk.Enabled {
+		return ""
+	}
+	for _, link := range h.config.Talk.Rooms {
+		if link.Room == roomID.String() {
+			return link.Token
+		}
+	}
+	return ""
+}
+
+// shareToTalk shares an archived file into the Talk conversation linked to
+// the room. Failures are logged; the file itself is already archived.
+func (h *MediaHandler) shareToTalk(ctx context.Context, evt *event.Event, msg *event.MessageEventContent, remotePath string) {
+	token := h.talkToken(evt.RoomID)
+	if token == "" {
+		return
+	}
+	sender := h.rooms.DisplayName(ctx, evt.RoomID, evt.Sender)
+	if sender == "" {
+		sender = evt.Sender.String()
+	}
+	caption := fmt.Sprintf("Shared by %s in Matrix", sender)
+	if text := msg.GetCaption(); text != "" {
+		caption += ":\n" + text
+	}
+	if err := h.nextcloud.ShareToTalk(ctx, remotePath, token, caption); err != nil {
+		log.Printf("Warning: %v", err)
+		return
+	}
+	log.Printf("Shared %s into Talk conversation %s", remotePath, token)
+}
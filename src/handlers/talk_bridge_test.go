@@ -0,0 +1,144 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+
+	"nextcloud-media-bridge/src/config"
+	"nextcloud-media-bridge/src/utils"
+)
+
+func TestTalkBridgePoll(t *testing.T) {
+	const roomID = "!roomid:example.com"
+	var mu sync.Mutex
+	var sent []event.MessageEventContent
+	var lastKnown []string
+	sendStatus := http.StatusOK
+
+	nt := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if r.URL.Path != "/ocs/v2.php/apps/spreed/api/v1/chat/a1b2c3d4" {
+			t.Errorf("unexpected Nextcloud request %s %s", r.Method, r.URL.Path)
+			return
+		}
+		if r.URL.Query().Get("lookIntoFuture") == "0" {
+			_, _ = w.Write([]byte(`{"ocs":{"meta":{"statuscode":200},"data":[{"id":10,"message":"old"}]}}`))
+			return
+		}
+		lastKnown = append(lastKnown, r.URL.Query().Get("lastKnownMessageId"))
+		if r.URL.Query().Get("lastKnownMessageId") == "13" {
+			_, _ = w.Write([]byte(`{"ocs":{"meta":{"statuscode":200},"data":[` +
+				`{"id":14,"actorType":"users","actorId":"carol","actorDisplayName":"Carol","message":"{file}","messageParameters":{"file":{"type":"file","name":"notes.pdf","path":"Talk/notes.pdf","mimetype":"application/pdf","size":4}}}` +
+				`]}}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"ocs":{"meta":{"statuscode":200},"data":[` +
+			`{"id":11,"actorType":"users","actorId":"carol","actorDisplayName":"Carol","message":"{file}","messageParameters":{"file":{"type":"file","name":"report.pdf","path":"Talk/report.pdf","mimetype":"application/pdf","size":4}}},` +
+			`{"id":12,"actorType":"users","actorId":"bridge","actorDisplayName":"Bridge","message":"{file}","messageParameters":{"file":{"type":"file","name":"photo.pdf","path":"media/photo.pdf","mimetype":"application/pdf","size":4}}},` +
+			`{"id":13,"actorType":"users","actorId":"carol","actorDisplayName":"Carol","message":"thanks","messageParameters":[]}` +
+			`]}}`))
+	}))
+	defer nt.Close()
+
+	mt := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case strings.Contains(r.URL.Path, "/send/m.room.message/") && sendStatus != http.StatusOK:
+			w.WriteHeader(sendStatus)
+			_, _ = w.Write([]byte(`{"errcode":"M_UNKNOWN","error":"failed"}`))
+		case strings.Contains(r.URL.Path, "/send/m.room.message/"):
+			var content event.MessageEventContent
+			_ = json.NewDecoder(r.Body).Decode(&content)
+			sent = append(sent, content)
+			_, _ = w.Write([]byte(`{"event_id":"$posted"}`))
+		default:
+			_, _ = w.Write([]byte(`{}`))
+		}
+	}))
+	defer mt.Close()
+
+	cfg := &config.Config{}
+	cfg.MediaProxy.ServerName = "media.example.com"
+	cfg.Talk.Enabled = true
+	cfg.Talk.Rooms = []config.TalkRoom{{Room: roomID, Token: "a1b2c3d4"}}
+	handler := newTestHandler(t, cfg, mt.URL, NewStorages(NewNextcloudClient(nt.URL+"/remote.php/dav/files/bridge", "bridge", "pass")))
+	bridge := NewTalkBridge(handler)
+
+	// The first poll only records where the conversation is
+	if posted, err := bridge.Poll(context.Background()); err != nil || posted != 0 || len(sent) != 0 {
+		t.Fatalf("expected no history to be posted, got %d: %v", posted, err)
+	}
+	posted, err := bridge.Poll(context.Background())
+	if err != nil {
+		t.Fatalf("Poll failed: %v", err)
+	}
+	if len(lastKnown) != 1 || lastKnown[0] != "10" {
+		t.Fatalf("expected messages after 10 to be fetched, got %v", lastKnown)
+	}
+	if posted != 1 || len(sent) != 1 {
+		t.Fatalf("expected one posted file, got %d (%d messages)", posted, len(sent))
+	}
+	msg := sent[0]
+	if msg.MsgType != event.MsgFile || msg.FileName != "report.pdf" || msg.Body != "Shared by Carol in Nextcloud Talk" {
+		t.Fatalf("unexpected message %+v", msg)
+	}
+	uri, _ := msg.URL.Parse()
+	if ref, err := utils.DecodeMediaID(testSecret, uri.FileID); err != nil || ref.Path != "Talk/report.pdf" {
+		t.Fatalf("unexpected media ref %+v: %v", ref, err)
+	}
+	if bridge.lastMessages["a1b2c3d4"] != 13 {
+		t.Fatalf("expected last handled message 13, got %d", bridge.lastMessages["a1b2c3d4"])
+	}
+
+	// Server errors are retried, the conversation stays at the failed message
+	sendStatus = http.StatusBadGateway
+	handler.as.BotIntent().Client.DefaultHTTPRetries = 0
+	if posted, err := bridge.Poll(context.Background()); err != nil || posted != 0 {
+		t.Fatalf("expected nothing to be posted, got %d: %v", posted, err)
+	}
+	if bridge.lastMessages["a1b2c3d4"] != 13 {
+		t.Fatalf("expected the failed message to be retried, got %d", bridge.lastMessages["a1b2c3d4"])
+	}
+
+	// Permanent errors skip the message
+	sendStatus = http.StatusForbidden
+	if posted, err := bridge.Poll(context.Background()); err != nil || posted != 0 {
+		t.Fatalf("expected nothing to be posted, got %d: %v", posted, err)
+	}
+	if bridge.lastMessages["a1b2c3d4"] != 14 {
+		t.Fatalf("expected the forbidden message to be skipped, got %d", bridge.lastMessages["a1b2c3d4"])
+	}
+}
+
+func TestTalkRetryable(t *testing.T) {
+	cases := []struct {
+		err  error
+		want bool
+	}{
+		{&StatusError{StatusCode: http.StatusNotFound}, false},
+		{fmt.Errorf("download failed: %w", &StatusError{StatusCode: http.StatusForbidden}), false},
+		{&StatusError{StatusCode: http.StatusServiceUnavailable, Maintenance: true}, true},
+		{&StatusError{StatusCode: http.StatusBadGateway}, true},
+		{mautrix.HTTPError{Response: &http.Response{StatusCode: http.StatusForbidden}, RespError: &mautrix.MForbidden}, false},
+		{mautrix.HTTPError{Response: &http.Response{StatusCode: http.StatusTooManyRequests}}, true},
+		{context.DeadlineExceeded, true},
+		{errors.New("connection refused"), true},
+	}
+	for _, tc := range cases {
+		if got := talkRetryable(tc.err); got != tc.want {
+			t.Errorf("talkRetryable(%v) = %v, want %v", tc.err, got, tc.want)
+		}
+	}
+}
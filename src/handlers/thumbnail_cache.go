@@ -0,0 +1,87 @@
+package handlers
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"nextcloud-media-bridge/src/utils"
+)
+
+const (
+	thumbnailCacheSize = 64 << 20 // Bytes of rendered thumbnails kept in memory
+	thumbnailCacheTTL  = time.Hour
+)
+
+// ThumbnailCache keeps recently rendered thumbnails, so repeated requests do
+// not download and scale the original again. Entries are keyed by storage,
+// path and version and expire after thumbnailCacheTTL, since files without a
+// version can still be replaced in place. The least recently used entries
+// are dropped once maxBytes is exceeded.
+type ThumbnailCache struct {
+	maxBytes int
+
+	lock    sync.Mutex
+	size    int
+	order   *list.List // Front is the most recently used
+	entries map[string]*list.Element
+}
+
+type thumbnailEntry struct {
+	key      string
+	data     []byte
+	rendered time.Time
+}
+
+func NewThumbnailCache(maxBytes int) *ThumbnailCache {
+	return &ThumbnailCache{maxBytes: maxBytes, order: list.New(), entries: map[string]*list.Element{}}
+}
+
+func thumbnailKey(ref utils.MediaRef) string {
+	return ref.Storage + "\x00" + ref.Path + "\x00" + ref.Version
+}
+
+// Get returns the cached thumbnail of a media reference.
+func (c *ThumbnailCache) Get(ref utils.MediaRef) ([]byte, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	element, ok := c.entries[thumbnailKey(ref)]
+	if !ok {
+		return nil, false
+	}
+	entry := element.Value.(*thumbnailEntry)
+	if time.Since(entry.rendered) > thumbnailCacheTTL {
+		c.remove(element)
+		return nil, false
+	}
+	c.order.MoveToFront(element)
+	return entry.data, true
+}
+
+// Add stores a rendered thumbnail.
+func (c *ThumbnailCache) Add(ref utils.MediaRef, data []byte) {
+	if c == nil || len(data) > c.maxBytes {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	key := thumbnailKey(ref)
+	if element, ok := c.entries[key]; ok {
+		c.remove(element)
+	}
+	c.entries[key] = c.order.PushFront(&thumbnailEntry{key: key, data: data, rendered: time.Now()})
+	c.size += len(data)
+	for c.size > c.maxBytes {
+		c.remove(c.order.Back())
+	}
+}
+
+// remove drops an entry. The lock must be held.
+func (c *ThumbnailCache) remove(element *list.Element) {
+	entry := c.order.Remove(element).(*thumbnailEntry)
+	delete(c.entries, entry.key)
+	c.size -= len(entry.data)
+}
@@ -0,0 +1,90 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/png"
+	"testing"
+
+	"nextcloud-media-bridge/src/config"
+	"nextcloud-media-bridge/src/utils"
+)
+
+// countingStorage counts downloads.
+type countingStorage struct {
+	Storage
+	downloads int
+}
+
+func (s *countingStorage) Download(ctx context.Context, remotePath string) (*StoredFile, error) {
+	s.downloads++
+	return s.Storage.Download(ctx, remotePath)
+}
+
+func TestOpenMediaCachesThumbnails(t *testing.T) {
+	disk, err := NewLocalStorage(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var image bytes.Buffer
+	if err := png.Encode(&image, imageOfSize(1600, 1200)); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err := disk.EnsureDirectories(ctx, "media/photo.png"); err != nil {
+		t.Fatal(err)
+	}
+	if err := disk.UploadReader(ctx, "media/photo.png", bytes.NewReader(image.Bytes()), int64(image.Len())); err != nil {
+		t.Fatal(err)
+	}
+	storage := &countingStorage{Storage: disk}
+	storages := NewStorages(nil)
+	storages.Add("disk", storage)
+	cfg := &config.Config{}
+	cfg.MediaProxy.Thumbnails.MaxWidth = 80
+	cfg.MediaProxy.Thumbnails.MaxHeight = 60
+	thumbnails := NewThumbnailCache(1 << 20)
+
+	ref := utils.MediaRef{Path: "media/photo.png", Storage: "disk", Thumbnail: true}
+	for i := 0; i < 3; i++ {
+		media, err := openMedia(ctx, cfg, storages, nil, nil, thumbnails, ref)
+		if err != nil {
+			t.Fatalf("openMedia failed: %v", err)
+		}
+		if media.ContentType != "image/jpeg" || media.ContentLength <= 0 {
+			t.Fatalf("unexpected thumbnail %+v", media)
+		}
+	}
+	if storage.downloads != 1 {
+		t.Fatalf("expected the original to be downloaded once, got %d", storage.downloads)
+	}
+	// A new version of the file is rendered again
+	ref.Version = "2"
+	if _, err := openMedia(ctx, cfg, storages, nil, nil, thumbnails, ref); err != nil || storage.downloads != 2 {
+		t.Fatalf("expected a new version to be rendered, got %d downloads: %v", storage.downloads, err)
+	}
+}
+
+func TestThumbnailCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	cache := NewThumbnailCache(10)
+	a, b, c := utils.MediaRef{Path: "a"}, utils.MediaRef{Path: "b"}, utils.MediaRef{Path: "c"}
+	cache.Add(a, []byte("aaaa"))
+	cache.Add(b, []byte("bbbb"))
+	cache.Get(a)
+	cache.Add(c, []byte("cccc"))
+	if _, ok := cache.Get(b); ok {
+		t.Fatalf("expected the least recently used thumbnail to be evicted")
+	}
+	if _, ok := cache.Get(a); !ok {
+		t.Fatalf("expected the recently used thumbnail to be kept")
+	}
+	cache.Add(utils.MediaRef{Path: "large"}, make([]byte, 11))
+	if _, ok := cache.Get(c); !ok {
+		t.Fatalf("expected a thumbnail larger than the cache not to evict others")
+	}
+}
+
+func imageOfSize(width, height int) image.Image {
+	return image.NewRGBA(image.Rect(0, 0, width, height))
+}
@@ -1,6 +1,10 @@
 package main
 
 import (
+	"bytes"
+	"image"
+	"image/jpeg"
+	"image/png"
 	"net/http"
 	"net/http/httptest"
 	"testing"
@@ -27,7 +31,7 @@ func TestMediaProxyDownload(t *testing.T) {
 	secret := []byte(cfg.MediaProxy.HMACSecret)
 
 	nextcloud := handlers.NewNextcloudClient(server.URL, "user", "pass")
-	proxy, err := handlers.NewMediaProxy(cfg, nextcloud, secret)
+	proxy, err := handlers.NewMediaProxy(cfg, handlers.NewStorages(nextcloud), secret, nil, nil)
 	if err != nil {
 		t.Fatalf("failed to create media proxy: %v", err)
 	}
@@ -48,3 +52,46 @@ func TestMediaProxyDownload(t *testing.T) {
 		t.Fatalf("unexpected status code: %d", response.Code)
 	}
 }
+
+func TestMediaProxyThumbnail(t *testing.T) {
+	var original bytes.Buffer
+	if err := png.Encode(&original, image.NewRGBA(image.Rect(0, 0, 1600, 1000))); err != nil {
+		t.Fatalf("failed to encode image: %v", err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(original.Bytes())
+	}))
+	defer server.Close()
+
+	cfg := &config.Config{}
+	cfg.MediaProxy.ServerName = "media.example.com"
+	cfg.MediaProxy.ServerKey = federation.GenerateSigningKey().SynapseString()
+	cfg.MediaProxy.Thumbnails.MaxWidth = 800
+	cfg.MediaProxy.Thumbnails.MaxHeight = 600
+	secret := []byte("secret")
+
+	proxy, err := handlers.NewMediaProxy(cfg, handlers.NewStorages(handlers.NewNextcloudClient(server.URL, "user", "pass")), secret, nil, nil)
+	if err != nil {
+		t.Fatalf("failed to create media proxy: %v", err)
+	}
+	mediaID, err := utils.EncodeMediaID(secret, utils.MediaRef{Path: "media/photo.png", FileName: "photo.png", MimeType: "image/png", Thumbnail: true})
+	if err != nil {
+		t.Fatalf("failed to encode media id: %v", err)
+	}
+	router := http.NewServeMux()
+	proxy.RegisterRoutes(router, zerolog.Nop())
+
+	request := httptest.NewRequest(http.MethodGet, "http://example.com/_matrix/client/v1/media/download/media.example.com/"+mediaID, nil)
+	response := httptest.NewRecorder()
+	router.ServeHTTP(response, request)
+	if response.Code != http.StatusOK {
+		t.Fatalf("unexpected status code: %d", response.Code)
+	}
+	thumbnail, err := jpeg.DecodeConfig(response.Body)
+	if err != nil {
+		t.Fatalf("thumbnail is not a JPEG: %v", err)
+	}
+	if thumbnail.Width != 800 || thumbnail.Height != 500 {
+		t.Fatalf("expected 800x500 thumbnail, got %dx%d", thumbnail.Width, thumbnail.Height)
+	}
+}
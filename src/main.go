@@ -26,15 +26,16 @@ import (
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(os.Args[1], os.Args[2:]))
+	}
+
 	cfg, err := loadConfig()
 	if err != nil {
 		log.Fatalf("Failed to load configuration: %v", err)
 	}
-	if cfg.Matrix.Appservice.RegistrationPath == "" {
-		log.Fatal("Missing Matrix appservice registration path")
-	}
-	if cfg.MediaProxy.HMACSecret == "" {
-		log.Fatal("Missing MEDIA_PROXY_HMAC_SECRET")
+	if err := cfg.Validate(); err != nil {
+		log.Fatalf("Invalid configuration (run check-config for details): %v", err)
 	}
 
 	registration, err := appservice.LoadRegistration(cfg.Matrix.Appservice.RegistrationPath)
@@ -57,6 +58,10 @@ func main() {
 	as.Log = zerolog.New(os.Stdout).With().Timestamp().Logger()
 
 	nextcloud := handlers.NewNextcloudClient(cfg.Nextcloud.BaseURL, cfg.Nextcloud.Username, cfg.Nextcloud.Password)
+	storages, err := handlers.OpenStorages(cfg, nextcloud)
+	if err != nil {
+		log.Fatalf("Failed to initialize storages: %v", err)
+	}
 
 	// Initialize crypto helper if encryption is enabled
 	var cryptoHelper *handlers.CryptoHelper
@@ -76,21 +81,49 @@ func main() {
 		as.Log.Info().Msg("End-to-end encryption disabled")
 	}
 
-	mediaHandler := handlers.NewMediaHandler(cfg, nextcloud, []byte(cfg.MediaProxy.HMACSecret), as, cryptoHelper)
+	rooms := handlers.NewRoomResolver(cfg, as)
+	moves := handlers.NewPathMoves(as)
+	if err := moves.Load(context.Background()); err != nil {
+		log.Printf("Warning: %v", err)
+	}
+	revoked := handlers.NewRevokedMedia(as)
+	if err := revoked.Load(context.Background()); err != nil {
+		log.Printf("Warning: %v", err)
+	}
+	var scanner *handlers.ClamAVClient
+	if cfg.Antivirus.Enabled {
+		scanner, err = handlers.NewClamAVClient(cfg.Antivirus.Address, cfg.Antivirus.Timeout)
+		if err != nil {
+			log.Fatalf("Failed to create virus scanner: %v", err)
+		}
+		if err := scanner.Ping(context.Background()); err != nil {
+			log.Printf("Warning: clamd is not reachable: %v", err)
+		}
+		as.Log.Info().Str("address", cfg.Antivirus.Address).Str("fail_policy", cfg.Antivirus.FailPolicy).Msg("Virus scanning enabled")
+	}
+	mediaHandler := handlers.NewMediaHandler(cfg, storages, []byte(cfg.MediaProxy.HMACSecret), as, cryptoHelper, rooms, moves, revoked, scanner)
 
-	mediaProxy, err := handlers.NewMediaProxy(cfg, nextcloud, []byte(cfg.MediaProxy.HMACSecret))
+	mediaProxy, err := handlers.NewMediaProxy(cfg, storages, []byte(cfg.MediaProxy.HMACSecret), moves, revoked)
 	if err != nil {
 		log.Fatalf("Failed to initialize media proxy: %v", err)
 	}
 	as.Log.Info().Str("media_proxy", cfg.MediaProxy.ServerName).Msg("Media proxy initialized")
 	mediaProxyMux := http.NewServeMux()
 	mediaProxy.RegisterRoutes(mediaProxyMux, as.Log)
+	if cfg.Gallery.Enabled {
+		handlers.NewGallery(mediaHandler).RegisterRoutes(mediaProxyMux)
+		as.Log.Info().Str("public_url", cfg.Gallery.PublicURL).Msg("Room galleries enabled")
+	}
+
+	if cfg.Quota.Enabled && cfg.Quota.Metrics {
+		as.Router.HandleFunc("GET /metrics", mediaHandler.ServeQuotaMetrics)
+	}
 
 	go as.Start()
 	as.Log.Info().Str("address", cfg.Matrix.Appservice.Hostname).Uint16("port", cfg.Matrix.Appservice.Port).Msg("Appservice listener starting")
 
 	// Initialize room manager and join configured rooms
-	roomManager := handlers.NewRoomManager(cfg, as)
+	roomManager := handlers.NewRoomManager(cfg, as, rooms)
 	go func() {
 		// Wait a bit for appservice to fully start
 		time.Sleep(2 * time.Second)
@@ -99,6 +132,39 @@ func main() {
 		// Start monitoring room membership every 5 minutes
 		roomManager.StartRoomMonitor(ctx, 5*time.Minute)
 	}()
+	if cfg.Reconcile.Enabled {
+		as.Log.Info().Dur("interval", cfg.Reconcile.Interval).Str("action", cfg.Reconcile.Action).Msg("Reconciliation with Nextcloud enabled")
+		go mediaHandler.StartReconciler(context.Background(), cfg.Reconcile.Interval)
+	}
+	if cfg.Outbox.Enabled {
+		outbox := handlers.NewOutboxWatcher(mediaHandler)
+		// Without the handled files every outbox file would be posted again
+		if err := outbox.Load(context.Background()); err != nil {
+			log.Fatalf("Failed to load outbox state: %v", err)
+		}
+		as.Log.Info().Str("template", cfg.Outbox.Template).Dur("interval", cfg.Outbox.Interval).Msg("Outbox folders enabled")
+		go outbox.Start(context.Background(), cfg.Outbox.Interval)
+	}
+	if cfg.Talk.Enabled {
+		talk := handlers.NewTalkBridge(mediaHandler)
+		// Without the last handled messages files could be posted again
+		if err := talk.Load(context.Background()); err != nil {
+			log.Fatalf("Failed to load Talk state: %v", err)
+		}
+		as.Log.Info().Int("conversations", len(cfg.Talk.Rooms)).Dur("interval", cfg.Talk.Interval).Msg("Nextcloud Talk bridging enabled")
+		go talk.Start(context.Background(), cfg.Talk.Interval)
+	}
+	if cfg.Mirror.Enabled {
+		as.Log.Info().Str("storage", cfg.Mirror.Storage).Msg("Replication to mirror enabled")
+		go mediaHandler.StartReplication(context.Background())
+	}
+	if cfg.Quota.Enabled {
+		as.Log.Info().Dur("interval", cfg.Quota.Interval).Ints("thresholds", cfg.Quota.Thresholds).Msg("Quota monitoring enabled")
+		go mediaHandler.StartQuotaMonitor(context.Background(), cfg.Quota.Interval)
+	}
+	if cfg.Gallery.Enabled && cfg.Gallery.Widget {
+		go mediaHandler.StartGalleryWidgets(context.Background())
+	}
 
 	mediaPort := cfg.MediaProxy.ListenPort
 	if mediaPort == 0 {
@@ -187,14 +253,22 @@ func main() {
 }
 
 func loadConfig() (*config.Config, error) {
-	configPath := os.Getenv("CONFIG_PATH")
-	if configPath != "" {
+	if configPath := defaultConfigPath(); configPath != "" {
 		return config.LoadConfig(configPath)
 	}
+	return config.LoadConfigFromEnv()
+}
+
+// defaultConfigPath returns $CONFIG_PATH or config/config.yaml if it exists,
+// or an empty string if the configuration should come from the environment.
+func defaultConfigPath() string {
+	if configPath := os.Getenv("CONFIG_PATH"); configPath != "" {
+		return configPath
+	}
 	if _, err := os.Stat("config/config.yaml"); err == nil {
-		return config.LoadConfig("config/config.yaml")
+		return "config/config.yaml"
 	}
-	return config.LoadConfigFromEnv(), nil
+	return ""
 }
 
 func mediaTLSHost(serverName, listenAddr string) string {
@@ -0,0 +1,343 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"strings"
+)
+
+// ErrUnsupportedImage is returned by StripImageMetadata for formats it cannot
+// rewrite.
+var ErrUnsupportedImage = errors.New("unsupported image format")
+
+const exifOrientationTag = 0x0112
+
+var (
+	jpegExifHeader = []byte("Exif\x00\x00")
+	jpegICCHeader  = []byte("ICC_PROFILE\x00")
+	pngSignature   = []byte("\x89PNG\r\n\x1a\n")
+)
+
+// StripImageMetadata removes EXIF, XMP, IPTC and text metadata such as GPS
+// coordinates and device serials from JPEG, PNG and WebP images. The EXIF
+// orientation is kept so images are still displayed upright, as are color
+// profiles. The returned bool reports whether anything was removed.
+func StripImageMetadata(data []byte) ([]byte, bool, error) {
+	switch {
+	case bytes.HasPrefix(data, []byte{0xFF, 0xD8}):
+		return stripJPEGMetadata(data)
+	case bytes.HasPrefix(data, pngSignature):
+		return stripPNGMetadata(data)
+	case len(data) >= 12 && string(data[:4]) == "RIFF" && string(data[8:12]) == "WEBP":
+		return stripWebPMetadata(data)
+	default:
+		return data, false, ErrUnsupportedImage
+	}
+}
+
+// IsStrippableImage reports whether StripImageMetadata supports the MIME type.
+func IsStrippableImage(mimeType string) bool {
+	mimeType, _, _ = strings.Cut(strings.ToLower(mimeType), ";")
+	switch strings.TrimSpace(mimeType) {
+	case "image/jpeg", "image/jpg", "image/png", "image/webp":
+		return true
+	}
+	return false
+}
+
+// stripJPEGMetadata keeps the JFIF header, ICC profiles and Adobe color
+// information, drops every other application segment and comment, and drops
+// data after the end of the image (embedded previews carry their own EXIF).
+func stripJPEGMetadata(data []byte) ([]byte, bool, error) {
+	var kept [][]byte
+	var orientation uint16
+	changed := false
+	pos := 2
+	for {
+		if pos >= len(data) || data[pos] != 0xFF {
+			return nil, false, fmt.Errorf("jpeg: invalid marker at offset %d", pos)
+		}
+		// Markers may be preceded by any number of fill bytes
+		for pos < len(data) && data[pos] == 0xFF {
+			pos++
+		}
+		if pos >= len(data) {
+			return nil, false, fmt.Errorf("jpeg: truncated marker")
+		}
+		marker := data[pos]
+		pos++
+		if marker == 0x01 || (marker >= 0xD0 && marker <= 0xD9) {
+			return nil, false, fmt.Errorf("jpeg: unexpected marker %#x before image data", marker)
+		}
+		if pos+2 > len(data) {
+			return nil, false, fmt.Errorf("jpeg: truncated segment")
+		}
+		length := int(binary.BigEndian.Uint16(data[pos:]))
+		if length < 2 || pos+length > len(data) {
+			return nil, false, fmt.Errorf("jpeg: invalid segment length")
+		}
+		payload := data[pos+2 : pos+length]
+		segment := data[pos-2 : pos+length]
+		pos += length
+
+		switch {
+		case marker == 0xE1:
+			tiff := bytes.TrimPrefix(payload, jpegExifHeader)
+			if value, ok := tiffOrientation(tiff); ok && len(tiff) < len(payload) {
+				orientation = value
+			}
+			if !isOrientationOnly(tiff) {
+				changed = true
+			}
+		case marker == 0xE2 && !bytes.HasPrefix(payload, jpegICCHeader),
+			marker >= 0xE3 && marker <= 0xEF && marker != 0xEE,
+			marker == 0xFE:
+			changed = true
+		default:
+			kept = append(kept, segment)
+		}
+		if marker == 0xDA {
+			break
+		}
+	}
+
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(data[:2])
+	exifWritten := orientation <= 1
+	for _, segment := range kept {
+		// The EXIF segment follows the JFIF header
+		if !exifWritten && segment[1] != 0xE0 {
+			writeJPEGOrientation(out, orientation)
+			exifWritten = true
+		}
+		out.Write(segment)
+	}
+	// Entropy-coded data and any further scans follow up to EOI
+	end := findJPEGEnd(data, pos)
+	out.Write(data[pos:end])
+	if end < len(data) {
+		changed = true
+	}
+	if !changed {
+		return data, false, nil
+	}
+	return out.Bytes(), true, nil
+}
+
+func writeJPEGOrientation(out *bytes.Buffer, orientation uint16) {
+	tiff := orientationTIFF(orientation)
+	out.Write([]byte{0xFF, 0xE1})
+	_ = binary.Write(out, binary.BigEndian, uint16(2+len(jpegExifHeader)+len(tiff)))
+	out.Write(jpegExifHeader)
+	out.Write(tiff)
+}
+
+// findJPEGEnd returns the offset just after the EOI marker of the scan data
+// starting at pos, or the end of data if there is none.
+func findJPEGEnd(data []byte, pos int) int {
+	for i := pos; i+1 < len(data); i++ {
+		if data[i] == 0xFF && data[i+1] == 0xD9 {
+			return i + 2
+		}
+	}
+	return len(data)
+}
+
+// stripPNGMetadata drops eXIf, text (including XMP in iTXt) and tIME chunks.
+func stripPNGMetadata(data []byte) ([]byte, bool, error) {
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(pngSignature)
+	changed := false
+	pos := len(pngSignature)
+	for pos < len(data) {
+		if pos+8 > len(data) {
+			return nil, false, fmt.Errorf("png: truncated chunk")
+		}
+		length := int(binary.BigEndian.Uint32(data[pos:]))
+		chunkType := string(data[pos+4 : pos+8])
+		end := pos + 12 + length
+		if length < 0 || end > len(data) {
+			return nil, false, fmt.Errorf("png: invalid chunk length")
+		}
+		chunk := data[pos:end]
+		payload := data[pos+8 : pos+8+length]
+		pos = end
+
+		switch chunkType {
+		case "eXIf":
+			if !isOrientationOnly(payload) {
+				changed = true
+			}
+			if orientation, ok := tiffOrientation(payload); ok && orientation > 1 {
+				writePNGChunk(out, "eXIf", orientationTIFF(orientation))
+			}
+		case "tEXt", "zTXt", "iTXt", "tIME":
+			changed = true
+		default:
+			out.Write(chunk)
+		}
+		if chunkType == "IEND" {
+			if pos < len(data) {
+				changed = true
+			}
+			return out.Bytes(), changed, nil
+		}
+	}
+	return nil, false, fmt.Errorf("png: missing IEND chunk")
+}
+
+func writePNGChunk(out *bytes.Buffer, chunkType string, payload []byte) {
+	_ = binary.Write(out, binary.BigEndian, uint32(len(payload)))
+	crc := crc32.NewIEEE()
+	crc.Write([]byte(chunkType))
+	crc.Write(payload)
+	out.WriteString(chunkType)
+	out.Write(payload)
+	_ = binary.Write(out, binary.BigEndian, crc.Sum32())
+}
+
+const (
+	webpFlagEXIF = 0x08
+	webpFlagXMP  = 0x04
+)
+
+// stripWebPMetadata drops the XMP chunk and reduces the EXIF chunk to the
+// orientation. Only the extended (VP8X) format carries metadata.
+func stripWebPMetadata(data []byte) ([]byte, bool, error) {
+	var chunks [][]byte
+	var vp8x []byte
+	changed := false
+	pos := 12
+	for pos < len(data) {
+		if pos+8 > len(data) {
+			return nil, false, fmt.Errorf("webp: truncated chunk")
+		}
+		fourCC := string(data[pos : pos+4])
+		size := int(binary.LittleEndian.Uint32(data[pos+4:]))
+		end := pos + 8 + size
+		if size < 0 || end > len(data) {
+			return nil, false, fmt.Errorf("webp: invalid chunk size")
+		}
+		payload := data[pos+8 : end]
+		if size%2 == 1 && end < len(data) {
+			end++
+		}
+		pos = end
+
+		switch fourCC {
+		case "EXIF":
+			if !isOrientationOnly(bytes.TrimPrefix(payload, jpegExifHeader)) {
+				changed = true
+			}
+			if orientation, ok := tiffOrientation(bytes.TrimPrefix(payload, jpegExifHeader)); ok && orientation > 1 {
+				chunks = append(chunks, webpChunk("EXIF", orientationTIFF(orientation)))
+			}
+		case "XMP ":
+			changed = true
+		case "VP8X":
+			vp8x = append([]byte(nil), payload...)
+			chunks = append(chunks, nil) // placeholder, written once flags are known
+		default:
+			chunks = append(chunks, webpChunk(fourCC, payload))
+		}
+	}
+	if !changed {
+		return data, false, nil
+	}
+
+	hasEXIF := false
+	for _, chunk := range chunks {
+		if chunk != nil && string(chunk[:4]) == "EXIF" {
+			hasEXIF = true
+		}
+	}
+	var body bytes.Buffer
+	body.WriteString("WEBP")
+	for _, chunk := range chunks {
+		if chunk == nil {
+			if len(vp8x) > 0 {
+				vp8x[0] &^= webpFlagXMP | webpFlagEXIF
+				if hasEXIF {
+					vp8x[0] |= webpFlagEXIF
+				}
+			}
+			chunk = webpChunk("VP8X", vp8x)
+		}
+		body.Write(chunk)
+	}
+	out := bytes.NewBuffer(make([]byte, 0, body.Len()+8))
+	out.WriteString("RIFF")
+	_ = binary.Write(out, binary.LittleEndian, uint32(body.Len()))
+	out.Write(body.Bytes())
+	return out.Bytes(), true, nil
+}
+
+func webpChunk(fourCC string, payload []byte) []byte {
+	chunk := make([]byte, 8, 9+len(payload))
+	copy(chunk, fourCC)
+	binary.LittleEndian.PutUint32(chunk[4:], uint32(len(payload)))
+	chunk = append(chunk, payload...)
+	if len(payload)%2 == 1 {
+		chunk = append(chunk, 0)
+	}
+	return chunk
+}
+
+// tiffOrientation reads the Orientation tag from IFD0 of a TIFF structure.
+func tiffOrientation(tiff []byte) (uint16, bool) {
+	if len(tiff) < 8 {
+		return 0, false
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 0, false
+	}
+	offset := int(order.Uint32(tiff[4:]))
+	if offset < 8 || offset+2 > len(tiff) {
+		return 0, false
+	}
+	count := int(order.Uint16(tiff[offset:]))
+	for i := 0; i < count; i++ {
+		entry := offset + 2 + i*12
+		if entry+12 > len(tiff) {
+			return 0, false
+		}
+		if order.Uint16(tiff[entry:]) == exifOrientationTag {
+			value := order.Uint16(tiff[entry+8:])
+			if value < 1 || value > 8 {
+				return 0, false
+			}
+			return value, true
+		}
+	}
+	return 0, false
+}
+
+// isOrientationOnly reports whether the TIFF block is one written by
+// orientationTIFF, so already stripped images are left unchanged.
+func isOrientationOnly(tiff []byte) bool {
+	orientation, ok := tiffOrientation(tiff)
+	return ok && orientation > 1 && bytes.Equal(tiff, orientationTIFF(orientation))
+}
+
+// orientationTIFF builds a TIFF structure holding only the Orientation tag.
+func orientationTIFF(orientation uint16) []byte {
+	tiff := []byte{
+		'M', 'M', 0x00, 0x2A, // big-endian TIFF header
+		0x00, 0x00, 0x00, 0x08, // IFD0 offset
+		0x00, 0x01, // one entry
+		0x01, 0x12, 0x00, 0x03, 0x00, 0x00, 0x00, 0x01, // Orientation, SHORT, count 1
+		0x00, 0x00, 0x00, 0x00, // value, filled in below
+		0x00, 0x00, 0x00, 0x00, // no next IFD
+	}
+	binary.BigEndian.PutUint16(tiff[18:], orientation)
+	return tiff
+}
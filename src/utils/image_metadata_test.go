@@ -0,0 +1,144 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+// testEXIF builds a little-endian TIFF block with an orientation and a
+// GPS-like ASCII marker that must not survive stripping.
+func testEXIF(orientation uint16) []byte {
+	tiff := []byte{'I', 'I', 0x2A, 0x00, 0x08, 0x00, 0x00, 0x00, 0x02, 0x00}
+	entry := make([]byte, 12)
+	binary.LittleEndian.PutUint16(entry[0:], 0x010F) // Make
+	binary.LittleEndian.PutUint16(entry[2:], 2)
+	binary.LittleEndian.PutUint32(entry[4:], 4)
+	copy(entry[8:], "GPS!")
+	tiff = append(tiff, entry...)
+	entry = make([]byte, 12)
+	binary.LittleEndian.PutUint16(entry[0:], exifOrientationTag)
+	binary.LittleEndian.PutUint16(entry[2:], 3)
+	binary.LittleEndian.PutUint32(entry[4:], 1)
+	binary.LittleEndian.PutUint16(entry[8:], orientation)
+	tiff = append(tiff, entry...)
+	return append(tiff, 0, 0, 0, 0)
+}
+
+func testImage() image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, 4, 4))
+	for i := range img.Pix {
+		img.Pix[i] = byte(i * 7)
+	}
+	return img
+}
+
+func TestStripJPEGMetadata(t *testing.T) {
+	var encoded bytes.Buffer
+	if err := jpeg.Encode(&encoded, testImage(), nil); err != nil {
+		t.Fatalf("failed to encode: %v", err)
+	}
+	exif := append([]byte("Exif\x00\x00"), testEXIF(6)...)
+	xmp := []byte("http://ns.adobe.com/xap/1.0/\x00<x:xmpmeta>GPS!</x:xmpmeta>")
+	var input bytes.Buffer
+	input.Write(encoded.Bytes()[:2])
+	for _, segment := range []struct {
+		marker  byte
+		payload []byte
+	}{{0xE1, exif}, {0xE1, xmp}, {0xFE, []byte("GPS! comment")}} {
+		input.Write([]byte{0xFF, segment.marker})
+		_ = binary.Write(&input, binary.BigEndian, uint16(len(segment.payload)+2))
+		input.Write(segment.payload)
+	}
+	input.Write(encoded.Bytes()[2:])
+	input.WriteString("GPS! trailing preview")
+
+	stripped, changed, err := StripImageMetadata(input.Bytes())
+	if err != nil || !changed {
+		t.Fatalf("expected metadata to be stripped, got changed=%v err=%v", changed, err)
+	}
+	if bytes.Contains(stripped, []byte("GPS!")) {
+		t.Fatalf("stripped image still contains metadata")
+	}
+	if _, err := jpeg.Decode(bytes.NewReader(stripped)); err != nil {
+		t.Fatalf("stripped image does not decode: %v", err)
+	}
+	exifStart := bytes.Index(stripped, []byte("Exif\x00\x00"))
+	if exifStart < 0 {
+		t.Fatalf("orientation EXIF segment missing")
+	}
+	if orientation, ok := tiffOrientation(stripped[exifStart+6:]); !ok || orientation != 6 {
+		t.Fatalf("expected orientation 6, got %d (ok=%v)", orientation, ok)
+	}
+
+	again, changed, err := StripImageMetadata(stripped)
+	if err != nil || changed || !bytes.Equal(again, stripped) {
+		t.Fatalf("stripping twice should be a no-op, got changed=%v err=%v", changed, err)
+	}
+}
+
+func TestStripPNGMetadata(t *testing.T) {
+	var encoded bytes.Buffer
+	if err := png.Encode(&encoded, testImage()); err != nil {
+		t.Fatalf("failed to encode: %v", err)
+	}
+	// Insert the metadata chunks after IHDR (8 byte signature + 25 byte chunk)
+	var input bytes.Buffer
+	input.Write(encoded.Bytes()[:33])
+	writePNGChunk(&input, "tEXt", []byte("Comment\x00GPS!"))
+	writePNGChunk(&input, "eXIf", testEXIF(3))
+	input.Write(encoded.Bytes()[33:])
+
+	stripped, changed, err := StripImageMetadata(input.Bytes())
+	if err != nil || !changed {
+		t.Fatalf("expected metadata to be stripped, got changed=%v err=%v", changed, err)
+	}
+	if bytes.Contains(stripped, []byte("GPS!")) {
+		t.Fatalf("stripped image still contains metadata")
+	}
+	if _, err := png.Decode(bytes.NewReader(stripped)); err != nil {
+		t.Fatalf("stripped image does not decode: %v", err)
+	}
+	exifStart := bytes.Index(stripped, []byte("eXIf"))
+	if orientation, ok := tiffOrientation(stripped[exifStart+4:]); !ok || orientation != 3 {
+		t.Fatalf("expected orientation 3, got %d (ok=%v)", orientation, ok)
+	}
+}
+
+func TestStripWebPMetadata(t *testing.T) {
+	vp8x := make([]byte, 10)
+	vp8x[0] = webpFlagEXIF | webpFlagXMP
+	var body bytes.Buffer
+	body.WriteString("WEBP")
+	body.Write(webpChunk("VP8X", vp8x))
+	body.Write(webpChunk("VP8L", []byte{0x2F, 0x00, 0x00, 0x00, 0x00}))
+	body.Write(webpChunk("EXIF", testEXIF(1)))
+	body.Write(webpChunk("XMP ", []byte("<x:xmpmeta>GPS!</x:xmpmeta>")))
+	var input bytes.Buffer
+	input.WriteString("RIFF")
+	_ = binary.Write(&input, binary.LittleEndian, uint32(body.Len()))
+	input.Write(body.Bytes())
+
+	stripped, changed, err := StripImageMetadata(input.Bytes())
+	if err != nil || !changed {
+		t.Fatalf("expected metadata to be stripped, got changed=%v err=%v", changed, err)
+	}
+	if bytes.Contains(stripped, []byte("GPS!")) || bytes.Contains(stripped, []byte("EXIF")) {
+		t.Fatalf("stripped image still contains metadata")
+	}
+	if size := binary.LittleEndian.Uint32(stripped[4:]); int(size) != len(stripped)-8 {
+		t.Fatalf("RIFF size %d does not match file length %d", size, len(stripped))
+	}
+	if flags := stripped[20]; flags&(webpFlagEXIF|webpFlagXMP) != 0 {
+		t.Fatalf("VP8X flags still announce metadata: %#x", flags)
+	}
+}
+
+func TestStripImageMetadataUnsupported(t *testing.T) {
+	if _, _, err := StripImageMetadata([]byte("GIF89a")); err != ErrUnsupportedImage {
+		t.Fatalf("expected ErrUnsupportedImage, got %v", err)
+	}
+}
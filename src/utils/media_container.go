@@ -0,0 +1,298 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"time"
+)
+
+// ParseMediaContainer returns the duration and, for video, the frame size of
+// MP4/MOV, WebM/Matroska, Ogg (Opus and Vorbis), WAV and FLAC files.
+func ParseMediaContainer(data []byte) (time.Duration, int, int) {
+	switch {
+	case len(data) >= 12 && string(data[4:8]) == "ftyp":
+		return parseMP4(data)
+	case bytes.HasPrefix(data, []byte{0x1A, 0x45, 0xDF, 0xA3}):
+		return parseMatroska(data)
+	case bytes.HasPrefix(data, []byte("OggS")):
+		return parseOgg(data), 0, 0
+	case len(data) >= 12 && string(data[:4]) == "RIFF" && string(data[8:12]) == "WAVE":
+		return parseWAV(data), 0, 0
+	case bytes.HasPrefix(data, []byte("fLaC")):
+		return parseFLAC(data), 0, 0
+	}
+	return 0, 0, 0
+}
+
+// mp4Boxes calls fn for each box in data with its type and payload.
+func mp4Boxes(data []byte, fn func(boxType string, payload []byte)) {
+	for pos := 0; pos+8 <= len(data); {
+		size := int64(binary.BigEndian.Uint32(data[pos:]))
+		boxType := string(data[pos+4 : pos+8])
+		header := int64(8)
+		switch size {
+		case 0:
+			size = int64(len(data) - pos)
+		case 1:
+			if pos+16 > len(data) {
+				return
+			}
+			size = int64(binary.BigEndian.Uint64(data[pos+8:]))
+			header = 16
+		}
+		if size < header || int64(pos)+size > int64(len(data)) {
+			return
+		}
+		fn(boxType, data[int64(pos)+header:int64(pos)+size])
+		pos += int(size)
+	}
+}
+
+func parseMP4(data []byte) (duration time.Duration, width, height int) {
+	mp4Boxes(data, func(boxType string, moov []byte) {
+		if boxType != "moov" {
+			return
+		}
+		mp4Boxes(moov, func(boxType string, payload []byte) {
+			switch boxType {
+			case "mvhd":
+				duration = parseMVHD(payload)
+			case "trak":
+				mp4Boxes(payload, func(boxType string, tkhd []byte) {
+					// The track size is a 16.16 fixed-point value at the end of tkhd
+					if boxType == "tkhd" && len(tkhd) >= 8 && width == 0 {
+						width = int(binary.BigEndian.Uint32(tkhd[len(tkhd)-8:]) >> 16)
+						height = int(binary.BigEndian.Uint32(tkhd[len(tkhd)-4:]) >> 16)
+					}
+				})
+			}
+		})
+	})
+	return duration, width, height
+}
+
+func parseMVHD(payload []byte) time.Duration {
+	if len(payload) < 1 {
+		return 0
+	}
+	var timescale, units uint64
+	if payload[0] == 1 {
+		if len(payload) < 32 {
+			return 0
+		}
+		timescale = uint64(binary.BigEndian.Uint32(payload[20:]))
+		units = binary.BigEndian.Uint64(payload[24:])
+	} else {
+		if len(payload) < 20 {
+			return 0
+		}
+		timescale = uint64(binary.BigEndian.Uint32(payload[12:]))
+		units = uint64(binary.BigEndian.Uint32(payload[16:]))
+	}
+	if timescale == 0 || units == math.MaxUint32 || units == math.MaxUint64 {
+		return 0
+	}
+	return time.Duration(float64(units) / float64(timescale) * float64(time.Second))
+}
+
+const (
+	ebmlSegment       = 0x18538067
+	ebmlInfo          = 0x1549A966
+	ebmlTimecodeScale = 0x2AD7B1
+	ebmlDuration      = 0x4489
+	ebmlTracks        = 0x1654AE6B
+	ebmlTrackEntry    = 0xAE
+	ebmlVideo         = 0xE0
+	ebmlPixelWidth    = 0xB0
+	ebmlPixelHeight   = 0xBA
+	ebmlCluster       = 0x1F43B675
+)
+
+// readEBMLVarInt reads an EBML variable-length integer. IDs keep their length
+// marker bit, sizes do not. An all-ones size means unknown and is returned as -1.
+func readEBMLVarInt(data []byte, keepMarker bool) (int64, int) {
+	if len(data) == 0 || data[0] == 0 {
+		return 0, 0
+	}
+	length := 1
+	for mask := byte(0x80); data[0]&mask == 0; mask >>= 1 {
+		length++
+	}
+	if length > len(data) {
+		return 0, 0
+	}
+	value := int64(data[0])
+	if !keepMarker {
+		value &= int64(0xFF >> length)
+	}
+	allOnes := value == int64(0xFF>>length)
+	for i := 1; i < length; i++ {
+		value = value<<8 | int64(data[i])
+		allOnes = allOnes && data[i] == 0xFF
+	}
+	if !keepMarker && allOnes {
+		return -1, length
+	}
+	return value, length
+}
+
+// ebmlElements calls fn for each element in data. Elements of unknown size
+// extend to the end of data.
+func ebmlElements(data []byte, fn func(id int64, payload []byte) bool) {
+	for pos := 0; pos < len(data); {
+		id, idLength := readEBMLVarInt(data[pos:], true)
+		if idLength == 0 {
+			return
+		}
+		size, sizeLength := readEBMLVarInt(data[pos+idLength:], false)
+		if sizeLength == 0 {
+			return
+		}
+		start := pos + idLength + sizeLength
+		end := int64(len(data))
+		if size >= 0 && int64(start)+size < end {
+			end = int64(start) + size
+		}
+		if !fn(id, data[start:end]) {
+			return
+		}
+		pos = int(end)
+	}
+}
+
+func ebmlUint(payload []byte) uint64 {
+	var value uint64
+	for _, b := range payload {
+		value = value<<8 | uint64(b)
+	}
+	return value
+}
+
+func parseMatroska(data []byte) (duration time.Duration, width, height int) {
+	timecodeScale := uint64(1_000_000)
+	var rawDuration float64
+	ebmlElements(data, func(id int64, segment []byte) bool {
+		if id != ebmlSegment {
+			return true
+		}
+		ebmlElements(segment, func(id int64, payload []byte) bool {
+			switch id {
+			case ebmlInfo:
+				ebmlElements(payload, func(id int64, value []byte) bool {
+					switch {
+					case id == ebmlTimecodeScale:
+						timecodeScale = ebmlUint(value)
+					case id == ebmlDuration && len(value) == 4:
+						rawDuration = float64(math.Float32frombits(binary.BigEndian.Uint32(value)))
+					case id == ebmlDuration && len(value) == 8:
+						rawDuration = math.Float64frombits(binary.BigEndian.Uint64(value))
+					}
+					return true
+				})
+			case ebmlTracks:
+				ebmlElements(payload, func(id int64, entry []byte) bool {
+					if id == ebmlTrackEntry {
+						ebmlElements(entry, func(id int64, video []byte) bool {
+							if id == ebmlVideo && width == 0 {
+								ebmlElements(video, func(id int64, value []byte) bool {
+									switch id {
+									case ebmlPixelWidth:
+										width = int(ebmlUint(value))
+									case ebmlPixelHeight:
+										height = int(ebmlUint(value))
+									}
+									return true
+								})
+							}
+							return true
+						})
+					}
+					return true
+				})
+			case ebmlCluster:
+				// Media data follows, the headers are done
+				return false
+			}
+			return true
+		})
+		return false
+	})
+	duration = time.Duration(rawDuration * float64(timecodeScale))
+	return duration, width, height
+}
+
+// parseOgg reads the sample rate from the Opus or Vorbis header and the
+// granule position of the last page.
+func parseOgg(data []byte) time.Duration {
+	if len(data) < 28 {
+		return 0
+	}
+	segments := int(data[26])
+	packetStart := 27 + segments
+	if packetStart >= len(data) {
+		return 0
+	}
+	packet := data[packetStart:]
+	var sampleRate, preSkip uint64
+	switch {
+	case bytes.HasPrefix(packet, []byte("OpusHead")) && len(packet) >= 12:
+		// Opus granule positions always count 48 kHz samples
+		sampleRate = 48000
+		preSkip = uint64(binary.LittleEndian.Uint16(packet[10:]))
+	case bytes.HasPrefix(packet, []byte("\x01vorbis")) && len(packet) >= 16:
+		sampleRate = uint64(binary.LittleEndian.Uint32(packet[12:]))
+	default:
+		return 0
+	}
+	last := bytes.LastIndex(data, []byte("OggS"))
+	if last < 0 || last+14 > len(data) || sampleRate == 0 {
+		return 0
+	}
+	granule := binary.LittleEndian.Uint64(data[last+6:])
+	if granule == math.MaxUint64 || granule < preSkip {
+		return 0
+	}
+	return time.Duration(float64(granule-preSkip) / float64(sampleRate) * float64(time.Second))
+}
+
+func parseWAV(data []byte) time.Duration {
+	var byteRate uint32
+	for pos := 12; pos+8 <= len(data); {
+		chunkID := string(data[pos : pos+4])
+		size := int(binary.LittleEndian.Uint32(data[pos+4:]))
+		payload := data[pos+8:]
+		switch chunkID {
+		case "fmt ":
+			if len(payload) >= 12 {
+				byteRate = binary.LittleEndian.Uint32(payload[8:])
+			}
+		case "data":
+			if byteRate == 0 {
+				return 0
+			}
+			// Streamed files may have a placeholder size, trust the file length
+			if size > len(payload) || size <= 0 {
+				size = len(payload)
+			}
+			return time.Duration(float64(size) / float64(byteRate) * float64(time.Second))
+		}
+		pos += 8 + size + size%2
+	}
+	return 0
+}
+
+// parseFLAC reads the sample rate and total samples from STREAMINFO, which is
+// always the first metadata block.
+func parseFLAC(data []byte) time.Duration {
+	if len(data) < 4+4+34 || data[4]&0x7F != 0 {
+		return 0
+	}
+	info := data[8:]
+	sampleRate := uint64(info[10])<<12 | uint64(info[11])<<4 | uint64(info[12])>>4
+	totalSamples := uint64(info[13]&0x0F)<<32 | uint64(binary.BigEndian.Uint32(info[14:]))
+	if sampleRate == 0 {
+		return 0
+	}
+	return time.Duration(float64(totalSamples) / float64(sampleRate) * float64(time.Second))
+}
@@ -13,6 +13,14 @@ type MediaRef struct {
 	Path     string `json:"path"`
 	FileName string `json:"file_name"`
 	MimeType string `json:"mime_type"`
+	// Thumbnail makes the proxy serve a scaled-down JPEG of the image.
+	Thumbnail bool `json:"thumbnail,omitempty"`
+	// Version tells apart the contents of a file that was replaced in place,
+	// so clients do not show a cached copy of the previous version.
+	Version string `json:"version,omitempty"`
+	// Storage names the storage backend holding the file; empty for the
+	// Nextcloud account.
+	Storage string `json:"storage,omitempty"`
 }
 
 var ErrInvalidMediaID = errors.New("invalid media id")
@@ -0,0 +1,81 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"strings"
+	"time"
+)
+
+// MediaInfo holds what AnalyzeMedia could find out about a file. Zero values
+// mean unknown.
+type MediaInfo struct {
+	Width    int
+	Height   int
+	Duration time.Duration
+	BlurHash string
+	// Image is the decoded, upright image for JPEG, PNG and GIF files, used to
+	// render thumbnails.
+	Image image.Image
+}
+
+// AnalyzeMedia reads dimensions and a blurhash from images and the duration
+// (and video dimensions) from MP4, WebM/Matroska, Ogg, WAV and FLAC files.
+// Only container headers are parsed; unknown formats return an empty result.
+func AnalyzeMedia(data []byte, mimeType string) MediaInfo {
+	major, _, _ := strings.Cut(strings.ToLower(mimeType), "/")
+	var info MediaInfo
+	switch major {
+	case "image":
+		info.Width, info.Height = ImageDimensions(data)
+		if img, err := DecodeImage(data); err == nil {
+			info.Image = img
+			xComponents, yComponents := BlurHashComponents(info.Width, info.Height)
+			info.BlurHash, _ = EncodeBlurHash(img, xComponents, yComponents)
+		}
+	case "video", "audio", "application":
+		info.Duration, info.Width, info.Height = ParseMediaContainer(data)
+	}
+	return info
+}
+
+// ImageDimensions returns the displayed size of an image, taking the EXIF
+// orientation into account. WebP sizes are read from the file header.
+func ImageDimensions(data []byte) (int, int) {
+	width, height := 0, 0
+	if config, _, err := image.DecodeConfig(bytes.NewReader(data)); err == nil {
+		width, height = config.Width, config.Height
+	} else {
+		width, height = webpDimensions(data)
+	}
+	if ImageOrientation(data) >= 5 {
+		width, height = height, width
+	}
+	return width, height
+}
+
+func webpDimensions(data []byte) (int, int) {
+	if len(data) < 30 || string(data[:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return 0, 0
+	}
+	payload := data[20:]
+	switch string(data[12:16]) {
+	case "VP8X":
+		width := int(payload[4]) | int(payload[5])<<8 | int(payload[6])<<16
+		height := int(payload[7]) | int(payload[8])<<8 | int(payload[9])<<16
+		return width + 1, height + 1
+	case "VP8L":
+		if payload[0] != 0x2F {
+			return 0, 0
+		}
+		bits := binary.LittleEndian.Uint32(payload[1:5])
+		return int(bits&0x3FFF) + 1, int(bits>>14&0x3FFF) + 1
+	case "VP8 ":
+		if payload[3] != 0x9D || payload[4] != 0x01 || payload[5] != 0x2A {
+			return 0, 0
+		}
+		return int(binary.LittleEndian.Uint16(payload[6:]) & 0x3FFF), int(binary.LittleEndian.Uint16(payload[8:]) & 0x3FFF)
+	}
+	return 0, 0
+}
@@ -0,0 +1,208 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestEncodeBlurHash(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 64, 48))
+	for y := 0; y < 48; y++ {
+		for x := 0; x < 64; x++ {
+			img.Set(x, y, color.RGBA{R: 255, A: 255})
+		}
+	}
+	hash, err := EncodeBlurHash(img, 4, 3)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// Size flag, maximum AC value, DC and 11 AC components
+	if len(hash) != 1+1+4+2*11 {
+		t.Fatalf("unexpected blurhash length %d: %s", len(hash), hash)
+	}
+	var dc strings83
+	dc.encode(0xFF0000, 4)
+	if hash[:1] != "L" || hash[2:6] != string(dc) {
+		t.Fatalf("unexpected blurhash prefix %s", hash)
+	}
+	if xComponents, yComponents := BlurHashComponents(1000, 250); xComponents != 4 || yComponents != 2 {
+		t.Fatalf("unexpected components %dx%d", xComponents, yComponents)
+	}
+}
+
+type strings83 []byte
+
+func (s *strings83) encode(value, length int) {
+	for i := 1; i <= length; i++ {
+		*s = append(*s, blurHashCharacters[(value/int(math.Pow(83, float64(length-i))))%83])
+	}
+}
+
+func TestImageOrientationAndDimensions(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 4, 2))
+	img.Set(0, 0, color.RGBA{R: 255, A: 255})
+	rotated := ApplyOrientation(img, 6)
+	if rotated.Bounds().Dx() != 2 || rotated.Bounds().Dy() != 4 {
+		t.Fatalf("expected 2x4 after rotation, got %v", rotated.Bounds())
+	}
+	// The top-left pixel moves to the top-right when rotating clockwise
+	if r, _, _, _ := rotated.At(1, 0).RGBA(); r != 0xFFFF {
+		t.Fatalf("expected red pixel at top-right after rotation")
+	}
+
+	var encoded bytes.Buffer
+	if err := png.Encode(&encoded, img); err != nil {
+		t.Fatalf("failed to encode: %v", err)
+	}
+	var withOrientation bytes.Buffer
+	withOrientation.Write(encoded.Bytes()[:33])
+	writePNGChunk(&withOrientation, "eXIf", orientationTIFF(6))
+	withOrientation.Write(encoded.Bytes()[33:])
+	if width, height := ImageDimensions(withOrientation.Bytes()); width != 2 || height != 4 {
+		t.Fatalf("expected displayed size 2x4, got %dx%d", width, height)
+	}
+	info := AnalyzeMedia(withOrientation.Bytes(), "image/png")
+	if info.BlurHash == "" || info.Image == nil {
+		t.Fatalf("expected blurhash and decoded image, got %+v", info)
+	}
+}
+
+func TestWebPOrientation(t *testing.T) {
+	vp8x := webpChunk("VP8X", []byte{webpFlagEXIF, 0, 0, 0, 3, 0, 0, 1, 0, 0})
+	exif := webpChunk("EXIF", orientationTIFF(6))
+	webp := func(chunks ...[]byte) []byte {
+		body := append([]byte("WEBP"), bytes.Join(chunks, nil)...)
+		header := binary.LittleEndian.AppendUint32([]byte("RIFF"), uint32(len(body)))
+		return append(header, body...)
+	}
+	if orientation := ImageOrientation(webp(vp8x, exif)); orientation != 6 {
+		t.Fatalf("expected orientation 6, got %d", orientation)
+	}
+	// The name of a chunk inside another chunk is not an EXIF chunk
+	if orientation := ImageOrientation(webp(webpChunk("ICCP", append([]byte("EXIF"), exif...)))); orientation != 1 {
+		t.Fatalf("expected no orientation for nested chunk name, got %d", orientation)
+	}
+
+	// Truncated and malformed files must not panic
+	full := webp(vp8x, exif)
+	for _, data := range [][]byte{
+		[]byte("RIFF0000WEBPEXIF"),
+		[]byte("RIFF0000WEBPVP8X"),
+		[]byte("RIFF0000WEBPEXIF\xff\xff\xff\xff"),
+		full[:len(full)-4],
+		full[:12+len(vp8x)+6],
+	} {
+		if orientation := ImageOrientation(data); orientation != 1 {
+			t.Fatalf("expected orientation 1 for truncated %q, got %d", data, orientation)
+		}
+		info := AnalyzeMedia(data, "image/webp")
+		if info.Image != nil {
+			t.Fatalf("expected no image for truncated %q", data)
+		}
+	}
+}
+
+func TestThumbnailSize(t *testing.T) {
+	if width, height := ThumbnailSize(4000, 3000, 800, 600); width != 800 || height != 600 {
+		t.Fatalf("unexpected size %dx%d", width, height)
+	}
+	if width, height := ThumbnailSize(1000, 4000, 800, 600); width != 150 || height != 600 {
+		t.Fatalf("unexpected size %dx%d", width, height)
+	}
+	if width, height := ThumbnailSize(300, 200, 800, 600); width != 300 || height != 200 {
+		t.Fatalf("small images should keep their size, got %dx%d", width, height)
+	}
+}
+
+func mp4Box(boxType string, payload ...[]byte) []byte {
+	body := bytes.Join(payload, nil)
+	box := make([]byte, 8, 8+len(body))
+	binary.BigEndian.PutUint32(box, uint32(8+len(body)))
+	copy(box[4:], boxType)
+	return append(box, body...)
+}
+
+func ebmlElement(id []byte, payload ...[]byte) []byte {
+	body := bytes.Join(payload, nil)
+	element := append([]byte(nil), id...)
+	// 8-byte size: 0x01 marker followed by 7 bytes
+	size := make([]byte, 8)
+	binary.BigEndian.PutUint64(size, uint64(len(body)))
+	size[0] = 0x01
+	element = append(element, size...)
+	return append(element, body...)
+}
+
+func TestParseMediaContainer(t *testing.T) {
+	mvhd := make([]byte, 100)
+	binary.BigEndian.PutUint32(mvhd[12:], 1000)  // timescale
+	binary.BigEndian.PutUint32(mvhd[16:], 12500) // duration
+	tkhd := make([]byte, 84)
+	binary.BigEndian.PutUint32(tkhd[76:], 1920<<16)
+	binary.BigEndian.PutUint32(tkhd[80:], 1080<<16)
+	mp4 := append(mp4Box("ftyp", []byte("isom")), mp4Box("moov", mp4Box("mvhd", mvhd), mp4Box("trak", mp4Box("tkhd", tkhd)))...)
+
+	duration := make([]byte, 8)
+	binary.BigEndian.PutUint64(duration, math.Float64bits(3500))
+	webm := append(ebmlElement([]byte{0x1A, 0x45, 0xDF, 0xA3}), ebmlElement([]byte{0x18, 0x53, 0x80, 0x67},
+		ebmlElement([]byte{0x15, 0x49, 0xA9, 0x66}, ebmlElement([]byte{0x44, 0x89}, duration)),
+		ebmlElement([]byte{0x16, 0x54, 0xAE, 0x6B}, ebmlElement([]byte{0xAE}, ebmlElement([]byte{0xE0},
+			ebmlElement([]byte{0xB0}, []byte{0x02, 0x80}), ebmlElement([]byte{0xBA}, []byte{0x01, 0xE0})))),
+		ebmlElement([]byte{0x1F, 0x43, 0xB6, 0x75}, []byte("cluster data")),
+	)...)
+
+	oggPage := func(granule uint64, packet []byte) []byte {
+		page := make([]byte, 27, 28+len(packet))
+		copy(page, "OggS")
+		binary.LittleEndian.PutUint64(page[6:], granule)
+		page[26] = 1
+		page = append(page, byte(len(packet)))
+		return append(page, packet...)
+	}
+	opusHead := []byte("OpusHead\x01\x02")
+	opusHead = binary.LittleEndian.AppendUint16(opusHead, 312)
+	opusHead = append(opusHead, make([]byte, 7)...)
+	ogg := append(oggPage(0, opusHead), oggPage(312+48000*2, []byte("audio"))...)
+
+	wav := []byte("RIFF\x00\x00\x00\x00WAVEfmt ")
+	wav = binary.LittleEndian.AppendUint32(wav, 16)
+	format := make([]byte, 16)
+	binary.LittleEndian.PutUint32(format[8:], 16000) // byte rate
+	wav = append(wav, format...)
+	wav = append(wav, "data"...)
+	wav = binary.LittleEndian.AppendUint32(wav, 24000)
+	wav = append(wav, make([]byte, 24000)...)
+
+	flac := []byte("fLaC\x80\x00\x00\x22")
+	streamInfo := make([]byte, 34)
+	// 44100 Hz in 20 bits, then channels/bps, then 36 bits of total samples
+	streamInfo[10], streamInfo[11], streamInfo[12] = 0x0A, 0xC4, 0x40
+	binary.BigEndian.PutUint32(streamInfo[14:], 44100*3)
+	flac = append(flac, streamInfo...)
+
+	cases := []struct {
+		name          string
+		data          []byte
+		duration      time.Duration
+		width, height int
+	}{
+		{"mp4", mp4, 12500 * time.Millisecond, 1920, 1080},
+		{"webm", webm, 3500 * time.Millisecond, 640, 480},
+		{"ogg", ogg, 2 * time.Second, 0, 0},
+		{"wav", wav, 1500 * time.Millisecond, 0, 0},
+		{"flac", flac, 3 * time.Second, 0, 0},
+		{"unknown", []byte("ID3 mp3 data"), 0, 0, 0},
+	}
+	for _, tc := range cases {
+		duration, width, height := ParseMediaContainer(tc.data)
+		if duration != tc.duration || width != tc.width || height != tc.height {
+			t.Fatalf("%s: expected %v %dx%d, got %v %dx%d", tc.name, tc.duration, tc.width, tc.height, duration, width, height)
+		}
+	}
+}
@@ -0,0 +1,316 @@
+package utils
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// PathTemplateVariables lists the variables supported in path templates.
+var PathTemplateVariables = []string{
+	"year", "month", "day", "hour", "week", "isoyear",
+	"room", "room_id", "room_name", "room_alias",
+	"user", "displayname", "sender_server",
+	"file", "basename", "ext",
+	"msgtype", "mimetype_major",
+	"event_id", "hash8",
+}
+
+// pathTemplateFilters maps filter names to whether they take an argument.
+var pathTemplateFilters = map[string]bool{
+	"lower":    false,
+	"upper":    false,
+	"slug":     false,
+	"truncate": true,
+}
+
+// PathTemplate is a parsed path template such as
+// "/media/${year}/${room|slug|unknown}/${file}".
+//
+// A placeholder is ${name} optionally followed by |-separated segments. A
+// segment naming a filter (lower, upper, slug, truncate:N) transforms the
+// value; any other segment is a default used when the value is empty.
+// Segments are applied left to right. Segments written like a filter with an
+// argument but naming no filter, such as "trunc:20", are rejected.
+type PathTemplate struct {
+	parts []templatePart
+}
+
+type templatePart struct {
+	literal  string
+	variable string
+	steps    []templateStep
+}
+
+type templateStep struct {
+	filter   string
+	arg      int
+	fallback string
+}
+
+// ParsePathTemplate parses a template and rejects unknown variables and
+// malformed placeholders.
+func ParsePathTemplate(template string) (*PathTemplate, error) {
+	parsed := &PathTemplate{}
+	rest := template
+	for {
+		start := strings.Index(rest, "${")
+		if start < 0 {
+			if rest != "" {
+				parsed.parts = append(parsed.parts, templatePart{literal: rest})
+			}
+			return parsed, nil
+		}
+		if start > 0 {
+			parsed.parts = append(parsed.parts, templatePart{literal: rest[:start]})
+		}
+		end := strings.Index(rest[start:], "}")
+		if end < 0 {
+			return nil, fmt.Errorf("unterminated placeholder %q", rest[start:])
+		}
+		part, err := parsePlaceholder(rest[start+2 : start+end])
+		if err != nil {
+			return nil, err
+		}
+		parsed.parts = append(parsed.parts, part)
+		rest = rest[start+end+1:]
+	}
+}
+
+func parsePlaceholder(body string) (templatePart, error) {
+	segments := strings.Split(body, "|")
+	name := strings.TrimSpace(segments[0])
+	if !isTemplateVariable(name) {
+		return templatePart{}, fmt.Errorf("unknown variable ${%s}", name)
+	}
+	part := templatePart{variable: name}
+	for _, segment := range segments[1:] {
+		filterName, arg, hasArg := strings.Cut(segment, ":")
+		takesArg, isFilter := pathTemplateFilters[filterName]
+		if !isFilter {
+			if suggestion, ok := misspelledFilter(segment); ok {
+				return templatePart{}, fmt.Errorf("unknown filter %q in ${%s}%s", segment, body, suggestion)
+			}
+			part.steps = append(part.steps, templateStep{fallback: segment})
+			continue
+		}
+		step := templateStep{filter: filterName}
+		if takesArg {
+			if !hasArg {
+				return templatePart{}, fmt.Errorf("filter %s in ${%s} requires an argument, e.g. %s:20", filterName, body, filterName)
+			}
+			length, err := strconv.Atoi(arg)
+			if err != nil || length <= 0 {
+				return templatePart{}, fmt.Errorf("filter %s in ${%s} needs a positive number, got %q", filterName, body, arg)
+			}
+			step.arg = length
+		} else if hasArg {
+			return templatePart{}, fmt.Errorf("filter %s in ${%s} does not take an argument", filterName, body)
+		}
+		part.steps = append(part.steps, step)
+	}
+	return part, nil
+}
+
+var filterCallSegment = regexp.MustCompile(`^[a-z_]+:[0-9]+$`)
+
+// misspelledFilter reports whether a default is written like a filter with an
+// argument, such as "trunc:20", which is never meant as a value. Plain words
+// are defaults, even if they resemble a filter name. It returns a suggestion
+// for the error message.
+func misspelledFilter(segment string) (string, bool) {
+	if !filterCallSegment.MatchString(segment) {
+		return "", false
+	}
+	name, _, _ := strings.Cut(segment, ":")
+	for filter, takesArg := range pathTemplateFilters {
+		if takesArg && editDistance(name, filter) <= len(filter)/2 {
+			return fmt.Sprintf(", did you mean %s?", filter), true
+		}
+	}
+	return "", true
+}
+
+// editDistance returns the optimal string alignment distance: the number of
+// inserted, deleted, replaced or swapped adjacent characters.
+func editDistance(a, b string) int {
+	previous2 := make([]int, len(b)+1)
+	previous := make([]int, len(b)+1)
+	current := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+			if i > 1 && j > 1 && a[i-1] == b[j-2] && a[i-2] == b[j-1] {
+				current[j] = min(current[j], previous2[j-2]+1)
+			}
+		}
+		previous2, previous, current = previous, current, previous2
+	}
+	return previous[len(b)]
+}
+
+func isTemplateVariable(name string) bool {
+	for _, variable := range PathTemplateVariables {
+		if variable == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Uses reports whether the template references the given variable, so callers
+// can skip expensive lookups for variables that are not needed.
+func (t *PathTemplate) Uses(variable string) bool {
+	for _, part := range t.parts {
+		if part.variable == variable {
+			return true
+		}
+	}
+	return false
+}
+
+// Variables returns the variables referenced by the template.
+func (t *PathTemplate) Variables() []string {
+	var variables []string
+	for _, part := range t.parts {
+		if part.variable != "" {
+			variables = append(variables, part.variable)
+		}
+	}
+	return variables
+}
+
+// Segments splits the template at "/" into one template per path segment.
+// Empty segments from leading or doubled slashes are dropped.
+func (t *PathTemplate) Segments() []*PathTemplate {
+	var segments []*PathTemplate
+	current := &PathTemplate{}
+	for _, part := range t.parts {
+		if part.variable != "" {
+			current.parts = append(current.parts, part)
+			continue
+		}
+		for i, piece := range strings.Split(part.literal, "/") {
+			if i > 0 {
+				if len(current.parts) > 0 {
+					segments = append(segments, current)
+				}
+				current = &PathTemplate{}
+			}
+			if piece != "" {
+				current.parts = append(current.parts, templatePart{literal: piece})
+			}
+		}
+	}
+	if len(current.parts) > 0 {
+		segments = append(segments, current)
+	}
+	return segments
+}
+
+// Render substitutes the variables and returns a cleaned path. Every value is
+// passed through SanitizePathSegment after filters and defaults are applied.
+func (t *PathTemplate) Render(vars map[string]string) string {
+	var builder strings.Builder
+	for _, part := range t.parts {
+		if part.variable == "" {
+			builder.WriteString(part.literal)
+			continue
+		}
+		value := vars[part.variable]
+		for _, step := range part.steps {
+			value = step.apply(value)
+		}
+		builder.WriteString(SanitizePathSegment(value))
+	}
+	return path.Clean(builder.String())
+}
+
+// RenderText substitutes the variables without sanitizing them as path
+// segments, for templates that produce names rather than paths.
+func (t *PathTemplate) RenderText(vars map[string]string) string {
+	var builder strings.Builder
+	for _, part := range t.parts {
+		if part.variable == "" {
+			builder.WriteString(part.literal)
+			continue
+		}
+		value := vars[part.variable]
+		for _, step := range part.steps {
+			value = step.apply(value)
+		}
+		builder.WriteString(value)
+	}
+	return strings.TrimSpace(builder.String())
+}
+
+func (s templateStep) apply(value string) string {
+	switch s.filter {
+	case "lower":
+		return strings.ToLower(value)
+	case "upper":
+		return strings.ToUpper(value)
+	case "slug":
+		return Slugify(value)
+	case "truncate":
+		if utf8.RuneCountInString(value) > s.arg {
+			return string([]rune(value)[:s.arg])
+		}
+		return value
+	default:
+		if value == "" {
+			return s.fallback
+		}
+		return value
+	}
+}
+
+var slugInvalid = regexp.MustCompile(`[^\p{L}\p{N}]+`)
+
+// Slugify lower-cases the value and collapses everything except letters and
+// digits into single dashes.
+func Slugify(value string) string {
+	return strings.Trim(slugInvalid.ReplaceAllString(strings.ToLower(value), "-"), "-")
+}
+
+// TimeTemplateVariables returns the date variables for a timestamp in UTC.
+func TimeTemplateVariables(eventTime time.Time) map[string]string {
+	if eventTime.IsZero() {
+		eventTime = time.Now()
+	}
+	eventTime = eventTime.UTC()
+	// The first days of January can belong to the last week of the previous
+	// year, so week is used together with isoyear
+	isoYear, week := eventTime.ISOWeek()
+	return map[string]string{
+		"year":    fmt.Sprintf("%d", eventTime.Year()),
+		"month":   fmt.Sprintf("%02d", eventTime.Month()),
+		"day":     fmt.Sprintf("%02d", eventTime.Day()),
+		"hour":    fmt.Sprintf("%02d", eventTime.Hour()),
+		"week":    fmt.Sprintf("%02d", week),
+		"isoyear": fmt.Sprintf("%d", isoYear),
+	}
+}
+
+// FileTemplateVariables returns file, basename and ext for a filename. The
+// extension is returned without the leading dot.
+func FileTemplateVariables(filename string) map[string]string {
+	ext := path.Ext(filename)
+	return map[string]string{
+		"file":     filename,
+		"basename": strings.TrimSuffix(filename, ext),
+		"ext":      strings.TrimPrefix(ext, "."),
+	}
+}
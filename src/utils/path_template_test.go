@@ -0,0 +1,79 @@
+package utils
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPathTemplateRender(t *testing.T) {
+	vars := TimeTemplateVariables(time.Date(2024, 5, 20, 7, 0, 0, 0, time.UTC))
+	for key, value := range FileTemplateVariables("Holiday Photo.JPG") {
+		vars[key] = value
+	}
+	vars["room"] = "Team Room: Ostsee"
+	vars["msgtype"] = "image"
+
+	cases := map[string]string{
+		"/media/${year}/${month}/${day}/${file}":                "/media/2024/05/20/Holiday Photo.JPG",
+		"/media/${msgtype}/${isoyear}-W${week}/${hour}/${file}": "/media/image/2024-W21/07/Holiday Photo.JPG",
+		"/media/${room|slug}/${basename|lower}.${ext|lower}":    "/media/team-room-ostsee/holiday photo.jpg",
+		"/media/${room_alias|no-alias}/${file}":                 "/media/no-alias/Holiday Photo.JPG",
+		"/media/${room_alias}/${file}":                          "/media/unknown/Holiday Photo.JPG",
+		"/media/${room|truncate:4|upper}/${file}":               "/media/TEAM/Holiday Photo.JPG",
+		"/media/${room_alias|tower}/${user|lover}/${file}":      "/media/tower/lover/Holiday Photo.JPG",
+		"/media/${room}/${file}":                                "/media/Team Room_ Ostsee/Holiday Photo.JPG",
+	}
+	for template, expected := range cases {
+		parsed, err := ParsePathTemplate(template)
+		if err != nil {
+			t.Fatalf("%s: parse failed: %v", template, err)
+		}
+		if rendered := parsed.Render(vars); rendered != expected {
+			t.Fatalf("%s: expected %q, got %q", template, expected, rendered)
+		}
+	}
+}
+
+func TestPathTemplateRenderText(t *testing.T) {
+	vars := map[string]string{"room": "Team Room: Ostsee", "msgtype": "image"}
+	cases := map[string]string{
+		"room:${room}":          "room:Team Room: Ostsee",
+		"room:${room|slug}":     "room:team-room-ostsee",
+		"type:${msgtype}":       "type:image",
+		"${room_alias|no-room}": "no-room",
+		" ${room_alias} ":       "",
+	}
+	for template, expected := range cases {
+		parsed, err := ParsePathTemplate(template)
+		if err != nil {
+			t.Fatalf("%s: parse failed: %v", template, err)
+		}
+		if rendered := parsed.RenderText(vars); rendered != expected {
+			t.Fatalf("%s: expected %q, got %q", template, expected, rendered)
+		}
+	}
+}
+
+func TestTimeTemplateVariablesISOYear(t *testing.T) {
+	// 2027-01-01 is a Friday in the last ISO week of 2026
+	vars := TimeTemplateVariables(time.Date(2027, 1, 1, 12, 0, 0, 0, time.UTC))
+	if vars["year"] != "2027" || vars["isoyear"] != "2026" || vars["week"] != "53" {
+		t.Fatalf("unexpected date variables %v", vars)
+	}
+}
+
+func TestParsePathTemplateErrors(t *testing.T) {
+	for _, template := range []string{
+		"/media/${roomname}/${file}",
+		"/media/${room/${file}",
+		"/media/${room|truncate}/${file}",
+		"/media/${room|truncate:x}/${file}",
+		"/media/${room|lower:3}/${file}",
+		"/media/${room|trunc:20}/${file}",
+		"/media/${room|size:20}/${file}",
+	} {
+		if _, err := ParsePathTemplate(template); err == nil {
+			t.Fatalf("%s: expected parse error", template)
+		}
+	}
+}
@@ -7,30 +7,6 @@ import (
 	"time"
 )
 
-// RenderPathTemplate renders a path template with the given variables
-// Supported variables: ${year}, ${month}, ${day}, ${room}, ${user}, ${file}
-func RenderPathTemplate(template, roomName, user, filename string, eventTime time.Time) string {
-	if eventTime.IsZero() {
-		eventTime = time.Now()
-	}
-
-	replacements := map[string]string{
-		"${year}":  fmt.Sprintf("%d", eventTime.Year()),
-		"${month}": fmt.Sprintf("%02d", eventTime.Month()),
-		"${day}":   fmt.Sprintf("%02d", eventTime.Day()),
-		"${room}":  roomName,
-		"${user}":  user,
-		"${file}":  filename,
-	}
-
-	result := template
-	for placeholder, value := range replacements {
-		result = strings.ReplaceAll(result, placeholder, value)
-	}
-
-	return path.Clean(result)
-}
-
 func GenerateNextcloudPath(basePath, channel, user, filename string) string {
 	year := time.Now().Year()
 	return fmt.Sprintf("%s/%d/%s/%s/%s", basePath, year, channel, user, filename)
@@ -0,0 +1,189 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif" // Register GIF for DecodeImage
+	"image/jpeg"
+	_ "image/png" // Register PNG for DecodeImage
+)
+
+// maxDecodePixels limits the images DecodeImage accepts, to keep memory use
+// bounded for huge or malicious images.
+const maxDecodePixels = 50_000_000
+
+// DecodeImage decodes a JPEG, PNG or GIF image and applies its EXIF
+// orientation, so the result is upright.
+func DecodeImage(data []byte) (image.Image, error) {
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if config.Width*config.Height > maxDecodePixels {
+		return nil, fmt.Errorf("image too large to decode (%dx%d)", config.Width, config.Height)
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	return ApplyOrientation(img, ImageOrientation(data)), nil
+}
+
+// ImageOrientation returns the EXIF orientation (1-8) of a JPEG, PNG or WebP
+// image, or 1 if there is none.
+func ImageOrientation(data []byte) uint16 {
+	var tiff []byte
+	switch {
+	case bytes.HasPrefix(data, []byte{0xFF, 0xD8}):
+		pos := 2
+		for pos+4 <= len(data) && data[pos] == 0xFF {
+			marker := data[pos+1]
+			length := int(data[pos+2])<<8 | int(data[pos+3])
+			if marker == 0xDA || length < 2 || pos+2+length > len(data) {
+				break
+			}
+			payload := data[pos+4 : pos+2+length]
+			if marker == 0xE1 && bytes.HasPrefix(payload, jpegExifHeader) {
+				tiff = payload[len(jpegExifHeader):]
+				break
+			}
+			pos += 2 + length
+		}
+	case bytes.HasPrefix(data, pngSignature):
+		if start := bytes.Index(data, []byte("eXIf")); start >= 4 {
+			length := int(data[start-4])<<24 | int(data[start-3])<<16 | int(data[start-2])<<8 | int(data[start-1])
+			if start+4+length <= len(data) {
+				tiff = data[start+4 : start+4+length]
+			}
+		}
+	case len(data) >= 12 && string(data[:4]) == "RIFF" && string(data[8:12]) == "WEBP":
+		pos := 12
+		for pos+8 <= len(data) {
+			size := int(binary.LittleEndian.Uint32(data[pos+4:]))
+			end := pos + 8 + size
+			if end > len(data) {
+				break
+			}
+			if string(data[pos:pos+4]) == "EXIF" {
+				tiff = bytes.TrimPrefix(data[pos+8:end], jpegExifHeader)
+				break
+			}
+			pos = end + size%2
+		}
+	}
+	if orientation, ok := tiffOrientation(tiff); ok {
+		return orientation
+	}
+	return 1
+}
+
+// ApplyOrientation rotates and mirrors an image according to its EXIF
+// orientation.
+func ApplyOrientation(img image.Image, orientation uint16) image.Image {
+	if orientation < 2 || orientation > 8 {
+		return img
+	}
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	outWidth, outHeight := width, height
+	if orientation >= 5 {
+		outWidth, outHeight = height, width
+	}
+	out := image.NewRGBA(image.Rect(0, 0, outWidth, outHeight))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2: // mirrored horizontally
+				dx, dy = width-1-x, y
+			case 3: // rotated 180°
+				dx, dy = width-1-x, height-1-y
+			case 4: // mirrored vertically
+				dx, dy = x, height-1-y
+			case 5: // mirrored along the top-left diagonal
+				dx, dy = y, x
+			case 6: // rotated 90° clockwise
+				dx, dy = height-1-y, x
+			case 7: // mirrored along the top-right diagonal
+				dx, dy = height-1-y, width-1-x
+			case 8: // rotated 90° counter-clockwise
+				dx, dy = y, width-1-x
+			}
+			out.Set(dx, dy, img.At(bounds.Min.X+x, bounds.Min.Y+y))
+		}
+	}
+	return out
+}
+
+// ResizeImage scales an image down to fit within maxWidth by maxHeight,
+// averaging the source pixels covered by each target pixel. Images that
+// already fit are returned unchanged.
+func ResizeImage(img image.Image, maxWidth, maxHeight int) image.Image {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	outWidth, outHeight := ThumbnailSize(width, height, maxWidth, maxHeight)
+	if outWidth == width && outHeight == height {
+		return img
+	}
+	out := image.NewRGBA(image.Rect(0, 0, outWidth, outHeight))
+	for y := 0; y < outHeight; y++ {
+		y0 := bounds.Min.Y + y*height/outHeight
+		y1 := max(y0+1, bounds.Min.Y+(y+1)*height/outHeight)
+		for x := 0; x < outWidth; x++ {
+			x0 := bounds.Min.X + x*width/outWidth
+			x1 := max(x0+1, bounds.Min.X+(x+1)*width/outWidth)
+			var r, g, b, a, count uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					pr, pg, pb, pa := img.At(sx, sy).RGBA()
+					r += uint64(pr)
+					g += uint64(pg)
+					b += uint64(pb)
+					a += uint64(pa)
+					count++
+				}
+			}
+			out.Set(x, y, color.RGBA64{
+				R: uint16(r / count),
+				G: uint16(g / count),
+				B: uint16(b / count),
+				A: uint16(a / count),
+			})
+		}
+	}
+	return out
+}
+
+// ThumbnailSize returns the size of an image scaled down to fit within
+// maxWidth by maxHeight, keeping the aspect ratio.
+func ThumbnailSize(width, height, maxWidth, maxHeight int) (int, int) {
+	if width <= maxWidth && height <= maxHeight {
+		return width, height
+	}
+	scale := min(float64(maxWidth)/float64(width), float64(maxHeight)/float64(height))
+	return max(1, int(float64(width)*scale+0.5)), max(1, int(float64(height)*scale+0.5))
+}
+
+// EncodeThumbnail scales an image to fit within maxWidth by maxHeight and
+// encodes it as JPEG. Transparent areas become white.
+func EncodeThumbnail(img image.Image, maxWidth, maxHeight int) ([]byte, image.Point, error) {
+	resized := ResizeImage(img, maxWidth, maxHeight)
+	bounds := resized.Bounds()
+	opaque := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	for y := 0; y < bounds.Dy(); y++ {
+		for x := 0; x < bounds.Dx(); x++ {
+			r, g, b, a := resized.At(bounds.Min.X+x, bounds.Min.Y+y).RGBA()
+			// Composite premultiplied colors over white
+			white := 0xFFFF - a
+			opaque.Set(x, y, color.RGBA64{R: uint16(r + white), G: uint16(g + white), B: uint16(b + white), A: 0xFFFF})
+		}
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, opaque, &jpeg.Options{Quality: 80}); err != nil {
+		return nil, image.Point{}, err
+	}
+	return buf.Bytes(), image.Point{X: bounds.Dx(), Y: bounds.Dy()}, nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"maunium.net/go/mautrix/appservice"
+
+	"nextcloud-media-bridge/src/handlers"
+)
+
+func runVerifyReplicas(args []string) int {
+	flags, configPath := newCommandFlags("verify-replicas")
+	repair := flags.Bool("repair", false, "copy missing or different files to the mirror and restore files only found in the mirror")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	cfg, _, err := loadCommandConfig(*configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load configuration: %v\n", err)
+		return 1
+	}
+	if err := cfg.Validate(); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid configuration: %v\n", err)
+		return 1
+	}
+	if !cfg.Mirror.Enabled {
+		fmt.Fprintln(os.Stderr, "No mirror is configured; set mirror.enabled and mirror.storage")
+		return 1
+	}
+	registration, err := appservice.LoadRegistration(cfg.Matrix.Appservice.RegistrationPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load appservice registration: %v\n", err)
+		return 1
+	}
+	as, err := appservice.CreateFull(appservice.CreateOpts{
+		Registration:     registration,
+		HomeserverDomain: cfg.Matrix.HomeserverDomain,
+		HomeserverURL:    cfg.Matrix.HomeserverURL,
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to initialize appservice: %v\n", err)
+		return 1
+	}
+	nextcloud := handlers.NewNextcloudClient(cfg.Nextcloud.BaseURL, cfg.Nextcloud.Username, cfg.Nextcloud.Password)
+	storages, err := handlers.OpenStorages(cfg, nextcloud)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to initialize storages: %v\n", err)
+		return 1
+	}
+
+	ctx := context.Background()
+	// Files are compared at their current path after room renames
+	moves := handlers.NewPathMoves(as)
+	if err := moves.Load(ctx); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+	}
+	rooms := handlers.NewRoomResolver(cfg, as)
+	mediaHandler := handlers.NewMediaHandler(cfg, storages, []byte(cfg.MediaProxy.HMACSecret), as, nil, rooms, moves, nil, nil)
+	report, err := mediaHandler.VerifyReplicas(ctx, *repair)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to verify replicas: %v\n", err)
+		return 1
+	}
+
+	unresolved := 0
+	for _, divergence := range report.Divergent {
+		outcome := ""
+		switch {
+		case divergence.Repaired:
+			outcome = " (repaired)"
+		case divergence.Error != "":
+			outcome = " (repair failed: " + divergence.Error + ")"
+		}
+		if !divergence.Repaired {
+			unresolved++
+		}
+		storage := divergence.Storage
+		if storage == "" {
+			storage = "nextcloud"
+		}
+		fmt.Printf("%s:%s: %s%s\n", storage, divergence.Path, divergence.Status, outcome)
+	}
+	fmt.Printf("\nChecked %d archived file(s): %d divergent, %d unresolved, %d could not be checked\n",
+		report.Checked, len(report.Divergent), unresolved, report.Failed)
+	if unresolved > 0 || report.Failed > 0 {
+		return 1
+	}
+	return 0
+}